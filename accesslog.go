@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"musicstore/errreport"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// this file implements the router with the request IDs and the structured
+// access logs, in place of the crud router.NewRouter.
+
+var accessLogger = log.ZoneLogger("musicstore/http")
+
+// requestIDKey of the request ID in the gin.Context. It's the key of the
+// crud log.RequestIDHook as well, so the logs of crud get it too.
+const requestIDKey = "request_id"
+
+// requestIDPattern: the request IDs accepted from the clients (or proxies).
+// Others are replaced, for they end up in the logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// newRouter creates the gin engine with the middlewares:
+// recovery, error reporting, request ID and access log.
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery(), errreport.Middleware, requestID, accessLog)
+	return r
+}
+
+// useLogFormat sets the format of all the logs: text (default) or json,
+// and adds the request_id field to the entries logged with the context
+// of a request, i.e. logger.WithContext(c).
+func useLogFormat(format string) error {
+	switch format {
+	case "", "text":
+	case "json":
+		log.Logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown Log.Format %q: want text or json", format)
+	}
+
+	// the crud default hook names the field "context": renamed
+	log.Logger.ReplaceHooks(logrus.LevelHooks{})
+	log.Logger.AddHook(log.ContextValueFieldHook{FieldKey: "request_id", ContextKey: requestIDKey})
+	return nil
+}
+
+// requestID assigns the request an ID: the X-Request-ID of the request
+// if it's sane, or a new UUID. It's responded in X-Request-ID as well.
+func requestID(c *gin.Context) {
+	id := c.GetHeader("X-Request-ID")
+	if !requestIDPattern.MatchString(id) {
+		id = uuid.NewString()
+	}
+	c.Set(requestIDKey, id)
+	c.Header("X-Request-ID", id)
+	c.Next()
+}
+
+// accessLog logs every request once it's done: method, path, route,
+// status, latency, size, client IP and the request ID.
+func accessLog(c *gin.Context) {
+	start := time.Now()
+	path := c.Request.URL.Path // handlers may change it
+	c.Next()
+
+	size := c.Writer.Size()
+	if size < 0 { // nothing written
+		size = 0
+	}
+	entry := accessLogger.WithContext(c).WithFields(logrus.Fields{
+		"method":     c.Request.Method,
+		"path":       path,
+		"route":      c.FullPath(),
+		"status":     c.Writer.Status(),
+		"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+		"size":       size,
+		"ip":         c.ClientIP(),
+		"user_agent": c.Request.UserAgent(),
+	})
+	if len(c.Errors) > 0 {
+		entry = entry.WithField("errors", c.Errors.String())
+	}
+
+	switch status := c.Writer.Status(); {
+	case status >= http.StatusInternalServerError:
+		entry.Error("access")
+	case status >= http.StatusBadRequest:
+		entry.Warn("access")
+	default:
+		entry.Info("access")
+	}
+}
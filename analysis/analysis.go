@@ -0,0 +1,391 @@
+// Package analysis runs the emotion analysis of tracks in background.
+//
+// Instead of blocking the import, a track is saved immediately with
+// model.AnalysisPending status and an analysis job is enqueued.
+// Workers take the jobs, run the analyzers (see Analyzer, e.g. emomusic),
+// and update the track.
+// Statuses are exposed by GET /jobs/:id and GET /tracks/:id.
+//
+// While the emomusic circuit breaker is open (i.e. the service is down),
+// jobs that can only be analyzed by emomusic are kept pending, and
+// analyzed once the service is back.
+package analysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/emomusic"
+	"musicstore/events"
+	"musicstore/metadata"
+	"musicstore/model"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = log.ZoneLogger("musicstore/analysis")
+
+// pollInterval is how often idle workers look for pending jobs,
+// in case they missed a wake up.
+const pollInterval = 10 * time.Second
+
+// JobTimeout bounds the analyzers of a job, so that a hung analyzer (e.g.
+// a stuck local program, or a slow emomusic) doesn't hold a worker
+// forever: the job fails, and the others go on. 0 for no timeout.
+var JobTimeout = 10 * time.Minute
+
+// wake idle workers up on new jobs.
+var wake = make(chan struct{}, 1)
+
+var (
+	// stopping is closed by Shutdown: workers take no more jobs.
+	stopping = make(chan struct{})
+	stopOnce sync.Once
+	// workers running
+	workersWg sync.WaitGroup
+	// jobsCtx of the jobs run by the workers, canceled by Shutdown if
+	// they're not done in time.
+	jobsCtx, cancelJobs = context.WithCancel(context.Background())
+)
+
+// interruptGrace: the interrupted jobs are waited for so long by
+// Shutdown, to leave them as they are in the database.
+const interruptGrace = 5 * time.Second
+
+// Start the analysis workers, and register the routes:
+//
+//   - POST /reanalyze: re-analyze tracks in background
+//
+// It should be called after metadata.Start.
+// Jobs interrupted by the last shutdown are picked up again.
+func Start(workers int, router gin.IRouter) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	err := metadata.RequeueRunningJobs(context.Background(), model.JobKindAnalysis)
+	if err != nil {
+		logger.WithError(err).Error("Start: RequeueRunningJobs failed")
+	}
+
+	for i := 0; i < workers; i++ {
+		workersWg.Add(1)
+		go worker(i)
+	}
+
+	logger.WithField("workers", workers).Info("analysis workers started")
+
+	registerRoutes(router)
+}
+
+// Enqueue an analysis job for the track.
+// The track should have been saved (i.e. with an ID).
+//
+// The analyzers are run in order (see runAnalyzers).
+// DefaultAnalyzers are used if it's empty.
+//
+// If filePath is not empty, analyzers work on the local file instead of
+// the AudioFileURL, e.g. for stores not reachable by emomusic.
+func Enqueue(ctx context.Context, track *model.Track, filePath string, analyzers []string) (*model.Job, error) {
+	job := &model.Job{
+		Kind:      model.JobKindAnalysis,
+		Status:    model.JobPending,
+		TrackID:   track.ID,
+		FilePath:  filePath,
+		Analyzers: encodeAnalyzers(analyzers),
+	}
+	if err := metadata.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	notify()
+	return job, nil
+}
+
+// EnqueueBatch enqueues the analysis jobs of the new tracks at once, e.g.
+// of a batch of an import: one insert instead of one per track. The
+// filePaths are of the tracks, as in Enqueue (nil for none).
+func EnqueueBatch(ctx context.Context, tracks []*model.Track, filePaths []string, analyzers []string) ([]*model.Job, error) {
+	jobs := make([]*model.Job, 0, len(tracks))
+	for i, track := range tracks {
+		job := &model.Job{
+			Kind:      model.JobKindAnalysis,
+			Status:    model.JobPending,
+			TrackID:   track.ID,
+			Analyzers: encodeAnalyzers(analyzers),
+		}
+		if i < len(filePaths) {
+			job.FilePath = filePaths[i]
+		}
+		jobs = append(jobs, job)
+	}
+	if err := metadata.CreateJobs(ctx, jobs); err != nil {
+		return nil, err
+	}
+
+	notify()
+	return jobs, nil
+}
+
+// EnqueueMany enqueues analysis jobs for the tracks.
+// If refresh, cached results are ignored.
+//
+// The file paths and analyzers are the same as the last analysis
+// jobs of the tracks, or AudioFileURLs and DefaultAnalyzers if none.
+func EnqueueMany(ctx context.Context, trackIDs []uint, refresh bool) ([]*model.Job, error) {
+	lastJobs, err := metadata.GetLastJobs(ctx, model.JobKindAnalysis)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*model.Job, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		job := &model.Job{
+			Kind:    model.JobKindAnalysis,
+			Status:  model.JobPending,
+			TrackID: id,
+			Refresh: refresh,
+		}
+		if last, ok := lastJobs[id]; ok {
+			job.FilePath = last.FilePath
+			job.Analyzers = last.Analyzers
+		}
+		jobs = append(jobs, job)
+	}
+	if err := metadata.CreateJobs(ctx, jobs); err != nil {
+		return nil, err
+	}
+
+	notify()
+	return jobs, nil
+}
+
+// notify an idle worker (if any) without blocking.
+func notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func worker(id int) {
+	defer workersWg.Done()
+	logger := logger.WithField("worker", id)
+
+	for !isStopping() {
+		job, err := metadata.ClaimJob(context.Background(), model.JobKindAnalysis)
+		if err != nil {
+			logger.WithError(err).Error("worker: ClaimJob failed")
+		}
+		if job == nil {
+			select {
+			case <-wake:
+			case <-time.After(pollInterval):
+			case <-stopping:
+			}
+			continue
+		}
+
+		if err := runJob(jobsCtx, logger, job); errors.Is(err, emomusic.ErrCircuitOpen) {
+			select {
+			case <-time.After(pollInterval):
+			case <-stopping:
+			}
+		}
+	}
+}
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the workers from taking new jobs, and waits for the
+// running ones, until ctx is done. Then the running ones are interrupted
+// (their analyzers canceled), kept running in the database, and picked
+// up again by the next Start.
+func Shutdown(ctx context.Context) error {
+	stopOnce.Do(func() { close(stopping) })
+
+	done := make(chan struct{})
+	go func() {
+		workersWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	cancelJobs()
+	select {
+	case <-done:
+	case <-time.After(interruptGrace):
+	}
+	return fmt.Errorf("Shutdown: analysis jobs interrupted: %w", ctx.Err())
+}
+
+// runJob analyzes the claimed job, and finishes it. If emomusic is down,
+// the job is requeued, and emomusic.ErrCircuitOpen is returned. If ctx
+// is done (interrupted), the job is left running, and ctx.Err() returned.
+func runJob(ctx context.Context, logger *logrus.Entry, job *model.Job) error {
+	logger.WithField("job", job.ID).
+		WithField("track", job.TrackID).
+		Debug("worker: analyzing")
+
+	err := analyze(ctx, job)
+	if ctx.Err() != nil {
+		logger.WithField("job", job.ID).
+			Info("worker: interrupted, the job is picked up again by the next start")
+		return ctx.Err()
+	}
+	if errors.Is(err, emomusic.ErrCircuitOpen) {
+		// emomusic is down: keep the job for later
+		if err := metadata.RequeueJob(context.Background(), job); err != nil {
+			logger.WithField("job", job.ID).
+				WithError(err).Error("worker: RequeueJob failed")
+		}
+		return err
+	}
+	if err != nil {
+		logger.WithField("job", job.ID).
+			WithField("track", job.TrackID).
+			WithError(err).Warn("worker: analysis failed")
+	}
+
+	if err := metadata.FinishJob(context.Background(), job, err); err != nil {
+		logger.WithField("job", job.ID).
+			WithError(err).Error("worker: FinishJob failed")
+	}
+	return nil
+}
+
+// Drain runs the pending jobs by the workers, without starting them in
+// background, until no job is left, e.g. for the offline imports.
+// It returns the number of the jobs run. If emomusic is down, the
+// remaining jobs are kept pending, and emomusic.ErrCircuitOpen is returned.
+// If ctx is done, the running jobs are interrupted and left running, to
+// be picked up again by the next Start.
+func Drain(ctx context.Context, workers int) (int, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		done     atomic.Int64
+		firstErr error
+		errOnce  sync.Once
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			logger := logger.WithField("worker", id)
+
+			for ctx.Err() == nil {
+				job, err := metadata.ClaimJob(ctx, model.JobKindAnalysis)
+				if err == nil && job == nil {
+					return // drained
+				}
+				if err == nil {
+					err = runJob(ctx, logger, job)
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+				done.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return int(done.Load()), firstErr
+}
+
+// analyze the track of the job, and save the result to the track
+// and its emotion history. Nothing is saved if ctx is done.
+func analyze(ctx context.Context, job *model.Job) error {
+	track, err := metadata.GetTrack(ctx, job.TrackID)
+	if err != nil {
+		return err
+	}
+
+	actx, cancel := ctx, context.CancelFunc(func() {})
+	if JobTimeout > 0 {
+		actx, cancel = context.WithTimeout(ctx, JobTimeout)
+	}
+	defer cancel()
+
+	ref := TrackRef{Track: track, FilePath: job.FilePath}
+	features, err := runAnalyzers(actx, decodeAnalyzers(job.Analyzers), ref, job.Refresh)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return saveAnalysis(ctx, job, track, features, err)
+}
+
+// saveAnalysis saves the result of the analyzers (err if they failed) of
+// the job to the track and its emotion history.
+func saveAnalysis(ctx context.Context, job *model.Job, track *model.Track, features Features, err error) error {
+	if errors.Is(err, emomusic.ErrCircuitOpen) {
+		return err // not analyzed at all: leave the track pending
+	}
+	if err != nil {
+		// a failed re-analysis keeps the previous result
+		if track.AnalysisStatus != model.AnalysisDone {
+			track.AnalysisStatus = model.AnalysisFailed
+		}
+	} else {
+		now := time.Now()
+		track.Emotion = *features.Emotion
+		track.AnalysisStatus = model.AnalysisDone
+		track.AnalyzedAt = &now
+		if features.BPM != nil {
+			track.BPM = *features.BPM
+		}
+		if features.Loudness != nil {
+			track.Loudness = *features.Loudness
+		}
+		if features.Cues != nil {
+			track.Cues = *features.Cues
+		}
+		if len(features.Genres) > 0 && track.Genre == "" {
+			track.Genre = strings.Join(features.Genres, ", ")
+		}
+	}
+
+	var record *model.EmotionRecord
+	if err == nil {
+		record = &model.EmotionRecord{
+			Emotion:      *features.Emotion,
+			Analyzer:     features.Analyzer,
+			ModelVersion: features.ModelVersion,
+			JobID:        job.ID,
+		}
+	}
+
+	err1 := metadata.UpdateTrackAnalysis(ctx, track, record)
+	if err1 == nil {
+		events.Publish(events.AnalysisCompleted, track)
+	} else if err == nil {
+		err = err1
+	}
+	return err
+}
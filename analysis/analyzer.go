@@ -0,0 +1,287 @@
+package analysis
+
+// This file defines the Analyzer interface, and the registry of
+// the named analyzers that stores can be configured with.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TrackRef refers to the audio of a track to analyze.
+type TrackRef struct {
+	Track *model.Track
+	// FilePath is the local audio file, if available.
+	// Analyzers should prefer it to Track.AudioFileURL.
+	FilePath string
+
+	audio *decodedAudio // shared by the analyzers of a job, see decode
+}
+
+// Features are the analysis results.
+// nil fields are not provided by the analyzer.
+type Features struct {
+	Emotion  *model.Emotion
+	BPM      *float64 // tempo in beats per minute
+	Loudness *model.Loudness
+	Cues     *model.Cues
+	Genres   []string // predicted genres, most confident first
+
+	// Analyzer is the name of the analyzer providing the Emotion.
+	// It's set by runAnalyzers.
+	Analyzer string
+	// ModelVersion of the analyzer providing the Emotion, if known.
+	ModelVersion string
+}
+
+// merge fills the missing fields of f with the ones of other.
+func (f *Features) merge(other Features) {
+	if f.Emotion == nil {
+		f.Emotion = other.Emotion
+		f.Analyzer = other.Analyzer
+		f.ModelVersion = other.ModelVersion
+	}
+	if f.BPM == nil {
+		f.BPM = other.BPM
+	}
+	if f.Loudness == nil {
+		f.Loudness = other.Loudness
+	}
+	if f.Cues == nil {
+		f.Cues = other.Cues
+	}
+	if f.Genres == nil {
+		f.Genres = other.Genres
+	}
+}
+
+// Analyzer analyzes the audio of a track.
+type Analyzer interface {
+	Analyze(ctx context.Context, ref TrackRef) (Features, error)
+}
+
+// AnalyzerFunc adapts a function to an Analyzer.
+type AnalyzerFunc func(ctx context.Context, ref TrackRef) (Features, error)
+
+func (f AnalyzerFunc) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	return f(ctx, ref)
+}
+
+// defaultAnalyzers are used if no analyzer is specified for a job.
+// It's set to ["heuristic"] by main if no emomusic server is configured.
+var (
+	defaultAnalyzers   = []string{"emomusic"}
+	defaultAnalyzersMu sync.RWMutex
+)
+
+// UseDefaultAnalyzers sets the analyzers of the jobs not specifying any,
+// e.g. on a reload of the config.
+func UseDefaultAnalyzers(names []string) {
+	defaultAnalyzersMu.Lock()
+	defer defaultAnalyzersMu.Unlock()
+	defaultAnalyzers = names
+}
+
+// DefaultAnalyzers returns the analyzers set by UseDefaultAnalyzers.
+func DefaultAnalyzers() []string {
+	defaultAnalyzersMu.RLock()
+	defer defaultAnalyzersMu.RUnlock()
+	return defaultAnalyzers
+}
+
+var (
+	analyzers   = map[string]Analyzer{}
+	analyzersMu sync.RWMutex
+)
+
+// Register an analyzer by name. It replaces the existing one of the name.
+//
+// Built-in analyzers:
+//
+//   - emomusic: the emomusic service, see EmomusicAnalyzer
+//   - stub: a neutral emotion for every track, see StubAnalyzer
+//   - heuristic: a rough local estimation, see HeuristicAnalyzer
+//   - tempo: BPM only, see TempoAnalyzer
+//   - loudness: loudness and ReplayGain only, see LoudnessAnalyzer
+//   - silence: silence and quiet intro/outro cues only, see SilenceAnalyzer
+//
+// The genre analyzer (see GenreAnalyzer) is registered by main
+// if the genre classifier is configured.
+func Register(name string, analyzer Analyzer) {
+	analyzersMu.Lock()
+	defer analyzersMu.Unlock()
+	analyzers[name] = analyzer
+}
+
+// getAnalyzer by name.
+func getAnalyzer(name string) (Analyzer, bool) {
+	analyzersMu.RLock()
+	defer analyzersMu.RUnlock()
+	a, ok := analyzers[name]
+	return a, ok
+}
+
+// CheckAnalyzers returns an error if any of the names is not registered.
+func CheckAnalyzers(names []string) error {
+	for _, name := range names {
+		if _, ok := getAnalyzer(name); !ok {
+			return fmt.Errorf("unknown analyzer %q (registered: %s)",
+				name, strings.Join(registeredAnalyzers(), ", "))
+		}
+	}
+	return nil
+}
+
+func registeredAnalyzers() []string {
+	analyzersMu.RLock()
+	defer analyzersMu.RUnlock()
+
+	names := make([]string, 0, len(analyzers))
+	for name := range analyzers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register("emomusic", EmomusicAnalyzer{})
+	Register("stub", StubAnalyzer{Emotion: model.Emotion{Valence: 0.5, Arousal: 0.5, Confidence: 0.1}})
+	Register("heuristic", HeuristicAnalyzer{})
+	Register("tempo", TempoAnalyzer{})
+	Register("loudness", LoudnessAnalyzer{})
+	Register("silence", SilenceAnalyzer{})
+}
+
+// encodeAnalyzers / decodeAnalyzers: analyzer names <-> model.Job.Analyzers
+func encodeAnalyzers(names []string) string {
+	return strings.Join(names, ",")
+}
+
+func decodeAnalyzers(s string) []string {
+	if s == "" {
+		return DefaultAnalyzers()
+	}
+	return strings.Split(s, ",")
+}
+
+// runAnalyzers runs the analyzers in order, and merges their results:
+// fields are taken from the first analyzer providing them, so later
+// analyzers work as fallbacks of the earlier ones.
+//
+// Emotions are cached (by the audio content hash and the analyzer name)
+// unless refresh.
+//
+// An error is returned if no emotion is got. It wraps the errors of all
+// the analyzers, so errors.Is(err, emomusic.ErrCircuitOpen) works.
+func runAnalyzers(ctx context.Context, names []string, ref TrackRef, refresh bool) (Features, error) {
+	var features Features
+	var errs []error
+
+	if ref.audio == nil {
+		ref.audio = &decodedAudio{} // decoded once for the local analyzers
+	}
+	for _, name := range names {
+		analyzer, ok := getAnalyzer(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown analyzer %q", name))
+			continue
+		}
+
+		f, err := analyzeCached(ctx, name, analyzer, ref, refresh)
+		if err != nil {
+			logger.WithField("track", ref.Track.ID).
+				WithField("analyzer", name).
+				WithError(err).Warn("runAnalyzers: analyzer failed")
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		f.Analyzer = name
+		if f.Emotion != nil && f.Emotion.Confidence == 0 {
+			f.Emotion.Confidence = defaultConfidence
+		}
+		features.merge(f)
+	}
+
+	if features.Emotion == nil {
+		if len(errs) == 0 {
+			errs = append(errs, errors.New("no analyzer provides emotion"))
+		}
+		return features, errors.Join(errs...)
+	}
+	return features, nil
+}
+
+// defaultConfidence of emotions from analyzers not reporting one.
+const defaultConfidence = 1
+
+// analyzeCached runs the analyzer, looking up (and saving) the emotion
+// from (to) the cache.
+//
+// Only results with an emotion are cached (with the BPM if any):
+// tempo-only or genre-only analyzers are run again.
+func analyzeCached(ctx context.Context, name string, analyzer Analyzer, ref TrackRef, refresh bool) (Features, error) {
+	hash := ref.Track.AudioFileHash
+	if cacheDisabled {
+		hash = ""
+	}
+
+	if hash != "" && !refresh {
+		cache, err := metadata.GetCachedEmotion(ctx, hash, name)
+		if err != nil {
+			logger.WithField("track", ref.Track.ID).WithError(err).
+				Warn("analyzeCached: GetCachedEmotion failed")
+		}
+		if cache != nil {
+			logger.WithField("track", ref.Track.ID).
+				WithField("analyzer", name).
+				Debug("analyzeCached: cache hit")
+			features := Features{Emotion: &cache.Emotion, ModelVersion: cache.ModelVersion}
+			if cache.BPM > 0 {
+				features.BPM = &cache.BPM
+			}
+			return features, nil
+		}
+	}
+
+	features, err := analyzer.Analyze(ctx, ref)
+	if err != nil {
+		return features, err
+	}
+
+	if hash != "" {
+		cacheFeatures(ctx, ref.Track, name, features)
+	}
+	return features, nil
+}
+
+// cacheDisabled: no database to cache in, e.g. for the remote workers
+// (see ServeRemote).
+var cacheDisabled bool
+
+// cacheFeatures saves the emotion (with the BPM if any) of the features
+// by the analyzer to the cache, if any.
+func cacheFeatures(ctx context.Context, track *model.Track, analyzer string, features Features) {
+	if track.AudioFileHash == "" || features.Emotion == nil {
+		return
+	}
+	cache := &model.EmotionCache{
+		Hash:         track.AudioFileHash,
+		Analyzer:     analyzer,
+		Emotion:      *features.Emotion,
+		ModelVersion: features.ModelVersion,
+	}
+	if features.BPM != nil {
+		cache.BPM = *features.BPM
+	}
+	if err := metadata.CacheEmotion(ctx, cache); err != nil {
+		logger.WithField("track", track.ID).WithError(err).
+			Warn("cacheFeatures: CacheEmotion failed")
+	}
+}
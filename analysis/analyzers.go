@@ -0,0 +1,312 @@
+package analysis
+
+// This file implements the built-in analyzers.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"musicstore/emomusic"
+	"musicstore/genre"
+	"musicstore/model"
+	"musicstore/sound"
+	"os/exec"
+	"sort"
+	"sync"
+)
+
+// maxDecodeSeconds of the audio decoded for the local analyzers: the
+// loudness of longer tracks is of their start, and their cues are not
+// detected. It bounds the memory (4 bytes per sample) of a job.
+const maxDecodeSeconds = 20 * 60
+
+// decodedAudio of a job, decoded once for all its local analyzers.
+type decodedAudio struct {
+	once sync.Once
+	pcm  sound.PCM
+	err  error
+}
+
+// decode the audio of the track, up to maxSeconds (maxDecodeSeconds if
+// 0 or more), once per job.
+func (ref TrackRef) decode(ctx context.Context, maxSeconds float64) (sound.PCM, error) {
+	if maxSeconds <= 0 || maxSeconds > maxDecodeSeconds {
+		maxSeconds = maxDecodeSeconds
+	}
+	src := ref.FilePath
+	if src == "" {
+		src = ref.Track.AudioFileURL
+	}
+	if ref.audio == nil {
+		return sound.Decode(ctx, src, maxSeconds)
+	}
+
+	ref.audio.once.Do(func() {
+		ref.audio.pcm, ref.audio.err = sound.Decode(ctx, src, maxDecodeSeconds)
+	})
+	pcm := ref.audio.pcm
+	if n := int(maxSeconds * sound.SampleRate); n < len(pcm) {
+		pcm = pcm[:n]
+	}
+	return pcm, ref.audio.err
+}
+
+// EmomusicAnalyzer gets the emotion from the emomusic service.
+// It uploads the local file if available, or lets emomusic
+// download the AudioFileURL.
+type EmomusicAnalyzer struct {
+	// ModelVersion of the emomusic deployment (emomusic does not report
+	// it), recorded in the emotion history.
+	ModelVersion string
+}
+
+func (e EmomusicAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	var emotion model.Emotion
+	var err error
+	if ref.FilePath != "" {
+		emotion, err = emomusic.AnalyzeFileContext(ctx, ref.FilePath)
+	} else {
+		emotion, err = emomusic.AnalyzeURIContext(ctx, ref.Track.AudioFileURL)
+	}
+	if err != nil {
+		return Features{}, err
+	}
+	return Features{Emotion: &emotion, ModelVersion: e.ModelVersion}, nil
+}
+
+// StubAnalyzer gives the same emotion to every track.
+// It's useful for development, or as the last fallback.
+type StubAnalyzer struct {
+	Emotion model.Emotion
+}
+
+func (s StubAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	emotion := s.Emotion
+	return Features{Emotion: &emotion}, nil
+}
+
+// ExecAnalyzer runs a local program (e.g. a local model) to analyze:
+//
+//	Command[0] Command[1:]... {FilePath or AudioFileURL}
+//
+// The program should print the emotion (and optionally the tempo and
+// the model version) as JSON to stdout:
+//
+//	{"valence": 0.5, "arousal": 0.5, "confidence": 0.9, "bpm": 120, "model_version": "v2"}
+//
+// All fields but valence and arousal are optional.
+type ExecAnalyzer struct {
+	Command []string
+}
+
+func (e ExecAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	if len(e.Command) == 0 {
+		return Features{}, errors.New("ExecAnalyzer: empty Command")
+	}
+
+	audio := ref.FilePath
+	if audio == "" {
+		audio = ref.Track.AudioFileURL
+	}
+
+	args := append(append([]string{}, e.Command[1:]...), audio)
+	cmd := exec.CommandContext(ctx, e.Command[0], args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Features{}, fmt.Errorf("ExecAnalyzer: %w: %s", err, stderr.String())
+	}
+
+	var result struct {
+		model.Emotion
+		BPM          *float64 `json:"bpm"`
+		ModelVersion string   `json:"model_version"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return Features{}, fmt.Errorf("ExecAnalyzer: bad output: %w", err)
+	}
+	return Features{Emotion: &result.Emotion, BPM: result.BPM, ModelVersion: result.ModelVersion}, nil
+}
+
+// HeuristicAnalyzer estimates a rough emotion from the audio itself,
+// without any service: louder, faster and brighter tracks get higher
+// arousal; faster and brighter ones get (slightly) higher valence.
+//
+// It decodes the audio by package sound, i.e. WAV files natively, and
+// other formats only if ffmpeg is installed.
+// The result is nowhere near a real model, but it keeps /murecom useful
+// when emomusic is not available.
+type HeuristicAnalyzer struct {
+	// MaxSeconds of the audio to analyze. Default: 120
+	MaxSeconds float64
+}
+
+// heuristicVersion is bumped whenever the HeuristicAnalyzer formula changes.
+const heuristicVersion = "heuristic-1"
+
+// heuristicConfidence is low: it's only a rough estimation.
+const heuristicConfidence = 0.3
+
+func (h HeuristicAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	maxSeconds := h.MaxSeconds
+	if maxSeconds <= 0 {
+		maxSeconds = 120
+	}
+
+	pcm, err := ref.decode(ctx, maxSeconds)
+	if err != nil {
+		return Features{}, fmt.Errorf("HeuristicAnalyzer: %w", err)
+	}
+	if len(pcm) == 0 {
+		return Features{}, errors.New("HeuristicAnalyzer: empty audio")
+	}
+
+	var features Features
+
+	// normalize the features into [0, 1]
+	energy := clamp01((sound.Decibels(pcm.RMS()) + 40) / 34) // -40 dBFS .. -6 dBFS
+	brightness := clamp01(pcm.ZeroCrossingRate() / 0.15)
+	tempo := 0.5 // unknown tempo: neutral
+	if bpm := pcm.Tempo(); bpm > 0 {
+		tempo = clamp01((bpm - 60) / 120) // 60 .. 180 BPM
+		features.BPM = &bpm
+	}
+
+	features.ModelVersion = heuristicVersion
+	features.Emotion = &model.Emotion{
+		Valence:    clamp01(0.25 + 0.3*tempo + 0.3*brightness + 0.1*energy),
+		Arousal:    clamp01(0.5*energy + 0.3*tempo + 0.2*brightness),
+		Confidence: heuristicConfidence,
+	}
+	return features, nil
+}
+
+// TempoAnalyzer detects the tempo (BPM) of the audio locally.
+// It provides no emotion, so it should follow an emotion analyzer,
+// e.g. [emomusic, tempo].
+type TempoAnalyzer struct {
+	// MaxSeconds of the audio to analyze. Default: 120
+	MaxSeconds float64
+}
+
+func (t TempoAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	maxSeconds := t.MaxSeconds
+	if maxSeconds <= 0 {
+		maxSeconds = 120
+	}
+
+	pcm, err := ref.decode(ctx, maxSeconds)
+	if err != nil {
+		return Features{}, fmt.Errorf("TempoAnalyzer: %w", err)
+	}
+
+	bpm := pcm.Tempo()
+	if bpm == 0 {
+		return Features{}, errors.New("TempoAnalyzer: no clear beat")
+	}
+	return Features{BPM: &bpm}, nil
+}
+
+// LoudnessAnalyzer measures the loudness (EBU R128) of the whole audio
+// (up to maxDecodeSeconds) locally, and the ReplayGain by it. It provides no emotion, so it should
+// follow an emotion analyzer, e.g. [emomusic, loudness].
+type LoudnessAnalyzer struct{}
+
+func (LoudnessAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	pcm, err := ref.decode(ctx, 0)
+	if err != nil {
+		return Features{}, fmt.Errorf("LoudnessAnalyzer: %w", err)
+	}
+
+	lufs := pcm.Loudness()
+	if math.IsInf(lufs, -1) {
+		return Features{}, errors.New("LoudnessAnalyzer: silent or too short")
+	}
+	return Features{Loudness: &model.Loudness{
+		LUFS:       lufs,
+		ReplayGain: sound.ReplayGainReference - lufs,
+		Peak:       pcm.Peak(),
+	}}, nil
+}
+
+// SilenceAnalyzer detects the leading and trailing silence, and the quiet
+// intro and outro of the whole audio locally (see sound.PCM.Cues), for
+// the tracks up to maxDecodeSeconds.
+// It provides no emotion, e.g. [emomusic, silence].
+type SilenceAnalyzer struct{}
+
+func (SilenceAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	pcm, err := ref.decode(ctx, 0)
+	if err != nil {
+		return Features{}, fmt.Errorf("SilenceAnalyzer: %w", err)
+	}
+
+	if pcm.Duration() >= maxDecodeSeconds {
+		return Features{}, fmt.Errorf("SilenceAnalyzer: longer than %ds", maxDecodeSeconds)
+	}
+	cues, ok := pcm.Cues()
+	if !ok {
+		return Features{}, errors.New("SilenceAnalyzer: silent")
+	}
+	return Features{Cues: &model.Cues{
+		AudioStart: cues.AudioStart,
+		IntroEnd:   cues.IntroEnd,
+		OutroStart: cues.OutroStart,
+		AudioEnd:   cues.AudioEnd,
+	}}, nil
+}
+
+func clamp01(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
+
+// GenreAnalyzer predicts the genres of untagged tracks by the genre
+// classifier (see package genre). Tracks with a genre (e.g. from the
+// file tags) are skipped. It provides no emotion.
+type GenreAnalyzer struct {
+	// Threshold is the minimum confidence of a predicted genre.
+	Threshold float64
+	// MaxGenres to keep, the most confident ones. 0 means no limit.
+	MaxGenres int
+}
+
+func (g GenreAnalyzer) Analyze(ctx context.Context, ref TrackRef) (Features, error) {
+	if ref.Track.Genre != "" {
+		return Features{}, nil
+	}
+
+	var predictions []genre.Prediction
+	var err error
+	if ref.FilePath != "" {
+		predictions, err = genre.ClassifyFile(ctx, ref.FilePath)
+	} else {
+		predictions, err = genre.ClassifyURI(ctx, ref.Track.AudioFileURL)
+	}
+	if err != nil {
+		return Features{}, fmt.Errorf("GenreAnalyzer: %w", err)
+	}
+
+	sort.SliceStable(predictions, func(i, j int) bool {
+		return predictions[i].Confidence > predictions[j].Confidence
+	})
+
+	var genres []string
+	for _, p := range predictions {
+		if p.Confidence < g.Threshold {
+			break
+		}
+		if p.Genre == "" {
+			continue
+		}
+		if g.MaxGenres > 0 && len(genres) >= g.MaxGenres {
+			break
+		}
+		genres = append(genres, p.Genre)
+	}
+	return Features{Genres: genres}, nil
+}
@@ -0,0 +1,179 @@
+package analysis
+
+import (
+	"errors"
+	"musicstore/metadata"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cdfmlr/crud/service"
+	"github.com/gin-gonic/gin"
+)
+
+func registerRoutes(r gin.IRouter) {
+	r.POST("/reanalyze", PostReanalyze)
+	r.GET("/tracks/:TrackID/emotions", GetEmotionHistory)
+	r.POST("/emotions/rollback", PostRollbackEmotions)
+}
+
+// ReanalyzeRequest selects the tracks to re-analyze.
+// Filters are combined with AND.
+type ReanalyzeRequest struct {
+	// All tracks. Required if no other filter is given,
+	// to avoid re-analyzing everything by accident.
+	All bool
+	// ZeroEmotion: tracks with valence = arousal = 0,
+	// i.e. never (successfully) analyzed.
+	ZeroEmotion bool
+	// IDs of the tracks.
+	IDs []uint
+	// AnalyzedBefore: tracks analyzed before the time (RFC 3339),
+	// or with unknown analysis time.
+	AnalyzedBefore *time.Time
+}
+
+// PostReanalyze handles: POST /reanalyze
+//
+// Body (JSON): ReanalyzeRequest, e.g.
+//
+//   - {"All": true}
+//   - {"ZeroEmotion": true}
+//   - {"IDs": [1, 2, 3]}
+//   - {"AnalyzedBefore": "2023-05-01T00:00:00Z"}
+//
+// The tracks are re-analyzed by emomusic in background,
+// ignoring cached results. Until then, they keep their old emotions.
+//
+// Response:
+//
+//   - 200: OK: {enqueued: 42}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func PostReanalyze(c *gin.Context) {
+	req := new(ReanalyzeRequest)
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	options, err := reanalyzeQueryOptions(req)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	ids, err := metadata.GetTrackIDs(c, options...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	jobs, err := EnqueueMany(c, ids, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enqueued": len(jobs)})
+}
+
+func reanalyzeQueryOptions(req *ReanalyzeRequest) ([]service.QueryOption, error) {
+	var options []service.QueryOption
+
+	if req.ZeroEmotion {
+		options = append(options, service.Where("valence = 0 AND arousal = 0"))
+	}
+	if len(req.IDs) > 0 {
+		options = append(options, service.Where("id IN ?", req.IDs))
+	}
+	if req.AnalyzedBefore != nil {
+		options = append(options, service.Where(
+			"(analyzed_at IS NULL OR analyzed_at < ?)", *req.AnalyzedBefore))
+	}
+
+	if len(options) == 0 && !req.All {
+		return nil, errors.New("no filter given: use All to re-analyze all tracks")
+	}
+	return options, nil
+}
+
+// GetEmotionHistory handles: GET /tracks/:TrackID/emotions
+//
+// Response:
+//
+//   - 200: OK: {emotions: [{record1}, {record2}, ...]}, latest first.
+//     The latest one is the current emotion of the track.
+//   - 400: Bad Request: {error: "bad request"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func GetEmotionHistory(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("TrackID"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	records, err := metadata.GetEmotionHistory(c, uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"emotions": records})
+}
+
+// RollbackEmotionsRequest selects the emotion records to roll back.
+// Filters are combined with AND, at least one is required.
+type RollbackEmotionsRequest struct {
+	Analyzer     string
+	ModelVersion string
+	JobIDs       []uint
+	TrackIDs     []uint
+	// Since: records created at or after the time (RFC 3339).
+	Since *time.Time
+}
+
+// PostRollbackEmotions handles: POST /emotions/rollback
+//
+// Body (JSON): RollbackEmotionsRequest, e.g.
+//
+//   - {"ModelVersion": "v2"}
+//   - {"Analyzer": "emomusic", "Since": "2023-05-01T00:00:00Z"}
+//
+// The selected records are removed from the history, and the affected
+// tracks get back the emotions of their latest remaining records.
+//
+// Response:
+//
+//   - 200: OK: {tracks: [1, 2, 3]}: IDs of the affected tracks
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func PostRollbackEmotions(c *gin.Context) {
+	req := new(RollbackEmotionsRequest)
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := metadata.EmotionRecordFilter{
+		Analyzer:     req.Analyzer,
+		ModelVersion: req.ModelVersion,
+		JobIDs:       req.JobIDs,
+		TrackIDs:     req.TrackIDs,
+		Since:        req.Since,
+	}
+	if filter.IsZero() {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "no filter given"})
+		return
+	}
+
+	trackIDs, err := metadata.RollbackEmotions(c, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tracks": trackIDs})
+}
@@ -0,0 +1,378 @@
+package analysis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"musicstore/emomusic"
+	"musicstore/metadata"
+	"musicstore/model"
+	"musicstore/nats"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the distribution of the analysis jobs to remote
+// workers (`musicstore worker`) by NATS, to scale the analysis out.
+//
+// The server claims the pending jobs, as the local workers do, and
+// publishes them (RemoteJob) to the subject, consumed by one of the
+// workers in the queue group. The worker runs the analyzers, and replies
+// the RemoteResult, which is saved by the server. Jobs without results
+// in the Timeout (lost, or the worker died) are requeued.
+//
+// Workers need no database: the track is sent with the job, and the
+// audio is read from the FilePath if it exists on the worker (e.g. shared
+// storage), from the AudioFileURL otherwise. Results are cached by the
+// server.
+
+// remoteQueue: the queue group of the remote workers.
+const remoteQueue = "musicstore-analysis"
+
+// RemoteJob is an analysis job sent to the remote workers.
+type RemoteJob struct {
+	JobID     uint
+	Track     *model.Track
+	FilePath  string
+	Analyzers []string
+	Refresh   bool
+}
+
+// RemoteResult of a RemoteJob, replied by the remote worker.
+type RemoteResult struct {
+	JobID    uint
+	Features Features
+	Error    string
+	// Requeue: the job is not analyzed at all (e.g. emomusic is down).
+	Requeue bool
+}
+
+// RemoteConfig configures the distribution of the jobs.
+type RemoteConfig struct {
+	// Subject to publish the jobs to, e.g. musicstore.jobs.analysis.
+	// Results are replied to {Subject}.results.
+	Subject string
+	// MaxInFlight: jobs dispatched and not finished yet, at most.
+	MaxInFlight int
+	// Timeout: a job without result in it is requeued.
+	Timeout time.Duration
+}
+
+// StartRemote dispatches the jobs to the remote workers by the conn,
+// instead of Start-ing local workers, and registers the routes as Start.
+func StartRemote(conn *nats.Conn, cfg RemoteConfig, router gin.IRouter) error {
+	if cfg.MaxInFlight < 1 {
+		cfg.MaxInFlight = 1
+	}
+
+	err := metadata.RequeueRunningJobs(context.Background(), model.JobKindAnalysis)
+	if err != nil {
+		logger.WithError(err).Error("StartRemote: RequeueRunningJobs failed")
+	}
+
+	d := &dispatcher{
+		conn:     conn,
+		cfg:      cfg,
+		results:  cfg.Subject + ".results",
+		inflight: map[uint]*dispatchedJob{},
+		slots:    make(chan struct{}, cfg.MaxInFlight),
+	}
+	if _, err := conn.Subscribe(d.results, "", d.handleResult); err != nil {
+		return err
+	}
+
+	workersWg.Add(2)
+	go d.dispatch()
+	go d.requeueExpired()
+
+	logger.WithField("subject", cfg.Subject).Info("analysis jobs are dispatched to the remote workers")
+
+	registerRoutes(router)
+	return nil
+}
+
+type dispatchedJob struct {
+	job      *model.Job
+	deadline time.Time
+}
+
+// dispatcher of the jobs to the remote workers.
+type dispatcher struct {
+	conn    *nats.Conn
+	cfg     RemoteConfig
+	results string // the subject
+
+	mu       sync.Mutex
+	inflight map[uint]*dispatchedJob // by job ID
+	// slots: one per job in flight
+	slots       chan struct{}
+	pausedUntil time.Time
+}
+
+// dispatch the pending jobs, until Shutdown.
+func (d *dispatcher) dispatch() {
+	defer workersWg.Done()
+
+	for {
+		select {
+		case d.slots <- struct{}{}:
+		case <-stopping:
+			return
+		}
+
+		wait := d.paused()
+		if wait == 0 {
+			job, err := metadata.ClaimJob(context.Background(), model.JobKindAnalysis)
+			if err != nil {
+				logger.WithError(err).Error("dispatch: ClaimJob failed")
+			}
+			if job != nil && d.dispatchJob(job) {
+				continue // the slot is taken by the job
+			}
+			wait = pollInterval
+		}
+
+		<-d.slots
+		select {
+		case <-wake:
+		case <-time.After(wait):
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// dispatchJob publishes the claimed job. If failed, the job is requeued
+// (or finished as failed, if the track is gone), and false is returned.
+func (d *dispatcher) dispatchJob(job *model.Job) bool {
+	ctx := context.Background()
+
+	track, err := metadata.GetTrack(ctx, job.TrackID)
+	if err != nil { // e.g. deleted
+		if err := metadata.FinishJob(ctx, job, err); err != nil {
+			logger.WithField("job", job.ID).WithError(err).Error("dispatchJob: FinishJob failed")
+		}
+		return false
+	}
+
+	err = d.publish(job, track)
+	if err == nil {
+		return true
+	}
+	logger.WithField("job", job.ID).WithError(err).Warn("dispatchJob: publish failed")
+
+	d.mu.Lock()
+	delete(d.inflight, job.ID)
+	d.mu.Unlock()
+	if err := metadata.RequeueJob(ctx, job); err != nil {
+		logger.WithField("job", job.ID).WithError(err).Error("dispatchJob: RequeueJob failed")
+	}
+	return false
+}
+
+// pause the dispatching for a while, e.g. emomusic is down.
+func (d *dispatcher) pause(duration time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pausedUntil = time.Now().Add(duration)
+}
+
+// paused returns the remaining time of the pause, if any.
+func (d *dispatcher) paused() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if wait := time.Until(d.pausedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// publish the job of the track to the workers.
+func (d *dispatcher) publish(job *model.Job, track *model.Track) error {
+	data, err := json.Marshal(RemoteJob{
+		JobID:     job.ID,
+		Track:     track,
+		FilePath:  job.FilePath,
+		Analyzers: decodeAnalyzers(job.Analyzers),
+		Refresh:   job.Refresh,
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.inflight[job.ID] = &dispatchedJob{job: job, deadline: time.Now().Add(d.cfg.Timeout)}
+	d.mu.Unlock()
+
+	return d.conn.Publish(d.cfg.Subject, d.results, data)
+}
+
+// forget the job in flight, and free its slot.
+// It returns nil if the job is not in flight (e.g. requeued already).
+func (d *dispatcher) forget(jobID uint) *model.Job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dj, ok := d.inflight[jobID]
+	if !ok {
+		return nil
+	}
+	delete(d.inflight, jobID)
+	<-d.slots
+	return dj.job
+}
+
+// handleResult saves the result replied by a worker.
+func (d *dispatcher) handleResult(msg *nats.Msg) {
+	var result RemoteResult
+	if err := json.Unmarshal(msg.Data, &result); err != nil {
+		logger.WithError(err).Warn("handleResult: bad result")
+		return
+	}
+	job := d.forget(result.JobID)
+	if job == nil {
+		logger.WithField("job", result.JobID).Debug("handleResult: job not in flight, result ignored")
+		return
+	}
+	ctx := context.Background()
+	if result.Requeue {
+		// emomusic is down: as the local workers, wait before the next jobs
+		d.pause(pollInterval)
+		if err := metadata.RequeueJob(ctx, job); err != nil {
+			logger.WithField("job", job.ID).WithError(err).Error("handleResult: RequeueJob failed")
+		}
+		return
+	}
+
+	defer notify() // a slot is free
+
+	track, err := metadata.GetTrack(ctx, job.TrackID)
+	if err == nil {
+		var analysisErr error
+		if result.Error != "" {
+			analysisErr = errors.New(result.Error)
+		} else {
+			cacheFeatures(ctx, track, result.Features.Analyzer, Features{
+				Emotion:      result.Features.Emotion,
+				ModelVersion: result.Features.ModelVersion,
+			})
+		}
+		err = saveAnalysis(ctx, job, track, result.Features, analysisErr)
+	}
+	if err != nil {
+		logger.WithField("job", job.ID).WithField("track", job.TrackID).
+			WithError(err).Warn("handleResult: analysis failed")
+	}
+
+	if err := metadata.FinishJob(ctx, job, err); err != nil {
+		logger.WithField("job", job.ID).WithError(err).Error("handleResult: FinishJob failed")
+	}
+}
+
+// requeueExpired requeues the jobs in flight beyond the Timeout, until
+// Shutdown.
+func (d *dispatcher) requeueExpired() {
+	defer workersWg.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopping:
+			return
+		}
+
+		now := time.Now()
+		var expired []uint
+		d.mu.Lock()
+		for id, dj := range d.inflight {
+			if now.After(dj.deadline) {
+				expired = append(expired, id)
+			}
+		}
+		d.mu.Unlock()
+
+		for _, id := range expired {
+			job := d.forget(id)
+			if job == nil {
+				continue
+			}
+			logger.WithField("job", id).Warn("requeueExpired: no result in time, requeued")
+			if err := metadata.RequeueJob(context.Background(), job); err != nil {
+				logger.WithField("job", id).WithError(err).Error("requeueExpired: RequeueJob failed")
+			}
+		}
+		if len(expired) > 0 {
+			notify()
+		}
+	}
+}
+
+// ServeRemote runs the jobs published to the subject (see StartRemote)
+// by the workers, as a remote worker, until the subscription is
+// unsubscribed. Shutdown waits for the running jobs.
+func ServeRemote(conn *nats.Conn, subject string, workers int) (*nats.Subscription, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	cacheDisabled = true
+
+	sem := make(chan struct{}, workers)
+	return conn.Subscribe(subject, remoteQueue, func(msg *nats.Msg) {
+		sem <- struct{}{}
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			defer func() { <-sem }()
+			runRemoteJob(conn, msg)
+		}()
+	})
+}
+
+// runRemoteJob runs the analyzers of the job, and replies the result.
+func runRemoteJob(conn *nats.Conn, msg *nats.Msg) {
+	var job RemoteJob
+	if err := json.Unmarshal(msg.Data, &job); err != nil || job.Track == nil {
+		logger.WithField("data", string(msg.Data)).Warn("runRemoteJob: bad job")
+		return
+	}
+	logger := logger.WithField("job", job.JobID).WithField("track", job.Track.ID)
+	logger.Debug("runRemoteJob: analyzing")
+
+	ref := TrackRef{Track: job.Track}
+	if _, err := os.Stat(job.FilePath); job.FilePath != "" && err == nil {
+		ref.FilePath = job.FilePath
+	}
+	analyzers := job.Analyzers
+	if len(analyzers) == 0 {
+		analyzers = DefaultAnalyzers()
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if JobTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, JobTimeout)
+	}
+	features, err := runAnalyzers(ctx, analyzers, ref, job.Refresh)
+	cancel()
+	result := RemoteResult{JobID: job.JobID, Features: features}
+	if errors.Is(err, emomusic.ErrCircuitOpen) {
+		result.Requeue = true
+	} else if err != nil {
+		result.Error = err.Error()
+		logger.WithError(err).Warn("runRemoteJob: analysis failed")
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.WithError(err).Error("runRemoteJob: Marshal failed")
+		return
+	}
+	if err := conn.Publish(msg.Reply, "", data); err != nil {
+		logger.WithError(err).Error("runRemoteJob: reply failed, the job is requeued on timeout")
+	}
+}
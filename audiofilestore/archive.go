@@ -0,0 +1,199 @@
+package audiofilestore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"musicstore/model"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// this file implements importing the audio files in an archive
+// (.zip, .tar.gz, .tgz) uploaded to POST /new.
+
+// Limits of an archive, against zip bombs.
+const (
+	maxArchiveEntries = 1000
+	maxArchiveBytes   = 4 << 30 // 4 GiB extracted
+)
+
+// ImportResult is the result of importing a file as a track.
+type ImportResult struct {
+	File  string
+	Track *model.Track `json:",omitempty"`
+	Error string       `json:",omitempty"`
+	// Duplicate: the track already exists, Track is the existing one.
+	Duplicate bool `json:",omitempty"`
+}
+
+// isArchive returns true if the file is a supported archive.
+// It checks the file extension.
+func isArchive(path string) bool {
+	name := strings.ToLower(path)
+	return strings.HasSuffix(name, ".zip") ||
+		strings.HasSuffix(name, ".tar.gz") ||
+		strings.HasSuffix(name, ".tgz")
+}
+
+// addTracksFromArchive extracts the music files in the archive into
+// the tmp dir, and adds each of them as a track.
+//
+// Options are applied to every track, so only the shared metadata
+// (e.g. Album, Artist) should be overridden.
+func (a *AudioFileStore) addTracksFromArchive(archive string, options ...AddTrackOption) ([]ImportResult, error) {
+	dir, err := os.MkdirTemp(a.tmpDir(), "archive-")
+	if err != nil {
+		return nil, fmt.Errorf("addTracksFromArchive: MkdirTemp failed: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := extractArchive(archive, dir)
+	if err != nil {
+		return nil, fmt.Errorf("addTracksFromArchive: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("addTracksFromArchive: no music file in the archive")
+	}
+
+	results := make([]ImportResult, 0, len(files))
+	for _, f := range files {
+		track, err := a.AddTrack(f.path, options...)
+		if err != nil {
+			a.rejectNewFile(f.path, QuarantinedFile{File: f.name, Source: "archive"}, err)
+		}
+		results = append(results, newImportResult(f.name, track, err))
+	}
+	return results, nil
+}
+
+// extractedFile is a music file extracted from an archive.
+type extractedFile struct {
+	name string // name in the archive
+	path string // extracted to
+}
+
+// extractArchive extracts the music files (see isMusicFile) in the
+// archive into dir. Other files are ignored (and count to the limits).
+//
+// Files are extracted flat, named {index}-{base name}, so the paths in
+// the archive (e.g. ../../etc) never escape dir.
+func extractArchive(archive string, dir string) ([]extractedFile, error) {
+	x := &extractor{dir: dir}
+
+	var err error
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		err = x.zip(archive)
+	} else {
+		err = x.tarGz(archive)
+	}
+	return x.files, err
+}
+
+type extractor struct {
+	dir     string
+	files   []extractedFile
+	entries int
+	bytes   int64
+}
+
+func (x *extractor) zip(archive string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = x.extract(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tarGz(archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue // dirs, links, ...
+		}
+		if err := x.extract(h.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extract a file in the archive, if it's a music file (by content).
+func (x *extractor) extract(name string, r io.Reader) error {
+	base := filepath.Base(filepath.FromSlash(name))
+	if strings.HasPrefix(base, ".") {
+		return nil // e.g. __MACOSX/._foo.mp3
+	}
+
+	x.entries++
+	if x.entries > maxArchiveEntries {
+		return fmt.Errorf("too many files in the archive (> %d)", maxArchiveEntries)
+	}
+
+	path := filepath.Join(x.dir, fmt.Sprintf("%04d-%s", x.entries, base))
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	remaining := maxArchiveBytes - x.bytes
+	n, err := io.Copy(out, io.LimitReader(r, remaining+1))
+	x.bytes += n
+	if err != nil {
+		return err
+	}
+	if n > remaining {
+		return fmt.Errorf("archive too large (> %d bytes extracted)", int64(maxArchiveBytes))
+	}
+	out.Close()
+
+	if !isMusicFile(path) {
+		os.Remove(path) // e.g. cover.jpg
+		return nil
+	}
+	if path, err = normalizeExtension(path); err != nil {
+		return err
+	}
+
+	x.files = append(x.files, extractedFile{name: name, path: path})
+	return nil
+}
@@ -2,57 +2,248 @@
 // Exposure an AudioFileStore with the following methods:
 //   - AddTrack: add a track (from audio file path) to the audiofilestore
 //   - AddTracksFromDir: read self.FileDir and add all the tracks in it
+//   - Rescan: add the new (or changed) tracks in self.FileDir
 //
 // Exposure Routes:
 //   - /audio: static audio file
 //   - /new: add track (upload file or download from url)
+//   - /new/uploads: chunked upload of large files
+//   - /rescan: import the new or changed files in the FileDir
+//   - /scan/progress: progress of the scans (SSE)
+//
+// And the admin routes of all stores (see RegisterAdminRoutes):
+//   - /admin/fsck: consistency check (and repair) of the stores
+//   - /admin/backup, /admin/restore: backup and restore of the musicstore
+//   - /tracks/:TrackID/tags: tag editing of the tracks and their files
+//   - /tracks/import: bulk import of track metadata
+//   - /tracks/:TrackID/hls: HLS streaming of the tracks
+//   - /tracks/:TrackID/waveform: waveform peaks of the tracks
 package audiofilestore
 
 import (
 	"context"
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"musicstore/emomusic"
+	"io"
+	"musicstore/analysis"
 	"musicstore/metadata"
 	"musicstore/model"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/cdfmlr/crud/log"
 	"github.com/gin-gonic/gin"
-	"github.com/sirupsen/logrus"
 )
 
 var logger = log.ZoneLogger("musicstore/audiofilestore")
 
-func init() {
-	// logger.Logger.SetLevel(logrus.DebugLevel)
-	logger.Logger.SetLevel(logrus.InfoLevel)
-}
-
 // AudioFileStore stores audio files in a local directory.
 type AudioFileStore struct {
 	Name           string
 	FileDir        string
 	BaseUrl        string
 	EnableEmomusic bool
+
+	// EmomusicUploadFile uploads the audio files to emomusic for
+	// analysis, instead of letting emomusic download them from BaseUrl.
+	// Enable it if the store is not reachable by emomusic.
+	EmomusicUploadFile bool
+
+	// Analyzers are the names of the analyzers (see analysis.Register)
+	// to run on new tracks, if EnableEmomusic.
+	// analysis.DefaultAnalyzers are used if empty.
+	Analyzers []string
+
+	// MaxUploadBytes is the max size of an upload (all the files of a
+	// POST /new, a chunked upload, or a download). 0 means no limit.
+	MaxUploadBytes int64
+	// AllowedContentTypes of uploaded files, e.g. audio/*.
+	// DefaultAllowedContentTypes are used if empty.
+	AllowedContentTypes []string
+	// CacheControl of the served audio files.
+	// DefaultCacheControl is used if empty.
+	CacheControl string
+
+	// OnDuplicate is the response to duplicate uploads:
+	// OnDuplicateError (default), OnDuplicateExisting or OnDuplicateConflict.
+	OnDuplicate string
+
+	// CacheMaxBytes of the cache ({FileDir}/.cache, e.g. HLS segments):
+	// the least recently used entries are evicted beyond it.
+	// DefaultCacheMaxBytes is used if 0, negative for no limit.
+	CacheMaxBytes int64
+
+	// TmpTTL: files in the tmp dir ({FileDir}/.tmp) older than it are
+	// removed. DefaultTmpTTL is used if 0.
+	TmpTTL time.Duration
+
+	// OnDelete is what to do with the files of deleted tracks:
+	// OnDeleteRemove (default), OnDeleteTrash or OnDeleteKeep.
+	OnDelete string
+
+	// Watch the WatchInbox (a subdirectory of the FileDir, or the FileDir
+	// itself if empty) for new files, which are imported automatically
+	// once not changed for WatchDebounce (DefaultWatchDebounce if 0).
+	Watch         bool
+	WatchInbox    string
+	WatchDebounce time.Duration
+
+	// ScanWorkers is the number of files processed concurrently by a
+	// rescan (and LoadFromDir). DefaultScanWorkers is used if 0.
+	// ScanWriteRate limits the imports (DB writes) per second, 0 for no limit.
+	ScanWorkers   int
+	ScanWriteRate float64
+
+	// DownloadWorkers is the number of concurrent downloads (of the URLs
+	// of POST /new). DefaultDownloadWorkers is used if 0.
+	DownloadWorkers int
+
+	// ScanFilter selects the files to scan in the FileDir,
+	// by LoadFromDir, rescans and the watcher.
+	ScanFilter ScanFilter
+
+	// FilenameTemplate names the stored audio files: a text/template over
+	// the track (e.g. {{.ID}}, {{.AudioFileHash}}, {{snake .Name}}), with
+	// the extension appended. DefaultFilenameTemplate is used if empty.
+	FilenameTemplate string
+	// Layout of the stored audio files: LayoutFlat (default) or
+	// LayoutArtistAlbum.
+	Layout string
+	// LinkMode: how the audio files are put into the FileDir, one of
+	// LinkModeHardlink (default), LinkModeCopy, LinkModeMove, LinkModeSymlink.
+	LinkMode string
+	// OnCollision: what to do if the name of a new file is taken, one of
+	// OnCollisionHash (default), OnCollisionID or OnCollisionError.
+	OnCollision string
+
+	// Library of the tracks added by the store (see library.go).
+	// model.DefaultLibrary is used if empty.
+	Library string
+
+	// ReadOnly stores only serve their files: uploads, imports, rescans,
+	// tag edits and the removal of files of deleted tracks are refused.
+	ReadOnly bool
+
+	// FetchCovers of the new tracks without one, from the Cover Art
+	// Archive (see coverart.go).
+	FetchCovers bool
+	// LocalizeCovers: store local copies of the external covers of the
+	// new tracks (e.g. hotlinked by the imported metadata), in place of them.
+	LocalizeCovers bool
+
+	// Offline stores (e.g. of the CLI commands, next to a running server)
+	// start no background workers: the jobs of the downloads and the
+	// covers are left to the server, and so are the sweeps of the files.
+	Offline bool
+
+	filenameTmpl     *template.Template
+	filenameTmplOnce sync.Once
+
+	rescanMu sync.Mutex   // one rescan at a time
+	progress scanProgress // of the running (or the last) rescan
+	addMu    sync.Mutex   // serializes the duplicate check and save of AddTrack
+	// batch of the new tracks of the running rescan, if any
+	batch atomic.Pointer[importBatch]
+
+	uploads      uploads       // chunked uploads in progress
+	downloadWake chan struct{} // wakes download workers up on new jobs
+	coverWake    chan struct{} // wakes the cover worker up on new jobs
+	watcher      *watcher      // of the inbox, if Watch
+
+	// settingsMu guards the options changed by StorePatch (see
+	// settings.go) once the store is running.
+	settingsMu sync.RWMutex
+
+	closer closer // see Close
 }
 
-func NewAudioFileStore(name, fileDir, baseUrl string, enableEmomusic bool, router gin.IRouter) *AudioFileStore {
+func NewAudioFileStore(name, fileDir, baseUrl string, enableEmomusic bool, router gin.IRouter, options ...AudioFileStoreOption) *AudioFileStore {
 	a := &AudioFileStore{
 		Name:           name,
 		FileDir:        fileDir,
 		BaseUrl:        baseUrl,
 		EnableEmomusic: enableEmomusic,
+		closer:         newCloser(),
 	}
 
+	for _, opt := range options {
+		opt(a)
+	}
+
+	registerStore(a)
+	metadata.OnTrackDeleted(a.onTrackDeleted)
+	if !a.Offline {
+		a.startTmpSweeper()
+		a.startDownloadWorkers()
+		a.startCoverWorker()
+		if err := a.startWatcher(); err != nil {
+			logger.WithField("store", a.Name).WithError(err).Error("NewAudioFileStore: startWatcher failed")
+		}
+	}
 	a.registerRoutes(router)
 
 	return a
 }
 
+// AudioFileStoreOption is the option type for NewAudioFileStore.
+type AudioFileStoreOption func(*AudioFileStore)
+
+// WithEmomusicUploadFile sets AudioFileStore.EmomusicUploadFile.
+func WithEmomusicUploadFile(upload bool) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.EmomusicUploadFile = upload
+	}
+}
+
+// WithOffline sets AudioFileStore.Offline.
+func WithOffline() AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.Offline = true
+	}
+}
+
+// WithMaxUploadBytes sets AudioFileStore.MaxUploadBytes.
+func WithMaxUploadBytes(n int64) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.MaxUploadBytes = n
+	}
+}
+
+// WithAllowedContentTypes sets AudioFileStore.AllowedContentTypes.
+func WithAllowedContentTypes(types ...string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.AllowedContentTypes = types
+	}
+}
+
+// WithTmpTTL sets AudioFileStore.TmpTTL.
+func WithTmpTTL(ttl time.Duration) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.TmpTTL = ttl
+	}
+}
+
+// WithOnDuplicate sets AudioFileStore.OnDuplicate.
+func WithOnDuplicate(onDuplicate string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.OnDuplicate = onDuplicate
+	}
+}
+
+// WithAnalyzers sets AudioFileStore.Analyzers.
+func WithAnalyzers(names ...string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.Analyzers = names
+	}
+}
+
 // this file implement an app that turns a local directory into a music store.
 // that is: build a database from the music files in the directory,
 // and generate config files for the music store.
@@ -60,76 +251,245 @@ func NewAudioFileStore(name, fileDir, baseUrl string, enableEmomusic bool, route
 
 // AddTrack adds a track (from audio file path) to the database.
 //
-// File will be hard linked to the FileDir. And named as:
+// File will be linked to the FileDir (by the LinkMode). And named by the
+// FilenameTemplate, by default:
 //
-//	{name_of_the_track}-{name_of_the_track}-{name_of_the_track}.mp3
+//	{name_of_the_track}-{artist_of_the_track}-{album_of_the_track}.mp3
 func (a *AudioFileStore) AddTrack(path string, options ...AddTrackOption) (*model.Track, error) {
+	inflight.begin()
+	defer inflight.end()
+
+	if a.readOnly() {
+		return nil, errReadOnly
+	}
+
+	track, format, err := a.prepareTrack(path, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// from the duplicate check to the save: concurrent AddTracks of the
+	// same track (e.g. by a rescan) must not both pass the check
+	a.addMu.Lock()
+	defer a.addMu.Unlock()
+
+	track.Artist, err = a.canonicalArtist(track.Artist)
+	if err != nil {
+		return nil, fmt.Errorf("AudioFileToTrack: CanonicalArtist failed: %w", err)
+	}
+
+	// check if track exists in the library: same name & artist, or same content
+	existing, err := metadata.FindDuplicateTrack(a.libraryContext(), track)
+	if err != nil {
+		return nil, fmt.Errorf("AudioFileToTrack: FindDuplicateTrack failed: %w", err)
+	}
+	if existing == nil { // or to be saved by the batch of a running rescan
+		existing = a.batch.Load().duplicate(track)
+	}
+	if existing != nil {
+		return nil, &DuplicateTrackError{Existing: existing}
+	}
+
+	// emotion analyze: in background, after the track is saved
+	if a.emomusicEnabled() {
+		track.AnalysisStatus = model.AnalysisPending
+	}
+
+	// Save audio file to FileDir (link it by the LinkMode) and the track to db.
+	// The track is saved first if its ID is needed to name the file.
+	oldpath := path
+	if a.filenameNeedsID() {
+		path, err = a.saveTrackThenLink(track, path, format)
+	} else {
+		path, err = a.linkThenSaveTrack(track, path, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.batch.Load().remember(track)
+
+	logger.WithField("ID", track.ID).
+		WithField("Name", track.Name).
+		WithField("AudioFileURL", track.AudioFileURL).
+		Info("AddTrack: success")
+
+	if a.emomusicEnabled() {
+		if _, err := a.enqueueAnalysis(track, path); err != nil {
+			logger.WithField("ID", track.ID).WithError(err).
+				Error("AddTrack: analysis.Enqueue failed")
+		}
+	}
+	a.maybeFetchCover(track)
+
+	if a.isInFileDir(oldpath) {
+		// 原来就在 FileDir 下，rm 原文件，相当于只是重命名
+		os.Remove(oldpath)
+	}
+
+	return track, nil
+}
+
+// canonicalArtist returns the spelling of the artist already in the
+// library (or in the batch of a running rescan), if the ArtistRules fold
+// the case, see model.ArtistKey.
+func (a *AudioFileStore) canonicalArtist(artist string) (string, error) {
+	if artist == "" || !model.CurrentArtistRules().FoldCase {
+		return artist, nil
+	}
+	existing, err := metadata.CanonicalArtist(a.libraryContext(), artist)
+	if err != nil {
+		return artist, err
+	}
+	if existing == "" {
+		existing = a.batch.Load().artist(artist)
+	}
+	if existing == "" {
+		return artist, nil
+	}
+	return existing, nil
+}
+
+// prepareTrack checks the content of the audio file (at path), and makes
+// the track of it: the tags overridden by the options, in the library of
+// the store, with the content hash. It returns the format of the file.
+func (a *AudioFileStore) prepareTrack(path string, options ...AddTrackOption) (*model.Track, string, error) {
+	// check the content: named by the real format
+	format, err := sniffFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("AudioFileToTrack: sniffFile failed: %w", err)
+	}
+	if !audioFormats[format] {
+		return nil, "", fmt.Errorf("AudioFileToTrack: %w: %s", errUnsupportedContent, path)
+	}
+
 	// get track metadata
 	track, err := model.TrackFromAudioFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("AudioFileToTrack: TrackFromAudioFile failed: %w", err)
+		return nil, "", fmt.Errorf("AudioFileToTrack: TrackFromAudioFile failed: %w", err)
 	}
 
 	// apply options
 	for _, opt := range options {
 		opt(a, track)
 	}
+	track.Artist = model.NormalizeArtist(track.Artist)
+
+	track.Library = a.library()
 
-	// check if track exists
-	if metadata.TrackExists(context.Background(), track) {
-		return nil, fmt.Errorf("AudioFileToTrack: track already exists: %s", track.Name)
+	// hash the audio content
+	track.AudioFileHash, err = fileSHA256(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("AudioFileToTrack: fileSHA256 failed: %w", err)
 	}
+	return track, format, nil
+}
 
-	// Save audio file to FileDir: hard link it
-	oldpath := path
-	path, err = a.hardLinkAudioFile(track, path)
+// linkThenSaveTrack links the audio file (at path) into the FileDir,
+// and then saves the track with the AudioFileURL of it.
+// It returns the new path of the file.
+func (a *AudioFileStore) linkThenSaveTrack(track *model.Track, path string, format string) (string, error) {
+	path, undo, err := a.linkAudioFile(track, path, format)
 	if err != nil {
-		return nil, fmt.Errorf("AudioFileToTrack: hardLinkAudioFile failed: %w", err)
+		return "", fmt.Errorf("AudioFileToTrack: linkAudioFile failed: %w", err)
 	}
 
 	// fill url
-	track.AudioFileURL, err = a.audioUrl(path)
-	if err != nil {
-		os.Remove(path) // rollback
+	if err := a.fillAudioFile(track, path); err != nil {
+		undo() // rollback
 
-		return nil, fmt.Errorf("AudioFileToTrack: AudioFileURL failed: %w", err)
+		return "", fmt.Errorf("AudioFileToTrack: AudioFileURL failed: %w", err)
 	}
 	// TODO: Image??
 
-	// emotion analyze
-	if a.EnableEmomusic {
-		emotion, err := emomusic.AnalyzeURI(track.AudioFileURL)
-		// emotion, err := emomusic.AnalyzeFile(path)
-		if err != nil {
-			os.Remove(path) // rollback
+	// save to db
+	err = metadata.CreateTrack(context.Background(), track)
+	if err != nil {
+		undo() // rollback
 
-			return nil, fmt.Errorf("AudioFileToTrack: AnalyzeURI failed: %w", err)
-		}
-		track.Emotion = emotion
+		return "", fmt.Errorf("AudioFileToTrack: Create failed: %w", err)
 	}
+	return path, nil
+}
 
-	// save to db
-	err = metadata.CreateTrack(context.Background(), track)
+// saveTrackThenLink saves the track (to get its ID), and then links
+// the audio file (at path) into the FileDir, named with the ID, and
+// updates the AudioFileURL of the track.
+// It returns the new path of the file.
+func (a *AudioFileStore) saveTrackThenLink(track *model.Track, path string, format string) (string, error) {
+	ctx := context.Background()
+
+	err := metadata.CreateTrack(ctx, track)
 	if err != nil {
-		os.Remove(path) // rollback
+		return "", fmt.Errorf("AudioFileToTrack: Create failed: %w", err)
+	}
 
-		return nil, fmt.Errorf("AudioFileToTrack: Create failed: %w", err)
+	path, undo, err := a.linkAudioFile(track, path, format)
+	if err != nil {
+		metadata.PurgeTrack(ctx, track) // rollback
+
+		return "", fmt.Errorf("AudioFileToTrack: linkAudioFile failed: %w", err)
 	}
 
-	logger.WithField("ID", track.ID).
-		WithField("Name", track.Name).
-		WithField("AudioFileURL", track.AudioFileURL).
-		Info("AddTrack: success")
+	if err = a.fillAudioFile(track, path); err == nil {
+		err = metadata.UpdateTrackFile(ctx, track)
+	}
+	if err != nil {
+		undo() // rollback
+		metadata.PurgeTrack(ctx, track)
 
-	oldpathAbs, err1 := filepath.Abs(oldpath)
-	aFileDirAbs, err2 := filepath.Abs(a.FileDir)
-	if err1 == nil && err2 == nil &&
-		strings.HasPrefix(oldpathAbs, aFileDirAbs) {
-		// 原来就在 FileDir 下，rm 原文件，相当于只是重命名
-		os.Remove(oldpath)
+		return "", fmt.Errorf("AudioFileToTrack: AudioFileURL failed: %w", err)
 	}
+	return path, nil
+}
 
-	return track, nil
+// fillAudioFile fills the AudioFileURL of the track, and remembers
+// the state of the file (at path) for rescans.
+func (a *AudioFileStore) fillAudioFile(track *model.Track, path string) error {
+	if st, err := os.Stat(path); err == nil {
+		track.FileSize = st.Size()
+		modTime := st.ModTime()
+		track.FileModTime = &modTime
+	}
+
+	u, err := a.audioUrl(path)
+	if err != nil {
+		return err
+	}
+	track.AudioFileURL = u
+	return nil
+}
+
+// enqueueAnalysis enqueues the emotion analysis of the track,
+// whose audio file is at path.
+func (a *AudioFileStore) enqueueAnalysis(track *model.Track, path string) (*model.Job, error) {
+	filePath := ""
+	if a.emomusicUploadFile() {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		filePath = abs
+	}
+	return analysis.Enqueue(context.Background(), track, filePath, a.analyzers())
+}
+
+// enqueueAnalyses enqueues the emotion analyses of the saved tracks
+// (with their files at the paths) at once, see analysis.EnqueueBatch.
+func (a *AudioFileStore) enqueueAnalyses(tracks []*model.Track, paths []string) error {
+	var filePaths []string
+	if a.emomusicUploadFile() {
+		filePaths = make([]string, len(paths))
+		for i, path := range paths {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			filePaths[i] = abs
+		}
+	}
+	_, err := analysis.EnqueueBatch(context.Background(), tracks, filePaths, a.analyzers())
+	return err
 }
 
 // AddTrackOption is the option type for AddTrack.
@@ -161,33 +521,67 @@ func OverrideTrackMetadata(track *model.Track) AddTrackOption {
 	}
 }
 
-// hardLinkAudioFile hard link the audio file to the FileDir.
-// It returns the new path.
+// linkAudioFile puts the audio file into the FileDir by the LinkMode
+// (hard link by default). It returns the new path, and a function to
+// undo it.
 //
 // The new path is constructed as:
 //
-//	{FileDir}/{name_of_the_track}-{name_of_the_track}-{name_of_the_track}.mp3
+//	{FileDir}/{FilenameTemplate}.mp3
+//
+// or, for LayoutArtistAlbum, with the directories created if needed:
+//
+//	{FileDir}/{artist}/{album}/{FilenameTemplate}.mp3
 //
-// If the file already exists, it returns an error.
-func (a *AudioFileStore) hardLinkAudioFile(track *model.Track, path string) (newpath string, err error) {
-	filename := fmt.Sprintf("%s-%s-%s%s",
-		stringToSnake(track.Name), stringToSnake(track.Artist), stringToSnake(track.Album),
-		filepath.Ext(path)) // Ext includes the dot
+// where the extension is ext (the sniffed format), instead of the one of path.
+//
+// If the name is taken, a suffix is appended, see OnCollision.
+func (a *AudioFileStore) linkAudioFile(track *model.Track, path string, ext string) (newpath string, undo func(), err error) {
+	return a.placeAudioFile(track, path, ext, a.linkMode(path))
+}
 
-	newpath = filepath.Join(a.FileDir, filename)
+// placeAudioFile is linkAudioFile by the given LinkMode.
+func (a *AudioFileStore) placeAudioFile(track *model.Track, path string, ext string, mode string) (newpath string, undo func(), err error) {
+	filename, err := a.audioFileName(track, ext) // ext includes the dot
+	if err != nil {
+		return "", nil, fmt.Errorf("linkAudioFile: audioFileName failed: %w", err)
+	}
 
-	// check if the file exists
-	if _, err := os.Stat(newpath); !errors.Is(err, os.ErrNotExist) {
-		return "", fmt.Errorf("hardLinkAudioFile: file already exists: %s. err=%w", newpath, err)
+	dir := filepath.Join(a.FileDir, a.audioFileDir(track))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("linkAudioFile: MkdirAll failed: %w", err)
+	}
+	filename, err = a.freeFilename(track, dir, filename, ext)
+	if err != nil {
+		return "", nil, fmt.Errorf("linkAudioFile: %w", err)
 	}
+	newpath = filepath.Join(dir, filename)
 
-	// hard link
-	err = os.Link(path, newpath)
+	// link the file, not the symlink (see ScanFilter.FollowSymlinks)
+	if target, err := filepath.EvalSymlinks(path); err == nil && mode != LinkModeMove {
+		path = target
+	}
+	undo, err = placeFile(path, newpath, mode)
 	if err != nil {
-		return "", fmt.Errorf("hardLinkAudioFile: Link failed: %w", err)
+		return "", nil, fmt.Errorf("linkAudioFile: %s failed: %w", mode, err)
 	}
 
-	return newpath, nil
+	return newpath, undo, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file content.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // stringToSnake converts "a string with spaces" to "a_string_with_spaces".
@@ -209,7 +603,8 @@ func (a *AudioFileStore) audioRelevantPath(path string) (string, error) {
 
 	relevant := strings.TrimPrefix(fileAbsPath, dirAbsPath)
 
-	return relevant, nil
+	// nested paths (see Layout): the separators of URLs
+	return filepath.ToSlash(relevant), nil
 }
 
 func (a *AudioFileStore) audioStaticBasePath() string {
@@ -228,76 +623,39 @@ func (a *AudioFileStore) audioUrl(path string) (string, error) {
 }
 
 // AddTracksFromDir adds all the tracks in the directory to the database.
-func (a *AudioFileStore) AddTracksFromDir() error {
+// Files already imported (and not changed) are skipped, see Rescan.
+//
+// With dryRun, nothing is imported: the report of DryRun is logged.
+func (a *AudioFileStore) AddTracksFromDir(dryRun bool) error {
 	logger.WithField("FileDir", a.FileDir).Info("AddTracksFromDir: start")
+	start := time.Now()
 
-	// enumerate music files
-	ch, err := enumMusicFiles(a.FileDir)
-	if err != nil {
-		return fmt.Errorf("AddTracksFromDir: enumMusicFiles failed: %w", err)
-	}
-
-	// add tracks
-	for path := range ch {
-		logger.WithField("path", path).Debug("AddTracksFromDir: AddTrack")
-		_, err := a.AddTrack(path)
+	if dryRun {
+		report, err := a.DryRun(context.Background())
 		if err != nil {
-			logger.Errorf("AddTracksFromDir: AddTrack failed: %v", err)
+			return fmt.Errorf("AddTracksFromDir: %w", err)
 		}
+		logDryRunReport(a, report)
+		return nil
+	}
+
+	summary, err := a.Rescan(context.Background())
+	if err != nil {
+		return fmt.Errorf("AddTracksFromDir: %w", err)
+	}
+	for _, failed := range summary.Failed {
+		logger.WithField("file", failed.File).
+			Errorf("AddTracksFromDir: AddTrack failed: %v", failed.Error)
 	}
 
+	logRescanSummary(a, summary, time.Since(start))
 	return nil
 }
 
 // isMusicFile returns true if the file is a music file.
-// It checks the file extension.
-// supported extensions: .mp3, .wav, .m4a
+// It checks the content (see sniffFile), not the extension.
+// supported formats: see audioFormats
 func isMusicFile(path string) bool {
-	ext := strings.ToLower(filepath.Ext(path))
-	switch ext {
-	case ".mp3", ".wav", ".m4a":
-		return true
-	default:
-		return false
-	}
-}
-
-// enumMusicFiles enumerates all the music files in the directory.
-// It returns a channel of the file paths.
-func enumMusicFiles(dir string) (chan string, error) {
-	if dir == "" {
-		return nil, errors.New("empty dir")
-	}
-	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
-		return nil, errors.New("not a dir")
-	}
-
-	ch := make(chan string, 3)
-
-	go func() {
-		defer close(ch)
-
-		// walk the directory
-		err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-
-			// skip non-music files
-			if d.IsDir() || !isMusicFile(path) {
-				return nil
-			}
-
-			// send the path to the channel
-			ch <- path
-
-			return nil
-		})
-
-		if err != nil {
-			fmt.Println("[ERR] filepath.Walk:", err)
-		}
-	}()
-
-	return ch, nil
+	format, err := sniffFile(path)
+	return err == nil && audioFormats[format]
 }
@@ -0,0 +1,480 @@
+package audiofilestore
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"musicstore/metadata"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the backup and restore of the musicstore, e.g. to
+// move it to a new machine: a tar.gz of the database snapshot, the
+// manifest of the files in the stores, and optionally the files.
+
+// Entries of a backup archive.
+const (
+	backupDBName       = "musicstore.db"
+	backupManifestName = "manifest.json"
+	backupFilesDir     = "files" // files/{store}/{path in the FileDir}
+)
+
+// BackupManifest lists the files of the stores in a backup.
+type BackupManifest struct {
+	CreatedAt time.Time
+	WithFiles bool // the files are in the backup
+	Stores    []BackupStore
+}
+
+// BackupStore lists the files of a store.
+type BackupStore struct {
+	Name  string
+	Files []BackupFile
+}
+
+// BackupFile is a file of a store.
+type BackupFile struct {
+	Path   string // relative to the FileDir, slash separated
+	Size   int64
+	SHA256 string
+}
+
+// manifest lists the regular files in the FileDir,
+// except the tmp, trash, cache and quarantine dirs, and the scan journal.
+func (a *AudioFileStore) manifest() (BackupStore, error) {
+	store := BackupStore{Name: a.Name}
+	tmp := filepath.Join(a.FileDir, tmpDirName)
+	trash := filepath.Join(a.FileDir, trashDirName)
+	cache := filepath.Join(a.FileDir, cacheDirName)
+	quarantine := filepath.Join(a.FileDir, quarantineDirName)
+
+	err := filepath.WalkDir(a.FileDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == tmp || p == trash || p == cache || p == quarantine {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil // symlinks are not backed up
+		}
+		if p == filepath.Join(a.FileDir, journalFileName) {
+			return nil
+		}
+
+		st, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hash, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		store.Files = append(store.Files, BackupFile{
+			Path: relPath(a.FileDir, p), Size: st.Size(), SHA256: hash,
+		})
+		return nil
+	})
+	return store, err
+}
+
+// WriteBackup writes the backup of the database and the stores into w,
+// as a tar.gz, e.g. for POST /admin/backup and `musicstore export`.
+//
+// Imports of all the stores are paused while the database is snapshotted
+// and the files are listed, so that they are consistent.
+func WriteBackup(ctx context.Context, w io.Writer, withFiles bool) error {
+	dir, err := os.MkdirTemp("", "musicstore-backup-*")
+	if err != nil {
+		return fmt.Errorf("WriteBackup: MkdirTemp failed: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := allStores()
+	manifest := BackupManifest{CreatedAt: time.Now(), WithFiles: withFiles}
+	dbPath := filepath.Join(dir, backupDBName)
+
+	err = func() error {
+		for _, a := range stores {
+			a.addMu.Lock()
+			defer a.addMu.Unlock()
+		}
+		if err := metadata.SnapshotDB(ctx, dbPath); err != nil {
+			return fmt.Errorf("SnapshotDB failed: %w", err)
+		}
+		for _, a := range stores {
+			store, err := a.manifest()
+			if err != nil {
+				return fmt.Errorf("manifest of store %q failed: %w", a.Name, err)
+			}
+			manifest.Stores = append(manifest.Stores, store)
+		}
+		return nil
+	}()
+	if err != nil {
+		return fmt.Errorf("WriteBackup: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := tarFile(tw, backupDBName, dbPath); err != nil {
+		return fmt.Errorf("WriteBackup: %w", err)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("WriteBackup: marshal manifest failed: %w", err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name: backupManifestName, Mode: 0644, Size: int64(len(manifestJSON)), ModTime: manifest.CreatedAt,
+	})
+	if err == nil {
+		_, err = tw.Write(manifestJSON)
+	}
+	if err != nil {
+		return fmt.Errorf("WriteBackup: write manifest failed: %w", err)
+	}
+
+	if withFiles {
+		for i, a := range stores {
+			for _, f := range manifest.Stores[i].Files {
+				name := path.Join(backupFilesDir, a.Name, f.Path)
+				if err := tarFile(tw, name, filepath.Join(a.FileDir, filepath.FromSlash(f.Path))); err != nil {
+					return fmt.Errorf("WriteBackup: %w", err)
+				}
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// tarFile writes the file at path into the tar, named name.
+func tarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(st, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tar %s failed: %w", name, err)
+	}
+
+	// the size is fixed by the header: a file growing meanwhile is cut
+	if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("tar %s failed: %w", name, err)
+	}
+	return nil
+}
+
+// RestoreResult is the result of a restore.
+type RestoreResult struct {
+	Files int // files restored into the stores
+	// Missing: files in the manifest not in the stores after the restore,
+	// as {store}/{path}: the tracks of them are found by fsck.
+	Missing []string
+	// Mismatched: files in the stores not matching the manifest (hash).
+	Mismatched []string
+	// Skipped: files of the stores not running here, as {store}/{path}.
+	Skipped []string
+}
+
+// maxRestoreBytes of a backup to restore: of the body, and of the
+// extracted entries (no decompression bombs).
+const maxRestoreBytes = 64 << 30 // 64 GiB
+
+// restoreBackup restores the backup (see WriteBackup) from r, in three
+// steps, so that a bad archive changes nothing:
+//
+//  1. the entries are staged: the database snapshot into a tmp dir, the
+//     files into the tmp dirs of the stores of the same names;
+//  2. they're validated: the snapshot is an intact database, and the
+//     staged files are in the manifest, with the same hashes;
+//  3. the files are moved into the stores, and the database is replaced
+//     by the snapshot.
+func restoreBackup(ctx context.Context, r io.Reader) (*RestoreResult, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("restoreBackup: not a tar.gz: %w", err)
+	}
+	extracted := &io.LimitedReader{R: gz, N: maxRestoreBytes + 1}
+	tr := tar.NewReader(extracted)
+
+	dir, err := os.MkdirTemp("", "musicstore-restore-*")
+	if err != nil {
+		return nil, fmt.Errorf("restoreBackup: MkdirTemp failed: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	result := &RestoreResult{}
+	var manifest *BackupManifest
+	dbPath := ""
+	var staged []stagedFile
+	stagingDirs := map[*AudioFileStore]string{}
+	defer func() {
+		for _, d := range stagingDirs {
+			os.RemoveAll(d)
+		}
+	}()
+
+	// 1. stage
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("restoreBackup: bad archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch {
+		case hdr.Name == backupDBName:
+			dbPath = filepath.Join(dir, backupDBName)
+			if _, err := writeFileFrom(dbPath, tr); err != nil {
+				return nil, fmt.Errorf("restoreBackup: %w", err)
+			}
+		case hdr.Name == backupManifestName:
+			manifest = new(BackupManifest)
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("restoreBackup: bad manifest: %w", err)
+			}
+		case strings.HasPrefix(hdr.Name, backupFilesDir+"/"):
+			storeName, rel, _ := strings.Cut(strings.TrimPrefix(hdr.Name, backupFilesDir+"/"), "/")
+			a := getStore(storeName)
+			if a == nil || !filepath.IsLocal(filepath.FromSlash(rel)) {
+				result.Skipped = append(result.Skipped, storeName+"/"+rel)
+				continue
+			}
+			if _, ok := stagingDirs[a]; !ok {
+				d, err := os.MkdirTemp(a.tmpDir(), "restore-*")
+				if err != nil {
+					return nil, fmt.Errorf("restoreBackup: MkdirTemp failed: %w", err)
+				}
+				stagingDirs[a] = d
+			}
+			f := stagedFile{store: a, rel: rel, tmp: filepath.Join(stagingDirs[a], strconv.Itoa(len(staged)))}
+			if f.sha256, err = writeFileFrom(f.tmp, tr); err != nil {
+				return nil, fmt.Errorf("restoreBackup: stage %s failed: %w", hdr.Name, err)
+			}
+			staged = append(staged, f)
+		}
+		if extracted.N <= 0 {
+			return nil, fmt.Errorf("restoreBackup: more than %d bytes extracted", int64(maxRestoreBytes))
+		}
+	}
+
+	// 2. validate
+	if dbPath == "" || manifest == nil {
+		return nil, errors.New("restoreBackup: bad archive: no database or manifest")
+	}
+	if err := metadata.CheckSnapshot(ctx, dbPath); err != nil {
+		return nil, fmt.Errorf("restoreBackup: bad database: %w", err)
+	}
+	hashes := map[string]string{} // {store}/{path} -> SHA256
+	for _, store := range manifest.Stores {
+		for _, f := range store.Files {
+			hashes[store.Name+"/"+f.Path] = f.SHA256
+		}
+	}
+	for _, f := range staged {
+		name := f.store.Name + "/" + f.rel
+		if want, ok := hashes[name]; !ok || want != f.sha256 {
+			return nil, fmt.Errorf("restoreBackup: bad archive: %s does not match the manifest", name)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("restoreBackup: %w", err)
+	}
+
+	// 3. swap
+	for _, f := range staged {
+		if err := f.store.restoreFile(f.rel, f.tmp); err != nil {
+			return nil, fmt.Errorf("restoreBackup: %w", err)
+		}
+		result.Files++
+	}
+	if err := metadata.RestoreDB(ctx, dbPath); err != nil {
+		return nil, fmt.Errorf("restoreBackup: %w", err)
+	}
+
+	for _, store := range manifest.Stores {
+		a := getStore(store.Name)
+		if a == nil {
+			continue
+		}
+		for _, f := range store.Files {
+			p := filepath.Join(a.FileDir, filepath.FromSlash(f.Path))
+			hash, err := fileSHA256(p)
+			switch {
+			case err != nil:
+				result.Missing = append(result.Missing, store.Name+"/"+f.Path)
+			case hash != f.SHA256:
+				result.Mismatched = append(result.Mismatched, store.Name+"/"+f.Path)
+			}
+		}
+	}
+	return result, nil
+}
+
+// stagedFile of a backup being restored, see restoreBackup.
+type stagedFile struct {
+	store  *AudioFileStore
+	rel    string // path in the FileDir, slash separated
+	tmp    string // the staged file
+	sha256 string
+}
+
+// restoreFile moves the staged file tmp into the FileDir (at the
+// relative path rel, slash separated), replacing the existing one.
+func (a *AudioFileStore) restoreFile(rel string, tmp string) error {
+	dst := filepath.Join(a.FileDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("restore %s failed: %w", rel, err)
+	}
+	return nil
+}
+
+// writeFileFrom writes the content of r into the new file at path,
+// and returns its SHA-256, hex.
+func writeFileFrom(path string, r io.Reader) (string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// PostBackup handles: POST /admin/backup
+//
+// It responds a backup (tar.gz) of the database and the manifest of the
+// files in the stores (with hashes). With the query files=true, the
+// files are included as well.
+//
+// Response:
+//
+//   - 200: OK: the tar.gz, as an attachment
+//   - 500: Internal Server Error: {error: "..."}, before the archive is sent
+func PostBackup(c *gin.Context) {
+	withFiles := c.Query("files") == "true"
+
+	// the snapshot is taken before the response is started,
+	// to report the errors of it
+	tmp, err := os.CreateTemp("", "musicstore-backup-*.tar.gz")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	start := time.Now()
+	if err := WriteBackup(c, tmp, withFiles); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.WithContext(c).WithField("files", withFiles).WithField("took", time.Since(start)).
+		Info("PostBackup: backup created")
+
+	filename := fmt.Sprintf("musicstore-backup-%s.tar.gz", start.Format("20060102-150405"))
+	c.FileAttachment(tmp.Name(), filename)
+}
+
+// PostRestore handles: POST /admin/restore
+//
+// It restores a backup (see PostBackup) from the body, or the File part of
+// a multipart form: the files (if any) into the stores of the same names,
+// and then the database. The data in the database is replaced. Nothing is
+// changed if the archive is bad (see restoreBackup), up to 64 GiB.
+//
+// It should be done on an idle musicstore (e.g. a new one), and
+// restarted after that. Run fsck for the tracks of the missing files.
+//
+// Response:
+//
+//   - 200: OK: {result: {Files: 42, Missing: ["store/a.mp3"], Mismatched: [...], Skipped: [...]}}
+//   - 400: Bad Request: {error: "..."}, e.g. a bad archive
+//   - 413: Request Entity Too Large: {error: "..."}
+//   - 500: Internal Server Error: {error: "..."}
+func PostRestore(c *gin.Context) {
+	if c.Request.ContentLength > maxRestoreBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("more than %d bytes", int64(maxRestoreBytes))})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRestoreBytes)
+
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, err := c.FormFile("File")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	result, err := restoreBackup(c, body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.WithContext(c).WithField("files", result.Files).
+		WithField("missing", len(result.Missing)).
+		WithField("mismatched", len(result.Mismatched)).
+		Warn("PostRestore: restored, a restart is recommended")
+	c.JSON(http.StatusOK, gin.H{"result": result})
+}
@@ -0,0 +1,239 @@
+package audiofilestore
+
+import (
+	"context"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"os"
+	"sync"
+)
+
+// this file implements the batched imports of a rescan (and LoadFromDir):
+// the new files are checked for duplicates against the tracks in memory,
+// prefetched once, and the tracks are saved by multi-row INSERTs, instead
+// of a query and an INSERT per file.
+
+// scanBatchSize is the number of new tracks saved at once by a rescan.
+const scanBatchSize = 200
+
+// importBatch collects the new tracks of a rescan, to save them at once.
+// The methods are no-ops on a nil batch.
+type importBatch struct {
+	a   *AudioFileStore
+	ctx context.Context
+
+	mu      sync.Mutex
+	byName  map[string]*model.Track // by dupNameKey
+	byHash  map[string]*model.Track // by AudioFileHash
+	artists map[string]string       // spellings, by model.ArtistKey
+	pending []pendingTrack
+	failed  map[int]error // of the saved files, by the index in the walk
+
+	journal *scanJournal // of the rescan, if any
+}
+
+// pendingTrack is a track to save, with its audio file linked already.
+type pendingTrack struct {
+	track   *model.Track
+	path    string // in the FileDir
+	oldpath string
+	undo    func()
+	index   int
+}
+
+// newImportBatch makes a batch checking the duplicates against the tracks
+// (e.g. all the tracks) in the library of the store.
+func newImportBatch(ctx context.Context, a *AudioFileStore, tracks []*model.Track) *importBatch {
+	b := &importBatch{
+		a:       a,
+		ctx:     ctx,
+		byName:  make(map[string]*model.Track, len(tracks)),
+		byHash:  make(map[string]*model.Track, len(tracks)),
+		artists: map[string]string{},
+		failed:  map[int]error{},
+	}
+	library := a.library()
+	for _, t := range tracks {
+		if t.Library == library {
+			b.remember(t)
+		}
+	}
+	return b
+}
+
+func dupNameKey(t *model.Track) string {
+	return t.Name + "\x00" + t.Artist
+}
+
+// duplicate returns the known track duplicating the track, as
+// metadata.FindDuplicateTrack does, or nil.
+func (b *importBatch) duplicate(track *model.Track) *model.Track {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.duplicateLocked(track)
+}
+
+func (b *importBatch) duplicateLocked(track *model.Track) *model.Track {
+	if t, ok := b.byName[dupNameKey(track)]; ok {
+		return t
+	}
+	if track.AudioFileHash != "" {
+		if t, ok := b.byHash[track.AudioFileHash]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// remember the track (e.g. added by AddTrack during the rescan) for the
+// duplicate checks.
+func (b *importBatch) remember(track *model.Track) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rememberLocked(track)
+}
+
+// artist returns the known spelling of the artist, or "".
+func (b *importBatch) artist(artist string) string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.artists[model.ArtistKey(artist)]
+}
+
+func (b *importBatch) rememberLocked(track *model.Track) {
+	if key := model.ArtistKey(track.Artist); key != "" {
+		if _, ok := b.artists[key]; !ok {
+			b.artists[key] = track.Artist
+		}
+	}
+	if _, ok := b.byName[dupNameKey(track)]; !ok {
+		b.byName[dupNameKey(track)] = track
+	}
+	if _, ok := b.byHash[track.AudioFileHash]; !ok && track.AudioFileHash != "" {
+		b.byHash[track.AudioFileHash] = track
+	}
+}
+
+// forgetLocked the track that failed to save.
+func (b *importBatch) forgetLocked(track *model.Track) {
+	if b.byName[dupNameKey(track)] == track {
+		delete(b.byName, dupNameKey(track))
+	}
+	if b.byHash[track.AudioFileHash] == track {
+		delete(b.byHash, track.AudioFileHash)
+	}
+}
+
+// add the new file (at path, the index-th in the walk) as AddTrack does,
+// but the track is saved later, by flush. The returned track gets its ID
+// once saved; a failed save is reported by close.
+func (b *importBatch) add(path string, index int) (*model.Track, error) {
+	a := b.a
+	track, format, err := a.prepareTrack(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// AddTrack: serialized with the ones of the API
+	a.addMu.Lock()
+	defer a.addMu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if spelled, ok := b.artists[model.ArtistKey(track.Artist)]; ok && model.CurrentArtistRules().FoldCase {
+		track.Artist = spelled // as canonicalArtist
+	}
+	if existing := b.duplicateLocked(track); existing != nil {
+		return nil, &DuplicateTrackError{Existing: existing}
+	}
+	if a.emomusicEnabled() {
+		track.AnalysisStatus = model.AnalysisPending
+	}
+
+	newpath, undo, err := a.linkAudioFile(track, path, format)
+	if err != nil {
+		return nil, fmt.Errorf("AudioFileToTrack: linkAudioFile failed: %w", err)
+	}
+	if err := a.fillAudioFile(track, newpath); err != nil {
+		undo()
+		return nil, fmt.Errorf("AudioFileToTrack: AudioFileURL failed: %w", err)
+	}
+
+	b.rememberLocked(track)
+	b.pending = append(b.pending, pendingTrack{
+		track: track, path: newpath, oldpath: path, undo: undo, index: index,
+	})
+	if len(b.pending) >= scanBatchSize {
+		b.flushLocked()
+	}
+	return track, nil
+}
+
+// flushLocked saves the pending tracks, and then enqueues their analysis
+// and removes the original files in the FileDir (renamed, as AddTrack).
+// If the save failed, the links are undone.
+func (b *importBatch) flushLocked() {
+	if len(b.pending) == 0 {
+		return
+	}
+	a := b.a
+	tracks := make([]*model.Track, len(b.pending))
+	for i, p := range b.pending {
+		tracks[i] = p.track
+	}
+
+	err := metadata.CreateTracks(b.ctx, tracks, scanBatchSize)
+	if err == nil && a.emomusicEnabled() {
+		// analyzed in background, by the analysis workers: the scan
+		// goes on meanwhile, however slow the analyzers are
+		paths := make([]string, len(b.pending))
+		for i, p := range b.pending {
+			paths[i] = p.path
+		}
+		if err := a.enqueueAnalyses(tracks, paths); err != nil {
+			logger.WithField("store", a.Name).WithField("tracks", len(tracks)).
+				WithError(err).Error("importBatch: analysis.EnqueueBatch failed")
+		}
+	}
+	for _, p := range b.pending {
+		if err != nil {
+			p.undo()
+			b.forgetLocked(p.track)
+			b.failed[p.index] = fmt.Errorf("AudioFileToTrack: Create failed: %w", err)
+			failed := newImportResult(relPath(a.FileDir, p.oldpath), nil, b.failed[p.index])
+			b.journal.doneFile(p.oldpath, &failed)
+			continue
+		}
+		b.journal.doneFile(p.oldpath, nil)
+		a.maybeFetchCover(p.track)
+		if a.isInFileDir(p.oldpath) && p.oldpath != p.path {
+			os.Remove(p.oldpath)
+		}
+	}
+
+	logger.WithField("store", a.Name).WithField("tracks", len(b.pending)).
+		WithError(err).Info("importBatch: flushed")
+	b.pending = b.pending[:0]
+}
+
+// close saves the pending tracks, and returns the errors of the ones
+// failed to save, by the index in the walk.
+func (b *importBatch) close() map[int]error {
+	b.a.addMu.Lock()
+	defer b.a.addMu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushLocked()
+	return b.failed
+}
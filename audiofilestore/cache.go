@@ -0,0 +1,236 @@
+package audiofilestore
+
+import (
+	"fmt"
+	"io/fs"
+	"musicstore/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// this file implements the cache of the files derived from the audio
+// files (e.g. HLS segments), generated lazily into {FileDir}/.cache.
+// The least recently used entries are evicted beyond the CacheMaxBytes.
+
+// cacheDirName is the name of the cache dir in the FileDir.
+const cacheDirName = ".cache"
+
+// DefaultCacheMaxBytes is the default AudioFileStore.CacheMaxBytes.
+const DefaultCacheMaxBytes = 10 << 30
+
+// WithCacheMaxBytes sets AudioFileStore.CacheMaxBytes.
+func WithCacheMaxBytes(n int64) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.CacheMaxBytes = n
+	}
+}
+
+// cacheMaxBytes returns the CacheMaxBytes, or the default. 0 for no limit.
+func (a *AudioFileStore) cacheMaxBytes() int64 {
+	if a.CacheMaxBytes < 0 {
+		return 0
+	}
+	if a.CacheMaxBytes > 0 {
+		return a.CacheMaxBytes
+	}
+	return DefaultCacheMaxBytes
+}
+
+// cacheLocks serializes the generations of a cache entry (by its dir).
+// The entries with locks (held or waited) are not evicted.
+var cacheLocks = struct {
+	sync.Mutex
+	m map[string]*cacheLock
+}{m: map[string]*cacheLock{}}
+
+// cacheLock of a cache entry, removed from the cacheLocks by the last
+// holder.
+type cacheLock struct {
+	sync.Mutex
+	refs int // holding or waiting, guarded by cacheLocks
+}
+
+func lockCacheEntry(dir string) (unlock func()) {
+	cacheLocks.Lock()
+	l, ok := cacheLocks.m[dir]
+	if !ok {
+		l = &cacheLock{}
+		cacheLocks.m[dir] = l
+	}
+	l.refs++
+	cacheLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		cacheLocks.Lock()
+		defer cacheLocks.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(cacheLocks.m, dir)
+		}
+	}
+}
+
+// cacheEntryLocked checks if the entry is being generated, or waited.
+func cacheEntryLocked(dir string) bool {
+	cacheLocks.Lock()
+	defer cacheLocks.Unlock()
+	return cacheLocks.m[dir] != nil
+}
+
+// cacheKey of the track: the content hash of its audio file, so that
+// a changed file gets new entries.
+func cacheKey(track *model.Track) string {
+	if track.AudioFileHash != "" {
+		return track.AudioFileHash
+	}
+	return fmt.Sprintf("id-%d", track.ID)
+}
+
+// cacheEntryDir is the dir of the entry of the kind (e.g. "hls") and key.
+func (a *AudioFileStore) cacheEntryDir(kind, key string) string {
+	return filepath.Join(a.FileDir, cacheDirName, kind, key)
+}
+
+// cached returns the dir of the cache entry, generated into it by
+// generate if not yet. Concurrent calls of the entry generate it once.
+func (a *AudioFileStore) cached(kind, key string, generate func(dir string) error) (string, error) {
+	dir := a.cacheEntryDir(kind, key)
+	if _, err := os.Stat(dir); err == nil {
+		touchCacheEntry(dir)
+		return dir, nil
+	}
+
+	unlock := lockCacheEntry(dir)
+	defer unlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil // generated meanwhile
+	}
+
+	// generated into a tmp dir, and renamed if done:
+	// no partial entries on failures or crashes.
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("cached: MkdirAll failed: %w", err)
+	}
+	tmp, err := os.MkdirTemp(parent, ".tmp-"+key+"-*")
+	if err != nil {
+		return "", fmt.Errorf("cached: MkdirTemp failed: %w", err)
+	}
+	if err := generate(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("cached: Rename failed: %w", err)
+	}
+	touchCacheEntry(dir)
+
+	go a.evictCache(dir)
+	return dir, nil
+}
+
+// touchCacheEntry marks the entry as used now: by its mtime.
+func touchCacheEntry(dir string) {
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+}
+
+// cacheEvictMu: one eviction at a time, others are skipped.
+var cacheEvictMu sync.Mutex
+
+// evictCache removes the least recently used entries of the cache of the
+// store, until it's not larger than the CacheMaxBytes. The entry keep
+// (just generated) and the locked ones are kept.
+func (a *AudioFileStore) evictCache(keep string) {
+	maxBytes := a.cacheMaxBytes()
+	if maxBytes <= 0 || !cacheEvictMu.TryLock() {
+		return
+	}
+	defer cacheEvictMu.Unlock()
+
+	type entry struct {
+		dir  string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var total int64
+
+	root := filepath.Join(a.FileDir, cacheDirName)
+	kinds, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, kind := range kinds {
+		keys, err := os.ReadDir(filepath.Join(root, kind.Name()))
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			info, err := key.Info()
+			if err != nil || !key.IsDir() || strings.HasPrefix(key.Name(), ".tmp-") {
+				continue
+			}
+			dir := filepath.Join(root, kind.Name(), key.Name())
+			size := dirSize(dir)
+			entries = append(entries, entry{dir: dir, size: size, used: info.ModTime()})
+			total += size
+		}
+	}
+	if total <= maxBytes {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	removed := 0
+	for _, e := range entries {
+		if total <= maxBytes {
+			break
+		}
+		if e.dir == keep || cacheEntryLocked(e.dir) {
+			continue
+		}
+		if err := os.RemoveAll(e.dir); err != nil {
+			continue
+		}
+		total -= e.size
+		removed++
+	}
+	if removed > 0 {
+		logger.WithField("store", a.Name).WithField("removed", removed).
+			WithField("size", total).WithField("max", maxBytes).Info("evictCache: cache entries evicted")
+	}
+}
+
+// dirSize is the total size of the files in the dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// removeCache removes all the cache entries of the track.
+func (a *AudioFileStore) removeCache(track *model.Track) {
+	kinds, err := os.ReadDir(filepath.Join(a.FileDir, cacheDirName))
+	if err != nil {
+		return
+	}
+	for _, kind := range kinds {
+		os.RemoveAll(a.cacheEntryDir(kind.Name(), cacheKey(track)))
+	}
+}
@@ -0,0 +1,298 @@
+package audiofilestore
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the bulk import of track metadata from a catalog
+// (a CSV or JSON file), e.g. migrating from a spreadsheet.
+
+// catalogMaxBytes limits the size of an imported catalog.
+const catalogMaxBytes = 32 << 20
+
+// CatalogRow is a track in a catalog.
+//
+// A row with the ID updates the track. Otherwise, the track of the same
+// Name and Artist is updated, or a new one is created. Only the non-empty
+// fields are updated.
+//
+// The audio file at FetchURL is downloaded into the store (see
+// POST /tracks/import), as a new track with the fields of the row.
+type CatalogRow struct {
+	ID            uint
+	Name          string
+	Artist        string
+	Album         string
+	Genre         string
+	CoverImageURL string
+	AudioFileURL  string // saved as is
+	FetchURL      string // downloaded into the store
+}
+
+// CatalogResult is the result of a row of the catalog.
+type CatalogResult struct {
+	Row    int          // 1-based, excluding the CSV header
+	Action string       // CatalogCreated, ...
+	Track  *model.Track `json:",omitempty"`
+	Job    *model.Job   `json:",omitempty"` // the download of FetchURL
+	Error  string       `json:",omitempty"`
+}
+
+// Actions of the catalog rows: CatalogResult.Action
+const (
+	CatalogCreated  = "created"
+	CatalogUpdated  = "updated"
+	CatalogFetching = "fetching"
+	CatalogFailed   = "failed"
+)
+
+// parseCatalog reads the rows of the catalog of the format ("csv" or "json").
+//
+// A CSV catalog has a header of the CatalogRow field names (case-insensitive),
+// in any order. A JSON one is an array of CatalogRows.
+func parseCatalog(r io.Reader, format string) ([]CatalogRow, error) {
+	switch format {
+	case "json":
+		var rows []CatalogRow
+		if err := json.NewDecoder(r).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("bad JSON catalog: %w", err)
+		}
+		return rows, nil
+	case "csv":
+		return parseCatalogCSV(r)
+	}
+	return nil, fmt.Errorf("unknown catalog format %q: want csv or json", format)
+}
+
+func parseCatalogCSV(r io.Reader) ([]CatalogRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("bad CSV catalog: no header: %w", err)
+	}
+
+	setters := make([]func(row *CatalogRow, v string) error, len(header))
+	for i, col := range header {
+		setters[i] = catalogColumn(strings.TrimSpace(col))
+		if setters[i] == nil {
+			return nil, fmt.Errorf("bad CSV catalog: unknown column %q", col)
+		}
+	}
+
+	var rows []CatalogRow
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad CSV catalog: %w", err)
+		}
+
+		var row CatalogRow
+		for i, v := range record {
+			if err := setters[i](&row, strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("bad CSV catalog: row %d: column %q: %w", len(rows)+1, header[i], err)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// catalogColumn returns the setter of the column of the CSV catalog,
+// or nil if it's unknown.
+func catalogColumn(col string) func(row *CatalogRow, v string) error {
+	str := func(f func(row *CatalogRow) *string) func(row *CatalogRow, v string) error {
+		return func(row *CatalogRow, v string) error {
+			*f(row) = v
+			return nil
+		}
+	}
+
+	switch strings.ToLower(col) {
+	case "id":
+		return func(row *CatalogRow, v string) error {
+			if v == "" {
+				return nil
+			}
+			id, err := strconv.ParseUint(v, 10, 0)
+			row.ID = uint(id)
+			return err
+		}
+	case "name":
+		return str(func(row *CatalogRow) *string { return &row.Name })
+	case "artist":
+		return str(func(row *CatalogRow) *string { return &row.Artist })
+	case "album":
+		return str(func(row *CatalogRow) *string { return &row.Album })
+	case "genre":
+		return str(func(row *CatalogRow) *string { return &row.Genre })
+	case "coverimageurl":
+		return str(func(row *CatalogRow) *string { return &row.CoverImageURL })
+	case "audiofileurl":
+		return str(func(row *CatalogRow) *string { return &row.AudioFileURL })
+	case "fetchurl":
+		return str(func(row *CatalogRow) *string { return &row.FetchURL })
+	}
+	return nil
+}
+
+// catalogFormat guesses the format of the catalog by the format query,
+// the Content-Type, or the extension of the file name.
+func catalogFormat(c *gin.Context, filename string) string {
+	if f := c.Query("format"); f != "" {
+		return strings.ToLower(f)
+	}
+	if ext := strings.ToLower(filepath.Ext(filename)); ext != "" {
+		return strings.TrimPrefix(ext, ".")
+	}
+	if strings.Contains(c.ContentType(), "json") {
+		return "json"
+	}
+	return "csv"
+}
+
+// importCatalogRow creates or updates the track of the row,
+// or enqueues the download of its FetchURL into the store.
+func importCatalogRow(ctx context.Context, row *CatalogRow, store *AudioFileStore) CatalogResult {
+	fail := func(err error) CatalogResult {
+		return CatalogResult{Action: CatalogFailed, Error: err.Error()}
+	}
+
+	fields := &model.Track{
+		Name:          row.Name,
+		Artist:        row.Artist,
+		Album:         row.Album,
+		Genre:         row.Genre,
+		CoverImageURL: row.CoverImageURL,
+		AudioFileURL:  row.AudioFileURL,
+	}
+
+	if row.FetchURL != "" {
+		if store == nil {
+			return fail(errors.New("FetchURL requires the Store query"))
+		}
+		if row.ID != 0 {
+			return fail(errors.New("FetchURL is for new tracks: unexpected ID"))
+		}
+		job, err := store.enqueueDownload(ctx, row.FetchURL, fields)
+		if err != nil {
+			return fail(err)
+		}
+		return CatalogResult{Action: CatalogFetching, Job: job}
+	}
+
+	var existing *model.Track
+	var err error
+	if row.ID != 0 {
+		existing, err = metadata.GetTrack(ctx, row.ID)
+	} else if row.Name != "" {
+		existing, err = metadata.FindDuplicateTrack(ctx, &model.Track{Name: row.Name, Artist: row.Artist})
+	} else {
+		return fail(errors.New("either ID or Name is required"))
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if existing == nil {
+		if err := metadata.CreateTrack(ctx, fields); err != nil {
+			return fail(err)
+		}
+		return CatalogResult{Action: CatalogCreated, Track: fields}
+	}
+
+	if err := metadata.UpdateTrackFields(ctx, existing, fields); err != nil {
+		return fail(err)
+	}
+	if updated, err := metadata.GetTrack(ctx, existing.ID); err == nil {
+		existing = updated
+	}
+	return CatalogResult{Action: CatalogUpdated, Track: existing}
+}
+
+// PostCatalogImport handles: POST /tracks/import
+//
+// It creates or updates the tracks of a catalog, see CatalogRow.
+// The catalog is the body, or the File part of a multipart form:
+//
+//	curl -X POST localhost:8080/tracks/import -F 'File=@catalog.csv'
+//	curl -X POST localhost:8080/tracks/import -H 'Content-Type: application/json' -d '[{"Name": "...", "Artist": "..."}]'
+//
+// The format is csv or json, by the format query, the extension of the
+// file, or the Content-Type. The audio files of the FetchURLs are
+// downloaded into the store of the Store query, in background jobs.
+//
+// Rows are imported one by one: a failed row does not stop the others.
+//
+// Response:
+//
+//   - 200: OK: {results: [{Row: 1, Action: "created", Track: {...}}, {Row: 2, Action: "fetching", Job: {...}}, {Row: 3, Action: "failed", Error: "..."}]}
+//   - 400: Bad Request: {error: "bad CSV catalog: ..."}
+//   - 404: Not Found: {error: "store not found: ..."}
+//   - 413: Request Entity Too Large: {error: "..."}
+func PostCatalogImport(c *gin.Context) {
+	var store *AudioFileStore
+	if name := c.Query("Store"); name != "" {
+		if store = getStore(name); store == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "store not found: " + name})
+			return
+		}
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, catalogMaxBytes)
+
+	var (
+		body     io.Reader = c.Request.Body
+		filename string
+	)
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, err := c.FormFile("File")
+		if err != nil {
+			c.JSON(uploadErrorStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body, filename = f, file.Filename
+	}
+
+	rows, err := parseCatalog(body, catalogFormat(c, filename))
+	if err != nil {
+		c.JSON(uploadErrorStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+
+	results := make([]CatalogResult, len(rows))
+	counts := map[string]int{}
+	for i := range rows {
+		results[i] = importCatalogRow(c, &rows[i], store)
+		results[i].Row = i + 1
+		counts[results[i].Action]++
+	}
+
+	logger.WithContext(c).WithField("rows", len(rows)).WithField("results", counts).
+		Info("PostCatalogImport: done")
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
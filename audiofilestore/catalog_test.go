@@ -0,0 +1,101 @@
+package audiofilestore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCatalog(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		want    []CatalogRow
+		wantErr bool
+	}{
+		{
+			name:   "csv",
+			format: "csv",
+			data:   "ID,Name,Artist,FetchURL\n1,a,b,\n,c,d,https://example.com/c.mp3\n",
+			want: []CatalogRow{
+				{ID: 1, Name: "a", Artist: "b"},
+				{Name: "c", Artist: "d", FetchURL: "https://example.com/c.mp3"},
+			},
+		},
+		{
+			name:   "csv header case-insensitive, in any order, spaces trimmed",
+			format: "csv",
+			data:   "artist, NAME ,coverimageurl\n b , a ,https://example.com/a.jpg\n",
+			want:   []CatalogRow{{Name: "a", Artist: "b", CoverImageURL: "https://example.com/a.jpg"}},
+		},
+		{
+			name:   "csv quoted",
+			format: "csv",
+			data:   "Name,Artist,Album\n\"a, b\",c,\"d \"\"e\"\"\"\n",
+			want:   []CatalogRow{{Name: "a, b", Artist: "c", Album: `d "e"`}},
+		},
+		{
+			name:   "csv header only",
+			format: "csv",
+			data:   "Name,Artist\n",
+			want:   nil,
+		},
+		{
+			name:    "csv unknown column",
+			format:  "csv",
+			data:    "Name,Year\na,2000\n",
+			wantErr: true,
+		},
+		{
+			name:    "csv bad ID",
+			format:  "csv",
+			data:    "ID,Name\nx,a\n",
+			wantErr: true,
+		},
+		{
+			name:    "csv wrong number of fields",
+			format:  "csv",
+			data:    "Name,Artist\na\n",
+			wantErr: true,
+		},
+		{
+			name:    "csv empty",
+			format:  "csv",
+			data:    "",
+			wantErr: true,
+		},
+		{
+			name:   "json",
+			format: "json",
+			data:   `[{"ID": 2, "Genre": "jazz"}, {"Name": "a", "AudioFileURL": "https://example.com/a.mp3"}]`,
+			want: []CatalogRow{
+				{ID: 2, Genre: "jazz"},
+				{Name: "a", AudioFileURL: "https://example.com/a.mp3"},
+			},
+		},
+		{
+			name:    "json not an array",
+			format:  "json",
+			data:    `{"Name": "a"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			format:  "xml",
+			data:    "<a/>",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCatalog(strings.NewReader(tt.data), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCatalog() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCatalog() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package audiofilestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the cover images uploaded for the tracks, stored
+// in {FileDir}/covers of the store of the audio file, and served as the
+// audio files.
+
+const (
+	// coversDirName is the name of the covers dir in the FileDir.
+	coversDirName = "covers"
+	// maxCoverBytes: the max size of an uploaded (or fetched) cover.
+	maxCoverBytes = 10 << 20 // 10 MiB
+	// maxCoverSide: larger covers are scaled down to it (in pixels).
+	maxCoverSide = 1200
+	// maxCoverPixels: larger covers (by their header) are refused before
+	// decoding them: a small file can claim huge dimensions, and be
+	// decoded to gigabytes.
+	maxCoverPixels = 40_000_000
+	// coverFetchTimeout: of fetching a cover from a URL.
+	coverFetchTimeout = 30 * time.Second
+)
+
+// coverExts by the formats decoded by image.DecodeConfig.
+var coverExts = map[string]string{"jpeg": ".jpg", "png": ".png", "gif": ".gif"}
+
+// CoverRequest is the JSON body of PutTrackCover, to fetch the image.
+type CoverRequest struct {
+	URL string `binding:"required"`
+}
+
+// coverImage checks the image (JPEG, PNG or GIF), and scales it down to
+// maxCoverSide if larger, re-encoded as JPEG. It returns the image and
+// the extension of its format. Images over maxCoverPixels are refused.
+func coverImage(data []byte) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: not an image (JPEG, PNG or GIF): %v", errUnsupportedContent, err)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > maxCoverPixels {
+		return nil, "", fmt.Errorf("%w: %dx%d image, more than %d pixels",
+			errUploadTooLarge, config.Width, config.Height, maxCoverPixels)
+	}
+	if config.Width <= maxCoverSide && config.Height <= maxCoverSide {
+		return data, coverExts[format], nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: bad image: %v", errUnsupportedContent, err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(img, maxCoverSide), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, "", fmt.Errorf("coverImage: jpeg.Encode failed: %w", err)
+	}
+	return buf.Bytes(), ".jpg", nil
+}
+
+// scaleDown the image to fit in side x side, averaging the source pixels
+// covered by each pixel (box filter).
+func scaleDown(src image.Image, side int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	nw, nh := side, side
+	if w > h {
+		nh = h * side / w
+	} else {
+		nw = w * side / h
+	}
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		y0, y1 := y*h/nh, (y+1)*h/nh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < nw; x++ {
+			x0, x1 := x*w/nw, (x+1)*w/nw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8), G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8), A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// readCover reads the image of the request: the "file" of a multipart
+// form, or fetched from the URL of a JSON CoverRequest.
+func readCover(c *gin.Context) ([]byte, error) {
+	if strings.HasPrefix(c.ContentType(), "application/json") {
+		var req CoverRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return nil, err
+		}
+		return fetchCover(c, req.URL)
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCoverBytes+multipartOverhead)
+	file, err := c.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	if file.Size > maxCoverBytes {
+		return nil, fmt.Errorf("%w: %d bytes > %d", errUploadTooLarge, file.Size, maxCoverBytes)
+	}
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// fetchCover gets the image at the URL, by the FetchPolicy.
+func fetchCover(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, coverFetchTimeout)
+	defer cancel()
+
+	resp, err := Fetch(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("fetchCover: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchCover: unexpected status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCoverBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetchCover: %w", err)
+	}
+	if len(data) > maxCoverBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", errUploadTooLarge, maxCoverBytes)
+	}
+	return data, nil
+}
+
+// isExternalCover checks if the cover image URL is on another host,
+// i.e. remote and not served by any store.
+func isExternalCover(u string) bool {
+	if !isRemoteURL(u) {
+		return false
+	}
+	_, _, owned := storeOfFile(u)
+	return !owned
+}
+
+// saveCover writes the cover image of the track into the covers dir,
+// named {track ID}-{short hash}{ext}, and returns the path.
+func (a *AudioFileStore) saveCover(track *model.Track, data []byte, ext string) (string, error) {
+	dir := filepath.Join(a.FileDir, coversDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("saveCover: MkdirAll failed: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s%s", track.ID, hex.EncodeToString(sum[:])[:collisionHashLen], ext))
+
+	// write then rename: never serve a partial file
+	tmp, err := os.CreateTemp(a.tmpDir(), "cover-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("saveCover: CreateTemp failed: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("saveCover: write failed: %w", err)
+	}
+	return path, nil
+}
+
+// PutTrackCover handles: PUT /tracks/:TrackID/cover
+//
+// It sets the cover image of the track, stored in the store of its audio
+// file. Images larger than 1200x1200 are scaled down.
+//
+// Body: multipart/form-data with the image as "file" (JPEG, PNG or GIF),
+// or JSON CoverRequest to fetch it:
+//
+//	{"URL": "https://example.com/cover.jpg"}
+//
+// Response:
+//
+//   - 200: OK: {track: {...}}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 403: Forbidden: {error: "the store is read-only"}
+//   - 404: Not Found: {error: "record not found"}
+//   - 413: Request Entity Too Large: over 10 MiB
+//   - 415: Unsupported Media Type: not an image
+//   - 422: Unprocessable Entity: {error: "the audio file of the track is not in any store"}
+//   - 500: Internal Server Error: {error: "..."}
+func PutTrackCover(c *gin.Context) {
+	track, a, _, ok := trackFile(c)
+	if !ok {
+		return
+	}
+	if a.readOnly() {
+		c.JSON(http.StatusForbidden, gin.H{"error": errReadOnly.Error()})
+		return
+	}
+
+	data, err := readCover(c)
+	if err != nil {
+		c.JSON(uploadErrorStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	data, ext, err := coverImage(data)
+	if err != nil {
+		c.JSON(uploadErrorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+
+	path, err := a.saveCover(track, data, ext)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := a.audioUrl(path)
+	if err == nil {
+		err = metadata.UpdateTrackFields(c, track, &model.Track{CoverImageURL: u})
+	}
+	if err != nil {
+		if u != track.CoverImageURL { // not the same image
+			os.Remove(path)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	old := track.CoverImageURL
+	track.CoverImageURL = u
+	removeOldCover(c, track, old)
+
+	logger.WithContext(c).WithField("store", a.Name).WithField("track", track.ID).
+		WithField("CoverImageURL", u).Info("PutTrackCover: cover saved")
+	c.JSON(http.StatusOK, gin.H{"track": track})
+}
+
+// removeOldCover removes the replaced cover image file of the track,
+// if it's in the covers dir of a store, and not used by other tracks.
+func removeOldCover(ctx context.Context, track *model.Track, old string) {
+	a, path, ok := storeOfFile(old)
+	if !ok || a.readOnly() || old == track.CoverImageURL ||
+		filepath.Dir(path) != filepath.Join(a.FileDir, coversDirName) ||
+		a.isFileShared(ctx, track, old) {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.WithField("store", a.Name).WithField("track", track.ID).
+			WithError(err).Warn("PutTrackCover: remove the old cover failed")
+	}
+}
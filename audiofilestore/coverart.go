@@ -0,0 +1,375 @@
+package audiofilestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cdfmlr/crud/service"
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the fallback covers of the tracks without one,
+// fetched from the Cover Art Archive by model.JobKindCover jobs: the
+// front cover of the MusicBrainz release of the track (by its recording
+// ID, or searched by the album and the artist), stored as an uploaded
+// one (see cover.go). The same jobs store local copies of the external
+// covers (see LocalizeCovers).
+
+var (
+	// MusicBrainzURL and CoverArtArchiveURL are the APIs used, e.g. to
+	// use mirrors.
+	MusicBrainzURL     = "https://musicbrainz.org/ws/2"
+	CoverArtArchiveURL = "https://coverartarchive.org"
+	// CoverArtUserAgent identifies the requests, as required by MusicBrainz.
+	CoverArtUserAgent = "musicstore (https://github.com/murchinroom/musicstore)"
+)
+
+// coverArtLimiter: MusicBrainz allows a request per second from a client,
+// so the cover workers of all the stores share it.
+var coverArtLimiter = newRateLimiter(1)
+
+// minReleaseScore: the search results (0-100) under it are not trusted.
+const minReleaseScore = 90
+
+var (
+	errNoRelease  = errors.New("no MusicBrainz release found")
+	errNoCoverArt = errors.New("no cover in the Cover Art Archive")
+)
+
+// WithFetchCovers sets AudioFileStore.FetchCovers and LocalizeCovers.
+func WithFetchCovers(fetch, localize bool) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.FetchCovers = fetch
+		a.LocalizeCovers = localize
+	}
+}
+
+// maybeFetchCover enqueues the cover job of the new track, if it has
+// no cover and FetchCovers, or an external one and LocalizeCovers.
+func (a *AudioFileStore) maybeFetchCover(track *model.Track) {
+	switch {
+	case track.CoverImageURL == "" && a.FetchCovers:
+	case isExternalCover(track.CoverImageURL) && a.LocalizeCovers:
+	default:
+		return
+	}
+	if _, err := a.enqueueCover(context.Background(), track.ID); err != nil {
+		logger.WithField("ID", track.ID).WithError(err).
+			Error("AddTrack: enqueueCover failed")
+	}
+}
+
+// enqueueCover enqueues a cover job of the track.
+func (a *AudioFileStore) enqueueCover(ctx context.Context, trackID uint) (*model.Job, error) {
+	job := &model.Job{
+		Kind:    model.JobKindCover,
+		Status:  model.JobPending,
+		Store:   a.Name,
+		TrackID: trackID,
+	}
+	if err := metadata.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case a.coverWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// startCoverWorker picks up the cover jobs interrupted by the last
+// shutdown, and starts the worker.
+func (a *AudioFileStore) startCoverWorker() {
+	a.coverWake = make(chan struct{}, 1)
+
+	err := metadata.RequeueRunningJobs(context.Background(), model.JobKindCover, a.ownJobs())
+	if err != nil {
+		logger.WithError(err).Error("startCoverWorker: RequeueRunningJobs failed")
+	}
+
+	go a.coverWorker()
+}
+
+func (a *AudioFileStore) coverWorker() {
+	logger := logger.WithField("store", a.Name).WithField("worker", "cover")
+
+	for !a.isClosed() {
+		job, err := metadata.ClaimJob(context.Background(), model.JobKindCover, a.ownJobs())
+		if err != nil {
+			logger.WithError(err).Error("coverWorker: ClaimJob failed")
+		}
+		if job == nil {
+			select {
+			case <-a.coverWake:
+			case <-time.After(downloadPollInterval):
+			case <-a.Done():
+			}
+			continue
+		}
+
+		inflight.begin()
+		err = a.runCoverJob(context.Background(), job)
+		if err != nil {
+			logger.WithField("job", job.ID).WithField("track", job.TrackID).
+				WithError(err).Info("coverWorker: no cover fetched")
+		}
+
+		if err := metadata.FinishJob(context.Background(), job, err); err != nil {
+			logger.WithField("job", job.ID).
+				WithError(err).Error("coverWorker: FinishJob failed")
+		}
+		inflight.end()
+	}
+}
+
+// runCoverJob fetches and saves the cover of the track of the job: a copy
+// of its external cover, or one from the Cover Art Archive if it has none.
+// Tracks with local covers (e.g. uploaded meanwhile) are skipped.
+func (a *AudioFileStore) runCoverJob(ctx context.Context, job *model.Job) error {
+	track, err := metadata.GetTrack(ctx, job.TrackID)
+	if err != nil {
+		return fmt.Errorf("GetTrack failed: %w", err)
+	}
+	external := isExternalCover(track.CoverImageURL)
+	if track.CoverImageURL != "" && !external {
+		return nil
+	}
+	if a.readOnly() {
+		return errReadOnly
+	}
+
+	var data []byte
+	source := track.CoverImageURL
+	if external {
+		data, err = fetchCover(ctx, source)
+	} else {
+		source, err = findRelease(ctx, track)
+		if err == nil {
+			data, err = fetchCoverArt(ctx, source)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	data, ext, err := coverImage(data)
+	if err != nil {
+		return err
+	}
+
+	path, err := a.saveCover(track, data, ext)
+	if err != nil {
+		return err
+	}
+	u, err := a.audioUrl(path)
+	if err == nil {
+		err = metadata.UpdateTrackFields(ctx, track, &model.Track{CoverImageURL: u})
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("UpdateTrackFields failed: %w", err)
+	}
+
+	logger.WithField("store", a.Name).WithField("track", track.ID).
+		WithField("source", source).Info("runCoverJob: cover saved")
+	return nil
+}
+
+// findRelease of the track: the one of its recording (by MusicBrainzID)
+// titled as the album (or the first one), or the best search result of
+// the album and the artist. It returns the release ID.
+func findRelease(ctx context.Context, track *model.Track) (string, error) {
+	var result struct {
+		Releases []struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+			Score int    `json:"score"`
+		} `json:"releases"`
+	}
+
+	switch {
+	case track.MusicBrainzID != "":
+		err := musicBrainzGet(ctx, "/recording/"+url.PathEscape(track.MusicBrainzID),
+			url.Values{"inc": {"releases"}}, &result)
+		if err != nil {
+			return "", err
+		}
+		for _, r := range result.Releases {
+			if strings.EqualFold(r.Title, track.Album) {
+				return r.ID, nil
+			}
+		}
+		if len(result.Releases) > 0 {
+			return result.Releases[0].ID, nil
+		}
+	case track.Album != "" && track.Artist != "":
+		query := fmt.Sprintf(`release:"%s" AND artist:"%s"`,
+			luceneEscaper.Replace(track.Album), luceneEscaper.Replace(track.Artist))
+		err := musicBrainzGet(ctx, "/release/",
+			url.Values{"query": {query}, "limit": {"5"}}, &result)
+		if err != nil {
+			return "", err
+		}
+		for _, r := range result.Releases {
+			if r.Score >= minReleaseScore {
+				return r.ID, nil
+			}
+		}
+	}
+	return "", errNoRelease
+}
+
+// luceneEscaper escapes the phrases in MusicBrainz search queries.
+var luceneEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// musicBrainzGet gets the JSON of the MusicBrainz API (rate limited).
+func musicBrainzGet(ctx context.Context, path string, query url.Values, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, coverFetchTimeout)
+	defer cancel()
+
+	query.Set("fmt", "json")
+	resp, err := coverArtGet(ctx, MusicBrainzURL+path+"?"+query.Encode())
+	if err != nil {
+		return fmt.Errorf("musicBrainzGet: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoRelease
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("musicBrainzGet: unexpected status: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// coverArtURL of the front cover (500px) of the release.
+func coverArtURL(release string) string {
+	return CoverArtArchiveURL + "/release/" + url.PathEscape(release) + "/front-500"
+}
+
+// fetchCoverArt gets the front cover of the release.
+func fetchCoverArt(ctx context.Context, release string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, coverFetchTimeout)
+	defer cancel()
+
+	resp, err := coverArtGet(ctx, coverArtURL(release))
+	if err != nil {
+		return nil, fmt.Errorf("fetchCoverArt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoCoverArt
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchCoverArt: unexpected status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCoverBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetchCoverArt: %w", err)
+	}
+	if len(data) > maxCoverBytes {
+		return nil, fmt.Errorf("fetchCoverArt: %w: more than %d bytes", errUploadTooLarge, maxCoverBytes)
+	}
+	return data, nil
+}
+
+// coverArtGet sends a GET request, waiting for the coverArtLimiter,
+// by the FetchPolicy (its AllowHosts must include the MusicBrainzURL and
+// the CoverArtArchiveURL hosts, and archive.org the covers redirect to).
+func coverArtGet(ctx context.Context, u string) (*http.Response, error) {
+	coverArtLimiter.wait()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", CoverArtUserAgent)
+	req.Header.Set("Accept", "application/json")
+
+	return FetchRequest(req)
+}
+
+// CoverFetchRequest selects the tracks to fetch the covers of: the ones
+// without a cover, in the stores, with a MusicBrainzID, or an album and
+// an artist to search.
+type CoverFetchRequest struct {
+	// All tracks. Required if no IDs are given.
+	All bool
+	// IDs of the tracks.
+	IDs []uint
+	// External: also the tracks with external covers, to store local
+	// copies of them.
+	External bool
+}
+
+// PostCoverFetch handles: POST /admin/covers/fetch
+//
+// It enqueues the cover jobs of the tracks without covers (or with
+// external ones), see CoverFetchRequest. The covers are fetched from the
+// Cover Art Archive in background, about one track per second.
+//
+// Body: JSON CoverFetchRequest, e.g.
+//
+//	{"All": true}
+//	{"IDs": [1, 2, 3]}
+//	{"All": true, "External": true}
+//
+// Response:
+//
+//   - 200: OK: {enqueued: 42}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "no filter given: use All to fetch the covers of all tracks"}
+//   - 500: Internal Server Error: {error: "..."}
+func PostCoverFetch(c *gin.Context) {
+	var req CoverFetchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.IDs) == 0 && !req.All {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "no filter given: use All to fetch the covers of all tracks"})
+		return
+	}
+
+	where := "(cover_image_url = '' AND (music_brainz_id <> '' OR (album <> '' AND artist <> '')))"
+	if req.External {
+		where += " OR cover_image_url LIKE 'http%'"
+	}
+	options := []service.QueryOption{service.Where("(" + where + ")")}
+	if len(req.IDs) > 0 {
+		options = append(options, service.Where("id IN ?", req.IDs))
+	}
+	tracks, err := metadata.GetTracks(c, options...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	enqueued := 0
+	for _, track := range tracks {
+		a, _, ok := storeOfFile(track.AudioFileURL)
+		if !ok || a.readOnly() || (track.CoverImageURL != "" && !isExternalCover(track.CoverImageURL)) {
+			continue
+		}
+		if _, err := a.enqueueCover(c, track.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "enqueued": enqueued})
+			return
+		}
+		enqueued++
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enqueued": enqueued})
+}
@@ -0,0 +1,149 @@
+package audiofilestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// this file cleans up the files of deleted tracks (see metadata.OnTrackDeleted).
+
+// What to do with the files of a deleted track: AudioFileStore.OnDelete
+const (
+	OnDeleteRemove = "remove" // remove the files (default)
+	OnDeleteTrash  = "trash"  // move the files into {FileDir}/.trash
+	OnDeleteKeep   = "keep"   // leave the files untouched
+)
+
+// trashDirName is the name of the trash dir in the FileDir.
+const trashDirName = ".trash"
+
+// WithOnDelete sets AudioFileStore.OnDelete.
+func WithOnDelete(onDelete string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.OnDelete = onDelete
+	}
+}
+
+// onTrackDeleted removes (or trashes) the audio file and the cover image
+// of the deleted track, if they are stored in this store, unless kept by
+// the ctx (see metadata.WithFilesKept, e.g. merging tracks).
+// The cached files derived from it are removed anyway.
+func (a *AudioFileStore) onTrackDeleted(ctx context.Context, track *model.Track) {
+	if a.isClosed() { // unmounted: the hook can't be unregistered
+		return
+	}
+	if _, ok := a.ownedFilePath(track.AudioFileURL); ok {
+		a.removeCache(track)
+	}
+	if a.OnDelete == OnDeleteKeep || a.readOnly() || metadata.FilesKept(ctx) {
+		return
+	}
+
+	for _, u := range []string{track.AudioFileURL, track.CoverImageURL} {
+		path, ok := a.ownedFilePath(u)
+		if !ok {
+			continue
+		}
+		if !a.isFileShared(ctx, track, u) {
+			a.removeFile(track, path)
+		}
+	}
+}
+
+// removeFile removes (or trashes) the file of the deleted track.
+func (a *AudioFileStore) removeFile(track *model.Track, path string) {
+	logger := logger.WithField("store", a.Name).
+		WithField("track", track.ID).WithField("file", path)
+
+	var err error
+	if a.OnDelete == OnDeleteTrash {
+		err = a.trashFile(path)
+	} else {
+		err = os.Remove(path)
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logger.Debug("onTrackDeleted: file already gone")
+	case err != nil:
+		logger.WithError(err).Warn("onTrackDeleted: remove file failed")
+	default:
+		logger.WithField("OnDelete", a.OnDelete).Info("onTrackDeleted: file removed")
+		a.removeEmptyDirs(filepath.Dir(path))
+	}
+}
+
+// removeEmptyDirs removes the dir and its parents, up to (excluding)
+// the FileDir, while they are empty, e.g. the album dirs (see Layout).
+func (a *AudioFileStore) removeEmptyDirs(dir string) {
+	for {
+		rel, err := filepath.Rel(a.FileDir, dir)
+		if err != nil || rel == "." || !filepath.IsLocal(rel) {
+			return // the FileDir, or out of it
+		}
+		if os.Remove(dir) != nil { // not empty, or else
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// trashFile moves the file into the trash dir, named
+// {unix time}-{base name} to not overwrite the trashed ones.
+func (a *AudioFileStore) trashFile(path string) error {
+	trash := filepath.Join(a.FileDir, trashDirName)
+	if err := os.MkdirAll(trash, 0755); err != nil {
+		return fmt.Errorf("trashFile: Mkdir failed: %w", err)
+	}
+
+	dst := filepath.Join(trash, fmt.Sprintf("%d-%s", time.Now().Unix(), filepath.Base(path)))
+	return os.Rename(path, dst)
+}
+
+// isFileShared checks if any other track refers to the file URL,
+// e.g. a shared cover image. The file is kept if so, or unknown.
+func (a *AudioFileStore) isFileShared(ctx context.Context, track *model.Track, fileUrl string) bool {
+	shared, err := metadata.IsFileURLShared(ctx, track.ID, fileUrl)
+	if err != nil {
+		logger.WithField("store", a.Name).WithField("track", track.ID).
+			WithError(err).Warn("onTrackDeleted: IsFileURLShared failed, keep the file")
+		return true
+	}
+	return shared
+}
+
+// ownedFilePath is the reverse of audioUrl: it returns the local path of
+// the file URL, if it's served by this store (in the FileDir).
+func (a *AudioFileStore) ownedFilePath(fileUrl string) (path string, ok bool) {
+	if fileUrl == "" {
+		return "", false
+	}
+
+	base, err := url.JoinPath(a.BaseUrl, a.audioStaticBasePath())
+	if err != nil {
+		return "", false
+	}
+	relevant, found := strings.CutPrefix(fileUrl, base+"/")
+	if !found {
+		return "", false
+	}
+	relevant, err = url.PathUnescape(relevant)
+	if err != nil {
+		return "", false
+	}
+
+	// no escaping from the FileDir, e.g. ../../etc/passwd
+	relevant = filepath.FromSlash(relevant)
+	if !filepath.IsLocal(relevant) {
+		return "", false
+	}
+	return filepath.Join(a.FileDir, relevant), true
+}
@@ -0,0 +1,316 @@
+package audiofilestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cdfmlr/crud/service"
+)
+
+// this file implements the background downloads of new tracks from URLs:
+// POST /new with AudioFileURL enqueues a model.JobKindDownload job, which
+// is taken by a download worker of the store.
+
+// DefaultDownloadWorkers is the default AudioFileStore.DownloadWorkers.
+const DefaultDownloadWorkers = 2
+
+const (
+	// downloadPollInterval: idle workers look for pending jobs,
+	// in case they missed a wake up.
+	downloadPollInterval = 10 * time.Second
+	// progressInterval: how often the download progress is saved.
+	progressInterval = time.Second
+)
+
+// startDownloadWorkers picks up the downloads interrupted by the last
+// shutdown, and starts the workers.
+func (a *AudioFileStore) startDownloadWorkers() {
+	a.downloadWake = make(chan struct{}, 1)
+
+	err := metadata.RequeueRunningJobs(context.Background(), model.JobKindDownload, a.ownJobs())
+	if err != nil {
+		logger.WithError(err).Error("startDownloadWorkers: RequeueRunningJobs failed")
+	}
+
+	for i := 0; i < a.downloadWorkers(); i++ {
+		go a.downloadWorker(i)
+	}
+}
+
+// WithDownloadWorkers sets AudioFileStore.DownloadWorkers.
+func WithDownloadWorkers(workers int) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.DownloadWorkers = workers
+	}
+}
+
+// downloadWorkers returns the DownloadWorkers, or the default.
+func (a *AudioFileStore) downloadWorkers() int {
+	if a.DownloadWorkers > 0 {
+		return a.DownloadWorkers
+	}
+	return DefaultDownloadWorkers
+}
+
+// ownJobs selects the jobs of this store.
+func (a *AudioFileStore) ownJobs() service.QueryOption {
+	return service.Where("store = ?", a.Name)
+}
+
+// enqueueDownload enqueues a download job of the URL.
+// Non-empty fields of the override are set to the new track.
+func (a *AudioFileStore) enqueueDownload(ctx context.Context, url string, override *model.Track) (*model.Job, error) {
+	if err := checkFetchURL(url); err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(override)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &model.Job{
+		Kind:       model.JobKindDownload,
+		Status:     model.JobPending,
+		Store:      a.Name,
+		URL:        url,
+		Metadata:   string(meta),
+		BytesTotal: -1,
+	}
+	if err := metadata.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	// wake a worker up
+	select {
+	case a.downloadWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (a *AudioFileStore) downloadWorker(id int) {
+	logger := logger.WithField("store", a.Name).WithField("downloadWorker", id)
+
+	for !a.isClosed() {
+		job, err := metadata.ClaimJob(context.Background(), model.JobKindDownload, a.ownJobs())
+		if err != nil {
+			logger.WithError(err).Error("downloadWorker: ClaimJob failed")
+		}
+		if job == nil {
+			select {
+			case <-a.downloadWake:
+			case <-time.After(downloadPollInterval):
+			case <-a.Done():
+			}
+			continue
+		}
+
+		logger.WithField("job", job.ID).WithField("url", job.URL).
+			Debug("downloadWorker: downloading")
+
+		inflight.begin()
+		err = a.runDownload(job)
+		if err != nil {
+			logger.WithField("job", job.ID).WithField("url", job.URL).
+				WithError(err).Warn("downloadWorker: download failed")
+		}
+
+		if err := metadata.FinishJob(context.Background(), job, err); err != nil {
+			logger.WithField("job", job.ID).
+				WithError(err).Error("downloadWorker: FinishJob failed")
+		}
+		inflight.end()
+	}
+}
+
+// runDownload downloads the URL of the job and adds the track(s).
+// It sets the TrackID (or the Results for an archive) of the job.
+func (a *AudioFileStore) runDownload(job *model.Job) error {
+	override := new(model.Track)
+	if job.Metadata != "" {
+		if err := json.Unmarshal([]byte(job.Metadata), override); err != nil {
+			return fmt.Errorf("bad job Metadata: %w", err)
+		}
+	}
+
+	path, err := a.downloadFile(job)
+	if err != nil {
+		return err
+	}
+
+	if isArchive(path) {
+		defer os.Remove(path)
+
+		override.Name = "" // tracks in an archive can not share a name
+		results, err := a.addTracksFromArchive(path, OverrideTrackMetadata(override))
+		if err != nil {
+			return err
+		}
+		applyOnDuplicate(results, a.OnDuplicate)
+		b, err := json.Marshal(results)
+		if err != nil {
+			return err
+		}
+		job.Results = string(b)
+		return nil
+	}
+
+	track, err := a.AddTrack(path, OverrideTrackMetadata(override))
+	if err != nil {
+		a.rejectNewFile(path, QuarantinedFile{Source: "download", URL: job.URL, Track: override}, err)
+
+		var dup *DuplicateTrackError
+		if errors.As(err, &dup) {
+			job.TrackID = dup.Existing.ID
+			if a.OnDuplicate == OnDuplicateExisting {
+				return nil
+			}
+		}
+		return err
+	}
+	job.TrackID = track.ID
+	return nil
+}
+
+// downloadFile downloads the URL of the job into the tmp dir,
+// saving the progress of the job. The download is limited by the
+// FetchPolicy: hosts, redirects, Timeout, and the MaxBytes if the
+// store has no MaxUploadBytes.
+func (a *AudioFileStore) downloadFile(job *model.Job) (savedpath string, err error) {
+	policy, _ := currentFetchPolicy()
+	maxBytes := a.maxUploadBytes()
+	if maxBytes <= 0 {
+		maxBytes = policy.MaxBytes
+	}
+	checkSize := func(size int64) error {
+		if maxBytes > 0 && size > maxBytes {
+			return fmt.Errorf("%w: %d bytes > %d", errUploadTooLarge, size, maxBytes)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), policy.Timeout)
+	defer cancel()
+
+	resp, err := Fetch(ctx, job.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	job.BytesDone = 0                   // maybe a retry
+	job.BytesTotal = resp.ContentLength // -1 if unknown
+	if err := checkSize(job.BytesTotal); err != nil {
+		return "", err
+	}
+
+	filename := guardFilename(downloadFilename(resp))
+
+	// a unique name: concurrent downloads of the same filename
+	// must not truncate each other
+	out, err := os.CreateTemp(a.tmpDir(), "*-"+filename)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	dst := out.Name()
+
+	var body io.Reader = resp.Body
+	if maxBytes > 0 {
+		body = io.LimitReader(body, maxBytes+1)
+	}
+
+	_, err = io.Copy(out, &progressReader{r: body, job: job})
+	metadata.UpdateJobProgress(context.Background(), job)
+	if err == nil {
+		err = checkSize(job.BytesDone)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	if job.BytesTotal >= 0 && job.BytesDone != job.BytesTotal {
+		os.Remove(dst)
+		return "", errors.New("download incomplete")
+	}
+
+	out.Close()
+	savedpath, err = normalizeExtension(dst)
+	if err == nil {
+		err = a.scanNewFile(context.Background(), savedpath)
+	}
+	if err != nil {
+		a.rejectNewFile(savedpath, QuarantinedFile{File: filename, Source: "download", URL: job.URL}, err)
+	}
+	return savedpath, err
+}
+
+// downloadFilename of the response: the filename of the Content-Disposition,
+// or the last element of the URL path (after redirects, without the query),
+// e.g. ".../song.mp3?token=x" -> "song.mp3". Without an extension, the one
+// of the Content-Type is added if it's a known format; the extension is
+// checked by sniffing the content anyway (normalizeExtension).
+func downloadFilename(resp *http.Response) string {
+	var filename string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		// no dirs: the name is from the remote
+		filename = path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	}
+	if (filename == "" || filename == "." || filename == "/") && resp.Request != nil {
+		filename = path.Base(resp.Request.URL.Path)
+	}
+	if filename == "." || filename == "/" {
+		filename = ""
+	}
+
+	if filepath.Ext(filename) == "" {
+		contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		for format, ct := range formatContentTypes {
+			if ct == contentType { // audio/ogg: .ogg, not the .opus with the codecs
+				if filename == "" {
+					filename = "download"
+				}
+				return filename + format
+			}
+		}
+	}
+	return filename
+}
+
+// progressReader counts the bytes read into job.BytesDone,
+// and saves it every progressInterval.
+type progressReader struct {
+	r         io.Reader
+	job       *model.Job
+	lastSaved time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.job.BytesDone += int64(n)
+
+	if time.Since(p.lastSaved) >= progressInterval {
+		p.lastSaved = time.Now()
+		if err := metadata.UpdateJobProgress(context.Background(), p.job); err != nil {
+			logger.WithField("job", p.job.ID).WithError(err).
+				Warn("progressReader: UpdateJobProgress failed")
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,221 @@
+package audiofilestore
+
+import (
+	"context"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"os"
+	"path/filepath"
+)
+
+// this file implements the dry-run scan of the FileDir: a report of what
+// a rescan would do, without writing anything.
+
+// DryRunReport is the result of a dry-run scan.
+type DryRunReport struct {
+	Scanned int // music files found
+	Skipped int // known and not changed
+
+	New     []DryRunFile // would be imported as tracks
+	Changed []DryRunFile // changed files of known tracks: would update them
+	// Duplicates would be rejected: of an existing track (Existing),
+	// or of another file of the scan (DuplicateOf).
+	Duplicates []DryRunFile
+	// Collisions are the New files whose Target is taken, by a file or
+	// another new one: named by the OnCollision of the store.
+	Collisions []DryRunFile
+	Failed     []DryRunFile
+}
+
+// DryRunFile is a file in the DryRunReport.
+type DryRunFile struct {
+	File  string       // relative to the FileDir
+	Track *model.Track `json:",omitempty"` // read from the file: tags and hash
+
+	// Target is where the file would be stored, relative to the FileDir.
+	// Empty if the name refers to the ID of the track (by the
+	// FilenameTemplate, or OnCollision: id).
+	Target string `json:",omitempty"`
+
+	Existing    *model.Track `json:",omitempty"`
+	DuplicateOf string       `json:",omitempty"`
+	Error       string       `json:",omitempty"`
+}
+
+// dryRun is the state of a dry-run scan.
+type dryRun struct {
+	a      *AudioFileStore
+	report DryRunReport
+	known  map[string]*model.Track // AudioFileURL -> track
+
+	// the new files of the scan so far, by hash, by name and artist,
+	// and by target
+	hashes  map[string]string
+	names   map[string]string
+	targets map[string]string
+}
+
+// DryRun walks the FileDir as Rescan does, reading the tags and detecting
+// the duplicates and the filename collisions of the files, without
+// importing them. Duplicates are looked up in the library of the store.
+func (a *AudioFileStore) DryRun(ctx context.Context) (*DryRunReport, error) {
+	ctx = model.WithLibrary(ctx, a.library())
+
+	tracks, err := metadata.GetTracks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("DryRun: GetTracks failed: %w", err)
+	}
+
+	d := &dryRun{
+		a:       a,
+		known:   make(map[string]*model.Track, len(tracks)),
+		hashes:  map[string]string{},
+		names:   map[string]string{},
+		targets: map[string]string{},
+	}
+	for _, track := range tracks {
+		if _, ok := a.ownedFilePath(track.AudioFileURL); ok {
+			d.known[track.AudioFileURL] = track
+		}
+	}
+
+	ch, err := a.enumMusicFiles(a.unchangedFiles(tracks))
+	if err != nil {
+		return nil, fmt.Errorf("DryRun: enumMusicFiles failed: %w", err)
+	}
+	for path := range ch {
+		d.report.Scanned++
+		d.file(ctx, path)
+	}
+	return &d.report, nil
+}
+
+func (d *dryRun) file(ctx context.Context, path string) {
+	a := d.a
+	f := DryRunFile{File: relPath(a.FileDir, path)}
+	fail := func(err error) {
+		f.Error = err.Error()
+		d.report.Failed = append(d.report.Failed, f)
+	}
+
+	u, err := a.audioUrl(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if track, ok := d.known[u]; ok {
+		if a.isFileUnchanged(track, path) {
+			d.report.Skipped++
+			return
+		}
+		f.Existing = track
+	}
+
+	format, err := sniffFile(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	f.Track, err = model.TrackFromAudioFile(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	f.Track.AudioFileHash, err = fileSHA256(path)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if f.Existing != nil {
+		if f.Existing.AudioFileHash == f.Track.AudioFileHash {
+			d.report.Skipped++ // touched only
+		} else {
+			d.report.Changed = append(d.report.Changed, f)
+		}
+		return
+	}
+
+	// duplicates: of the tracks, or of the new files so far
+	if f.Existing, err = metadata.FindDuplicateTrack(ctx, f.Track); err != nil {
+		fail(err)
+		return
+	}
+	name := f.Track.Name + "\x00" + f.Track.Artist
+	if f.Existing == nil {
+		if f.DuplicateOf = d.hashes[f.Track.AudioFileHash]; f.DuplicateOf == "" {
+			f.DuplicateOf = d.names[name]
+		}
+	}
+	if f.Existing != nil || f.DuplicateOf != "" {
+		d.report.Duplicates = append(d.report.Duplicates, f)
+		return
+	}
+	d.hashes[f.Track.AudioFileHash] = f.File
+	d.names[name] = f.File
+
+	if err := d.target(&f, path, format); err != nil {
+		fail(err)
+		return
+	}
+	d.report.New = append(d.report.New, f)
+}
+
+// target sets the Target of the new file, and reports the collision.
+// Names by the ID of the track (see filenameNeedsID) are unknown.
+func (d *dryRun) target(f *DryRunFile, path, format string) error {
+	a := d.a
+	if a.filenameNeedsID() {
+		return nil
+	}
+
+	filename, err := a.audioFileName(f.Track, format)
+	if err != nil {
+		return err
+	}
+	f.Target = relPath(a.FileDir, filepath.Join(a.FileDir, a.audioFileDir(f.Track), filename))
+
+	target := filepath.Join(a.FileDir, filepath.FromSlash(f.Target))
+	taken := d.targets[f.Target] != ""
+	if !taken && fileExists(target) {
+		// the file itself, already named so: not a collision
+		st1, err1 := os.Stat(path)
+		st2, err2 := os.Stat(target)
+		taken = err1 != nil || err2 != nil || !os.SameFile(st1, st2)
+	}
+	if taken {
+		d.report.Collisions = append(d.report.Collisions, *f)
+	}
+	d.targets[f.Target] = f.File
+	return nil
+}
+
+// logDryRunReport logs the report, one line for each file to notice.
+func logDryRunReport(a *AudioFileStore, report *DryRunReport) {
+	logger := logger.WithField("store", a.Name)
+	for _, f := range report.Duplicates {
+		dup := f.DuplicateOf
+		if f.Existing != nil {
+			dup = fmt.Sprintf("track %d", f.Existing.ID)
+		}
+		logger.WithField("file", f.File).WithField("duplicateOf", dup).
+			Warn("dry run: duplicate")
+	}
+	for _, f := range report.Collisions {
+		logger.WithField("file", f.File).WithField("target", f.Target).
+			WithField("OnCollision", a.OnCollision).Warn("dry run: filename collision")
+	}
+	for _, f := range report.Failed {
+		logger.WithField("file", f.File).Errorf("dry run: failed: %v", f.Error)
+	}
+
+	logger.WithField("scanned", report.Scanned).
+		WithField("skipped", report.Skipped).
+		WithField("new", len(report.New)).
+		WithField("changed", len(report.Changed)).
+		WithField("duplicates", len(report.Duplicates)).
+		WithField("collisions", len(report.Collisions)).
+		WithField("failed", len(report.Failed)).
+		Info("dry run: done, nothing is written")
+}
@@ -0,0 +1,98 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the handling of duplicate tracks.
+
+// ErrTrackExists: AddTrack failed because the track already exists.
+// The error is a *DuplicateTrackError with the existing track.
+var ErrTrackExists = errors.New("track already exists")
+
+// DuplicateTrackError is returned by AddTrack for a duplicate track.
+type DuplicateTrackError struct {
+	Existing *model.Track
+}
+
+func (e *DuplicateTrackError) Error() string {
+	return fmt.Sprintf("AudioFileToTrack: track already exists: %s (ID=%d)", e.Existing.Name, e.Existing.ID)
+}
+
+func (e *DuplicateTrackError) Is(target error) bool {
+	return target == ErrTrackExists
+}
+
+// Responses to duplicate uploads (AudioFileStore.OnDuplicate).
+const (
+	// OnDuplicateError: 422 with the error, as any other failure. Default.
+	OnDuplicateError = "error"
+	// OnDuplicateExisting: 200 with the existing track, as if it's added.
+	OnDuplicateExisting = "existing"
+	// OnDuplicateConflict: 409 with the error and the existing track.
+	OnDuplicateConflict = "conflict"
+)
+
+// onDuplicate returns the response to duplicates for the request:
+// the OnDuplicate query, or the AudioFileStore.OnDuplicate.
+func (a *AudioFileStore) onDuplicate(c *gin.Context) string {
+	if q := c.Query("OnDuplicate"); q != "" {
+		return q
+	}
+	if a.OnDuplicate != "" {
+		return a.OnDuplicate
+	}
+	return OnDuplicateError
+}
+
+// respondAddTrackError responds the error of AddTrack.
+// Duplicates are responded according to onDuplicate.
+func (a *AudioFileStore) respondAddTrackError(c *gin.Context, err error) {
+	var dup *DuplicateTrackError
+	if errors.As(err, &dup) {
+		switch a.onDuplicate(c) {
+		case OnDuplicateExisting:
+			c.JSON(http.StatusOK, gin.H{"track": dup.Existing, "duplicate": true})
+			return
+		case OnDuplicateConflict:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "track": dup.Existing})
+			return
+		}
+	}
+
+	c.JSON(uploadErrorStatus(err, http.StatusUnprocessableEntity), gin.H{"error": err.Error()})
+}
+
+// newImportResult makes the ImportResult of AddTrack.
+// For a duplicate, the Track is the existing one.
+func newImportResult(file string, track *model.Track, err error) ImportResult {
+	result := ImportResult{File: file, Track: track}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	var dup *DuplicateTrackError
+	if errors.As(err, &dup) {
+		result.Track = dup.Existing
+		result.Duplicate = true
+	}
+	return result
+}
+
+// applyOnDuplicate clears the errors of the duplicate results,
+// if they are treated as the existing tracks.
+func applyOnDuplicate(results []ImportResult, onDuplicate string) {
+	if onDuplicate != OnDuplicateExisting {
+		return
+	}
+	for i := range results {
+		if results[i].Duplicate {
+			results[i].Error = ""
+		}
+	}
+}
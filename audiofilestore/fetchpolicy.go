@@ -0,0 +1,196 @@
+package audiofilestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// this file implements the policy of fetching the URLs given by the
+// clients (AudioFileURLs of POST /new, FetchURLs of catalogs, cover URLs):
+// without it, anyone who can add a track could make the musicstore fetch
+// http://169.254.169.254/ or the internal services next to it.
+
+// FetchPolicy limits the fetches of the URLs given by the clients.
+type FetchPolicy struct {
+	// AllowHosts: the hosts that can be fetched, e.g. "cdn.example.com",
+	// or "*.example.com" for the subdomains. Any host if empty.
+	AllowHosts []string
+	// DenyHosts: the hosts that can't be fetched, over the AllowHosts.
+	DenyHosts []string
+	// AllowPrivate addresses: loopback, private, link-local, ...
+	// Blocked by default, by the addresses resolved when connecting
+	// (so no DNS names pointing to them, nor redirects to them).
+	AllowPrivate bool
+	// MaxRedirects to follow. Use a negative one to follow none.
+	MaxRedirects int
+	// Timeout of a download, including reading the body.
+	Timeout time.Duration
+	// MaxBytes of a download, for the stores without MaxUploadBytes.
+	MaxBytes int64
+}
+
+// DefaultFetchPolicy is used if no policy is given by UseFetchPolicy.
+var DefaultFetchPolicy = FetchPolicy{
+	MaxRedirects: 5,
+	Timeout:      30 * time.Minute,
+	MaxBytes:     2 << 30, // 2 GiB
+}
+
+// ErrFetchNotAllowed is returned for URLs blocked by the FetchPolicy.
+var ErrFetchNotAllowed = errors.New("URL not allowed")
+
+// cgnat is the shared address space (RFC 6598), not covered by IsPrivate.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+var (
+	fetchPolicy   = DefaultFetchPolicy
+	fetchClient   = DefaultFetchPolicy.client()
+	fetchPolicyMu sync.RWMutex
+)
+
+// UseFetchPolicy sets the policy of fetching the URLs of the clients.
+// Zero fields are filled with the values of DefaultFetchPolicy,
+// except the hosts and AllowPrivate.
+func UseFetchPolicy(p FetchPolicy) error {
+	for _, patterns := range [][]string{p.AllowHosts, p.DenyHosts} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("UseFetchPolicy: bad host pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if p.MaxRedirects == 0 {
+		p.MaxRedirects = DefaultFetchPolicy.MaxRedirects
+	} else if p.MaxRedirects < 0 {
+		p.MaxRedirects = 0
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultFetchPolicy.Timeout
+	}
+	if p.MaxBytes == 0 {
+		p.MaxBytes = DefaultFetchPolicy.MaxBytes
+	}
+
+	fetchPolicyMu.Lock()
+	defer fetchPolicyMu.Unlock()
+	fetchPolicy = p
+	fetchClient = p.client()
+	return nil
+}
+
+// currentFetchPolicy returns the FetchPolicy and its client.
+func currentFetchPolicy() (FetchPolicy, *http.Client) {
+	fetchPolicyMu.RLock()
+	defer fetchPolicyMu.RUnlock()
+	return fetchPolicy, fetchClient
+}
+
+// checkFetchURL checks the URL by the current FetchPolicy, before
+// accepting it. The addresses are checked when connecting.
+func checkFetchURL(s string) error {
+	p, _ := currentFetchPolicy()
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("not an http(s) URL: %q", s)
+	}
+	return p.checkURL(u)
+}
+
+// Fetch GETs the URL with the client of the current FetchPolicy, for
+// the other packages fetching remote URLs (e.g. imgproxy).
+// The ctx should have a deadline: the client has no timeout of itself.
+func Fetch(ctx context.Context, s string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s, nil)
+	if err != nil {
+		return nil, err
+	}
+	return FetchRequest(req)
+}
+
+// FetchRequest does the request (e.g. with headers) with the client of
+// the current FetchPolicy, after checking its URL.
+func FetchRequest(req *http.Request) (*http.Response, error) {
+	if err := checkFetchURL(req.URL.String()); err != nil {
+		return nil, err
+	}
+	_, client := currentFetchPolicy()
+	return client.Do(req)
+}
+
+// checkURL checks the host of the URL by the AllowHosts and DenyHosts,
+// and by its address if it's an IP.
+func (p FetchPolicy) checkURL(u *url.URL) error {
+	host := strings.ToLower(u.Hostname())
+	if matchHost(p.DenyHosts, host) || (len(p.AllowHosts) > 0 && !matchHost(p.AllowHosts, host)) {
+		return fmt.Errorf("%w: host %s", ErrFetchNotAllowed, host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !p.AllowPrivate && isPrivateIP(ip) {
+		return fmt.Errorf("%w: private address %s", ErrFetchNotAllowed, host)
+	}
+	return nil
+}
+
+// matchHost checks if the host matches any of the patterns.
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateIP: not a public address.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || cgnat.Contains(ip)
+}
+
+// client of the policy: the addresses are checked when connecting,
+// and the redirects are checked as the URLs. No proxy from the
+// environment: the addresses checked would be the ones of the proxy.
+func (p FetchPolicy) client() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if p.AllowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("%w: private address %s", ErrFetchNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          16,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > p.MaxRedirects {
+				return fmt.Errorf("%w: more than %d redirects", ErrFetchNotAllowed, p.MaxRedirects)
+			}
+			return p.checkURL(req.URL)
+		},
+	}
+}
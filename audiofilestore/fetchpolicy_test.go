@@ -0,0 +1,108 @@
+package audiofilestore
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true}, // link-local: cloud metadata
+		{"100.64.0.1", true},      // CGNAT
+		{"100.127.255.255", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::", true},
+		{"8.8.8.8", false},
+		{"100.128.0.1", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isPrivateIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isPrivateIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"Example.COM"}, "example.com", true},
+		{[]string{"example.com"}, "www.example.com", false},
+		{[]string{"*.example.com"}, "www.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com"}, "a.b.example.com", true},
+		{[]string{"*.example.com"}, "example.com.evil.org", false},
+		{[]string{"a.org", "*.archive.org"}, "ia800.archive.org", true},
+		{nil, "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := matchHost(tt.patterns, tt.host); got != tt.want {
+				t.Errorf("matchHost(%v, %q) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchPolicyCheckURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  FetchPolicy
+		url     string
+		wantErr bool
+	}{
+		{name: "public host", url: "https://example.com/a.mp3"},
+		{name: "public IP", url: "http://8.8.8.8/a.mp3"},
+		{name: "private IP", url: "http://10.0.0.1/a.mp3", wantErr: true},
+		{name: "loopback IPv6", url: "http://[::1]:8080/a.mp3", wantErr: true},
+		{name: "metadata IP", url: "http://169.254.169.254/latest", wantErr: true},
+		{name: "AllowPrivate", policy: FetchPolicy{AllowPrivate: true}, url: "http://10.0.0.1/a.mp3"},
+		{name: "denied host", policy: FetchPolicy{DenyHosts: []string{"*.example.com"}}, url: "https://cdn.example.com/a.mp3", wantErr: true},
+		{name: "denied host by case", policy: FetchPolicy{DenyHosts: []string{"example.com"}}, url: "https://EXAMPLE.com/a.mp3", wantErr: true},
+		{name: "allowed host", policy: FetchPolicy{AllowHosts: []string{"*.example.com"}}, url: "https://cdn.example.com/a.mp3"},
+		{name: "not allowed host", policy: FetchPolicy{AllowHosts: []string{"*.example.com"}}, url: "https://example.org/a.mp3", wantErr: true},
+		{name: "allowed but private", policy: FetchPolicy{AllowHosts: []string{"10.0.0.1"}}, url: "http://10.0.0.1/a.mp3", wantErr: true},
+		{
+			name:    "deny over allow",
+			policy:  FetchPolicy{AllowHosts: []string{"*.example.com"}, DenyHosts: []string{"bad.example.com"}},
+			url:     "https://bad.example.com/a.mp3",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.policy.checkURL(u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkURL(%s) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrFetchNotAllowed) {
+				t.Errorf("checkURL(%s) error = %v, want ErrFetchNotAllowed", tt.url, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"musicstore/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// this file implements the naming of the stored audio files
+// by AudioFileStore.FilenameTemplate, and the directory layout of them.
+
+// Layouts of the stored audio files: AudioFileStore.Layout
+const (
+	LayoutFlat        = "flat"         // {FileDir}/{filename} (default)
+	LayoutArtistAlbum = "artist/album" // {FileDir}/{artist}/{album}/{filename}
+)
+
+// Directory names for the tracks without the artist or album.
+const (
+	unknownArtist = "Unknown Artist"
+	unknownAlbum  = "Unknown Album"
+)
+
+// WithLayout sets AudioFileStore.Layout.
+func WithLayout(layout string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.Layout = layout
+	}
+}
+
+// CheckLayout checks if the layout is known.
+func CheckLayout(layout string) error {
+	switch layout {
+	case "", LayoutFlat, LayoutArtistAlbum:
+		return nil
+	}
+	return fmt.Errorf("unknown Layout %q: want %q or %q", layout, LayoutFlat, LayoutArtistAlbum)
+}
+
+// audioFileDir returns the directory (relative to the FileDir) of the
+// audio file of the track, by the Layout.
+func (a *AudioFileStore) audioFileDir(track *model.Track) string {
+	if a.Layout != LayoutArtistAlbum {
+		return ""
+	}
+	artist := sanitizeFilename(track.Artist)
+	if artist == "" {
+		artist = unknownArtist
+	}
+	album := sanitizeFilename(track.Album)
+	if album == "" {
+		album = unknownAlbum
+	}
+	return filepath.Join(artist, album)
+}
+
+// DefaultFilenameTemplate names the files as {name}-{artist}-{album}.
+const DefaultFilenameTemplate = `{{snake .Name}}-{{snake .Artist}}-{{snake .Album}}`
+
+// WithFilenameTemplate sets AudioFileStore.FilenameTemplate.
+func WithFilenameTemplate(tmpl string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.FilenameTemplate = tmpl
+	}
+}
+
+// filenameFuncs are the functions available in the filename templates.
+var filenameFuncs = template.FuncMap{
+	"snake": stringToSnake,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// trunc n s: the first n runes of s
+	"trunc": func(n int, s string) string {
+		if r := []rune(s); len(r) > n {
+			return string(r[:n])
+		}
+		return s
+	},
+}
+
+// parseFilenameTemplate parses the template (DefaultFilenameTemplate if empty).
+func parseFilenameTemplate(tmpl string) (*template.Template, error) {
+	if tmpl == "" {
+		tmpl = DefaultFilenameTemplate
+	}
+	return template.New("filename").Funcs(filenameFuncs).
+		Option("missingkey=error").Parse(tmpl)
+}
+
+// CheckFilenameTemplate checks the syntax of the filename template,
+// and that it works on a track.
+func CheckFilenameTemplate(tmpl string) error {
+	t, err := parseFilenameTemplate(tmpl)
+	if err == nil {
+		sample := &model.Track{Name: "name", Artist: "artist", Album: "album", AudioFileHash: "0123456789abcdef"}
+		_, err = executeFilenameTemplate(t, sample)
+	}
+	if err != nil {
+		return fmt.Errorf("bad FilenameTemplate %q: %w", tmpl, err)
+	}
+	return nil
+}
+
+// filenameTemplate returns the parsed FilenameTemplate,
+// or the default one if it is bad.
+func (a *AudioFileStore) filenameTemplate() *template.Template {
+	a.filenameTmplOnce.Do(func() {
+		t, err := parseFilenameTemplate(a.FilenameTemplate)
+		if err != nil {
+			logger.WithField("store", a.Name).WithError(err).
+				Error("bad FilenameTemplate: using the default one")
+			t, _ = parseFilenameTemplate("")
+		}
+		a.filenameTmpl = t
+	})
+	return a.filenameTmpl
+}
+
+// filenameNeedsID checks if the FilenameTemplate (or the OnCollision)
+// refers to the ID of the track: the file can be named only after the
+// track is saved.
+func (a *AudioFileStore) filenameNeedsID() bool {
+	return strings.Contains(a.FilenameTemplate, ".ID") || a.OnCollision == OnCollisionID
+}
+
+// What to do if the name of a new file is taken by another one:
+// AudioFileStore.OnCollision
+const (
+	OnCollisionHash  = "hash"  // append -{short content hash} (default)
+	OnCollisionID    = "id"    // append -{track ID}
+	OnCollisionError = "error" // fail the import
+)
+
+// collisionHashLen is the length of the hash suffix. Longer ones are
+// tried if it's still taken.
+const collisionHashLen = 8
+
+// WithOnCollision sets AudioFileStore.OnCollision.
+func WithOnCollision(onCollision string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.OnCollision = onCollision
+	}
+}
+
+// CheckOnCollision checks if the OnCollision is known.
+func CheckOnCollision(onCollision string) error {
+	switch onCollision {
+	case "", OnCollisionHash, OnCollisionID, OnCollisionError:
+		return nil
+	}
+	return fmt.Errorf("unknown OnCollision %q: want %q, %q or %q",
+		onCollision, OnCollisionHash, OnCollisionID, OnCollisionError)
+}
+
+// freeFilename returns a file name in the dir for the track, not taken by
+// any file: the filename (with the ext), or with a suffix by OnCollision.
+func (a *AudioFileStore) freeFilename(track *model.Track, dir, filename, ext string) (string, error) {
+	if !fileExists(filepath.Join(dir, filename)) {
+		return filename, nil
+	}
+
+	name := strings.TrimSuffix(filename, ext)
+	var candidates []string
+
+	switch a.OnCollision {
+	case OnCollisionError:
+		return "", fmt.Errorf("file already exists: %s", filepath.Join(dir, filename))
+	case OnCollisionID:
+		candidates = append(candidates, fmt.Sprintf("%s-%d%s", name, track.ID, ext))
+	default: // OnCollisionHash
+		for n := collisionHashLen; n < len(track.AudioFileHash); n *= 2 {
+			candidates = append(candidates, fmt.Sprintf("%s-%s%s", name, track.AudioFileHash[:n], ext))
+		}
+		candidates = append(candidates, fmt.Sprintf("%s-%s%s", name, track.AudioFileHash, ext))
+	}
+
+	for _, c := range candidates {
+		if !fileExists(filepath.Join(dir, c)) {
+			logger.WithField("store", a.Name).WithField("taken", filename).
+				WithField("filename", c).Info("filename collision: suffix appended")
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("file already exists: %s, and all the suffixed ones", filepath.Join(dir, filename))
+}
+
+// fileExists checks if anything (including a dangling symlink) is at the path.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// audioFileName names the audio file of the track by the FilenameTemplate,
+// with the ext (including the dot) appended.
+func (a *AudioFileStore) audioFileName(track *model.Track, ext string) (string, error) {
+	name, err := executeFilenameTemplate(a.filenameTemplate(), track)
+	if err != nil {
+		return "", err
+	}
+	return name + ext, nil
+}
+
+func executeFilenameTemplate(t *template.Template, track *model.Track) (string, error) {
+	var sb strings.Builder
+	if err := t.Execute(&sb, track); err != nil {
+		return "", err
+	}
+
+	name := sanitizeFilename(sb.String())
+	if name == "" {
+		return "", fmt.Errorf("empty filename of track %q", track.Name)
+	}
+	return name, nil
+}
+
+// sanitizeFilename makes the name a safe file name: path separators and
+// control characters are replaced by "_", and the leading dots (hidden
+// files, "..") and surrounding spaces are trimmed.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.TrimLeft(strings.TrimSpace(name), ".")
+}
@@ -0,0 +1,250 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// this file implements the filter of the files to scan (by LoadFromDir,
+// rescans and the watcher) in the FileDir.
+
+// ScanFilter selects the files to scan in the FileDir.
+//
+// Patterns are globs (see path.Match) with "**" matching any number of
+// directories, e.g. "**/demo/**". A pattern without a slash matches the
+// base name, e.g. "*.tmp.mp3".
+type ScanFilter struct {
+	// Include: if not empty, only the files matching any of them are scanned.
+	Include []string
+	// Exclude: files and directories matching any of them are skipped.
+	Exclude []string
+
+	// SkipHidden skips the files and directories whose names start with a dot.
+	SkipHidden bool
+	// FollowSymlinks scans the targets of symbolic links, instead of
+	// skipping them. Imported targets are linked into the FileDir (see LinkMode).
+	FollowSymlinks bool
+}
+
+// WithScanFilter sets AudioFileStore.ScanFilter.
+func WithScanFilter(filter ScanFilter) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.ScanFilter = filter
+	}
+}
+
+// CheckPatterns checks the syntax of the glob patterns.
+func CheckPatterns(patterns ...string) error {
+	for _, pattern := range patterns {
+		for _, seg := range strings.Split(pattern, "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return fmt.Errorf("bad pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// skipDir checks if the directory (rel: relative path to the FileDir,
+// slash separated) should be skipped with all its contents.
+func (f *ScanFilter) skipDir(rel string) bool {
+	if rel == "." || rel == "" {
+		return false
+	}
+	if f.SkipHidden && isHidden(rel) {
+		return true
+	}
+	return matchAny(f.Exclude, rel)
+}
+
+// skipFile checks if the file (rel: relative path to the FileDir,
+// slash separated) should be skipped.
+func (f *ScanFilter) skipFile(rel string) bool {
+	if f.SkipHidden && isHidden(rel) {
+		return true
+	}
+	if matchAny(f.Exclude, rel) {
+		return true
+	}
+	return len(f.Include) > 0 && !matchAny(f.Include, rel)
+}
+
+func isHidden(rel string) bool {
+	return strings.HasPrefix(path.Base(rel), ".")
+}
+
+// matchAny checks if the relative path matches any of the patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches the relative path against the pattern, see ScanFilter.
+func matchGlob(pattern, rel string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(pattern[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segs[0])
+	return ok && matchSegments(pattern[1:], segs[1:])
+}
+
+// relPath returns the path relative to the dir, slash separated.
+func relPath(dir, p string) string {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// enumMusicFiles enumerates all the music files in the FileDir,
+// filtered by the ScanFilter.
+// It returns a channel of the file paths.
+//
+// The files are sniffed (see isMusicFile), except the ones known to be
+// music files by the known func (nil for none), e.g. the unchanged
+// audio files of the tracks (see unchangedFiles): a rescan of a big
+// library opens only the new or changed files.
+func (a *AudioFileStore) enumMusicFiles(known func(path string, d os.DirEntry) bool) (chan string, error) {
+	dir := a.FileDir
+	if dir == "" {
+		return nil, errors.New("empty dir")
+	}
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		return nil, errors.New("not a dir")
+	}
+
+	ch := make(chan string, 3)
+
+	go func() {
+		defer close(ch)
+
+		w := &musicFileWalker{a: a, ch: ch, known: known, visited: map[string]bool{}}
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			w.visited[real] = true
+		}
+		if err := w.walk(dir, dir); err != nil {
+			logger.WithField("store", a.Name).WithError(err).
+				Error("enumMusicFiles: walk failed")
+		}
+	}()
+
+	return ch, nil
+}
+
+// musicFileWalker walks the FileDir for enumMusicFiles.
+type musicFileWalker struct {
+	a       *AudioFileStore
+	ch      chan string
+	known   func(path string, d os.DirEntry) bool // not to sniff, if not nil
+	visited map[string]bool                       // real paths of the dirs walked, against symlink loops
+}
+
+func (w *musicFileWalker) isMusicFile(p string, d os.DirEntry) bool {
+	if w.known != nil && w.known(p, d) {
+		return true
+	}
+	return isMusicFile(p)
+}
+
+// walk the real dir, reporting the paths as under the dir as.
+// They differ for the target of a followed symlink.
+func (w *musicFileWalker) walk(real, as string) error {
+	tmp := filepath.Join(w.a.FileDir, tmpDirName)
+	trash := filepath.Join(w.a.FileDir, trashDirName)
+	cache := filepath.Join(w.a.FileDir, cacheDirName)
+	covers := filepath.Join(w.a.FileDir, coversDirName)
+	quarantine := filepath.Join(w.a.FileDir, quarantineDirName)
+	filter := &w.a.ScanFilter
+
+	return filepath.WalkDir(real, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// p under real -> under as
+		if real != as {
+			if r, err := filepath.Rel(real, p); err == nil {
+				p = filepath.Join(as, r)
+			}
+		}
+		rel := relPath(w.a.FileDir, p)
+
+		if d.IsDir() {
+			// never import the uploads in progress, the deleted tracks,
+			// the cached derived files, the cover images, or the
+			// quarantined files
+			if p == tmp || p == trash || p == cache || p == covers || p == quarantine || filter.skipDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.Type()&os.ModeSymlink != 0 {
+			if !filter.FollowSymlinks {
+				return nil
+			}
+			return w.followSymlink(p, rel)
+		}
+
+		if filter.skipFile(rel) || !w.isMusicFile(p, d) {
+			return nil
+		}
+		w.ch <- p
+		return nil
+	})
+}
+
+// followSymlink walks the target dir of the link, or sends the target
+// file (by the path of the link) if it's a music file.
+func (w *musicFileWalker) followSymlink(link, rel string) error {
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return nil // dangling
+	}
+	st, err := os.Stat(target)
+	if err != nil {
+		return nil
+	}
+
+	if st.IsDir() {
+		if w.visited[target] || w.a.ScanFilter.skipDir(rel) {
+			return nil
+		}
+		w.visited[target] = true
+		return w.walk(target, link)
+	}
+
+	if !w.a.ScanFilter.skipFile(rel) && isMusicFile(link) {
+		w.ch <- link
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package audiofilestore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"*.mp3", "a.mp3", true},
+		{"*.mp3", "x/y/a.mp3", true}, // no "/": the file name
+		{"*.mp3", "a.flac", false},
+		{"*.tmp.mp3", "x/a.tmp.mp3", true},
+		{"demo/*", "demo/a.mp3", true},
+		{"demo/*", "x/demo/a.mp3", false},
+		{"/demo/*", "demo/a.mp3", true},
+		{"**/demo/**", "demo/a.mp3", true},
+		{"**/demo/**", "x/y/demo/z/a.mp3", true},
+		{"**/demo/**", "x/demos/a.mp3", false},
+		{"x/**/a.mp3", "x/a.mp3", true},
+		{"x/**/a.mp3", "x/y/z/a.mp3", true},
+		{"x/**/a.mp3", "y/x/a.mp3", false},
+		{"**", "x/y/a.mp3", true},
+		{"x/*.mp3", "x/y/a.mp3", false},
+		{"[", "a.mp3", false}, // bad pattern
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.rel, func(t *testing.T) {
+			if got := matchGlob(tt.pattern, tt.rel); got != tt.want {
+				t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.rel, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanFilterSkip(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   ScanFilter
+		rel      string
+		dir      bool
+		wantSkip bool
+	}{
+		{"no filter", ScanFilter{}, "x/a.mp3", false, false},
+		{"excluded file", ScanFilter{Exclude: []string{"*.tmp.mp3"}}, "x/a.tmp.mp3", false, true},
+		{"excluded dir", ScanFilter{Exclude: []string{"**/demo"}}, "x/demo", true, true},
+		{"included file", ScanFilter{Include: []string{"*.flac"}}, "x/a.flac", false, false},
+		{"not included file", ScanFilter{Include: []string{"*.flac"}}, "x/a.mp3", false, true},
+		{"include doesn't skip dirs", ScanFilter{Include: []string{"*.flac"}}, "x", true, false},
+		{"exclude wins over include", ScanFilter{Include: []string{"*.mp3"}, Exclude: []string{"**/demo/**"}}, "demo/a.mp3", false, true},
+		{"hidden file", ScanFilter{SkipHidden: true}, "x/.a.mp3", false, true},
+		{"hidden dir", ScanFilter{SkipHidden: true}, ".sync", true, true},
+		{"hidden file kept", ScanFilter{}, "x/.a.mp3", false, false},
+		{"root dir never skipped", ScanFilter{SkipHidden: true, Exclude: []string{"**"}}, ".", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bool
+			if tt.dir {
+				got = tt.filter.skipDir(tt.rel)
+			} else {
+				got = tt.filter.skipFile(tt.rel)
+			}
+			if got != tt.wantSkip {
+				t.Errorf("skip %q = %v, want %v", tt.rel, got, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestCheckPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		wantErr  bool
+	}{
+		{nil, false},
+		{[]string{"**/demo/**", "*.tmp.mp3", "[a-z]*.mp3"}, false},
+		{[]string{"*.mp3", "["}, true},
+		{[]string{"x/[/a.mp3"}, true},
+	}
+	for _, tt := range tests {
+		if err := CheckPatterns(tt.patterns...); (err != nil) != tt.wantErr {
+			t.Errorf("CheckPatterns(%q) = %v, want error: %v", tt.patterns, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEnumMusicFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter ScanFilter
+		want   []string // relative to the FileDir
+	}{
+		{
+			name: "no filter skips the symlinks",
+			want: []string{".hidden/a.mp3", "a.mp3", "demo/a.mp3", "x/.b.mp3", "x/a.tmp.mp3"},
+		},
+		{
+			name:   "excluded",
+			filter: ScanFilter{Exclude: []string{"**/demo/**", "*.tmp.mp3"}},
+			want:   []string{".hidden/a.mp3", "a.mp3", "x/.b.mp3"},
+		},
+		{
+			name:   "hidden skipped",
+			filter: ScanFilter{SkipHidden: true},
+			want:   []string{"a.mp3", "demo/a.mp3", "x/a.tmp.mp3"},
+		},
+		{
+			name:   "symlinks followed",
+			filter: ScanFilter{SkipHidden: true, FollowSymlinks: true},
+			want:   []string{"a.mp3", "demo/a.mp3", "link.mp3", "linkdir/c.mp3", "x/a.tmp.mp3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outside := t.TempDir()
+			for _, f := range []string{
+				"a.mp3", "demo/a.mp3", "x/a.tmp.mp3", "x/.b.mp3", ".hidden/a.mp3", "notes.txt",
+				filepath.Join(outside, "b.mp3"), filepath.Join(outside, "d/c.mp3"),
+			} {
+				p := f
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(dir, f)
+				}
+				content := "ID3 not really"
+				if filepath.Ext(p) != ".mp3" {
+					content = "text"
+				}
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink(filepath.Join(outside, "b.mp3"), filepath.Join(dir, "link.mp3")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(filepath.Join(outside, "d"), filepath.Join(dir, "linkdir")); err != nil {
+				t.Fatal(err)
+			}
+			// a loop, walked once
+			if err := os.Symlink(dir, filepath.Join(dir, "x", "loop")); err != nil {
+				t.Fatal(err)
+			}
+
+			a := &AudioFileStore{Name: "test", FileDir: dir, ScanFilter: tt.filter}
+			ch, err := a.enumMusicFiles(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for p := range ch {
+				got = append(got, relPath(dir, p))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("enumMusicFiles() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
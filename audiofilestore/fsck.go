@@ -0,0 +1,404 @@
+package audiofilestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the consistency check (fsck) between the database
+// and the files of the stores, and the repair of the problems found.
+
+// FsckReport is the problems of a store found by fsck.
+type FsckReport struct {
+	Store string
+
+	// MissingFiles: tracks of the store whose audio file does not exist.
+	MissingFiles []FsckTrack
+	// OrphanFiles: music files in the FileDir (relative paths) that
+	// no track refers to.
+	OrphanFiles []string
+	// URLMismatches: tracks whose AudioFileURL refers to an existing file
+	// of the store, but not by the URL of the store (e.g. BaseUrl changed).
+	URLMismatches []FsckTrack
+
+	orphans map[string]bool // absolute paths of OrphanFiles
+}
+
+// FsckTrack is a track with a problem.
+type FsckTrack struct {
+	TrackID      uint
+	AudioFileURL string
+	ExpectedURL  string `json:",omitempty"` // for URLMismatches
+
+	track *model.Track
+}
+
+// Problems is the number of the problems found.
+func (r *FsckReport) Problems() int {
+	return len(r.MissingFiles) + len(r.OrphanFiles) + len(r.URLMismatches)
+}
+
+// fsck checks the tracks (of all stores) against the files of the store.
+func (a *AudioFileStore) fsck(tracks []*model.Track) (*FsckReport, error) {
+	report := &FsckReport{Store: a.Name, orphans: map[string]bool{}}
+
+	referenced := map[string]bool{}
+	for _, track := range tracks {
+		path, ok := a.localFilePath(track.AudioFileURL)
+		if !ok {
+			continue // not a file of this store
+		}
+		_, err := os.Stat(path)
+		exists := err == nil
+
+		if _, owned := a.ownedFilePath(track.AudioFileURL); !owned {
+			if !exists {
+				continue // looks alike, but it's not ours
+			}
+			expected, err := a.audioUrl(path)
+			if err != nil {
+				return nil, fmt.Errorf("fsck: audioUrl failed: %w", err)
+			}
+			report.URLMismatches = append(report.URLMismatches, FsckTrack{
+				TrackID:      track.ID,
+				AudioFileURL: track.AudioFileURL,
+				ExpectedURL:  expected,
+				track:        track,
+			})
+		} else if !exists {
+			report.MissingFiles = append(report.MissingFiles, FsckTrack{
+				TrackID:      track.ID,
+				AudioFileURL: track.AudioFileURL,
+				track:        track,
+			})
+		}
+		referenced[filepath.Clean(path)] = true
+	}
+
+	// the referenced files are skipped anyway: not sniffed
+	ch, err := a.enumMusicFiles(func(path string, _ os.DirEntry) bool {
+		return referenced[filepath.Clean(path)]
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fsck: enumMusicFiles failed: %w", err)
+	}
+	for path := range ch {
+		path = filepath.Clean(path)
+		if referenced[path] {
+			continue
+		}
+		rel, err := filepath.Rel(a.FileDir, path)
+		if err != nil {
+			rel = path
+		}
+		report.OrphanFiles = append(report.OrphanFiles, filepath.ToSlash(rel))
+		report.orphans[path] = true
+	}
+
+	return report, nil
+}
+
+// localFilePath returns the path in the FileDir of the file URL, if it looks
+// like a URL of the store: {any base}/{store name}/audio/{relevant path}.
+// Unlike ownedFilePath, the base of the URL is not checked.
+func (a *AudioFileStore) localFilePath(fileUrl string) (path string, ok bool) {
+	if fileUrl == "" {
+		return "", false
+	}
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return "", false
+	}
+	_, relevant, found := strings.Cut(u.Path, a.audioStaticBasePath()+"/")
+	if !found {
+		return "", false
+	}
+
+	relevant = filepath.FromSlash(relevant)
+	if !filepath.IsLocal(relevant) {
+		return "", false
+	}
+	return filepath.Join(a.FileDir, relevant), true
+}
+
+// FsckRepairOptions are the repairs to do.
+type FsckRepairOptions struct {
+	// Relink: fix the URLMismatches, and relink the tracks of MissingFiles
+	// to the OrphanFiles with the same content (AudioFileHash).
+	Relink bool
+	// DeleteOrphans: remove the OrphanFiles (after Relink),
+	// or trash them if the OnDelete of the store is OnDeleteTrash.
+	DeleteOrphans bool
+	// MarkMissing: mark the tracks of MissingFiles (after Relink) as
+	// FileMissing, which are then excluded from murecom.
+	// The marks of the tracks whose files are back are cleared.
+	MarkMissing bool
+}
+
+// FsckRepairResult is the repairs done on a store.
+type FsckRepairResult struct {
+	Store          string
+	Relinked       []uint   // track IDs
+	DeletedOrphans []string // relative paths
+	MarkedMissing  []uint   // track IDs
+	Unmarked       []uint   // track IDs, whose files are back
+	Errors         []string `json:",omitempty"`
+}
+
+// repair fixes the problems in the report of fsck.
+// Failures of single repairs are collected in the Errors.
+func (a *AudioFileStore) repair(ctx context.Context, report *FsckReport, tracks []*model.Track, opts FsckRepairOptions) *FsckRepairResult {
+	result := &FsckRepairResult{Store: a.Name}
+	fail := func(format string, args ...any) {
+		result.Errors = append(result.Errors, fmt.Sprintf(format, args...))
+	}
+
+	missing := report.MissingFiles
+	if opts.Relink {
+		for _, m := range report.URLMismatches {
+			m.track.AudioFileURL = m.ExpectedURL
+			m.track.FileMissing = false
+			if err := metadata.UpdateTrackFile(ctx, m.track); err != nil {
+				fail("relink track %d: %v", m.TrackID, err)
+				continue
+			}
+			result.Relinked = append(result.Relinked, m.TrackID)
+		}
+
+		missing = a.relinkMissing(ctx, report, result, fail)
+	}
+
+	if opts.DeleteOrphans {
+		for path := range report.orphans {
+			var err error
+			if a.OnDelete == OnDeleteTrash {
+				err = a.trashFile(path)
+			} else {
+				err = os.Remove(path)
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				fail("delete orphan %s: %v", path, err)
+				continue
+			}
+			a.removeEmptyDirs(filepath.Dir(path))
+			rel, _ := filepath.Rel(a.FileDir, path)
+			result.DeletedOrphans = append(result.DeletedOrphans, filepath.ToSlash(rel))
+		}
+	}
+
+	if opts.MarkMissing {
+		isMissing := map[uint]bool{}
+		for _, m := range missing {
+			isMissing[m.TrackID] = true
+			if m.track.FileMissing {
+				continue
+			}
+			m.track.FileMissing = true
+			if err := metadata.UpdateTrackFile(ctx, m.track); err != nil {
+				fail("mark track %d missing: %v", m.TrackID, err)
+				continue
+			}
+			result.MarkedMissing = append(result.MarkedMissing, m.TrackID)
+		}
+
+		for _, track := range tracks {
+			if !track.FileMissing || isMissing[track.ID] {
+				continue
+			}
+			if _, ok := a.ownedFilePath(track.AudioFileURL); !ok {
+				continue
+			}
+			track.FileMissing = false
+			if err := metadata.UpdateTrackFile(ctx, track); err != nil {
+				fail("unmark track %d: %v", track.ID, err)
+				continue
+			}
+			result.Unmarked = append(result.Unmarked, track.ID)
+		}
+	}
+
+	return result
+}
+
+// relinkMissing relinks the tracks of MissingFiles to the orphan files
+// with the same content. The relinked orphans are removed from the
+// report.orphans. It returns the tracks still missing.
+func (a *AudioFileStore) relinkMissing(ctx context.Context, report *FsckReport, result *FsckRepairResult, fail func(string, ...any)) []FsckTrack {
+	if len(report.MissingFiles) == 0 || len(report.orphans) == 0 {
+		return report.MissingFiles
+	}
+
+	byHash := map[string]string{} // hash -> orphan path
+	for path := range report.orphans {
+		hash, err := fileSHA256(path)
+		if err != nil {
+			fail("hash orphan %s: %v", path, err)
+			continue
+		}
+		byHash[hash] = path
+	}
+
+	var stillMissing []FsckTrack
+	for _, m := range report.MissingFiles {
+		path, found := byHash[m.track.AudioFileHash]
+		if m.track.AudioFileHash == "" || !found {
+			stillMissing = append(stillMissing, m)
+			continue
+		}
+
+		u, err := a.audioUrl(path)
+		if err != nil {
+			fail("relink track %d: %v", m.TrackID, err)
+			stillMissing = append(stillMissing, m)
+			continue
+		}
+		m.track.AudioFileURL = u
+		m.track.FileMissing = false
+		if err := metadata.UpdateTrackFile(ctx, m.track); err != nil {
+			fail("relink track %d: %v", m.TrackID, err)
+			stillMissing = append(stillMissing, m)
+			continue
+		}
+
+		result.Relinked = append(result.Relinked, m.TrackID)
+		delete(byHash, m.track.AudioFileHash) // one file, one track
+		delete(report.orphans, path)
+	}
+	return stillMissing
+}
+
+// errStoreNotFound: no store of the name.
+var errStoreNotFound = errors.New("store not found")
+
+// fsckStores returns the stores to check: the one of the name,
+// or all if name is empty.
+func fsckStores(name string) ([]*AudioFileStore, error) {
+	if name == "" {
+		return allStores(), nil
+	}
+	a := getStore(name)
+	if a == nil {
+		return nil, fmt.Errorf("%w: %s", errStoreNotFound, name)
+	}
+	return []*AudioFileStore{a}, nil
+}
+
+// Fsck checks the stores (the one of the name, or all if empty) against
+// the database. If repair is not nil, the problems found are repaired
+// by the options, and the results of the repairs are returned as well.
+func Fsck(ctx context.Context, name string, repair *FsckRepairOptions) ([]*FsckReport, []*FsckRepairResult, error) {
+	stores, err := fsckStores(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tracks []*model.Track
+	reports := make([]*FsckReport, 0, len(stores))
+	var repairs []*FsckRepairResult
+	for _, a := range stores {
+		// reload: tracks may be relinked by the repair of the last store
+		if tracks == nil || repair != nil {
+			if tracks, err = metadata.GetTracks(ctx); err != nil {
+				return nil, nil, fmt.Errorf("Fsck: GetTracks failed: %w", err)
+			}
+		}
+
+		report, err := a.fsck(tracks)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Fsck: %w", err)
+		}
+		reports = append(reports, report)
+
+		if repair == nil {
+			continue
+		}
+		result := a.repair(ctx, report, tracks, *repair)
+		repairs = append(repairs, result)
+
+		logger.WithContext(ctx).WithField("store", a.Name).
+			WithField("relinked", len(result.Relinked)).
+			WithField("deletedOrphans", len(result.DeletedOrphans)).
+			WithField("markedMissing", len(result.MarkedMissing)).
+			WithField("errors", len(result.Errors)).
+			Info("Fsck: repaired")
+	}
+
+	return reports, repairs, nil
+}
+
+// fsckErrorStatus is the http status of the errors of Fsck.
+func fsckErrorStatus(err error) int {
+	if errors.Is(err, errStoreNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// GetFsck handles: GET /admin/fsck
+//
+// Query:
+//
+//   - Store: the name of the store to check. All stores if empty.
+//
+// Response:
+//
+//   - 200: OK: {reports: [{Store: "...", MissingFiles: [...], OrphanFiles: [...], URLMismatches: [...]}]}
+//   - 404: Not Found: {error: "store not found: ..."}
+//   - 500: Internal Server Error: {error: "..."}
+func GetFsck(c *gin.Context) {
+	reports, _, err := Fsck(c, c.Query("Store"), nil)
+	if err != nil {
+		c.JSON(fsckErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reports": reports})
+}
+
+// PostFsckRepairRequest is the body of POST /admin/fsck/repair.
+type PostFsckRepairRequest struct {
+	// Store: the name of the store to repair. All stores if empty.
+	Store string
+	FsckRepairOptions
+}
+
+// PostFsckRepair handles: POST /admin/fsck/repair
+//
+// It runs fsck, and repairs the problems found, by the options.
+//
+// Body: JSON
+//
+//	{"Store": "...", "Relink": true, "DeleteOrphans": true, "MarkMissing": true}
+//
+// Response:
+//
+//   - 200: OK: {reports: [...], repairs: [{Store: "...", Relinked: [1, 2], DeletedOrphans: ["a.mp3"], MarkedMissing: [3], ...}]}
+//     reports are the problems found before the repairs.
+//   - 400: Bad Request: {error: "..."}
+//   - 404: Not Found: {error: "store not found: ..."}
+//   - 500: Internal Server Error: {error: "..."}
+func PostFsckRepair(c *gin.Context) {
+	var req PostFsckRepairRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reports, repairs, err := Fsck(c, req.Store, &req.FsckRepairOptions)
+	if err != nil {
+		c.JSON(fsckErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reports": reports, "repairs": repairs})
+}
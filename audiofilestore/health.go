@@ -0,0 +1,35 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// this file implements the health check of the stores, for the
+// readiness of musicstore.
+
+// errNoStores: no store is mounted.
+var errNoStores = errors.New("no store mounted")
+
+// HealthCheck checks if the stores are mounted, with the FileDirs
+// accessible. It returns the errors by the store names, with the key ""
+// if there is no store at all. Empty for healthy.
+func HealthCheck() map[string]error {
+	errs := map[string]error{}
+
+	all := allStores()
+	if len(all) == 0 {
+		errs[""] = errNoStores
+	}
+	for _, a := range all {
+		st, err := os.Stat(a.FileDir)
+		switch {
+		case err != nil:
+			errs[a.Name] = err
+		case !st.IsDir():
+			errs[a.Name] = fmt.Errorf("FileDir is not a dir: %s", a.FileDir)
+		}
+	}
+	return errs
+}
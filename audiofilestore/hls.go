@@ -0,0 +1,125 @@
+package audiofilestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the HLS streaming of the tracks: the playlist and
+// the segments are transcoded (by ffmpeg) on the first request, and
+// cached (see cached).
+
+const (
+	hlsCacheKind   = "hls"
+	hlsPlaylist    = "index.m3u8"
+	hlsSegmentTime = 10     // seconds
+	hlsBitrate     = "128k" // AAC
+	// hlsTimeout of a transcoding.
+	hlsTimeout = 10 * time.Minute
+)
+
+// generateHLS transcodes the audio file src into the HLS playlist and
+// segments in dir:
+//
+//	ffmpeg -i src -vn -c:a aac -b:a 128k -f hls -hls_time 10 -hls_playlist_type vod dir/index.m3u8
+//
+// ffmpeg is killed if ctx is done.
+func generateHLS(ctx context.Context, src, dir string) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return errors.New("ffmpeg not found: required to transcode HLS")
+	}
+
+	args := []string{
+		"-v", "error", "-i", src,
+		"-vn", "-c:a", "aac", "-b:a", hlsBitrate,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentTime),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "seg%04d.ts"),
+		filepath.Join(dir, hlsPlaylist),
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// GetTrackHLS handles: GET /tracks/:TrackID/hls/:File
+//
+// It serves the HLS playlist (File = index.m3u8) of the track, and the
+// segments referred by it. They are transcoded on the first request.
+//
+// Response:
+//
+//   - 200: OK: the playlist (application/vnd.apple.mpegurl) or the segment (video/mp2t)
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "..."}: no such track, file or segment
+//   - 422: Unprocessable Entity: {error: "the audio file of the track is not in any store"}
+//   - 500: Internal Server Error: {error: "..."}, e.g. ffmpeg not found
+func GetTrackHLS(c *gin.Context) {
+	file := c.Param("File")
+	if file != filepath.Base(file) || !(file == hlsPlaylist || strings.HasSuffix(file, ".ts")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such HLS file: " + file})
+		return
+	}
+
+	track, a, path, ok := trackFile(c)
+	if !ok {
+		return
+	}
+
+	dir, err := a.hls(c, track, path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the audio file of the track is missing"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	p := filepath.Join(dir, file)
+	if _, err := os.Stat(p); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such HLS file: " + file})
+		return
+	}
+	if file == hlsPlaylist {
+		c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	} else {
+		c.Header("Content-Type", "video/mp2t")
+	}
+	c.File(p)
+}
+
+// hls returns the dir of the HLS files of the track,
+// whose audio file is at path, transcoding it if not cached,
+// in hlsTimeout.
+func (a *AudioFileStore) hls(ctx context.Context, track *model.Track, path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return a.cached(hlsCacheKind, cacheKey(track), func(dir string) error {
+		logger.WithField("store", a.Name).WithField("track", track.ID).
+			Info("hls: transcoding")
+		ctx, cancel := context.WithTimeout(ctx, hlsTimeout)
+		defer cancel()
+		return generateHLS(ctx, path, dir)
+	})
+}
@@ -1,13 +1,64 @@
 package audiofilestore
 
-import "github.com/gin-gonic/gin"
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registeredRoutes: names of the stores whose routes are registered.
+// gin can't unregister routes, so the routes of a name are registered
+// once, and resolve the store by the name at each request (see storeRoute):
+// a store can be replaced or unmounted at runtime (see Unmount).
+var registeredRoutes = map[string]bool{}
 
 func (a *AudioFileStore) registerRoutes(r gin.IRouter) {
-	group := r.Group(a.Name)
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if registeredRoutes[a.Name] {
+		return
+	}
+	registeredRoutes[a.Name] = true
+
+	h := func(handler func(*AudioFileStore, *gin.Context)) gin.HandlerFunc {
+		return storeRoute(a.Name, handler)
+	}
+
+	group := r.Group(a.Name, h((*AudioFileStore).checkLibrary))
+
+	// audio files
+	group.GET("/audio/*filepath", h((*AudioFileStore).GetAudioFile)) // a.audioStaticBasePath
+	group.HEAD("/audio/*filepath", h((*AudioFileStore).GetAudioFile))
 
-	// static audio file
-	group.Static("/audio", a.FileDir)  // a.audioStaticBasePath
+	writable := h((*AudioFileStore).checkWritable)
 
 	// add track
-	group.POST("/new", a.PostNewTrack)
+	group.POST("/new", writable, h((*AudioFileStore).PostNewTrack))
+	group.POST("/new/jobs", writable, h((*AudioFileStore).PostUploadJob))
+
+	// chunked upload
+	group.POST("/new/uploads", writable, h((*AudioFileStore).PostUpload))
+	group.PATCH("/new/uploads/:UploadID", writable, h((*AudioFileStore).PatchUpload))
+	group.POST("/new/uploads/:UploadID/commit", writable, h((*AudioFileStore).PostUploadCommit))
+	group.DELETE("/new/uploads/:UploadID", writable, h((*AudioFileStore).DeleteUpload))
+
+	// incremental scan of the FileDir
+	group.POST("/rescan", writable, h((*AudioFileStore).PostRescan))
+	group.GET("/scan/progress", h((*AudioFileStore).GetScanProgress))
+}
+
+// storeRoute resolves the store by the name, and calls the handler of it.
+//
+// Response (aborted):
+//
+//   - 404: Not Found: {error: "no such store"}: unmounted
+func storeRoute(name string, handler func(*AudioFileStore, *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a := getStore(name)
+		if a == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no such store"})
+			return
+		}
+		handler(a, c)
+	}
 }
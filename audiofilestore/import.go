@@ -0,0 +1,68 @@
+package audiofilestore
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// this file implements importing the audio files from outside the
+// FileDir of the store, e.g. by `musicstore import`.
+
+// Import adds the audio files at path as tracks: a music file,
+// an archive (see isArchive), or a directory (recursively, by the
+// ScanFilter of the store). Failures of single files are in the results.
+func (a *AudioFileStore) Import(path string) ([]ImportResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Import: %w", err)
+	}
+
+	var results []ImportResult
+	switch {
+	case info.IsDir():
+		results, err = a.importDir(path)
+	case isArchive(path):
+		results, err = a.addTracksFromArchive(path)
+	default:
+		track, err := a.AddTrack(path)
+		results = []ImportResult{newImportResult(path, track, err)}
+	}
+	if err != nil {
+		return results, fmt.Errorf("Import: %w", err)
+	}
+
+	applyOnDuplicate(results, a.OnDuplicate)
+	return results, nil
+}
+
+// importDir adds the music files in the dir.
+func (a *AudioFileStore) importDir(dir string) ([]ImportResult, error) {
+	var results []ImportResult
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if a.ScanFilter.skipDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 && !a.ScanFilter.FollowSymlinks {
+			return nil
+		}
+		if a.ScanFilter.skipFile(rel) || !isMusicFile(path) {
+			return nil
+		}
+
+		track, err := a.AddTrack(path)
+		results = append(results, newImportResult(path, track, err))
+		return nil
+	})
+	return results, err
+}
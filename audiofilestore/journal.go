@@ -0,0 +1,171 @@
+package audiofilestore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// this file implements the journal of the rescans: the progress of a
+// rescan is saved in the FileDir as it goes, so that an interrupted one
+// (crashed, or shut down) resumes where it left off, instead of
+// processing (and failing) all the files again.
+
+const (
+	// journalFileName is the name of the journal file in the FileDir.
+	journalFileName = ".scan-journal.json"
+
+	// the journal is saved every journalSaveEvery files done, or
+	// journalSaveInterval, whichever comes first.
+	journalSaveEvery    = 200
+	journalSaveInterval = 5 * time.Second
+)
+
+// ScanJournal is the saved progress of an unfinished rescan.
+//
+// The files done are recorded by their paths in the walk, not by their
+// positions: the imported files are renamed (by the FilenameTemplate),
+// so the walk of the resumed rescan differs from the interrupted one.
+// The new tracks are saved in batches: their files are recorded once
+// saved (or failed).
+type ScanJournal struct {
+	StartedAt time.Time
+	UpdatedAt time.Time
+
+	Done   []string       // the files done, relative to the FileDir
+	Failed []ImportResult // of the done files
+}
+
+// scanJournal tracks the ScanJournal of the running rescan.
+// The methods are no-ops on a nil journal.
+type scanJournal struct {
+	a *AudioFileStore
+
+	mu      sync.Mutex
+	j       ScanJournal
+	done    map[string]bool // j.Done
+	saved   int             // len(j.Done) of the last save
+	savedAt time.Time
+}
+
+func (a *AudioFileStore) journalPath() string {
+	return filepath.Join(a.FileDir, journalFileName)
+}
+
+// openScanJournal loads the journal of the interrupted rescan of the
+// store, or starts a new one.
+func openScanJournal(a *AudioFileStore) *scanJournal {
+	now := time.Now()
+	s := &scanJournal{a: a, done: map[string]bool{}, savedAt: now}
+
+	b, err := os.ReadFile(a.journalPath())
+	if err == nil {
+		err = json.Unmarshal(b, &s.j)
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		s.j = ScanJournal{StartedAt: now}
+	case err != nil:
+		logger.WithField("store", a.Name).WithError(err).
+			Warn("scanJournal: bad journal, starting over")
+		s.j = ScanJournal{StartedAt: now}
+	default:
+		logger.WithField("store", a.Name).
+			WithField("done", len(s.j.Done)).WithField("startedAt", s.j.StartedAt).
+			Info("scanJournal: resuming the interrupted rescan")
+	}
+	for _, file := range s.j.Done {
+		s.done[file] = true
+	}
+	s.saved = len(s.j.Done)
+	return s
+}
+
+// isDone tells if the file at path is done by the interrupted rescan.
+func (s *scanJournal) isDone(path string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[relPath(s.a.FileDir, path)]
+}
+
+// failed returns the failures recorded by the interrupted rescan.
+func (s *scanJournal) failed() []ImportResult {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ImportResult(nil), s.j.Failed...)
+}
+
+// doneFile records the file at path as done, i.e. skipped, or saved, or
+// failed with the result.
+func (s *scanJournal) doneFile(path string, failed *ImportResult) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := relPath(s.a.FileDir, path)
+	if s.done[file] {
+		return
+	}
+	s.done[file] = true
+	s.j.Done = append(s.j.Done, file)
+	if failed != nil {
+		s.j.Failed = append(s.j.Failed, *failed)
+	}
+
+	if len(s.j.Done)-s.saved >= journalSaveEvery || time.Since(s.savedAt) >= journalSaveInterval {
+		s.saveLocked()
+	}
+}
+
+func (s *scanJournal) saveLocked() {
+	if len(s.j.Done) == s.saved {
+		return
+	}
+	s.j.UpdatedAt = time.Now()
+	s.savedAt = s.j.UpdatedAt
+
+	b, err := json.Marshal(s.j)
+	if err == nil {
+		// written aside and renamed, never left half written by a crash
+		tmp := s.a.journalPath() + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, s.a.journalPath())
+		}
+	}
+	if err != nil {
+		logger.WithField("store", s.a.Name).WithError(err).
+			Warn("scanJournal: save failed")
+		return
+	}
+	s.saved = len(s.j.Done)
+}
+
+// close ends the journal: removed if the rescan is finished, or saved
+// to resume by the next one.
+func (s *scanJournal) close(finished bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if finished {
+		if err := os.Remove(s.a.journalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.WithField("store", s.a.Name).WithError(err).
+				Warn("scanJournal: remove failed")
+		}
+		return
+	}
+	s.saveLocked()
+}
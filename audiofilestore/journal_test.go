@@ -0,0 +1,98 @@
+package audiofilestore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScanJournalResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		done     []string // files done by the interrupted rescan
+		failed   []string // of the done ones
+		finished bool     // closed as finished
+		journal  string   // if not empty, written as the journal first
+		wantDone []string // done by the reopened journal
+	}{
+		{
+			name:     "resumes the done files",
+			done:     []string{"a.mp3", "x/b.mp3", "c.mp3"},
+			failed:   []string{"x/b.mp3"},
+			wantDone: []string{"a.mp3", "x/b.mp3", "c.mp3"},
+		},
+		{
+			name:     "a file done twice is recorded once",
+			done:     []string{"a.mp3", "a.mp3"},
+			wantDone: []string{"a.mp3"},
+		},
+		{
+			name:     "removed once finished",
+			done:     []string{"a.mp3"},
+			finished: true,
+		},
+		{
+			name:    "bad journal starts over",
+			journal: "{not json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &AudioFileStore{Name: "test", FileDir: t.TempDir()}
+			if tt.journal != "" {
+				if err := os.WriteFile(a.journalPath(), []byte(tt.journal), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			isFailed := map[string]bool{}
+			for _, f := range tt.failed {
+				isFailed[f] = true
+			}
+
+			j := openScanJournal(a)
+			for _, f := range tt.done {
+				var failed *ImportResult
+				if isFailed[f] {
+					failed = &ImportResult{File: f, Error: "bad tags"}
+				}
+				j.doneFile(filepath.Join(a.FileDir, filepath.FromSlash(f)), failed)
+			}
+			j.close(tt.finished)
+
+			_, err := os.Stat(a.journalPath())
+			if tt.finished != os.IsNotExist(err) {
+				t.Fatalf("journal file: Stat error = %v, finished %v", err, tt.finished)
+			}
+
+			j = openScanJournal(a)
+			if got := j.j.Done; !reflect.DeepEqual(got, tt.wantDone) && len(got)+len(tt.wantDone) > 0 {
+				t.Errorf("reopened journal: Done = %v, want %v", got, tt.wantDone)
+			}
+			for _, f := range tt.wantDone {
+				if !j.isDone(filepath.Join(a.FileDir, filepath.FromSlash(f))) {
+					t.Errorf("isDone(%s) = false, want true", f)
+				}
+			}
+			if j.isDone(filepath.Join(a.FileDir, "new.mp3")) {
+				t.Errorf("isDone(new.mp3) = true, want false")
+			}
+			var failed []string
+			for _, r := range j.failed() {
+				failed = append(failed, r.File)
+			}
+			if !reflect.DeepEqual(failed, tt.failed) {
+				t.Errorf("failed() = %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
+
+func TestScanJournalNil(t *testing.T) {
+	var j *scanJournal
+	j.doneFile("a.mp3", nil)
+	if j.isDone("a.mp3") || j.failed() != nil {
+		t.Error("nil journal: want no-ops")
+	}
+	j.close(true)
+}
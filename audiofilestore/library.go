@@ -0,0 +1,47 @@
+package audiofilestore
+
+import (
+	"context"
+	"musicstore/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file puts the stores into libraries (see model.DefaultLibrary):
+// the tracks added by a store are in its library, and the requests scoped
+// to another library (see auth) can not reach the store.
+
+// WithLibrary sets AudioFileStore.Library.
+func WithLibrary(library string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.Library = library
+	}
+}
+
+// library of the store: the Library, or model.DefaultLibrary.
+func (a *AudioFileStore) library() string {
+	if a.Library == "" {
+		return model.DefaultLibrary
+	}
+	return a.Library
+}
+
+// libraryContext is a background context scoped to the library of the
+// store, e.g. to check duplicates only among the tracks of the library.
+func (a *AudioFileStore) libraryContext() context.Context {
+	return model.WithLibrary(context.Background(), a.library())
+}
+
+// checkLibrary rejects the requests scoped to other libraries.
+//
+// Response (aborted):
+//
+//   - 404: Not Found: {error: "no such store in the library"}
+func (a *AudioFileStore) checkLibrary(c *gin.Context) {
+	if library := model.LibraryOf(c); library != "" && library != a.library() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no such store in the library"})
+		return
+	}
+	c.Next()
+}
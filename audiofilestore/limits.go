@@ -0,0 +1,118 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the limits of uploads: size and content type.
+
+// DefaultAllowedContentTypes of uploaded files, if not configured.
+// application/ogg is the legacy type of Ogg (Vorbis, Opus) files.
+// Archives are allowed for imports (see isArchive), and
+// application/octet-stream for clients not knowing the audio type.
+var DefaultAllowedContentTypes = []string{
+	"audio/*",
+	"application/ogg",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-tar",
+	"application/octet-stream",
+}
+
+// multipartOverhead is allowed above MaxUploadBytes for a multipart
+// request: boundaries, part headers and the other form fields.
+const multipartOverhead = 1 << 20 // 1 MiB
+
+var (
+	errUploadTooLarge     = errors.New("upload too large")
+	errUnsupportedContent = errors.New("unsupported content type")
+)
+
+// uploadErrorStatus is the HTTP status for the upload error:
+// 413 for errUploadTooLarge, 415 for errUnsupportedContent,
+// 422 for errInfected, 503 for errScanFailed, or def.
+func uploadErrorStatus(err error, def int) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUploadTooLarge), errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedContent):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errScanFailed):
+		return http.StatusServiceUnavailable
+	default:
+		return def
+	}
+}
+
+// limitRequestBody rejects the request early if its declared size is
+// over MaxUploadBytes, and caps the body that can be read.
+func (a *AudioFileStore) limitRequestBody(c *gin.Context) error {
+	maxBytes := a.maxUploadBytes()
+	if maxBytes <= 0 {
+		return nil
+	}
+	limit := maxBytes + multipartOverhead
+	if c.Request.ContentLength > limit {
+		return fmt.Errorf("%w: more than %d bytes", errUploadTooLarge, maxBytes)
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	return nil
+}
+
+// checkUploadSize returns errUploadTooLarge if size is over MaxUploadBytes.
+func (a *AudioFileStore) checkUploadSize(size int64) error {
+	if maxBytes := a.maxUploadBytes(); maxBytes > 0 && size > maxBytes {
+		return fmt.Errorf("%w: %d bytes > MaxUploadBytes (%d)", errUploadTooLarge, size, maxBytes)
+	}
+	return nil
+}
+
+// checkUploadedFile checks the size and the declared content type
+// of an uploaded file.
+func (a *AudioFileStore) checkUploadedFile(file *multipart.FileHeader) error {
+	if err := a.checkUploadSize(file.Size); err != nil {
+		return fmt.Errorf("%s: %w", file.Filename, err)
+	}
+	if err := a.checkContentType(file.Header.Get("Content-Type")); err != nil {
+		return fmt.Errorf("%s: %w", file.Filename, err)
+	}
+	return nil
+}
+
+// checkContentType returns errUnsupportedContent if the content type
+// does not match any of the AllowedContentTypes (or the defaults).
+// Patterns like "audio/*" match any subtype.
+func (a *AudioFileStore) checkContentType(contentType string) error {
+	allowed := a.AllowedContentTypes
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedContentTypes
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: %q", errUnsupportedContent, contentType)
+	}
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || pattern == "*/*" {
+			return nil
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok &&
+			strings.HasPrefix(mediaType, prefix+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", errUnsupportedContent, mediaType)
+}
@@ -0,0 +1,127 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// this file implements the ways to put an audio file into the FileDir:
+// AudioFileStore.LinkMode.
+
+// LinkModes: how the audio files are put into the FileDir.
+const (
+	LinkModeHardlink = "hardlink" // hard link (default)
+	LinkModeCopy     = "copy"     // copy the content
+	LinkModeMove     = "move"     // move (rename) the source file
+	LinkModeSymlink  = "symlink"  // symbolic link to the (absolute) source
+)
+
+// WithLinkMode sets AudioFileStore.LinkMode.
+func WithLinkMode(mode string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.LinkMode = mode
+	}
+}
+
+// CheckLinkMode checks if the link mode is known.
+func CheckLinkMode(mode string) error {
+	switch mode {
+	case "", LinkModeHardlink, LinkModeCopy, LinkModeMove, LinkModeSymlink:
+		return nil
+	}
+	return fmt.Errorf("unknown LinkMode %q: want one of %s, %s, %s, %s",
+		mode, LinkModeHardlink, LinkModeCopy, LinkModeMove, LinkModeSymlink)
+}
+
+// linkMode returns the LinkMode to put the src file into the FileDir.
+//
+// Files already in the FileDir (e.g. uploads in the tmp dir, scanned
+// files) are never symlinked: they are removed after imported.
+func (a *AudioFileStore) linkMode(src string) string {
+	mode := a.LinkMode
+	if mode == "" {
+		mode = LinkModeHardlink
+	}
+	if mode == LinkModeSymlink && a.isInFileDir(src) {
+		mode = LinkModeMove
+	}
+	return mode
+}
+
+// isInFileDir checks if the path is in the FileDir.
+func (a *AudioFileStore) isInFileDir(path string) bool {
+	pathAbs, err1 := filepath.Abs(path)
+	dirAbs, err2 := filepath.Abs(a.FileDir)
+	return err1 == nil && err2 == nil &&
+		strings.HasPrefix(pathAbs, dirAbs+string(filepath.Separator))
+}
+
+// placeFile puts the src file at dst by the mode. Hard links and moves
+// across filesystems (EXDEV) fall back to copies.
+//
+// It returns a function undoing it: removing dst, or moving it back.
+func placeFile(src, dst, mode string) (undo func(), err error) {
+	remove := func() { os.Remove(dst) }
+
+	switch mode {
+	case LinkModeCopy:
+		return remove, copyFile(src, dst)
+	case LinkModeSymlink:
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return nil, err
+		}
+		return remove, os.Symlink(abs, dst)
+	case LinkModeMove:
+		err := os.Rename(src, dst)
+		if errors.Is(err, syscall.EXDEV) {
+			if err = copyFile(src, dst); err == nil {
+				os.Remove(src)
+			}
+			return func() { copyFile(dst, src); os.Remove(dst) }, err
+		}
+		return func() { os.Rename(dst, src) }, err
+	default: // LinkModeHardlink
+		err := os.Link(src, dst)
+		if errors.Is(err, syscall.EXDEV) {
+			logger.WithField("src", src).Debug("placeFile: cross-device link, copy it")
+			err = copyFile(src, dst)
+		}
+		return remove, err
+	}
+}
+
+// copyFile copies the content of the src file to the new dst file.
+// The dst is removed if failed.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	// keep the modification time, as hard links and moves do
+	if st, err := in.Stat(); err == nil {
+		os.Chtimes(dst, st.ModTime(), st.ModTime())
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package audiofilestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cdfmlr/crud/service"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// this file implements the migration of tracks between stores,
+// e.g. to move some of them to a new disk when one fills up.
+
+// errMigrateBusy is returned if either store is rescanning or migrating.
+var errMigrateBusy = errors.New("a rescan or migration of the stores is in progress")
+
+// MigrateResult of a track, see Migrate.
+type MigrateResult struct {
+	TrackID uint
+	From    string `json:",omitempty"` // the AudioFileURLs
+	To      string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+// MigrateSummary is the result of a migration.
+type MigrateSummary struct {
+	Moved  []MigrateResult
+	Failed []MigrateResult
+}
+
+// Migrate moves the audio files of the tracks (by IDs, in the store a)
+// into the store dst. For each track, the file is copied into dst (named
+// by its FilenameTemplate and Layout), verified by the AudioFileHash, and
+// the AudioFileURL updated, then the file in a is removed (unless shared
+// by other tracks). Cover images are left where they are.
+//
+// With no IDs, all the tracks of a are migrated, up to limit (0: no limit).
+//
+// Rescans of both stores are held off meanwhile. It stops between the
+// tracks if ctx is done (e.g. the client is gone): the tracks left are
+// not in the summary.
+func (a *AudioFileStore) Migrate(ctx context.Context, dst *AudioFileStore, ids []uint, limit int) (*MigrateSummary, error) {
+	if a.readOnly() || dst.readOnly() {
+		return nil, errReadOnly
+	}
+	if !a.rescanMu.TryLock() {
+		return nil, errMigrateBusy
+	}
+	defer a.rescanMu.Unlock()
+	if !dst.rescanMu.TryLock() {
+		return nil, errMigrateBusy
+	}
+	defer dst.rescanMu.Unlock()
+
+	inflight.begin()
+	defer inflight.end()
+
+	tracks, err := a.tracksToMigrate(ctx, ids, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Migrate: %w", err)
+	}
+
+	summary := &MigrateSummary{Moved: []MigrateResult{}, Failed: []MigrateResult{}}
+	for i, track := range tracks {
+		if ctx.Err() != nil {
+			logger.WithField("migrated", i).WithField("left", len(tracks)-i).
+				Warn("Migrate: canceled, the tracks left are not migrated")
+			break
+		}
+		result := MigrateResult{TrackID: track.ID, From: track.AudioFileURL}
+		if err := a.migrateTrack(ctx, dst, track); err != nil {
+			result.Error = err.Error()
+			summary.Failed = append(summary.Failed, result)
+			continue
+		}
+		result.To = track.AudioFileURL
+		summary.Moved = append(summary.Moved, result)
+	}
+	return summary, nil
+}
+
+// tracksToMigrate gets the tracks by the IDs, or the ones of the store.
+func (a *AudioFileStore) tracksToMigrate(ctx context.Context, ids []uint, limit int) ([]*model.Track, error) {
+	if len(ids) == 0 {
+		base, err := url.JoinPath(a.BaseUrl, a.audioStaticBasePath())
+		if err != nil {
+			return nil, fmt.Errorf("JoinPath failed: %w", err)
+		}
+		options := []service.QueryOption{metadata.FileURLPrefix(base + "/"), service.OrderBy("id", false)}
+		if limit > 0 {
+			options = append(options, service.WithPage(limit, 0))
+		}
+		return metadata.GetTracks(ctx, options...)
+	}
+
+	tracks := make([]*model.Track, 0, len(ids))
+	for _, id := range ids {
+		track, err := metadata.GetTrack(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("GetTrack(%d) failed: %w", id, err)
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// migrateTrack moves the audio file of the track from a to dst,
+// and updates the track.
+func (a *AudioFileStore) migrateTrack(ctx context.Context, dst *AudioFileStore, track *model.Track) error {
+	src, ok := a.ownedFilePath(track.AudioFileURL)
+	if !ok {
+		return fmt.Errorf("the audio file is not in the store %q", a.Name)
+	}
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("the audio file is missing: %w", err)
+	}
+
+	hash := track.AudioFileHash
+	if hash == "" {
+		var err error
+		if hash, err = fileSHA256(src); err != nil {
+			return fmt.Errorf("fileSHA256 failed: %w", err)
+		}
+	}
+
+	newpath, undo, err := dst.placeAudioFile(track, src, filepath.Ext(src), LinkModeCopy)
+	if err != nil {
+		return err
+	}
+
+	// verify the copy before the original is gone
+	if got, err := fileSHA256(newpath); err != nil || got != hash {
+		undo()
+		return fmt.Errorf("the copy is not verified: sha256 %s, want %s (%v)", got, hash, err)
+	}
+
+	oldUrl := track.AudioFileURL
+	track.AudioFileHash = hash
+	if err = dst.fillAudioFile(track, newpath); err == nil {
+		err = metadata.UpdateTrackFile(ctx, track)
+	}
+	if err != nil {
+		undo()
+		track.AudioFileURL = oldUrl
+		return fmt.Errorf("UpdateTrackFile failed: %w", err)
+	}
+
+	a.removeCache(track)
+	if !a.isFileShared(ctx, track, oldUrl) {
+		if err := os.Remove(src); err != nil {
+			logger.WithField("store", a.Name).WithField("track", track.ID).
+				WithError(err).Warn("Migrate: remove the source file failed")
+		} else {
+			a.removeEmptyDirs(filepath.Dir(src))
+		}
+	}
+
+	logger.WithField("track", track.ID).WithField("from", a.Name).
+		WithField("to", dst.Name).WithField("AudioFileURL", track.AudioFileURL).
+		Info("Migrate: track moved")
+	return nil
+}
+
+// MigrateRequest is the body of PostMigrate.
+type MigrateRequest struct {
+	To    string `binding:"required"` // name of the target store
+	IDs   []uint // of the tracks, all the tracks of the store if empty
+	Limit int    // max tracks to migrate without IDs, 0 for no limit
+}
+
+// PostMigrate handles: POST /admin/stores/:name/migrate
+//
+// It moves the audio files of the tracks from the store to another one,
+// e.g. to rebalance the disks, see Migrate.
+//
+// Body: JSON MigrateRequest, e.g.
+//
+//	{"To": "bigdisk", "IDs": [1, 2, 3]}
+//	{"To": "bigdisk", "Limit": 500}
+//
+// Response:
+//
+//   - 200: OK: {summary: {Moved: [{TrackID: 1, From: "...", To: "..."}], Failed: [{TrackID: 2, From: "...", Error: "..."}]}}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 403: Forbidden: {error: "the store is read-only"}
+//   - 404: Not Found: {error: "no such store"}, or a track not found
+//   - 409: Conflict: {error: "a rescan or migration of the stores is in progress"}
+//   - 500: Internal Server Error: {error: "..."}
+func PostMigrate(c *gin.Context) {
+	var req MigrateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	a, dst := getStore(c.Param("name")), getStore(req.To)
+	if a == nil || dst == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such store"})
+		return
+	}
+	if a == dst {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the target store is the source one"})
+		return
+	}
+	if a.library() != dst.library() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the stores are of different libraries"})
+		return
+	}
+
+	start := time.Now()
+
+	summary, err := a.Migrate(c, dst, req.IDs, req.Limit)
+	switch {
+	case errors.Is(err, errReadOnly):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, errMigrateBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		logger.WithField("from", a.Name).WithField("to", dst.Name).
+			WithField("moved", len(summary.Moved)).WithField("failed", len(summary.Failed)).
+			WithField("took", time.Since(start)).Info("PostMigrate: done")
+		c.JSON(http.StatusOK, gin.H{"summary": summary})
+	}
+}
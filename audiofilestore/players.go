@@ -0,0 +1,145 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"musicstore/players"
+	"os"
+)
+
+// this file implements importing the library of another player (iTunes,
+// Navidrome, beets): the tracks with their play counts and ratings, and
+// the playlists.
+
+// PlayerImport is the report of ImportPlayer.
+type PlayerImport struct {
+	Source string
+	// Tracks: File is the path in the library of the player. Duplicate if
+	// the track existed (by the file in a store, by the content, or by
+	// the name and the artist).
+	Tracks []ImportResult
+	// Missing: the files not found.
+	Missing []string `json:",omitempty"`
+	// Streams: tracks without a local file, skipped.
+	Streams   int `json:",omitempty"`
+	Playlists []PlayerPlaylist
+}
+
+// PlayerPlaylist is an imported playlist.
+type PlayerPlaylist struct {
+	Name   string
+	Tracks int
+	// Missing: the tracks not imported, left out of the playlist.
+	Missing int `json:",omitempty"`
+}
+
+// ImportPlayer imports the library of a player into the store.
+//
+// Each track is matched to an existing one: by the file, if it's in a
+// store (e.g. the music folder of the player is the FileDir), or by its
+// content hash. Others are added to the store (see AddTrack and
+// LinkMode: with LinkModeSymlink the files stay in place), with the tags
+// from the player. The PlayCount, Rating and LastPlayedAt of the tracks
+// are set to the ones in the player, and the playlists are created, or
+// replaced on re-imports.
+func (a *AudioFileStore) ImportPlayer(lib *players.Library) (*PlayerImport, error) {
+	report := &PlayerImport{Source: lib.Source}
+	imported := map[string]*model.Track{} // by the ID in the player
+
+	for _, t := range lib.Tracks {
+		if t.Path == "" {
+			report.Streams++
+			continue
+		}
+		if _, err := os.Stat(t.Path); err != nil {
+			report.Missing = append(report.Missing, t.Path)
+			continue
+		}
+
+		tags := &model.Track{Name: t.Name, Artist: t.Artist, Album: t.Album}
+		track, existed, err := a.importFile(t.Path, OverrideTrackMetadata(tags))
+		result := newImportResult(t.Path, track, err)
+		result.Duplicate = existed
+		report.Tracks = append(report.Tracks, result)
+		if err != nil {
+			continue
+		}
+
+		track.PlayCount = t.PlayCount
+		track.Rating = t.Rating
+		track.LastPlayedAt = t.LastPlayed
+		if err := metadata.UpdateTrackStats(a.libraryContext(), track); err != nil {
+			logger.WithField("track", track.ID).WithError(err).
+				Warn("ImportPlayer: UpdateTrackStats failed")
+		}
+		imported[t.ID] = track
+	}
+
+	for _, p := range lib.Playlists {
+		playlist := &model.Playlist{
+			Library: a.library(),
+			Name:    p.Name,
+			Source:  lib.Source + ":" + p.ID,
+		}
+		result := PlayerPlaylist{Name: p.Name}
+		for _, id := range p.TrackIDs {
+			track, ok := imported[id]
+			if !ok {
+				result.Missing++
+				continue
+			}
+			playlist.Items = append(playlist.Items, model.PlaylistItem{
+				Position: len(playlist.Items),
+				TrackID:  track.ID,
+			})
+		}
+		result.Tracks = len(playlist.Items)
+
+		if err := metadata.SavePlaylist(a.libraryContext(), playlist); err != nil {
+			return report, fmt.Errorf("ImportPlayer: SavePlaylist %q failed: %w", p.Name, err)
+		}
+		report.Playlists = append(report.Playlists, result)
+	}
+	return report, nil
+}
+
+// importFile finds the track of the audio file at path (see
+// FindTrackByFile), or adds it with the options. existed is true if it's
+// not added.
+func (a *AudioFileStore) importFile(path string, options ...AddTrackOption) (track *model.Track, existed bool, err error) {
+	ctx := a.libraryContext()
+
+	// in a store: by the URL
+	for _, s := range allStores() {
+		if !s.isInFileDir(path) {
+			continue
+		}
+		u, err := s.audioUrl(path)
+		if err != nil {
+			break
+		}
+		track, err := metadata.FindTrackByFile(ctx, u, "")
+		if err != nil || track != nil {
+			return track, track != nil, err
+		}
+	}
+
+	// by the content
+	hash, err := fileSHA256(path)
+	if err != nil {
+		return nil, false, err
+	}
+	track, err = metadata.FindTrackByFile(ctx, "", hash)
+	if err != nil || track != nil {
+		return track, track != nil, err
+	}
+
+	track, err = a.AddTrack(path, options...)
+	var dup *DuplicateTrackError
+	if errors.As(err, &dup) { // by the name and the artist
+		return dup.Existing, true, nil
+	}
+	return track, false, err
+}
@@ -3,10 +3,8 @@ package audiofilestore
 import (
 	"errors"
 	"fmt"
-	"io"
 	"mime/multipart"
 	"musicstore/model"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -43,36 +41,196 @@ type PostNewTrackResponse struct {
 //
 // The metadata of the track will be saved to the database,
 // and the music file will be saved to the disk.
+//
+// AudioFileURL is downloaded in background: a job is returned
+// immediately (202), check its progress (BytesDone / BytesTotal),
+// status and the resulting track by GET /jobs/:id.
+//
+// The progress of a large File can be tracked likewise: create an upload
+// job by POST /new/jobs, and send the File with ?job={ID}, see
+// PostUploadJob.
+//
+// The File (or AudioFileURL) can also be an archive (.zip, .tar.gz, .tgz)
+// of music files, each is added as a track. Multiple files can be sent
+// in one request as multiple File (or File[]) parts:
+//
+//	curl -F 'File=@a.mp3' -F 'File=@b.mp3'
+//
+// Name is ignored for archives and multiple files.
+//
+// Query OnDuplicate (default: the store config, or "error") decides the
+// response to a track that already exists (same name and artist, or same
+// audio content): error (422), existing (200 with the existing track and
+// duplicate: true), or conflict (409 with the existing track).
+//
+// Response:
+//
+//   - 200: OK: {track: {...}}, or for archives and multiple files:
+//     {results: [{File: "a.mp3", Track: {...}}, {File: "b.mp3", Error: "..."}]}
+//   - 202: Accepted: {job: {...}}, for AudioFileURL
+//   - 400: Bad Request: {error: "bad request"}
+//   - 403: Forbidden: {error: "the store is read-only"}, or the
+//     AudioFileURL is not allowed by the FetchPolicy
+//   - 409: Conflict: {error: "...", track: {existing}}, for a duplicate
+//     track if OnDuplicate=conflict
+//   - 413: Request Entity Too Large: over MaxUploadBytes
+//   - 415: Unsupported Media Type: not in AllowedContentTypes
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"},
+//     or {error: "infected file: ..."} by the scanner (see ScanPolicy)
+//   - 503: Service Unavailable: {error: "scan failed: ..."}
 func (a *AudioFileStore) PostNewTrack(c *gin.Context) {
+	if !a.trackUpload(c) {
+		return
+	}
+	defer finishUpload(c)
+
+	if err := a.limitRequestBody(c); err != nil {
+		c.JSON(uploadErrorStatus(err, 400), gin.H{"error": err.Error()})
+		return
+	}
+
 	// bind file: https://github.com/gin-gonic/examples/blob/master/file-binding/main.go
 	req := new(PostNewTrackRequest)
 	if err := c.ShouldBind(req); err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
+		c.JSON(uploadErrorStatus(err, 400), gin.H{"error": err.Error()})
 		return
 	}
 
+	uploadPhase(c, model.JobPhaseAnalyzing)
+
+	files := multipartFiles(c)
+	if len(files) > 1 {
+		a.postNewFiles(c, req, files)
+		return
+	}
+	if len(files) == 1 {
+		req.File = files[0] // maybe a File[] part
+	}
+
 	if err := checkUploadRequest(c, req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
+	if req.AudioFileURL != "" {
+		if err := checkFetchURL(req.AudioFileURL); err != nil {
+			status := 400
+			if errors.Is(err, ErrFetchNotAllowed) {
+				status = 403
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := a.enqueueDownload(c, req.AudioFileURL, &req.Track)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(202, gin.H{"job": job})
+		return
+	}
+
+	if err := a.checkUploadedFile(req.File); err != nil {
+		c.JSON(uploadErrorStatus(err, 400), gin.H{"error": err.Error()})
+		return
+	}
+
 	// save file
 	savedpath, err := a.saveFile(c, req)
 	if err != nil {
-		c.JSON(422, gin.H{"error": err.Error()})
+		c.JSON(uploadErrorStatus(err, 422), gin.H{"error": err.Error()})
+		return
+	}
+
+	if isArchive(savedpath) {
+		a.postNewArchive(c, req, savedpath)
 		return
 	}
 
 	// add track to lib
-	track, err := a.AddTrack(savedpath, OverrideTrackMetadata(&req.Track))
+	track, err := a.AddTrack(savedpath, OverrideTrackMetadata(&req.Track), linkingPhase(c))
 	if err != nil {
-		c.JSON(422, gin.H{"error": err.Error()})
+		// AddTrack removes it only on success
+		a.rejectNewFile(savedpath, QuarantinedFile{File: req.File.Filename, Source: "upload", Track: &req.Track}, err)
+		a.respondAddTrackError(c, err)
 		return
 	}
 
 	c.JSON(200, gin.H{"track": track})
 }
 
+// postNewArchive adds the tracks in the uploaded archive.
+func (a *AudioFileStore) postNewArchive(c *gin.Context, req *PostNewTrackRequest, archive string) {
+	defer os.Remove(archive)
+
+	override := req.Track
+	override.Name = "" // tracks in an archive can not share a name
+
+	results, err := a.addTracksFromArchive(archive, OverrideTrackMetadata(&override), linkingPhase(c))
+	if err != nil {
+		c.JSON(422, gin.H{"error": err.Error()})
+		return
+	}
+
+	applyOnDuplicate(results, a.onDuplicate(c))
+	c.JSON(200, gin.H{"results": results})
+}
+
+// multipartFiles returns the File and File[] parts of the request.
+func multipartFiles(c *gin.Context) []*multipart.FileHeader {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil
+	}
+	return append(form.File["File"], form.File["File[]"]...)
+}
+
+// postNewFiles adds the tracks of multiple uploaded files.
+// Each file is added independently: failures are reported per file.
+func (a *AudioFileStore) postNewFiles(c *gin.Context, req *PostNewTrackRequest, files []*multipart.FileHeader) {
+	if req.AudioFileURL != "" {
+		c.JSON(400, gin.H{"error": "both File and AudioFileURL are provided, but only one is allowed"})
+		return
+	}
+
+	override := req.Track
+	override.Name = "" // tracks can not share a name
+	options := []AddTrackOption{OverrideTrackMetadata(&override), linkingPhase(c)}
+
+	results := make([]ImportResult, 0, len(files))
+	for _, file := range files {
+		if err := a.checkUploadedFile(file); err != nil {
+			results = append(results, ImportResult{File: file.Filename, Error: err.Error()})
+			continue
+		}
+
+		savedpath, err := a.saveMultipartFile(c, file)
+		if err != nil {
+			results = append(results, ImportResult{File: file.Filename, Error: err.Error()})
+			continue
+		}
+
+		if isArchive(savedpath) {
+			archiveResults, err := a.addTracksFromArchive(savedpath, options...)
+			os.Remove(savedpath)
+			if err != nil {
+				results = append(results, ImportResult{File: file.Filename, Error: err.Error()})
+			}
+			results = append(results, archiveResults...)
+			continue
+		}
+
+		track, err := a.AddTrack(savedpath, options...)
+		if err != nil {
+			a.rejectNewFile(savedpath, QuarantinedFile{File: file.Filename, Source: "upload", Track: &override}, err)
+		}
+		results = append(results, newImportResult(file.Filename, track, err))
+	}
+
+	applyOnDuplicate(results, a.onDuplicate(c))
+	c.JSON(200, gin.H{"results": results})
+}
+
 // success returns true
 func checkUploadRequest(c *gin.Context, req *PostNewTrackRequest) error {
 	if req.File == nil && req.AudioFileURL == "" {
@@ -86,20 +244,20 @@ func checkUploadRequest(c *gin.Context, req *PostNewTrackRequest) error {
 	return nil
 }
 
-// saveFile saves the file to the disk.
+// saveFile saves the uploaded file to the disk.
+// AudioFileURLs are downloaded in background instead, see enqueueDownload.
 func (a *AudioFileStore) saveFile(c *gin.Context, req *PostNewTrackRequest) (savedpath string, err error) {
-	switch {
-	case req.File != nil:
-		return a.saveFileFromMultipart(c, req)
-	case req.AudioFileURL != "":
-		return a.saveFileFromURL(c, req)
-	default:
-		return "", errors.New("neither File nor AudioFileURL is provided")
+	if req.File == nil {
+		return "", errors.New("no File is provided")
 	}
+	return a.saveFileFromMultipart(c, req)
 }
 
+// tmpDirName is the name of the tmp dir in the FileDir.
+const tmpDirName = ".tmp"
+
 func (a *AudioFileStore) tmpDir() string {
-	tmp := filepath.Join(a.FileDir, ".tmp")
+	tmp := filepath.Join(a.FileDir, tmpDirName)
 
 	// create tmp dir if not exists
 	if _, err := os.Stat(tmp); errors.Is(err, os.ErrNotExist) {
@@ -114,52 +272,58 @@ func (a *AudioFileStore) tmpDir() string {
 
 // saveFileFromMultipart saves the file from the multipart request.
 func (a *AudioFileStore) saveFileFromMultipart(c *gin.Context, req *PostNewTrackRequest) (savedpath string, err error) {
-	file := req.File
+	return a.saveMultipartFile(c, req.File)
+}
 
-	filename := filepath.Base(file.Filename)
-	filename = guardFilename(filename)
+// saveMultipartFile saves the uploaded file into the tmp dir.
+// The extension of the saved file is corrected by its content,
+// see normalizeExtension, and it's scanned, see scanNewFile.
+// Files failing them are quarantined, see rejectNewFile.
+func (a *AudioFileStore) saveMultipartFile(c *gin.Context, file *multipart.FileHeader) (savedpath string, err error) {
+	filename := guardFilename(file.Filename)
 	dst := filepath.Join(a.tmpDir(), filename)
 
-	err = c.SaveUploadedFile(file, dst)
-	return dst, err
-}
+	if err := c.SaveUploadedFile(file, dst); err != nil {
+		return dst, err
+	}
 
-// saveFileFromURL saves the file from the given URL.
-func (a *AudioFileStore) saveFileFromURL(c *gin.Context, req *PostNewTrackRequest) (savedpath string, err error) {
-	// download file
-	resp, err := http.Get(req.AudioFileURL)
+	savedpath, err = normalizeExtension(dst)
+	if err == nil {
+		err = a.scanNewFile(c, savedpath)
+	}
 	if err != nil {
-		return "", err
+		a.rejectNewFile(savedpath, QuarantinedFile{File: file.Filename, Source: "upload"}, err)
 	}
-	defer resp.Body.Close()
+	return savedpath, err
+}
 
-	// get filename from URL
-	tokens := strings.Split(req.AudioFileURL, "/")
-	filename := tokens[len(tokens)-1]
-	filename = guardFilename(filename)
+// ErrBadFilename: the filename has no name of a file to save as,
+// e.g. "..", or invalid bytes.
+var ErrBadFilename = errors.New("bad filename")
 
-	// save file
-	dst := filepath.Join(a.tmpDir(), filename)
-	out, err := os.Create(dst)
-	if err != nil {
-		return "", err
+// checkFilename checks the filename given by a client, see ErrBadFilename.
+// Directories in it are ignored, see guardFilename.
+func checkFilename(filename string) error {
+	if strings.ContainsRune(filename, 0) {
+		return fmt.Errorf("%w: %q", ErrBadFilename, filename)
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return dst, err
+	switch filepath.Base(filename) {
+	case ".", "..", string(filepath.Separator):
+		return fmt.Errorf("%w: %q", ErrBadFilename, filename)
+	}
+	return nil
 }
 
-// guardFilename guards the filename:
-//   - If it is empty, generate a random filename.
-//   - If it has no extension, add ".mp3" to the end.
+// guardFilename guards the filename to save a file as in a dir:
+//   - Directories are stripped, i.e. the base name.
+//   - If it is bad (see checkFilename), or empty, generate a random filename.
+//
+// The extension is not guarded: the file is named by its content
+// after saved, see normalizeExtension.
 func guardFilename(filename string) string {
-	if filename == "" {
+	if filename == "" || checkFilename(filename) != nil {
 		// random filename
-		filename = fmt.Sprintf("%d.mp3", time.Now().UnixNano())
-	}
-	if filepath.Ext(filename) == "" {
-		filename += ".mp3"
+		return fmt.Sprintf("%d", time.Now().UnixNano())
 	}
-	return filename
+	return filepath.Base(filename)
 }
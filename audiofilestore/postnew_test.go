@@ -0,0 +1,41 @@
+package audiofilestore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGuardFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string // "" for a random one
+		wantErr  bool   // of checkFilename
+	}{
+		{"a.mp3", "a.mp3", false},
+		{"x/y/a.mp3", "a.mp3", false},
+		{"../../etc/a.mp3", "a.mp3", false},
+		{"", "", true},
+		{".", "", true},
+		{"..", "", true},
+		{"x/..", "", true},
+		{"/", "", true},
+		{"a\x00.mp3", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			err := checkFilename(tt.filename)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrBadFilename)) {
+				t.Errorf("checkFilename(%q) = %v, want error: %v", tt.filename, err, tt.wantErr)
+			}
+
+			got := guardFilename(tt.filename)
+			if tt.want != "" && got != tt.want {
+				t.Errorf("guardFilename(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+			if tt.want == "" && (got == "" || strings.ContainsAny(got, "/.\x00")) {
+				t.Errorf("guardFilename(%q) = %q, want a random name", tt.filename, got)
+			}
+		})
+	}
+}
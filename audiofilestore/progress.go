@@ -0,0 +1,128 @@
+package audiofilestore
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the progress reporting of the scans of the FileDir
+// (LoadFromDir and rescans), streamed as Server-Sent Events.
+
+// progressPollInterval: how often the SSE stream checks for new progress.
+const progressPollInterval = 500 * time.Millisecond
+
+// ScanProgress is the progress of the running (or the last) scan.
+type ScanProgress struct {
+	Running bool
+
+	Discovered int // music files found so far
+	Processed  int // = Added + Updated + Skipped + Failed
+	Added      int
+	Updated    int
+	Skipped    int
+	Failed     int
+
+	Current string // the file processing (the last started one)
+
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+// scanProgress is the concurrent-safe ScanProgress of a store.
+// version increases on every change, for the watchers to poll.
+type scanProgress struct {
+	mu      sync.Mutex
+	p       ScanProgress
+	version uint64
+}
+
+func (s *scanProgress) update(f func(p *ScanProgress)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.p)
+	s.version++
+}
+
+func (s *scanProgress) start() {
+	now := time.Now()
+	s.update(func(p *ScanProgress) {
+		*p = ScanProgress{Running: true, StartedAt: &now}
+	})
+}
+
+func (s *scanProgress) finish() {
+	now := time.Now()
+	s.update(func(p *ScanProgress) {
+		p.Running = false
+		p.Current = ""
+		p.FinishedAt = &now
+	})
+}
+
+func (s *scanProgress) discover() {
+	s.update(func(p *ScanProgress) { p.Discovered++ })
+}
+
+func (s *scanProgress) begin(file string) {
+	s.update(func(p *ScanProgress) { p.Current = file })
+}
+
+// done counts a processed file by its outcome (scanSkipped, ...).
+func (s *scanProgress) done(outcome int) {
+	s.update(func(p *ScanProgress) {
+		p.Processed++
+		switch outcome {
+		case scanSkipped:
+			p.Skipped++
+		case scanAdded:
+			p.Added++
+		case scanUpdated:
+			p.Updated++
+		case scanFailed:
+			p.Failed++
+		}
+	})
+}
+
+func (s *scanProgress) snapshot() (ScanProgress, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.p, s.version
+}
+
+// GetScanProgress handles: GET /{store}/scan/progress
+//
+// It streams the progress of the scans (LoadFromDir and rescans) of the
+// store as Server-Sent Events, until the client disconnects:
+//
+//	event: progress
+//	data: {"Running": true, "Discovered": 120, "Processed": 42, "Added": 3, ..., "Current": "a.mp3"}
+//
+// An event is sent on connecting (the last scan, if not running),
+// and on every change after that.
+func (a *AudioFileStore) GetScanProgress(c *gin.Context) {
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+
+	var sent uint64
+	first := true
+
+	c.Stream(func(w io.Writer) bool {
+		p, version := a.progress.snapshot()
+		if first || version != sent {
+			c.SSEvent("progress", p)
+			sent, first = version, false
+			return true
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-ticker.C:
+			return true
+		}
+	})
+}
@@ -0,0 +1,364 @@
+package audiofilestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the quarantine of the new files failing to be
+// imported (unsupported content, bad tags, infected, ...): instead of
+// removed, they're moved into {FileDir}/.quarantine, each with a JSON
+// sidecar of the failure, to be retried or discarded by the admins.
+
+const (
+	// quarantineDirName is the name of the quarantine dir in the FileDir.
+	quarantineDirName = ".quarantine"
+	// quarantineTTL: quarantined files older than it are removed.
+	quarantineTTL = 30 * 24 * time.Hour
+	// sidecarExt of the JSON sidecars: {ID}.quarantine.json, not to be
+	// taken for quarantined .json files (e.g. of a catalog).
+	sidecarExt = ".quarantine.json"
+	// legacySidecarExt of the sidecars quarantined by older versions:
+	// {ID}.json, read if there's no {ID}.quarantine.json.
+	legacySidecarExt = ".json"
+)
+
+// Reasons of the QuarantinedFiles.
+const (
+	QuarantineFailed   = "failed"   // AddTrack failed, e.g. bad tags
+	QuarantineInfected = "infected" // by the scanner, see ScanPolicy
+)
+
+// QuarantinedFile is the sidecar of a file in the quarantine.
+type QuarantinedFile struct {
+	ID     string // name of the file in the quarantine dir
+	Store  string
+	File   string // the original name
+	Source string // upload | download | archive | retry
+	URL    string `json:",omitempty"` // of the download
+	Reason string // QuarantineFailed | QuarantineInfected
+	Error  string
+	Size   int64
+	Time   time.Time
+	// Track: the metadata given with the file, used by the retries.
+	Track *model.Track `json:",omitempty"`
+}
+
+// rejectNewFile quarantines the new file (in the tmp dir) failed to be
+// added. It's removed instead if it's a duplicate, rejected by a
+// read-only store, or infected without the Quarantine of the ScanPolicy.
+// Fields of q other than the File, Source, URL and Track are filled here.
+func (a *AudioFileStore) rejectNewFile(path string, q QuarantinedFile, cause error) {
+	var dup *DuplicateTrackError
+	infected := errors.Is(cause, errInfected)
+	if errors.As(cause, &dup) || errors.Is(cause, errReadOnly) ||
+		(infected && !currentScanPolicy().Quarantine) {
+		os.Remove(path)
+		return
+	}
+	q.Reason = QuarantineFailed
+	if infected {
+		q.Reason = QuarantineInfected
+	}
+	q.Error = cause.Error()
+
+	if err := a.quarantineFile(path, q); err != nil {
+		logger.WithField("store", a.Name).WithField("file", filepath.Base(path)).
+			WithError(err).Error("rejectNewFile: quarantine failed, removing the file")
+		os.Remove(path)
+	}
+}
+
+// quarantineFile moves the file into the quarantine dir, named
+// {unix nano}-{base name}, with the sidecar q.
+func (a *AudioFileStore) quarantineFile(path string, q QuarantinedFile) error {
+	dir := filepath.Join(a.FileDir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("quarantineFile: Mkdir failed: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("quarantineFile: %w", err)
+	}
+	q.ID = fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(path))
+	if strings.HasSuffix(q.ID, sidecarExt) {
+		q.ID += "_" // not a sidecar
+	}
+	q.Store = a.Name
+	q.Size = info.Size()
+	q.Time = time.Now()
+	if q.File == "" {
+		q.File = filepath.Base(path)
+	}
+
+	dst := filepath.Join(dir, q.ID)
+	if err := os.Rename(path, dst); err != nil {
+		return fmt.Errorf("quarantineFile: %w", err)
+	}
+	os.Chmod(dst, 0600)
+	if err := a.writeSidecar(q); err != nil {
+		return err
+	}
+
+	logger.WithField("store", a.Name).WithField("file", q.File).
+		WithField("reason", q.Reason).WithField("error", q.Error).
+		Warn("quarantineFile: file quarantined")
+	return nil
+}
+
+// writeSidecar of the quarantined file.
+func (a *AudioFileStore) writeSidecar(q QuarantinedFile) error {
+	b, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	sidecar := filepath.Join(a.FileDir, quarantineDirName, q.ID+sidecarExt)
+	if err := os.WriteFile(sidecar, b, 0600); err != nil {
+		return fmt.Errorf("writeSidecar: %w", err)
+	}
+	return nil
+}
+
+// quarantined lists the quarantined files of the store, oldest first.
+// Files without a readable sidecar are listed by their names.
+func (a *AudioFileStore) quarantined() ([]QuarantinedFile, error) {
+	dir := filepath.Join(a.FileDir, quarantineDirName)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	var files []QuarantinedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, sidecarExt) ||
+			(strings.HasSuffix(name, legacySidecarExt) && names[strings.TrimSuffix(name, legacySidecarExt)]) {
+			continue
+		}
+		q, err := a.quarantinedFile(entry.Name())
+		if err != nil {
+			continue // removed meanwhile
+		}
+		files = append(files, *q)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Time.Before(files[j].Time) })
+	return files, nil
+}
+
+// quarantinedFile by the ID, with its sidecar.
+func (a *AudioFileStore) quarantinedFile(id string) (*QuarantinedFile, error) {
+	if id != filepath.Base(id) || strings.HasPrefix(id, ".") || strings.HasSuffix(id, sidecarExt) {
+		return nil, os.ErrNotExist
+	}
+	path := filepath.Join(a.FileDir, quarantineDirName, id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &QuarantinedFile{ID: id, Store: a.Name, File: id, Size: info.Size(), Time: info.ModTime()}
+	b, err := os.ReadFile(path + sidecarExt)
+	if errors.Is(err, os.ErrNotExist) {
+		b, err = os.ReadFile(path + legacySidecarExt)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, q); err != nil {
+			q.Error = "bad sidecar: " + err.Error()
+		}
+	}
+	return q, nil
+}
+
+// discardQuarantined removes the quarantined file and its sidecar.
+func (a *AudioFileStore) discardQuarantined(id string) error {
+	path := filepath.Join(a.FileDir, quarantineDirName, id)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	removeSidecar(path)
+	return nil
+}
+
+// removeSidecar of the quarantined file at path, and the legacy one.
+func removeSidecar(path string) {
+	os.Remove(path + sidecarExt)
+	os.Remove(path + legacySidecarExt)
+}
+
+// retryQuarantined imports the quarantined file again, with the metadata
+// of the sidecar: scanned, and added as a track. The file is quarantined
+// again (by a new ID) if it fails, or removed if it's a duplicate.
+func (a *AudioFileStore) retryQuarantined(q *QuarantinedFile) (*model.Track, error) {
+	dir, err := os.MkdirTemp(a.tmpDir(), "retry-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// by the original name: the track may be named by it
+	path := filepath.Join(dir, guardFilename(q.File))
+	if err := os.Rename(filepath.Join(a.FileDir, quarantineDirName, q.ID), path); err != nil {
+		return nil, err
+	}
+	removeSidecar(filepath.Join(a.FileDir, quarantineDirName, q.ID))
+
+	retry := QuarantinedFile{File: q.File, Source: "retry", URL: q.URL, Track: q.Track}
+	path, err = normalizeExtension(path)
+	if err == nil {
+		err = a.scanNewFile(context.Background(), path)
+	}
+	if err != nil {
+		a.rejectNewFile(path, retry, err)
+		return nil, err
+	}
+
+	override := q.Track
+	if override == nil {
+		override = new(model.Track)
+	}
+	track, err := a.AddTrack(path, OverrideTrackMetadata(override))
+	if err != nil {
+		a.rejectNewFile(path, retry, err)
+		return nil, err
+	}
+	return track, nil
+}
+
+// sweepQuarantine removes the quarantined files older than the
+// quarantineTTL, with their sidecars.
+func (a *AudioFileStore) sweepQuarantine() {
+	files, err := a.quarantined()
+	if err != nil {
+		logger.WithField("store", a.Name).WithError(err).Warn("sweepQuarantine: failed")
+		return
+	}
+	removed := 0
+	for _, q := range files {
+		if time.Since(q.Time) >= quarantineTTL && a.discardQuarantined(q.ID) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		logger.WithField("store", a.Name).WithField("removed", removed).
+			Info("sweepQuarantine: expired files removed")
+	}
+}
+
+// GetQuarantine handles: GET /admin/quarantine
+//
+// It lists the quarantined files of all the stores, see QuarantinedFile.
+// They're removed after 30 days.
+//
+// Response:
+//
+//   - 200: OK: {quarantine: [{ID: "1700000000000000000-song.mp3", Store: "foo", File: "song.mp3",
+//     Source: "upload", Reason: "failed", Error: "...", Size: 123, Time: "...", Track: {...}}, ...]}
+//   - 500: Internal Server Error: {error: "..."}
+func GetQuarantine(c *gin.Context) {
+	files := []QuarantinedFile{}
+	for _, a := range allStores() {
+		q, err := a.quarantined()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		files = append(files, q...)
+	}
+	c.JSON(http.StatusOK, gin.H{"quarantine": files})
+}
+
+// quarantinedOfRequest gets the store and the quarantined file of the
+// :store and :ID params, or responds 404.
+func quarantinedOfRequest(c *gin.Context) (*AudioFileStore, *QuarantinedFile, bool) {
+	a := getStore(c.Param("store"))
+	if a == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such store"})
+		return nil, nil, false
+	}
+	q, err := a.quarantinedFile(c.Param("ID"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such quarantined file"})
+		return nil, nil, false
+	}
+	return a, q, true
+}
+
+// PostQuarantineRetry handles: POST /admin/quarantine/:store/:ID/retry
+//
+// It imports the quarantined file again, e.g. after the scanner or the
+// tag parsing was fixed. If it fails again, it's quarantined again, by a
+// new ID.
+//
+// Response:
+//
+//   - 200: OK: {track: {...}}
+//   - 403: Forbidden: {error: "the store is read-only"}
+//   - 404: Not Found: {error: "no such quarantined file"}
+//   - 409: Conflict: {error: "...", track: {existing}}, for a duplicate (removed)
+//   - 422: Unprocessable Entity: {error: "..."}
+func PostQuarantineRetry(c *gin.Context) {
+	a, q, ok := quarantinedOfRequest(c)
+	if !ok {
+		return
+	}
+	if a.readOnly() {
+		c.JSON(http.StatusForbidden, gin.H{"error": errReadOnly.Error()})
+		return
+	}
+
+	track, err := a.retryQuarantined(q)
+	if err != nil {
+		var dup *DuplicateTrackError
+		if errors.As(err, &dup) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "track": dup.Existing})
+			return
+		}
+		c.JSON(uploadErrorStatus(err, http.StatusUnprocessableEntity), gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.WithField("store", a.Name).WithField("file", q.File).WithField("track", track.ID).
+		Info("PostQuarantineRetry: quarantined file imported")
+	c.JSON(http.StatusOK, gin.H{"track": track})
+}
+
+// DeleteQuarantined handles: DELETE /admin/quarantine/:store/:ID
+//
+// It discards the quarantined file.
+//
+// Response:
+//
+//   - 204: No Content
+//   - 404: Not Found: {error: "no such quarantined file"}
+//   - 500: Internal Server Error: {error: "..."}
+func DeleteQuarantined(c *gin.Context) {
+	a, q, ok := quarantinedOfRequest(c)
+	if !ok {
+		return
+	}
+	if err := a.discardQuarantined(q.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,34 @@
+package audiofilestore
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements read-only stores: serving the files of an
+// existing collection (e.g. a NAS mount) without ever writing into it.
+
+// errReadOnly is returned by the writes to a read-only store.
+var errReadOnly = errors.New("the store is read-only")
+
+// WithReadOnly sets AudioFileStore.ReadOnly.
+func WithReadOnly(readOnly bool) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.ReadOnly = readOnly
+	}
+}
+
+// checkWritable aborts the requests writing to a read-only store.
+//
+// Response (aborted):
+//
+//   - 403: Forbidden: {error: "the store is read-only"}
+func (a *AudioFileStore) checkWritable(c *gin.Context) {
+	if a.readOnly() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errReadOnly.Error()})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,457 @@
+package audiofilestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the incremental scan of the FileDir:
+// only the new or changed files are imported.
+
+// DefaultScanWorkers is the default AudioFileStore.ScanWorkers.
+const DefaultScanWorkers = 4
+
+// WithScanWorkers sets AudioFileStore.ScanWorkers and ScanWriteRate.
+func WithScanWorkers(workers int, writeRate float64) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.ScanWorkers = workers
+		a.ScanWriteRate = writeRate
+	}
+}
+
+// scanWorkers returns the ScanWorkers, or the default.
+func (a *AudioFileStore) scanWorkers() int {
+	if a.ScanWorkers > 0 {
+		return a.ScanWorkers
+	}
+	return DefaultScanWorkers
+}
+
+// errRescanRunning is returned if a rescan of the store is in progress.
+var errRescanRunning = errors.New("a rescan is in progress")
+
+// RescanSummary is the result of a rescan.
+type RescanSummary struct {
+	Scanned int // music files found
+	Skipped int // known and not changed
+	Resumed int // done by the interrupted rescan resumed, see ScanJournal
+
+	Added   []ImportResult // new files imported as tracks
+	Updated []ImportResult // changed files of known tracks
+	Failed  []ImportResult
+}
+
+// Rescan walks the FileDir, skipping the files already known (the audio
+// files of the tracks, with the same size and modification time: neither
+// opened nor queried), and imports the new files as tracks.
+//
+// Changed files of known tracks update their tags and audio file fields,
+// and are re-analyzed if EnableEmomusic. A file with a new modification
+// time but the same content only updates the file state.
+//
+// Files are processed by ScanWorkers concurrently, and the imports (the
+// DB writes) are limited to ScanWriteRate per second, if set. The new
+// tracks are checked for duplicates in memory and saved in batches (see
+// importBatch), unless the FilenameTemplate needs their IDs.
+// The results in the summary are in the order of the walk.
+//
+// The progress is journaled (see ScanJournal): a rescan interrupted by a
+// crash or a shutdown is resumed by the next one, skipping the files it
+// has done (by their paths).
+func (a *AudioFileStore) Rescan(ctx context.Context) (*RescanSummary, error) {
+	if a.readOnly() {
+		return nil, errReadOnly
+	}
+	if !a.rescanMu.TryLock() {
+		return nil, errRescanRunning
+	}
+	defer a.rescanMu.Unlock()
+
+	inflight.begin()
+	defer inflight.end()
+
+	a.progress.start()
+	defer a.progress.finish()
+
+	journal := openScanJournal(a)
+
+	tracks, err := metadata.GetTracks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Rescan: GetTracks failed: %w", err)
+	}
+	known := make(map[string]*model.Track, len(tracks)) // AudioFileURL -> track
+	for _, track := range tracks {
+		if _, ok := a.ownedFilePath(track.AudioFileURL); ok {
+			known[track.AudioFileURL] = track
+		}
+	}
+
+	// the new files are saved in batches, unless they are named by the
+	// IDs: then one by one, by AddTrack
+	if !a.filenameNeedsID() {
+		b := newImportBatch(ctx, a, tracks)
+		b.journal = journal
+		a.batch.Store(b)
+		defer a.batch.Store(nil)
+	}
+
+	ch, err := a.enumMusicFiles(a.unchangedFiles(tracks))
+	if err != nil {
+		return nil, fmt.Errorf("Rescan: enumMusicFiles failed: %w", err)
+	}
+
+	// index the files in the walk order. The ones done by the
+	// interrupted rescan are skipped, with their failures reported again.
+	var (
+		resumed       int
+		resumedFailed []ImportResult
+	)
+	files := make(chan scanFile)
+	go func() {
+		defer close(files)
+		walkedDone := map[string]bool{}
+
+		index := 0
+		for path := range ch {
+			a.progress.discover()
+			if journal.isDone(path) {
+				resumed++
+				walkedDone[relPath(a.FileDir, path)] = true
+				a.progress.done(scanSkipped)
+				continue
+			}
+			files <- scanFile{index: index, path: path}
+			index++
+		}
+
+		for _, r := range journal.failed() {
+			if walkedDone[r.File] { // else gone since then
+				resumedFailed = append(resumedFailed, r)
+			}
+		}
+	}()
+
+	limit := newRateLimiter(a.ScanWriteRate)
+	defer limit.stop()
+
+	var (
+		results []scanResult
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < a.scanWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if a.isClosed() {
+					continue // shutting down: skip the rest
+				}
+				r := a.rescanFile(ctx, f, known, limit)
+				a.progress.done(r.outcome)
+				if !r.pending { // else by the batch, once saved
+					journal.doneFile(f.path, r.failed())
+				}
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if b := a.batch.Load(); b != nil {
+		failed := b.close()
+		for i := range results {
+			if err, ok := failed[results[i].index]; ok {
+				results[i].ImportResult = newImportResult(results[i].File, nil, err)
+				results[i].outcome = scanFailed
+			}
+		}
+	}
+
+	journal.close(!a.isClosed() && ctx.Err() == nil)
+
+	sort.Slice(results, func(i, j int) bool { return results[i].index < results[j].index })
+
+	summary := &RescanSummary{
+		Scanned: len(results) + resumed,
+		Skipped: resumed - len(resumedFailed),
+		Resumed: resumed,
+		Failed:  resumedFailed,
+	}
+	for _, r := range results {
+		switch r.outcome {
+		case scanSkipped:
+			summary.Skipped++
+		case scanAdded:
+			summary.Added = append(summary.Added, r.ImportResult)
+		case scanUpdated:
+			summary.Updated = append(summary.Updated, r.ImportResult)
+		case scanFailed:
+			summary.Failed = append(summary.Failed, r.ImportResult)
+		}
+	}
+	return summary, nil
+}
+
+// scanFile is a file to rescan, the index-th in the walk.
+type scanFile struct {
+	index int
+	path  string
+}
+
+// Outcomes of rescanning a file.
+const (
+	scanSkipped = iota
+	scanAdded
+	scanUpdated
+	scanFailed
+)
+
+type scanResult struct {
+	ImportResult
+	index   int
+	outcome int
+	pending bool // added to the batch, not saved yet
+}
+
+// failed returns the result if failed, or nil.
+func (r *scanResult) failed() *ImportResult {
+	if r.outcome != scanFailed {
+		return nil
+	}
+	return &r.ImportResult
+}
+
+// rescanFile imports the file if it's new, or updates the known track
+// of it if changed. known is read only.
+func (a *AudioFileStore) rescanFile(ctx context.Context, f scanFile, known map[string]*model.Track, limit *rateLimiter) scanResult {
+	rel, err := filepath.Rel(a.FileDir, f.path)
+	if err != nil {
+		rel = f.path
+	}
+	rel = filepath.ToSlash(rel)
+	a.progress.begin(rel)
+
+	result := func(outcome int, track *model.Track, err error) scanResult {
+		if err != nil {
+			outcome = scanFailed
+		}
+		return scanResult{ImportResult: newImportResult(rel, track, err), index: f.index, outcome: outcome}
+	}
+
+	u, err := a.audioUrl(f.path)
+	if err != nil {
+		return result(scanFailed, nil, err)
+	}
+
+	if track, ok := known[u]; ok {
+		if a.isFileUnchanged(track, f.path) {
+			return result(scanSkipped, track, nil)
+		}
+		limit.wait()
+		changed, err := a.rescanKnown(ctx, track, f.path)
+		if !changed && err == nil {
+			return result(scanSkipped, track, nil)
+		}
+		return result(scanUpdated, track, err)
+	}
+
+	limit.wait()
+	var track *model.Track
+	b := a.batch.Load()
+	if b != nil {
+		track, err = b.add(f.path, f.index)
+	} else {
+		track, err = a.AddTrack(f.path)
+	}
+
+	var dup *DuplicateTrackError
+	if errors.As(err, &dup) && dup.Existing.AudioFileURL == u {
+		// renamed to it by an AddTrack of the rescan: walked after that
+		return result(scanSkipped, dup.Existing, nil)
+	}
+	r := result(scanAdded, track, err)
+	r.pending = b != nil && err == nil
+	return r
+}
+
+// isFileUnchanged checks the size and modification time of the audio file
+// (at path) against the recorded ones of the track.
+func (a *AudioFileStore) isFileUnchanged(track *model.Track, path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && fileStateMatches(track, st)
+}
+
+func fileStateMatches(track *model.Track, st os.FileInfo) bool {
+	return !track.FileMissing &&
+		track.FileModTime != nil && track.FileModTime.Equal(st.ModTime()) &&
+		track.FileSize == st.Size()
+}
+
+// unchangedFiles returns the known func of enumMusicFiles for the audio
+// files of the tracks, in the FileDir, unchanged since recorded: by the
+// entries of the walk, without opening (or stating) them again.
+func (a *AudioFileStore) unchangedFiles(tracks []*model.Track) func(path string, d os.DirEntry) bool {
+	byPath := make(map[string]*model.Track, len(tracks))
+	for _, track := range tracks {
+		if path, ok := a.ownedFilePath(track.AudioFileURL); ok {
+			byPath[path] = track
+		}
+	}
+	return func(path string, d os.DirEntry) bool {
+		track, ok := byPath[filepath.Clean(path)]
+		if !ok {
+			return false
+		}
+		st, err := d.Info()
+		return err == nil && fileStateMatches(track, st)
+	}
+}
+
+// rescanKnown checks the audio file (at path) of the known track,
+// and updates the track if the file is changed.
+func (a *AudioFileStore) rescanKnown(ctx context.Context, track *model.Track, path string) (changed bool, err error) {
+	if a.isFileUnchanged(track, path) {
+		return false, nil
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	modTime := st.ModTime()
+
+	hash, err := fileSHA256(path)
+	if err != nil {
+		return false, fmt.Errorf("rescanKnown: fileSHA256 failed: %w", err)
+	}
+
+	track.FileSize = st.Size()
+	track.FileModTime = &modTime
+	track.FileMissing = false
+
+	if hash == track.AudioFileHash {
+		// touched (or imported before the file state is recorded)
+		return false, metadata.UpdateTrackFile(ctx, track)
+	}
+
+	tags, err := model.TrackFromAudioFile(path)
+	if err != nil {
+		return false, fmt.Errorf("rescanKnown: TrackFromAudioFile failed: %w", err)
+	}
+	a.removeCache(track) // of the old content
+
+	track.Name = tags.Name
+	track.Artist, err = a.canonicalArtist(model.NormalizeArtist(tags.Artist))
+	if err != nil {
+		return false, fmt.Errorf("rescanKnown: CanonicalArtist failed: %w", err)
+	}
+	track.Album = tags.Album
+	track.Genre = tags.Genre
+	track.AudioFileHash = hash
+	if a.emomusicEnabled() {
+		track.AnalysisStatus = model.AnalysisPending
+	}
+
+	if err := metadata.UpdateTrackFromFile(ctx, track); err != nil {
+		return false, err
+	}
+
+	if a.emomusicEnabled() {
+		if _, err := a.enqueueAnalysis(track, path); err != nil {
+			logger.WithField("ID", track.ID).WithError(err).
+				Error("rescanKnown: analysis.Enqueue failed")
+		}
+	}
+	return true, nil
+}
+
+// PostRescan handles: POST /{store}/rescan
+//
+// It imports the new or changed files in the FileDir, see Rescan.
+// With the query dryRun=true, nothing is imported: it reports what
+// would be done, see DryRun.
+//
+// Response:
+//
+//   - 200: OK: {summary: {Scanned: 100, Skipped: 97, Added: [{File: "a.mp3", Track: {...}}], Updated: [...], Failed: [...]}}
+//   - 200: OK (dryRun): {report: {Scanned: 100, Skipped: 97, New: [{File: "a.mp3", Track: {...}, Target: "a-b-c.mp3"}], Changed: [...], Duplicates: [...], Collisions: [...], Failed: [...]}}
+//   - 403: Forbidden: {error: "the store is read-only"}
+//   - 409: Conflict: {error: "a rescan is in progress"}
+//   - 500: Internal Server Error: {error: "..."}
+func (a *AudioFileStore) PostRescan(c *gin.Context) {
+	if c.Query("dryRun") == "true" {
+		report, err := a.DryRun(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"report": report})
+		return
+	}
+
+	start := time.Now()
+
+	summary, err := a.Rescan(c)
+	if errors.Is(err, errRescanRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logRescanSummary(a, summary, time.Since(start))
+	c.JSON(http.StatusOK, gin.H{"summary": summary})
+}
+
+func logRescanSummary(a *AudioFileStore, summary *RescanSummary, took time.Duration) {
+	logger.WithField("store", a.Name).
+		WithField("scanned", summary.Scanned).
+		WithField("skipped", summary.Skipped).
+		WithField("added", len(summary.Added)).
+		WithField("updated", len(summary.Updated)).
+		WithField("failed", len(summary.Failed)).
+		WithField("took", took).
+		Info("rescan: done")
+}
+
+// rateLimiter limits the calls of wait to rate per second.
+// A nil rateLimiter (for rate <= 0) does not limit.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / rate))}
+}
+
+// wait blocks until the next call is allowed.
+func (l *rateLimiter) wait() {
+	if l != nil {
+		<-l.ticker.C
+	}
+}
+
+func (l *rateLimiter) stop() {
+	if l != nil {
+		l.ticker.Stop()
+	}
+}
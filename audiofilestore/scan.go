@@ -0,0 +1,205 @@
+package audiofilestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// this file implements the scanning of the files uploaded or downloaded
+// (into the tmp dir) by an antivirus, before they are added as tracks:
+// by clamd (INSTREAM), or by a command (e.g. clamdscan).
+
+// ScanPolicy: the scanner of the new files, none by default.
+type ScanPolicy struct {
+	// Clamd: the address of clamd, "unix:/run/clamav/clamd.ctl" or
+	// "host:3310". The files are streamed to it: its StreamMaxLength
+	// must be over the largest file (e.g. MaxUploadBytes).
+	Clamd string
+	// Command to run, with the file appended, if no Clamd, e.g.
+	// ["clamdscan", "--no-summary", "--fdpass"]. Exit code 0: clean,
+	// 1: infected (as clamscan), others: failed.
+	Command []string
+	// Quarantine the infected files (see quarantine.go), instead of
+	// removing them.
+	Quarantine bool
+	// FailOpen accepts the files if the scanner fails. They're rejected
+	// by default.
+	FailOpen bool
+	// Timeout of a scan. Default: 5m.
+	Timeout time.Duration
+}
+
+// defaultScanTimeout of ScanPolicy.Timeout.
+const defaultScanTimeout = 5 * time.Minute
+
+var (
+	errInfected   = errors.New("infected file")
+	errScanFailed = errors.New("scan failed")
+)
+
+var (
+	scanPolicy   ScanPolicy
+	scanPolicyMu sync.RWMutex
+)
+
+// UseScanPolicy sets the scanner of the new files.
+func UseScanPolicy(p ScanPolicy) {
+	if p.Timeout <= 0 {
+		p.Timeout = defaultScanTimeout
+	}
+
+	scanPolicyMu.Lock()
+	defer scanPolicyMu.Unlock()
+	scanPolicy = p
+}
+
+func currentScanPolicy() ScanPolicy {
+	scanPolicyMu.RLock()
+	defer scanPolicyMu.RUnlock()
+	return scanPolicy
+}
+
+// scanNewFile scans the new file in the tmp dir, if a scanner is set.
+// It returns errInfected for an infected file, and errScanFailed if the
+// scan fails, unless the policy FailOpen. The file is left to the caller:
+// see rejectNewFile.
+func (a *AudioFileStore) scanNewFile(ctx context.Context, path string) error {
+	p := currentScanPolicy()
+	if p.Clamd == "" && len(p.Command) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	logger := logger.WithField("store", a.Name).WithField("file", filepath.Base(path))
+
+	var signature string
+	var err error
+	if p.Clamd != "" {
+		signature, err = clamdScan(ctx, p.Clamd, path)
+	} else {
+		signature, err = commandScan(ctx, p.Command, path)
+	}
+
+	switch {
+	case err != nil && p.FailOpen:
+		logger.WithError(err).Warn("scanNewFile: scan failed, accepting the file (FailOpen)")
+		return nil
+	case err != nil:
+		logger.WithError(err).Error("scanNewFile: scan failed, file rejected")
+		return fmt.Errorf("%w: %v", errScanFailed, err)
+	case signature == "":
+		return nil
+	}
+
+	logger.WithField("signature", signature).Warn("scanNewFile: infected file rejected")
+	return fmt.Errorf("%w: %s", errInfected, signature)
+}
+
+// clamdScan streams the file to clamd (zINSTREAM), and returns the
+// signature found, or "" if clean.
+func clamdScan(ctx context.Context, addr string, path string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// chunks of {length uint32 big endian}{data}, ended by a 0 length.
+	// A write error may be clamd refusing the stream: read its reply.
+	werr := func() error {
+		if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4+64<<10)
+		for {
+			n, err := f.Read(buf[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(buf[:4], uint32(n))
+				if _, err := conn.Write(buf[:4+n]); err != nil {
+					return err
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := conn.Write([]byte{0, 0, 0, 0})
+		return err
+	}()
+
+	reply, err := io.ReadAll(conn)
+	if len(reply) == 0 {
+		if werr != nil {
+			return "", fmt.Errorf("clamd: %w", werr)
+		}
+		return "", fmt.Errorf("clamd: no reply: %v", err)
+	}
+
+	// "stream: OK", "stream: {signature} FOUND", or "... ERROR"
+	r := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	switch {
+	case strings.HasSuffix(r, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(r, "stream: "), " FOUND"), nil
+	case strings.HasSuffix(r, " OK") && werr == nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("clamd: %s", r)
+	}
+}
+
+// commandScan runs the command with the file appended: exit code 0 is
+// clean, 1 is infected, with the last line of the output as the
+// signature.
+func commandScan(ctx context.Context, command []string, path string) (string, error) {
+	args := append(append([]string{}, command[1:]...), path)
+	cmd := exec.CommandContext(ctx, command[0], args...)
+
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		out = bytes.TrimSpace(out)
+		if i := bytes.LastIndexByte(out, '\n'); i >= 0 {
+			out = out[i+1:]
+		}
+		if len(out) == 0 {
+			return "unknown", nil
+		}
+		return string(out), nil
+	default:
+		return "", fmt.Errorf("%s: %w: %s", command[0], err, bytes.TrimSpace(out))
+	}
+}
@@ -0,0 +1,190 @@
+package audiofilestore
+
+import (
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// this file implements serving the audio files: GET (and HEAD)
+// /{store}/audio/* and /tracks/:TrackID/audio, with validators (ETag,
+// Last-Modified) and ranges.
+
+// DefaultCacheControl is the default AudioFileStore.CacheControl:
+// stored files change rarely (e.g. retagged), and are revalidated by
+// ETag after that.
+const DefaultCacheControl = "public, max-age=86400"
+
+// WithCacheControl sets AudioFileStore.CacheControl.
+func WithCacheControl(cacheControl string) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.CacheControl = cacheControl
+	}
+}
+
+// GetAudioFile handles: GET|HEAD /{store}/audio/*filepath
+//
+// It serves the file in the FileDir, by http.ServeContent: conditional
+// requests (If-None-Match, If-Modified-Since, If-Range) and ranges are
+// honored. The files in the hidden dirs (uploads in progress, trash and
+// cache) and the directories are not served.
+//
+// Response:
+//
+//   - 200: OK: the file, with ETag, Last-Modified and Cache-Control
+//   - 206: Partial Content: the range of the file
+//   - 304: Not Modified
+//   - 404: Not Found
+//   - 412: Precondition Failed
+//   - 416: Requested Range Not Satisfiable
+func (a *AudioFileStore) GetAudioFile(c *gin.Context) {
+	rel := path.Clean("/" + c.Param("filepath"))[1:]
+	if rel == "" || isHiddenPath(rel) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	a.serveFile(c, filepath.Join(a.FileDir, filepath.FromSlash(rel)))
+}
+
+// serveFile serves the file at path in the FileDir, see GetAudioFile.
+func (a *AudioFileStore) serveFile(c *gin.Context, p string) {
+	f, err := os.Open(p)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	cacheControl := a.cacheControl()
+	if cacheControl == "" {
+		cacheControl = DefaultCacheControl
+	}
+	c.Header("ETag", fileETag(st))
+	c.Header("Cache-Control", cacheControl)
+
+	// Last-Modified, the conditions, ranges and HEAD are handled by it
+	http.ServeContent(c.Writer, c.Request, st.Name(), st.ModTime(), f)
+}
+
+// fileETag is a strong ETag of the file, by its size and modification
+// time: a changed file (e.g. retagged, see writeTags) is replaced with
+// a new one.
+func fileETag(st os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size())
+}
+
+// isHiddenPath checks if any element of the relative path (slash
+// separated) is hidden: starts with a dot.
+func isHiddenPath(rel string) bool {
+	for _, elem := range strings.Split(rel, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetTrackAudio handles: GET|HEAD /tracks/:TrackID/audio
+//
+// It's the canonical URL of the audio of a track: the file is served from
+// the store holding it (as GetAudioFile), resolved on each request, so it
+// works after the BaseUrl of the store changed as well (see
+// resolveTrackFile). Tracks of remote files (not in any store) are
+// redirected to their AudioFileURL.
+//
+// Response:
+//
+//   - 200, 206, 304, 412, 416: as GetAudioFile
+//   - 302: Found: to the AudioFileURL of a remote file
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "..."}: no such track, or file
+//   - 500: Internal Server Error: {error: "internal server error"}
+func GetTrackAudio(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("TrackID"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	track, err := metadata.GetTrack(c, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	a, p, ok := resolveTrackFile(track)
+	switch {
+	case ok:
+		a.serveFile(c, p)
+	case a == nil && isRemoteURL(track.AudioFileURL):
+		c.Redirect(http.StatusFound, track.AudioFileURL)
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "the audio file of the track is missing"})
+	}
+}
+
+// resolveTrackFile finds the store holding the audio file of the track,
+// and the path of it:
+//
+//   - by the AudioFileURL, if it's of a store (see ownedFilePath)
+//   - or by the path of the URL: {any}/{store}/audio/{file}, e.g. after
+//     the BaseUrl (or the PathPrefix) changed.
+//
+// ok is false if the file is not found. The store is non-nil if the URL
+// is of a store, but the file is missing from it.
+func resolveTrackFile(track *model.Track) (a *AudioFileStore, path string, ok bool) {
+	if a, p, owned := storeOfFile(track.AudioFileURL); owned {
+		if fileExists(p) {
+			return a, p, true
+		}
+		return a, "", false
+	}
+
+	u, err := url.Parse(track.AudioFileURL)
+	if err != nil {
+		return nil, "", false
+	}
+	for _, s := range allStores() {
+		_, rel, found := strings.Cut(u.Path, s.audioStaticBasePath()+"/")
+		if !found {
+			continue
+		}
+		rel = filepath.FromSlash(rel)
+		if !filepath.IsLocal(rel) || isHiddenPath(filepath.ToSlash(rel)) {
+			continue
+		}
+		if p := filepath.Join(s.FileDir, rel); fileExists(p) {
+			return s, p, true
+		}
+		a = s
+	}
+	return a, "", false
+}
+
+// isRemoteURL checks if the URL is http(s), e.g. of a track added by
+// POST /tracks with the AudioFileURL of another server.
+func isRemoteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,199 @@
+package audiofilestore
+
+import (
+	"context"
+	"fmt"
+	"musicstore/analysis"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"net/url"
+
+	"github.com/cdfmlr/crud/service"
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the changes of the options of running stores,
+// e.g. to turn on the emotion analysis without a restart.
+//
+// The changes are kept until the store is remounted by a reload
+// with its config changed.
+
+// StorePatch is the options to change: nil fields are kept.
+type StorePatch struct {
+	EnableEmomusic     *bool
+	EmomusicUploadFile *bool
+	Analyzers          *[]string
+	ReadOnly           *bool
+	MaxUploadBytes     *int64
+	CacheControl       *string
+
+	// AnalyzeUnanalyzed: enqueue the analysis of the tracks of the store
+	// never analyzed (e.g. added while EnableEmomusic was off).
+	// It requires EnableEmomusic (after the patch).
+	AnalyzeUnanalyzed bool
+}
+
+// apply the patch to the store.
+func (p *StorePatch) apply(a *AudioFileStore) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+
+	if p.EnableEmomusic != nil {
+		a.EnableEmomusic = *p.EnableEmomusic
+	}
+	if p.EmomusicUploadFile != nil {
+		a.EmomusicUploadFile = *p.EmomusicUploadFile
+	}
+	if p.Analyzers != nil {
+		a.Analyzers = *p.Analyzers
+	}
+	if p.ReadOnly != nil {
+		a.ReadOnly = *p.ReadOnly
+	}
+	if p.MaxUploadBytes != nil {
+		a.MaxUploadBytes = *p.MaxUploadBytes
+	}
+	if p.CacheControl != nil {
+		a.CacheControl = *p.CacheControl
+	}
+}
+
+// The options of StorePatch are read by these getters, under the
+// settingsMu: they may be changed while the store is serving.
+
+func (a *AudioFileStore) emomusicEnabled() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.EnableEmomusic
+}
+
+func (a *AudioFileStore) emomusicUploadFile() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.EmomusicUploadFile
+}
+
+func (a *AudioFileStore) analyzers() []string {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.Analyzers
+}
+
+func (a *AudioFileStore) readOnly() bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.ReadOnly
+}
+
+func (a *AudioFileStore) maxUploadBytes() int64 {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.MaxUploadBytes
+}
+
+func (a *AudioFileStore) cacheControl() string {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.CacheControl
+}
+
+// analyzeUnanalyzed enqueues the analysis of the tracks of the store
+// with AnalysisNone. It returns the number of enqueued tracks.
+func (a *AudioFileStore) analyzeUnanalyzed(ctx context.Context) (int, error) {
+	base, err := url.JoinPath(a.BaseUrl, a.audioStaticBasePath())
+	if err != nil {
+		return 0, fmt.Errorf("analyzeUnanalyzed: JoinPath failed: %w", err)
+	}
+	tracks, err := metadata.GetTracks(ctx, metadata.FileURLPrefix(base+"/"),
+		service.Where("analysis_status = ?", model.AnalysisNone))
+	if err != nil {
+		return 0, fmt.Errorf("analyzeUnanalyzed: GetTracks failed: %w", err)
+	}
+
+	enqueued := 0
+	for _, track := range tracks {
+		path, _ := a.ownedFilePath(track.AudioFileURL)
+
+		track.AnalysisStatus = model.AnalysisPending
+		if err := metadata.UpdateAnalysisStatus(ctx, track); err != nil {
+			return enqueued, fmt.Errorf("analyzeUnanalyzed: UpdateAnalysisStatus failed: %w", err)
+		}
+		if _, err := a.enqueueAnalysis(track, path); err != nil {
+			return enqueued, fmt.Errorf("analyzeUnanalyzed: analysis.Enqueue failed: %w", err)
+		}
+		enqueued++
+	}
+	return enqueued, nil
+}
+
+// PatchStore handles: PATCH /admin/stores/:name
+//
+// It changes the options of the running store, see StorePatch.
+//
+// Body: JSON StorePatch, e.g.
+//
+//	{"EnableEmomusic": true, "AnalyzeUnanalyzed": true}
+//	{"ReadOnly": true}
+//
+// Response:
+//
+//   - 200: OK: {store: {...}, enqueued: 42}, see GetStores
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "no such store"}
+//   - 422: Unprocessable Entity: {error: "..."}, e.g. an unknown analyzer
+//   - 500: Internal Server Error: {error: "..."}
+func PatchStore(c *gin.Context) {
+	var patch StorePatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	a := getStore(c.Param("name"))
+	if a == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such store"})
+		return
+	}
+
+	if patch.Analyzers != nil {
+		if err := analysis.CheckAnalyzers(*patch.Analyzers); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if patch.MaxUploadBytes != nil && *patch.MaxUploadBytes < 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "negative MaxUploadBytes"})
+		return
+	}
+	emomusic := a.emomusicEnabled()
+	if patch.EnableEmomusic != nil {
+		emomusic = *patch.EnableEmomusic
+	}
+	if patch.AnalyzeUnanalyzed && !emomusic {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "AnalyzeUnanalyzed requires EnableEmomusic"})
+		return
+	}
+
+	patch.apply(a)
+	logger.WithContext(c).WithField("store", a.Name).
+		WithField("EnableEmomusic", a.emomusicEnabled()).WithField("ReadOnly", a.readOnly()).
+		Info("PatchStore: options changed")
+
+	enqueued := 0
+	if patch.AnalyzeUnanalyzed {
+		var err error
+		enqueued, err = a.analyzeUnanalyzed(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "enqueued": enqueued})
+			return
+		}
+	}
+
+	info, err := a.info(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"store": info, "enqueued": enqueued})
+}
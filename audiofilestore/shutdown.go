@@ -0,0 +1,76 @@
+package audiofilestore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// this file implements the graceful shutdown of the stores: the running
+// imports, scans and downloads are waited for. The downloads interrupted
+// anyway are requeued on the next start (see startDownloadWorkers).
+
+// inflight counts the running imports, scans and downloads of all stores.
+var inflight = newTracker()
+
+// tracker counts the running works, and tells when there is none.
+type tracker struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed while n == 0
+}
+
+func newTracker() *tracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &tracker{idle: idle}
+}
+
+func (t *tracker) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.n++
+}
+
+func (t *tracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n == 0 {
+		close(t.idle)
+	}
+}
+
+// wait until no work is running, or ctx is done.
+// It returns the number of the works still running.
+func (t *tracker) wait(ctx context.Context) (int, error) {
+	t.mu.Lock()
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return 0, nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.n, ctx.Err()
+	}
+}
+
+// Shutdown closes all the stores, so that no scan or download is started
+// (and the running scans skip the rest files), and waits for the running
+// imports, scans and downloads, until ctx is done.
+func Shutdown(ctx context.Context) error {
+	for _, a := range allStores() {
+		a.Close()
+	}
+
+	if n, err := inflight.wait(ctx); err != nil {
+		return fmt.Errorf("Shutdown: %d imports, scans or downloads still running: %w", n, err)
+	}
+	return nil
+}
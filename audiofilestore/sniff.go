@@ -0,0 +1,169 @@
+package audiofilestore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// this file implements content sniffing: the format of a file is told
+// by its magic bytes instead of the (untrusted) extension.
+
+// Formats (by canonical extension) that can be sniffed.
+const (
+	formatMP3   = ".mp3"
+	formatWAV   = ".wav"
+	formatM4A   = ".m4a"
+	formatFLAC  = ".flac"
+	formatOGG   = ".ogg"
+	formatOpus  = ".opus"
+	formatZip   = ".zip"
+	formatTarGz = ".tar.gz"
+)
+
+// audioFormats are the supported audio formats.
+var audioFormats = map[string]bool{
+	formatMP3:  true,
+	formatWAV:  true,
+	formatM4A:  true,
+	formatFLAC: true,
+	formatOGG:  true,
+	formatOpus: true,
+}
+
+// formatContentTypes are the Content-Types of the audio formats,
+// served by the static routes: the mime table of the system may not
+// know some of them, e.g. .flac and .opus.
+var formatContentTypes = map[string]string{
+	formatMP3:  "audio/mpeg",
+	formatWAV:  "audio/wav",
+	formatM4A:  "audio/mp4",
+	formatFLAC: "audio/flac",
+	formatOGG:  "audio/ogg",
+	formatOpus: "audio/ogg; codecs=opus",
+}
+
+func init() {
+	for format, contentType := range formatContentTypes {
+		if err := mime.AddExtensionType(format, contentType); err != nil {
+			panic(fmt.Errorf("sniff: AddExtensionType(%s) failed: %w", format, err))
+		}
+	}
+}
+
+// formatAliases are the other extensions of the formats.
+var formatAliases = map[string]string{
+	".mp4": formatM4A,
+	".tgz": formatTarGz,
+	".oga": formatOGG,
+}
+
+// sniffHeadSize is the number of bytes read to sniff the format.
+const sniffHeadSize = 64
+
+// sniffFormat tells the format of the content by its head bytes.
+// It returns "" if unknown.
+func sniffFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return formatMP3 // ID3v2 tagged mp3
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return formatWAV
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return formatM4A // ISO base media: m4a, mp4
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return formatFLAC
+	case bytes.HasPrefix(head, []byte("OggS")):
+		if bytes.Contains(head, []byte("OpusHead")) {
+			return formatOpus
+		}
+		return formatOGG
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return formatZip
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatTarGz // gzip: assume a tarball
+	case isMPEGAudioFrame(head):
+		return formatMP3 // mp3 without ID3
+	default:
+		return ""
+	}
+}
+
+// isMPEGAudioFrame checks the header of an MPEG audio frame:
+// 11 bits of frame sync, a valid version, layer, bitrate and sample rate.
+func isMPEGAudioFrame(head []byte) bool {
+	if len(head) < 4 || head[0] != 0xFF || head[1]&0xE0 != 0xE0 {
+		return false
+	}
+	version := (head[1] >> 3) & 0x3
+	layer := (head[1] >> 1) & 0x3
+	bitrate := head[2] >> 4
+	sampleRate := (head[2] >> 2) & 0x3
+	return version != 1 && layer != 0 && bitrate != 0xF && sampleRate != 0x3
+}
+
+// sniffFile tells the format of the file. It returns "" if unknown.
+func sniffFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffHeadSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return sniffFormat(head[:n]), nil
+}
+
+// fileExt returns the (lower case) extension of the path,
+// with the compound ones (e.g. .tar.gz) recognized.
+func fileExt(path string) string {
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, formatTarGz) {
+		return formatTarGz
+	}
+	return filepath.Ext(lower)
+}
+
+// matchesFormat returns true if the extension is one of the format.
+func matchesFormat(ext, format string) bool {
+	if alias, ok := formatAliases[ext]; ok {
+		ext = alias
+	}
+	return ext == format
+}
+
+// normalizeExtension sniffs the format of the file, and renames it to
+// the right extension if needed, e.g. "download" -> "download.mp3",
+// "song.mp3" (actually a m4a) -> "song.m4a".
+//
+// It returns the new path, or errUnsupportedContent if the format is
+// unknown.
+func normalizeExtension(path string) (string, error) {
+	format, err := sniffFile(path)
+	if err != nil {
+		return path, err
+	}
+	if format == "" {
+		return path, fmt.Errorf("%w: unknown format of %s", errUnsupportedContent, filepath.Base(path))
+	}
+
+	ext := fileExt(path)
+	if matchesFormat(ext, format) {
+		return path, nil
+	}
+
+	newpath := strings.TrimSuffix(path, path[len(path)-len(ext):]) + format
+	if err := os.Rename(path, newpath); err != nil {
+		return path, err
+	}
+	return newpath, nil
+}
@@ -0,0 +1,83 @@
+package audiofilestore
+
+import (
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements GET /stats: the statistics of the tracks, in
+// total and by store, for dashboards.
+
+// maxStatsDays of the import activity.
+const maxStatsDays = 366
+
+// StoreStats are the TrackStats of the tracks in a store.
+type StoreStats struct {
+	Name string
+	*metadata.TrackStats
+}
+
+// GetStats handles: GET /stats?days=30
+//
+// It responds the statistics of the tracks (in the library of the request,
+// if any): the totals, the ones of each store (tracks with remote audio
+// files are only in the totals), and the number of tracks imported each
+// day of the last days (default 30, up to 366).
+//
+// Response:
+//
+//   - 200: OK: {total: {Tracks: 42, Artists: 7, Albums: 5, Hours: 2.9, Bytes: 398458880, MissingCover: 3, MissingEmotion: 1, MissingDuration: 1},
+//     stores: [{Name: "foo", Tracks: 40, ...}], imports: [{Day: "2023-05-01", Tracks: 12}, ...]}
+//   - 400: Bad Request: {error: "bad days"}
+//   - 500: Internal Server Error: {error: "..."}
+func GetStats(c *gin.Context) {
+	days := 30
+	if s := c.Query("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxStatsDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad days: want 1 to 366"})
+			return
+		}
+		days = n
+	}
+
+	total, err := metadata.GetTrackStats(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	library := model.LibraryOf(c)
+	stores := []StoreStats{}
+	for _, a := range allStores() {
+		if library != "" && library != a.library() {
+			continue
+		}
+		base, err := url.JoinPath(a.BaseUrl, a.audioStaticBasePath())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stats, err := metadata.GetTrackStats(c, metadata.FileURLPrefix(base+"/"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stores = append(stores, StoreStats{Name: a.Name, TrackStats: stats})
+	}
+
+	since := time.Now().AddDate(0, 0, 1-days).Truncate(24 * time.Hour)
+	imports, err := metadata.GetImportsByDay(c, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": total, "stores": stores, "imports": imports})
+}
@@ -0,0 +1,213 @@
+package audiofilestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// this file keeps the registry of the running stores (by name),
+// for the routes working across stores, e.g. /admin/fsck,
+// /tracks/:TrackID/tags and /stores.
+
+var (
+	stores   = map[string]*AudioFileStore{}
+	storesMu sync.RWMutex
+)
+
+// registerStore adds the store to the registry.
+// It replaces the existing one of the same name.
+func registerStore(a *AudioFileStore) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	stores[a.Name] = a
+}
+
+// getStore by name. It returns nil if not found.
+func getStore(name string) *AudioFileStore {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+	return stores[name]
+}
+
+// allStores returns the stores sorted by name.
+func allStores() []*AudioFileStore {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+
+	all := make([]*AudioFileStore, 0, len(stores))
+	for _, a := range stores {
+		all = append(all, a)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// storeOfFile finds the store serving the file URL,
+// and returns the local path of the file.
+func storeOfFile(fileUrl string) (*AudioFileStore, string, bool) {
+	for _, a := range allStores() {
+		if path, ok := a.ownedFilePath(fileUrl); ok {
+			return a, path, true
+		}
+	}
+	return nil, "", false
+}
+
+// LocalPath returns the local path of the file URL (e.g. the AudioFileURL
+// of a track), if it's served by any store.
+func LocalPath(fileUrl string) (string, bool) {
+	_, path, ok := storeOfFile(fileUrl)
+	return path, ok
+}
+
+// trackFile gets the track (by the TrackID param), the store of its
+// audio file, and the path of the file, for the routes of the tracks
+// across stores. It responds the errors.
+func trackFile(c *gin.Context) (*model.Track, *AudioFileStore, string, bool) {
+	id, err := strconv.ParseUint(c.Param("TrackID"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, nil, "", false
+	}
+
+	track, err := metadata.GetTrack(c, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, nil, "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, "", false
+	}
+
+	a, path, ok := storeOfFile(track.AudioFileURL)
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "the audio file of the track is not in any store"})
+		return nil, nil, "", false
+	}
+	return track, a, path, true
+}
+
+// StoreInfo describes a mounted store, see GetStores.
+type StoreInfo struct {
+	Name string
+	// BasePath of the routes of the store, e.g. /{store}/new,
+	// and AudioBaseUrl of its audio files.
+	BasePath     string
+	AudioBaseUrl string
+	Library      string
+	// Tracks: the number of tracks with audio files in the store.
+	Tracks         int64
+	ReadOnly       bool
+	EnableEmomusic bool
+}
+
+// info of the store, counting its tracks in the library of the ctx.
+func (a *AudioFileStore) info(ctx context.Context) (*StoreInfo, error) {
+	base, err := url.JoinPath(a.BaseUrl, a.audioStaticBasePath())
+	if err != nil {
+		return nil, fmt.Errorf("info: JoinPath failed: %w", err)
+	}
+	count, err := metadata.CountTracksWithFileURLPrefix(ctx, base+"/")
+	if err != nil {
+		return nil, fmt.Errorf("info: CountTracksWithFileURLPrefix failed: %w", err)
+	}
+
+	return &StoreInfo{
+		Name:           a.Name,
+		BasePath:       "/" + a.Name,
+		AudioBaseUrl:   base,
+		Library:        a.library(),
+		Tracks:         count,
+		ReadOnly:       a.readOnly(),
+		EnableEmomusic: a.emomusicEnabled(),
+	}, nil
+}
+
+// GetStores handles: GET /stores
+//
+// It lists the mounted stores (sorted by name). Stores of other libraries
+// than the one of the request (if any) are not listed.
+//
+// Response:
+//
+//   - 200: OK: {stores: [{Name: "foo", BasePath: "/foo", AudioBaseUrl: "http://.../foo/audio", Library: "default", Tracks: 42, ReadOnly: false, EnableEmomusic: true}]}
+//   - 500: Internal Server Error: {error: "..."}
+func GetStores(c *gin.Context) {
+	library := model.LibraryOf(c)
+
+	infos := []*StoreInfo{}
+	for _, a := range allStores() {
+		if library != "" && library != a.library() {
+			continue
+		}
+		info, err := a.info(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		infos = append(infos, info)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"stores": infos})
+}
+
+// RegisterAdminRoutes registers the admin routes of all the stores:
+//
+//   - GET /admin/fsck: check the consistency of the stores and the database
+//   - POST /admin/fsck/repair: fix the problems found by fsck
+//   - POST /admin/backup: backup of the database and the files
+//   - POST /admin/restore: restore a backup
+//   - POST /admin/covers/fetch: fetch the missing covers of tracks
+//   - PATCH /admin/stores/:name: change the options of a store
+//   - POST /admin/stores/:name/migrate: move tracks to another store
+//   - GET /admin/quarantine: the files failed to be imported
+//   - POST /admin/quarantine/:store/:ID/retry: import a quarantined file again
+//   - DELETE /admin/quarantine/:store/:ID: discard a quarantined file
+//   - GET /tracks/:TrackID/tags: the tags in the audio file of the track
+//   - PATCH /tracks/:TrackID/tags: edit the tags of the track and its file
+//   - POST /tracks/import: import track metadata from a CSV or JSON catalog
+//   - GET /tracks/:TrackID/hls/index.m3u8: HLS streaming of the track
+//   - GET /tracks/:TrackID/waveform: waveform peaks of the track
+//   - GET /tracks/:TrackID/audio: the audio file of the track
+//   - PUT /tracks/:TrackID/cover: upload the cover image of the track
+//   - GET /stores: the mounted stores
+//   - GET /stats: statistics of the tracks, for dashboards
+//
+// It should be called only once, with the stores started before or after.
+func RegisterAdminRoutes(r gin.IRouter) {
+	group := r.Group("/admin")
+
+	group.GET("/fsck", GetFsck)
+	group.POST("/fsck/repair", PostFsckRepair)
+	group.POST("/backup", PostBackup)
+	group.POST("/restore", PostRestore)
+	group.POST("/covers/fetch", PostCoverFetch)
+	group.PATCH("/stores/:name", PatchStore)
+	group.POST("/stores/:name/migrate", PostMigrate)
+	group.GET("/quarantine", GetQuarantine)
+	group.POST("/quarantine/:store/:ID/retry", PostQuarantineRetry)
+	group.DELETE("/quarantine/:store/:ID", DeleteQuarantined)
+
+	r.GET("/tracks/:TrackID/tags", GetTrackTags)
+	r.PATCH("/tracks/:TrackID/tags", PatchTrackTags)
+	r.POST("/tracks/import", PostCatalogImport)
+	r.GET("/tracks/:TrackID/hls/:File", GetTrackHLS)
+	r.GET("/tracks/:TrackID/waveform", GetTrackWaveform)
+	r.GET("/tracks/:TrackID/audio", GetTrackAudio)
+	r.HEAD("/tracks/:TrackID/audio", GetTrackAudio)
+	r.PUT("/tracks/:TrackID/cover", PutTrackCover)
+	r.GET("/stores", GetStores)
+	r.GET("/stats", GetStats)
+}
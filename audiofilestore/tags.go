@@ -0,0 +1,267 @@
+package audiofilestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements editing the tags of a track in both the database
+// and its audio file (written by ffmpeg), keeping them consistent.
+
+// errNoFFmpeg: tags are written by ffmpeg.
+var errNoFFmpeg = errors.New("ffmpeg not found: required to write the tags")
+
+// TagEdits are the tags to set. nil fields are left unchanged.
+type TagEdits struct {
+	Name   *string
+	Artist *string
+	Album  *string
+	Genre  *string
+}
+
+// TagChange is a tag to change, with the current values
+// in the database and in the audio file.
+type TagChange struct {
+	Field string
+	DB    string
+	File  string
+	New   string
+}
+
+// changes of the edits to the track and its file tags:
+// the edited tags differing from either of them.
+func (e *TagEdits) changes(track *model.Track, file *model.FileTags) []TagChange {
+	fields := []struct {
+		name     string
+		edit     *string
+		db, file string
+	}{
+		{"Name", e.Name, track.Name, file.Name},
+		{"Artist", e.Artist, track.Artist, file.Artist},
+		{"Album", e.Album, track.Album, file.Album},
+		{"Genre", e.Genre, track.Genre, file.Genre},
+	}
+
+	var changes []TagChange
+	for _, f := range fields {
+		if f.edit == nil || (*f.edit == f.db && *f.edit == f.file) {
+			continue
+		}
+		changes = append(changes, TagChange{Field: f.name, DB: f.db, File: f.file, New: *f.edit})
+	}
+	return changes
+}
+
+// writeTags applies the changes to the track and its audio file (at path).
+//
+// The file is retagged into a copy, which replaces the file once the
+// track is updated: a hard linked source (see LinkMode) is left untouched.
+// The name of the file is kept, even if the FilenameTemplate refers to
+// the changed tags.
+func (a *AudioFileStore) writeTags(ctx context.Context, track *model.Track, path string, changes []TagChange) error {
+	if a.readOnly() {
+		return errReadOnly
+	}
+
+	tmp, err := os.CreateTemp(a.tmpDir(), "tags-*"+filepath.Ext(path))
+	if err != nil {
+		return fmt.Errorf("writeTags: CreateTemp failed: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name()) // gone once renamed
+
+	if err := ffmpegWriteTags(ctx, path, tmp.Name(), changes); err != nil {
+		return fmt.Errorf("writeTags: %w", err)
+	}
+
+	hash, err := fileSHA256(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("writeTags: fileSHA256 failed: %w", err)
+	}
+	st, err := os.Stat(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("writeTags: Stat failed: %w", err)
+	}
+
+	updated := *track
+	for _, c := range changes {
+		switch c.Field {
+		case "Name":
+			updated.Name = c.New
+		case "Artist":
+			updated.Artist = c.New
+		case "Album":
+			updated.Album = c.New
+		case "Genre":
+			updated.Genre = c.New
+		}
+	}
+	modTime := st.ModTime()
+	updated.AudioFileHash, updated.FileSize, updated.FileModTime = hash, st.Size(), &modTime
+
+	err = metadata.UpdateTrackTags(ctx, &updated, func() error {
+		return os.Rename(tmp.Name(), path)
+	})
+	if err != nil {
+		return fmt.Errorf("writeTags: UpdateTrackTags failed: %w", err)
+	}
+
+	a.removeCache(track) // of the old content
+	*track = updated
+	return nil
+}
+
+// ffmpegTagKeys: Track fields -> ffmpeg metadata keys
+var ffmpegTagKeys = map[string]string{
+	"Name":   "title",
+	"Artist": "artist",
+	"Album":  "album",
+	"Genre":  "genre",
+}
+
+// ffmpegWriteTags copies the audio file src to dst (of the same format),
+// with the tags changed, without re-encoding, killed if ctx is done:
+//
+//	ffmpeg -i src -map 0 -c copy -metadata title=... dst
+func ffmpegWriteTags(ctx context.Context, src, dst string, changes []TagChange) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return errNoFFmpeg
+	}
+
+	args := []string{"-v", "error", "-i", src, "-map", "0", "-c", "copy", "-map_metadata", "0"}
+	ext := strings.ToLower(filepath.Ext(dst))
+	for _, c := range changes {
+		kv := ffmpegTagKeys[c.Field] + "=" + c.New
+		args = append(args, "-metadata", kv)
+		if ext == ".ogg" || ext == ".opus" {
+			// Vorbis comments are of the stream
+			args = append(args, "-metadata:s:a:0", kv)
+		}
+	}
+	if ext == ".mp3" {
+		args = append(args, "-id3v2_version", "3")
+	}
+	args = append(args, "-y", dst)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// trackAndFile gets the track (by the TrackID param), the store of its
+// audio file, and the path and tags of the file. It responds the errors.
+func trackAndFile(c *gin.Context) (*model.Track, *AudioFileStore, string, *model.FileTags, bool) {
+	track, a, path, ok := trackFile(c)
+	if !ok {
+		return nil, nil, "", nil, false
+	}
+
+	tags, err := model.ReadFileTags(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusConflict, gin.H{"error": "the audio file of the track is missing: " + err.Error()})
+		return nil, nil, "", nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, "", nil, false
+	}
+
+	return track, a, path, tags, true
+}
+
+// GetTrackTags handles: GET /tracks/:TrackID/tags
+//
+// Response:
+//
+//   - 200: OK: {track: {...}, fileTags: {Name: "...", Artist: "...", Album: "...", Genre: "..."}}
+//     fileTags are the tags in the audio file, which may differ from the track.
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "record not found"}
+//   - 409: Conflict: {error: "the audio file of the track is missing: ..."}
+//   - 422: Unprocessable Entity: {error: "the audio file of the track is not in any store"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func GetTrackTags(c *gin.Context) {
+	track, _, _, tags, ok := trackAndFile(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"track": track, "fileTags": tags})
+}
+
+// PatchTrackTags handles: PATCH /tracks/:TrackID/tags
+//
+// It sets the tags of the track in both the database and its audio file.
+// With the query preview=true, nothing is changed: the diff is returned.
+//
+// Body: JSON TagEdits, the tags to set, e.g.
+//
+//	{"Artist": "foo", "Album": "bar"}
+//
+// Response:
+//
+//   - 200: OK: {track: {...}, fileTags: {...}, diff: [{Field: "Artist", DB: "...", File: "...", New: "foo"}], applied: true}
+//     track and fileTags are the ones after the changes (before, if previewed).
+//   - 400: Bad Request: {error: "bad request"}
+//   - 403: Forbidden: {error: "the store is read-only"}
+//   - 404: Not Found: {error: "record not found"}
+//   - 409: Conflict: {error: "the audio file of the track is missing: ..."}
+//   - 422: Unprocessable Entity: {error: "the audio file of the track is not in any store"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+//   - 501: Not Implemented: {error: "ffmpeg not found: ..."}
+func PatchTrackTags(c *gin.Context) {
+	var edits TagEdits
+	if err := c.ShouldBindJSON(&edits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	track, a, path, tags, ok := trackAndFile(c)
+	if !ok {
+		return
+	}
+
+	changes := edits.changes(track, tags)
+	if c.Query("preview") == "true" || len(changes) == 0 {
+		c.JSON(http.StatusOK, gin.H{"track": track, "fileTags": tags, "diff": changes, "applied": false})
+		return
+	}
+
+	err := a.writeTags(c, track, path, changes)
+	if errors.Is(err, errNoFFmpeg) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errReadOnly) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.WithContext(c).WithField("store", a.Name).WithField("track", track.ID).
+		WithField("diff", changes).Info("PatchTrackTags: tags written")
+
+	if tags, err = model.ReadFileTags(path); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"track": track, "fileTags": tags, "diff": changes, "applied": true})
+}
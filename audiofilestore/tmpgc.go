@@ -0,0 +1,165 @@
+package audiofilestore
+
+import (
+	"context"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// this file implements the garbage collection of the tmp dir:
+// files left by failed imports, abandoned chunked uploads, etc.,
+// of the covers dir: images no longer used by any track, and of the
+// quarantine (see quarantine.go).
+
+// DefaultTmpTTL is the default AudioFileStore.TmpTTL.
+const DefaultTmpTTL = 24 * time.Hour
+
+// tmpTTL returns the TmpTTL, or the default.
+func (a *AudioFileStore) tmpTTL() time.Duration {
+	if a.TmpTTL > 0 {
+		return a.TmpTTL
+	}
+	return DefaultTmpTTL
+}
+
+// startTmpSweeper cleans the tmp dir now (i.e. at startup), and
+// periodically in background.
+func (a *AudioFileStore) startTmpSweeper() {
+	ttl := a.tmpTTL()
+
+	a.sweepTmp(ttl)
+	a.sweepCovers(ttl)
+	a.sweepQuarantine()
+
+	interval := ttl / 2
+	if interval < time.Minute {
+		interval = time.Minute
+	} else if interval > time.Hour {
+		interval = time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.sweepTmp(ttl)
+				a.sweepCovers(ttl)
+				a.sweepQuarantine()
+			case <-a.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sweepTmp removes the entries in the tmp dir not modified for ttl,
+// and forgets the chunked uploads not appended for ttl, and fails the
+// upload jobs not used (or interrupted) for ttl.
+func (a *AudioFileStore) sweepTmp(ttl time.Duration) {
+	logger := logger.WithField("store", a.Name)
+
+	n, err := metadata.FailStaleJobs(context.Background(), model.JobKindUpload,
+		time.Now().Add(-ttl), "upload abandoned or interrupted", a.ownJobs())
+	if err != nil {
+		logger.WithError(err).Warn("sweepTmp: FailStaleJobs failed")
+	} else if n > 0 {
+		logger.WithField("jobs", n).Info("sweepTmp: stale upload jobs failed")
+	}
+
+	for _, up := range a.uploads.expire(ttl) {
+		os.Remove(up.path)
+	}
+
+	tmp := a.tmpDir()
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		logger.WithError(err).Warn("sweepTmp: ReadDir failed")
+		return
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ttl {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(tmp, entry.Name())); err != nil {
+			logger.WithField("file", entry.Name()).WithError(err).
+				Warn("sweepTmp: remove failed")
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		logger.WithField("removed", removed).Info("sweepTmp: tmp files removed")
+	}
+}
+
+// sweepCovers removes the images in the covers dir not used by any
+// track (e.g. replaced), and not modified for ttl: the ones just saved
+// may not be set to their tracks yet.
+//
+// The covers are matched by their names in the URLs, not the whole URLs:
+// those are of the BaseUrl (and PathPrefix) when saved, that may have
+// changed since then. If no URL matches at all, nothing is removed.
+func (a *AudioFileStore) sweepCovers(ttl time.Duration) {
+	if a.readOnly() {
+		return
+	}
+	logger := logger.WithField("store", a.Name)
+
+	dir := filepath.Join(a.FileDir, coversDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return // no covers yet
+	}
+
+	urls, err := metadata.GetCoverImageURLs(context.Background(), "/"+coversDirName+"/")
+	if err != nil {
+		logger.WithError(err).Warn("sweepCovers: GetCoverImageURLs failed")
+		return
+	}
+	used := map[string]bool{} // names in the covers dir
+	for u := range urls {
+		if p, err := url.Parse(u); err == nil && path.Base(path.Dir(p.Path)) == coversDirName {
+			used[path.Base(p.Path)] = true
+		}
+	}
+	matched := false
+	for _, entry := range entries {
+		matched = matched || used[entry.Name()]
+	}
+	if !matched {
+		logger.Warn("sweepCovers: no track uses a cover of the dir, skipped")
+		return
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < ttl {
+			continue
+		}
+		if used[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			logger.WithField("file", entry.Name()).WithError(err).
+				Warn("sweepCovers: remove failed")
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		logger.WithField("removed", removed).Info("sweepCovers: unused covers removed")
+	}
+}
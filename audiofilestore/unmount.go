@@ -0,0 +1,76 @@
+package audiofilestore
+
+import "sync"
+
+// this file implements the unmounting of the stores at runtime, e.g. when
+// removed from the config (reloaded on SIGHUP): the background workers
+// (tmp sweeper, download workers, watcher) stop, and the routes of the
+// store respond 404 (until a store of the name is mounted again).
+//
+// The files and the tracks of the store are untouched.
+
+// closer of a store: closed on Close.
+type closer struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newCloser() closer {
+	return closer{ch: make(chan struct{})}
+}
+
+func (c *closer) close() {
+	c.once.Do(func() { close(c.ch) })
+}
+
+// Done is closed when the store is closed.
+func (a *AudioFileStore) Done() <-chan struct{} {
+	return a.closer.ch
+}
+
+// isClosed checks if the store is closed.
+func (a *AudioFileStore) isClosed() bool {
+	select {
+	case <-a.closer.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the background workers of the store, and removes it from
+// the registry, if it's still the registered one of its name.
+// The running downloads finish, and the running scans skip the rest files.
+func (a *AudioFileStore) Close() {
+	a.closer.close()
+	if a.watcher != nil {
+		a.watcher.fs.Close()
+	}
+
+	storesMu.Lock()
+	if stores[a.Name] == a {
+		delete(stores, a.Name)
+	}
+	storesMu.Unlock()
+
+	logger.WithField("store", a.Name).Info("Close: store unmounted")
+}
+
+// Unmount closes the store of the name, if mounted.
+func Unmount(name string) bool {
+	a := getStore(name)
+	if a == nil {
+		return false
+	}
+	a.Close()
+	return true
+}
+
+// StoreNames of the mounted stores, sorted.
+func StoreNames() []string {
+	var names []string
+	for _, a := range allStores() {
+		names = append(names, a.Name)
+	}
+	return names
+}
@@ -0,0 +1,337 @@
+package audiofilestore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"musicstore/model"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements a chunked upload API for large files:
+//
+//	POST  /new/uploads             init: {Filename, Size}
+//	PATCH /new/uploads/:id         append a chunk (raw body)
+//	POST  /new/uploads/:id/commit  add the assembled file as a new track
+//	DELETE /new/uploads/:id        abort
+//
+// Chunks are appended to {FileDir}/.tmp/upload-{id}.part in order.
+// Uploads not appended for the TmpTTL are dropped, see sweepTmp.
+
+// maxChunkSize is the max body size of a PATCH /new/uploads/:id.
+const maxChunkSize = 64 << 20 // 64 MiB
+
+// Upload is a chunked upload in progress.
+type Upload struct {
+	ID       string
+	Filename string
+	Size     int64 // declared total size
+	Offset   int64 // bytes received
+	Created  time.Time
+	Updated  time.Time // last appended
+
+	mu   sync.Mutex
+	path string // the part file
+}
+
+// uploads of a store, by ID.
+type uploads struct {
+	mu sync.Mutex
+	m  map[string]*Upload
+}
+
+func (u *uploads) get(id string) (*Upload, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	up, ok := u.m[id]
+	return up, ok
+}
+
+func (u *uploads) put(up *Upload) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.m == nil {
+		u.m = make(map[string]*Upload)
+	}
+	u.m[up.ID] = up
+}
+
+func (u *uploads) remove(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.m, id)
+}
+
+// expire removes and returns the uploads not updated for ttl.
+func (u *uploads) expire(ttl time.Duration) []*Upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var expired []*Upload
+	for id, up := range u.m {
+		up.mu.Lock()
+		if time.Since(up.Updated) >= ttl {
+			expired = append(expired, up)
+			delete(u.m, id)
+		}
+		up.mu.Unlock()
+	}
+	return expired
+}
+
+// PostUploadRequest initializes a chunked upload.
+type PostUploadRequest struct {
+	Filename string `binding:"required"`
+	Size     int64  `binding:"required"`
+}
+
+// PostUpload handles: POST /new/uploads
+//
+// Body (JSON): {"Filename": "audio.mp3", "Size": 12345678}
+//
+// Response:
+//
+//   - 201: Created: {upload: {ID, Filename, Size, Offset}}
+//   - 400: Bad Request: {error: "bad request"}, or a bad Filename, e.g. ".."
+//   - 413: Request Entity Too Large: Size is over MaxUploadBytes
+//   - 500: Internal Server Error: {error: "internal server error"}
+func (a *AudioFileStore) PostUpload(c *gin.Context) {
+	req := new(PostUploadRequest)
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Size should be > 0"})
+		return
+	}
+	if err := checkFilename(req.Filename); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.checkUploadSize(req.Size); err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	up := &Upload{
+		ID:       id,
+		Filename: guardFilename(req.Filename),
+		Size:     req.Size,
+		Created:  time.Now(),
+		Updated:  time.Now(),
+		path:     filepath.Join(a.tmpDir(), "upload-"+id+".part"),
+	}
+
+	f, err := os.Create(up.path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	f.Close()
+
+	a.uploads.put(up)
+
+	c.JSON(http.StatusCreated, gin.H{"upload": up})
+}
+
+// PatchUpload handles: PATCH /new/uploads/:UploadID
+//
+// Body: the next chunk (raw bytes), at most 64 MiB.
+// Header Upload-Offset (optional): the offset of the chunk,
+// must be the Offset of the upload, i.e. chunks are appended in order.
+//
+// Response:
+//
+//   - 200: OK: {upload: {ID, Filename, Size, Offset}}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "upload not found"}
+//   - 409: Conflict: {error: "offset mismatch"}: retry from the Offset
+//   - 413: Request Entity Too Large: the chunk or total size is too large
+//   - 500: Internal Server Error: {error: "internal server error"}
+func (a *AudioFileStore) PatchUpload(c *gin.Context) {
+	up, ok := a.uploads.get(c.Param("UploadID"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if h := c.GetHeader("Upload-Offset"); h != "" {
+		offset, err := strconv.ParseInt(h, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad Upload-Offset"})
+			return
+		}
+		if offset != up.Offset {
+			c.JSON(http.StatusConflict, gin.H{"error": "offset mismatch", "upload": up})
+			return
+		}
+	}
+	if c.Request.ContentLength > maxChunkSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "chunk too large"})
+		return
+	}
+
+	f, err := os.OpenFile(up.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	// read one more byte than allowed to detect the overflow
+	limit := min64(maxChunkSize, up.Size-up.Offset)
+	n, err := io.Copy(f, io.LimitReader(c.Request.Body, limit+1))
+	if err == nil && n > limit {
+		err = errTooLarge
+	}
+	if err != nil {
+		// drop the partial chunk: the client retries from up.Offset
+		if err1 := f.Truncate(up.Offset); err1 != nil {
+			logger.WithContext(c).WithError(err1).Error("PatchUpload: Truncate failed")
+		}
+		if errors.Is(err, errTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "chunk exceeds the declared Size or 64 MiB"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	up.Offset += n
+	up.Updated = time.Now()
+
+	c.JSON(http.StatusOK, gin.H{"upload": up})
+}
+
+var errTooLarge = errors.New("too large")
+
+// PostUploadCommit handles: POST /new/uploads/:UploadID/commit
+//
+// Body (JSON, optional): track metadata to override, as in POST /new:
+// {"Name": "...", "Artist": "...", "Album": "...", "CoverImageURL": "..."}
+//
+// Response:
+//
+//   - 200: OK: {track: {...}}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "upload not found"}
+//   - 409: Conflict: {error: "upload incomplete"}, or a duplicate track,
+//     see OnDuplicate of POST /new
+//   - 415: Unsupported Media Type: {error: "unsupported content type"}
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"}, or
+//     {error: "infected file: ..."}
+//   - 503: Service Unavailable: {error: "scan failed: ..."}
+func (a *AudioFileStore) PostUploadCommit(c *gin.Context) {
+	up, ok := a.uploads.get(c.Param("UploadID"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+
+	override := new(model.Track)
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(override); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if up.Offset != up.Size {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload incomplete", "upload": up})
+		return
+	}
+
+	// give it the real name, then the right extension
+	dir, err := os.MkdirTemp(a.tmpDir(), "upload-"+up.ID+"-")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, up.Filename)
+	if err := os.Rename(up.path, path); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	a.uploads.remove(up.ID)
+
+	rejected := QuarantinedFile{File: up.Filename, Source: "upload", Track: override}
+	path, err = normalizeExtension(path)
+	if err == nil {
+		err = a.scanNewFile(c, path)
+	}
+	if err != nil {
+		a.rejectNewFile(path, rejected, err)
+		c.JSON(uploadErrorStatus(err, http.StatusUnprocessableEntity), gin.H{"error": err.Error()})
+		return
+	}
+
+	track, err := a.AddTrack(path, OverrideTrackMetadata(override))
+	if err != nil {
+		a.rejectNewFile(path, rejected, err)
+		a.respondAddTrackError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"track": track})
+}
+
+// DeleteUpload handles: DELETE /new/uploads/:UploadID
+//
+// Response:
+//
+//   - 204: No Content
+//   - 404: Not Found: {error: "upload not found"}
+func (a *AudioFileStore) DeleteUpload(c *gin.Context) {
+	up, ok := a.uploads.get(c.Param("UploadID"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	a.uploads.remove(up.ID)
+	os.Remove(up.path)
+
+	c.Status(http.StatusNoContent)
+}
+
+// newUploadID returns a random hex ID.
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("newUploadID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,181 @@
+package audiofilestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"musicstore/metadata"
+	"musicstore/model"
+	"net/http"
+	"strconv"
+
+	"github.com/cdfmlr/crud/service"
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the progress of the uploads by POST /new: the
+// client creates an upload job (POST /new/jobs), sends the upload with
+// ?job={ID}, and polls GET /jobs/:JobID meanwhile for the bytes received
+// and the phase, e.g. for a progress bar of a large FLAC.
+
+const (
+	// uploadJobKey of the upload job of the request, in the gin context.
+	uploadJobKey = "musicstore/audiofilestore.uploadJob"
+	// maxRecordedResponse: the response of POST /new recorded into the
+	// upload job (the error, the track or the results).
+	maxRecordedResponse = 1 << 20 // 1 MiB
+)
+
+// PostUploadJob handles: POST /new/jobs
+//
+// It creates an upload job, to be given to POST /new?job={ID}: the job
+// is updated with the progress of the upload (BytesDone / BytesTotal of
+// the request body, and the Phase: receiving -> analyzing -> linking),
+// and finished with the resulting track (or results, or error).
+//
+// Response:
+//
+//   - 201: Created: {job: {ID: 42, Kind: "upload", Status: "pending", ...}}
+//   - 403: Forbidden: {error: "the store is read-only"}
+//   - 500: Internal Server Error: {error: "..."}
+func (a *AudioFileStore) PostUploadJob(c *gin.Context) {
+	job := &model.Job{
+		Kind:       model.JobKindUpload,
+		Status:     model.JobPending,
+		Store:      a.Name,
+		BytesTotal: -1,
+	}
+	if err := metadata.CreateJob(c, job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"job": job})
+}
+
+// trackUpload starts the upload job of the ?job= query of the request,
+// if any: the reading of the body is counted into it, and the response
+// is recorded for finishUpload. It responds and returns false if the
+// job is not a pending upload job of the store.
+func (a *AudioFileStore) trackUpload(c *gin.Context) bool {
+	if c.Query("job") == "" {
+		return true
+	}
+	id, err := strconv.ParseUint(c.Query("job"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad job: " + err.Error()})
+		return false
+	}
+
+	job, err := metadata.ClaimJob(c, model.JobKindUpload, a.ownJobs(), service.Where("id = ?", id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if job == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such pending upload job of the store"})
+		return false
+	}
+
+	job.Phase = model.JobPhaseReceiving
+	job.BytesTotal = c.Request.ContentLength // -1 if unknown
+	saveUploadProgress(job)
+
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{&progressReader{r: c.Request.Body, job: job}, c.Request.Body}
+	c.Writer = &responseRecorder{ResponseWriter: c.Writer}
+	c.Set(uploadJobKey, job)
+	return true
+}
+
+// uploadPhase sets the phase of the upload job of the request, if any.
+func uploadPhase(c *gin.Context, phase string) {
+	v, ok := c.Get(uploadJobKey)
+	if !ok {
+		return
+	}
+	job := v.(*model.Job)
+	if job.Phase != phase {
+		job.Phase = phase
+		saveUploadProgress(job)
+	}
+}
+
+// linkingPhase is an AddTrackOption setting the linking phase of the
+// upload job of the request: it's applied after the tags are read, and
+// then the file is hashed, checked for duplicates and linked.
+func linkingPhase(c *gin.Context) AddTrackOption {
+	return func(a *AudioFileStore, track *model.Track) {
+		uploadPhase(c, model.JobPhaseLinking)
+	}
+}
+
+// finishUpload finishes the upload job of the request, if any, by the
+// response: the track, or the results, or the error.
+func finishUpload(c *gin.Context) {
+	v, ok := c.Get(uploadJobKey)
+	if !ok {
+		return
+	}
+	job := v.(*model.Job)
+	rec, _ := c.Writer.(*responseRecorder)
+	if rec == nil {
+		return
+	}
+
+	var resp struct {
+		Error   string          `json:"error"`
+		Track   *model.Track    `json:"track"`
+		Results json.RawMessage `json:"results"`
+	}
+	json.Unmarshal(rec.body.Bytes(), &resp) // best effort
+
+	var err error
+	if rec.Status() >= http.StatusMultipleChoices {
+		if resp.Error == "" {
+			resp.Error = http.StatusText(rec.Status())
+		}
+		err = errors.New(resp.Error)
+	}
+	if resp.Track != nil {
+		job.TrackID = resp.Track.ID
+	}
+	if len(resp.Results) > 0 {
+		job.Results = string(resp.Results)
+	}
+
+	saveUploadProgress(job)
+	if err := metadata.FinishJob(context.Background(), job, err); err != nil {
+		logger.WithField("job", job.ID).WithError(err).Error("finishUpload: FinishJob failed")
+	}
+}
+
+// saveUploadProgress saves the bytes and the phase of the upload job.
+func saveUploadProgress(job *model.Job) {
+	if err := metadata.UpdateJobProgress(context.Background(), job); err != nil {
+		logger.WithField("job", job.ID).WithError(err).Warn("saveUploadProgress: UpdateJobProgress failed")
+	}
+}
+
+// responseRecorder records (the head of) the response body.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if n := maxRecordedResponse - r.body.Len(); n > 0 {
+		if len(b) < n {
+			n = len(b)
+		}
+		r.body.Write(b[:n])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
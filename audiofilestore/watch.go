@@ -0,0 +1,274 @@
+package audiofilestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"musicstore/metadata"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// this file implements the watcher importing the files dropped into the
+// FileDir (or the inbox in it), e.g. synced by rsync, without calling
+// the API.
+
+// DefaultWatchDebounce is the default AudioFileStore.WatchDebounce.
+const DefaultWatchDebounce = 2 * time.Second
+
+// WithWatch enables the watcher (see AudioFileStore.Watch) of the inbox,
+// a subdirectory of the FileDir ("" for the FileDir itself).
+// DefaultWatchDebounce is used if debounce is 0.
+func WithWatch(inbox string, debounce time.Duration) AudioFileStoreOption {
+	return func(a *AudioFileStore) {
+		a.Watch = true
+		a.WatchInbox = inbox
+		a.WatchDebounce = debounce
+	}
+}
+
+// watcher imports the new files in dir, once they are stable: not changed
+// (no events, same size and modification time) for the debounce.
+type watcher struct {
+	a        *AudioFileStore
+	dir      string
+	debounce time.Duration
+	fs       *fsnotify.Watcher
+
+	pending map[string]*pendingFile
+	failed  map[string]time.Time // path -> modification time when failed
+}
+
+type pendingFile struct {
+	lastEvent time.Time
+	size      int64
+	modTime   time.Time
+	checked   bool // size and modTime are set
+}
+
+// startWatcher starts watching the inbox, if Watch is enabled.
+func (a *AudioFileStore) startWatcher() error {
+	if !a.Watch || a.readOnly() {
+		return nil
+	}
+
+	dir := filepath.Join(a.FileDir, a.WatchInbox)
+	if !filepath.IsLocal(a.WatchInbox) && a.WatchInbox != "" {
+		return fmt.Errorf("startWatcher: inbox is not in the FileDir: %s", a.WatchInbox)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("startWatcher: MkdirAll failed: %w", err)
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("startWatcher: NewWatcher failed: %w", err)
+	}
+
+	w := &watcher{
+		a:        a,
+		dir:      dir,
+		debounce: a.WatchDebounce,
+		fs:       fsw,
+		pending:  map[string]*pendingFile{},
+		failed:   map[string]time.Time{},
+	}
+	if w.debounce <= 0 {
+		w.debounce = DefaultWatchDebounce
+	}
+
+	// files already in the inbox are imported as well,
+	// while the FileDir itself is loaded by LoadFromDir.
+	if err := w.addDir(dir, a.WatchInbox != ""); err != nil {
+		fsw.Close()
+		return fmt.Errorf("startWatcher: %w", err)
+	}
+
+	logger.WithField("store", a.Name).WithField("dir", dir).
+		Info("startWatcher: watching for new files")
+
+	a.watcher = w
+	go w.run()
+	return nil
+}
+
+// addDir watches the dir and its subdirectories,
+// and schedules the files in them to import, if withFiles.
+func (w *watcher) addDir(dir string, withFiles bool) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if w.ignored(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return w.fs.Add(path)
+		}
+		if withFiles {
+			w.touch(path)
+		}
+		return nil
+	})
+}
+
+// ignored: the tmp and trash dirs, hidden files (e.g. the temporary files
+// of rsync: .name.XXXXXX), symlinks (unless FollowSymlinks, see below),
+// and the files skipped by the ScanFilter.
+//
+// The targets of the symlinked dirs are not watched.
+func (w *watcher) ignored(path string) bool {
+	if path == w.dir {
+		return false
+	}
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return true
+	}
+
+	st, err := os.Lstat(path)
+	if err != nil {
+		return false // removed: handled as an event
+	}
+	if st.Mode()&os.ModeSymlink != 0 {
+		if !w.a.ScanFilter.FollowSymlinks {
+			return true
+		}
+		if st, err = os.Stat(path); err != nil || st.IsDir() {
+			return true
+		}
+	}
+
+	rel := relPath(w.a.FileDir, path)
+	if st.IsDir() {
+		return w.a.ScanFilter.skipDir(rel)
+	}
+	return w.a.ScanFilter.skipFile(rel)
+}
+
+// touch (re)schedules the file to import after the debounce.
+func (w *watcher) touch(path string) {
+	p, ok := w.pending[path]
+	if !ok {
+		p = &pendingFile{}
+		w.pending[path] = p
+	}
+	p.lastEvent = time.Now()
+}
+
+func (w *watcher) run() {
+	logger := logger.WithField("store", w.a.Name)
+
+	ticker := time.NewTicker(w.debounce / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			logger.WithError(err).Warn("watcher: fsnotify error")
+		case <-ticker.C:
+			w.importStable()
+		}
+	}
+}
+
+func (w *watcher) handle(event fsnotify.Event) {
+	path := event.Name
+	if w.ignored(path) {
+		return
+	}
+
+	switch {
+	case event.Has(fsnotify.Create):
+		if st, err := os.Stat(path); err == nil && st.IsDir() {
+			// a new dir (e.g. an album): its files may be there
+			// before it's watched
+			if err := w.addDir(path, true); err != nil {
+				logger.WithField("store", w.a.Name).WithField("dir", path).
+					WithError(err).Warn("watcher: addDir failed")
+			}
+			return
+		}
+		w.touch(path)
+	case event.Has(fsnotify.Write):
+		w.touch(path)
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		delete(w.pending, path)
+	}
+}
+
+// importStable imports the pending files that are stable.
+func (w *watcher) importStable() {
+	for path, p := range w.pending {
+		if time.Since(p.lastEvent) < w.debounce {
+			continue
+		}
+
+		st, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path) // gone
+			continue
+		}
+		if !p.checked || st.Size() != p.size || !st.ModTime().Equal(p.modTime) {
+			// still changing, e.g. written without events: check later
+			p.checked, p.size, p.modTime = true, st.Size(), st.ModTime()
+			p.lastEvent = time.Now()
+			continue
+		}
+
+		delete(w.pending, path)
+		if failedAt, ok := w.failed[path]; ok && failedAt.Equal(st.ModTime()) {
+			continue // failed already, and not changed since
+		}
+		w.importFile(path, st.ModTime())
+	}
+}
+
+func (w *watcher) importFile(path string, modTime time.Time) {
+	logger := logger.WithField("store", w.a.Name).WithField("path", path)
+
+	if !isMusicFile(path) {
+		logger.Debug("watcher: not a music file, ignored")
+		return
+	}
+
+	// files of the store, e.g. added by the API or the watcher itself
+	if u, err := w.a.audioUrl(path); err == nil {
+		shared, err := metadata.IsFileURLShared(context.Background(), 0, u) // 0: any track
+		if err == nil && shared {
+			return
+		}
+	}
+
+	track, err := w.a.AddTrack(path)
+	if err != nil {
+		w.failed[path] = modTime
+
+		var dup *DuplicateTrackError
+		if errors.As(err, &dup) {
+			logger.WithField("existing", dup.Existing.ID).
+				Info("watcher: track already exists, ignored")
+			return
+		}
+		logger.WithError(err).Warn("watcher: AddTrack failed")
+		return
+	}
+	delete(w.failed, path)
+
+	logger.WithField("ID", track.ID).Info("watcher: track imported")
+}
@@ -0,0 +1,198 @@
+package audiofilestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"musicstore/model"
+	"musicstore/sound"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the waveform peaks of the tracks, for rendering
+// seek bars: computed on the first request, and cached (see cached).
+
+const (
+	waveformCacheKind = "waveform"
+	waveformFile      = "waveform.json"
+	// waveformResolution: peaks computed and cached.
+	// Requests of fewer points are downsampled from them.
+	waveformResolution = 4096
+	// waveformDefaultPoints: peaks responded by default.
+	waveformDefaultPoints = 1000
+	// waveformMaxSeconds: longer tracks get no waveform. The whole audio
+	// is decoded in memory (4 bytes per sample) to compute it.
+	waveformMaxSeconds = 30 * 60
+	// waveformTimeout of decoding the audio.
+	waveformTimeout = 2 * time.Minute
+)
+
+// errWaveformTooLong: the track is longer than waveformMaxSeconds.
+var errWaveformTooLong = fmt.Errorf("the track is longer than %ds: no waveform", waveformMaxSeconds)
+
+// Waveform of a track.
+type Waveform struct {
+	Duration float64 // seconds
+	// Peaks are the max absolute amplitudes of the equal parts of the
+	// track, in [0, 255] (linear).
+	Peaks []uint8
+}
+
+// MarshalJSON: Peaks as numbers, not base64.
+func (w Waveform) MarshalJSON() ([]byte, error) {
+	peaks := make([]int, len(w.Peaks))
+	for i, p := range w.Peaks {
+		peaks[i] = int(p)
+	}
+	return json.Marshal(struct {
+		Duration float64
+		Peaks    []int
+	}{w.Duration, peaks})
+}
+
+func (w *Waveform) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Duration float64
+		Peaks    []int
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	w.Duration = v.Duration
+	w.Peaks = make([]uint8, len(v.Peaks))
+	for i, p := range v.Peaks {
+		w.Peaks[i] = uint8(p)
+	}
+	return nil
+}
+
+// downsample the peaks to n points (by the max), if there are more.
+func (w Waveform) downsample(n int) Waveform {
+	if n <= 0 || n >= len(w.Peaks) {
+		return w
+	}
+	peaks := make([]uint8, n)
+	for i := range peaks {
+		for _, p := range w.Peaks[i*len(w.Peaks)/n : (i+1)*len(w.Peaks)/n] {
+			peaks[i] = max8(peaks[i], p)
+		}
+	}
+	return Waveform{Duration: w.Duration, Peaks: peaks}
+}
+
+func max8(a, b uint8) uint8 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// waveform returns the waveform of the track, whose audio file is at
+// path, computing it if not cached, in waveformTimeout.
+func (a *AudioFileStore) waveform(ctx context.Context, track *model.Track, path string) (*Waveform, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	dir, err := a.cached(waveformCacheKind, cacheKey(track), func(dir string) error {
+		ctx, cancel := context.WithTimeout(ctx, waveformTimeout)
+		defer cancel()
+
+		// a second more: to tell the longer tracks
+		pcm, err := sound.Decode(ctx, path, waveformMaxSeconds+1)
+		if err != nil {
+			return err
+		}
+		if pcm.Duration() > waveformMaxSeconds {
+			return errWaveformTooLong
+		}
+		w := Waveform{Duration: pcm.Duration()}
+		for _, p := range pcm.Peaks(waveformResolution) {
+			w.Peaks = append(w.Peaks, uint8(math.Round(math.Min(p, 1)*255)))
+		}
+
+		data, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, waveformFile), data, 0644)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, waveformFile))
+	if err != nil {
+		return nil, err
+	}
+	w := new(Waveform)
+	if err := json.Unmarshal(data, w); err != nil {
+		return nil, fmt.Errorf("bad cached waveform: %w", err)
+	}
+	return w, nil
+}
+
+// GetTrackWaveform handles: GET /tracks/:TrackID/waveform
+//
+// It responds the waveform peaks of the track, computed on the first
+// request. Query:
+//
+//   - points: number of peaks, up to 4096. Default: 1000
+//   - format: json (default) or binary: the peaks as bytes
+//     (application/octet-stream), with the duration in the
+//     X-Duration header.
+//
+// Response:
+//
+//   - 200: OK: {Duration: 215.3, Peaks: [0, 12, 255, ...]}, peaks in [0, 255]
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "..."}: no such track, or file
+//   - 422: Unprocessable Entity: {error: "the audio file of the track is not in any store"},
+//     or the track is too long (over 30 minutes)
+//   - 500: Internal Server Error: {error: "..."}, e.g. ffmpeg not found
+func GetTrackWaveform(c *gin.Context) {
+	points := waveformDefaultPoints
+	if q := c.Query("points"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n <= 0 || n > waveformResolution {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("bad points: want 1 .. %d", waveformResolution)})
+			return
+		}
+		points = n
+	}
+
+	track, a, path, ok := trackFile(c)
+	if !ok {
+		return
+	}
+
+	w, err := a.waveform(c, track, path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the audio file of the track is missing"})
+		return
+	}
+	if errors.Is(err, errWaveformTooLong) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	*w = w.downsample(points)
+
+	if c.Query("format") == "binary" {
+		c.Header("X-Duration", strconv.FormatFloat(w.Duration, 'f', 3, 64))
+		c.Data(http.StatusOK, "application/octet-stream", w.Peaks)
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
@@ -0,0 +1,272 @@
+// Package auth implements the authentication of the API users by tokens,
+// and the role-based access control of the routes.
+//
+// Users are configured with a token and a role (see UseUsers). Requests
+// authenticate with the header "Authorization: Bearer {token}", or the
+// query ?access_token={token} for clients that can not set headers,
+// e.g. the <audio> elements. Without any user configured, the access
+// control is disabled: everyone is an admin.
+//
+// The write routes can be restricted to some networks as well
+// (see UseNetworks).
+//
+// Requests are scoped to a library (see model.DefaultLibrary), selected
+// by the header "X-Library" or the query ?library=, among the Libraries
+// of the user.
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/gin-gonic/gin"
+)
+
+var logger = log.ZoneLogger("musicstore/auth")
+
+// Roles of the users. Each role can do what the lower ones can:
+// listener < uploader < admin.
+const (
+	RoleListener = "listener" // read-only, and murecom
+	RoleUploader = "uploader" // + add tracks to the stores
+	RoleAdmin    = "admin"    // + everything else: edit / delete tracks, rescans, ...
+
+	// RolePublic is required by the public routes (see RequiredRole):
+	// no token needed, from any network.
+	RolePublic = ""
+)
+
+// levels of the roles, 0 for unknown ones.
+var levels = map[string]int{
+	RoleListener: 1,
+	RoleUploader: 2,
+	RoleAdmin:    3,
+}
+
+// CheckRole checks if the role is known.
+func CheckRole(role string) error {
+	if levels[role] == 0 {
+		return fmt.Errorf("unknown role %q: want %q, %q or %q",
+			role, RoleListener, RoleUploader, RoleAdmin)
+	}
+	return nil
+}
+
+// User of the API.
+type User struct {
+	Name  string
+	Token string
+	Role  string
+	// Libraries the user can access, the first one by default.
+	// Empty for all the libraries.
+	Libraries []string
+}
+
+// can checks if the user has the role (or a higher one).
+func (u *User) can(role string) bool {
+	return u != nil && levels[u.Role] >= levels[role]
+}
+
+var (
+	users     []User
+	anonymous *User // nil: requests without a token are rejected
+	usersMu   sync.RWMutex
+)
+
+// UseUsers sets the users of the API, replacing the old ones.
+//
+// anonymousRole is the role of the requests without a token, e.g.
+// "listener" to keep the audio files public for emomusic to download.
+// Empty to reject them. They access the model.DefaultLibrary only.
+func UseUsers(us []User, anonymousRole string) error {
+	for _, u := range us {
+		if u.Token == "" {
+			return fmt.Errorf("user %q: empty Token", u.Name)
+		}
+		if err := CheckRole(u.Role); err != nil {
+			return fmt.Errorf("user %q: %w", u.Name, err)
+		}
+	}
+	var anon *User
+	if anonymousRole != "" {
+		if err := CheckRole(anonymousRole); err != nil {
+			return fmt.Errorf("anonymous: %w", err)
+		}
+		anon = &User{Name: "anonymous", Role: anonymousRole, Libraries: []string{model.DefaultLibrary}}
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	users = us
+	anonymous = anon
+	return nil
+}
+
+// enabled checks if any user is configured.
+func enabled() bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return len(users) > 0
+}
+
+// lookup the user by the token. nil if not found.
+func lookup(token string) *User {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+
+	if token == "" {
+		return anonymous
+	}
+	for i := range users {
+		if subtle.ConstantTimeCompare([]byte(users[i].Token), []byte(token)) == 1 {
+			u := users[i]
+			return &u
+		}
+	}
+	return nil
+}
+
+// lookupBy finds the user of the name (any user if empty) whose token
+// passes the check. nil if not found.
+func lookupBy(name string, check func(token string) bool) *User {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+
+	for i := range users {
+		if name != "" && users[i].Name != name {
+			continue
+		}
+		if check(users[i].Token) {
+			u := users[i]
+			return &u
+		}
+	}
+	return nil
+}
+
+// requestToken gets the token of the request: from the Authorization
+// header, or the access_token query.
+func requestToken(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return c.Query("access_token")
+}
+
+// userKey of the authenticated user in the gin.Context.
+const userKey = "musicstore/auth.user"
+
+// UserOf returns the authenticated user of the request,
+// nil if the access control is disabled.
+func UserOf(c *gin.Context) *User {
+	if u, ok := c.Get(userKey); ok {
+		return u.(*User)
+	}
+	return nil
+}
+
+// Middleware authenticates the requests, and checks if the user has the
+// role required by the route (see RequiredRole), and if the client IP is
+// allowed for the write routes (see UseNetworks).
+// It should be used before registering the routes.
+//
+// Response (aborted):
+//
+//   - 401: Unauthorized: {error: "..."}: no or bad token
+//   - 403: Forbidden: {error: "..."}: the role of the user is not enough,
+//     the network of the client is not allowed, or the library selected
+//     is not accessible by the user
+func Middleware(c *gin.Context) {
+	if c.FullPath() == "" { // no route: 404
+		c.Next()
+		return
+	}
+
+	role := RequiredRole(c.Request.Method, c.FullPath())
+	if role == RolePublic {
+		c.Next()
+		return
+	}
+	if role != RoleListener && !ipAllowed(c.ClientIP()) {
+		logger.WithContext(c).WithField("ip", c.ClientIP()).
+			WithField("route", c.Request.Method+" "+c.FullPath()).
+			Info("Middleware: network not allowed")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden: network not allowed"})
+		return
+	}
+
+	if !enabled() {
+		library, _ := libraryScope(c, nil)
+		setLibraryScope(c, library)
+		c.Next()
+		return
+	}
+
+	user := lookup(requestToken(c))
+	if user == nil {
+		c.Header("WWW-Authenticate", `Bearer realm="musicstore"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized: missing or bad token"})
+		return
+	}
+
+	if !user.can(role) {
+		logger.WithContext(c).WithField("user", user.Name).WithField("role", user.Role).
+			WithField("route", c.Request.Method+" "+c.FullPath()).
+			Debug("Middleware: forbidden")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("forbidden: %s role required", role)})
+		return
+	}
+
+	library, err := libraryScope(c, user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	setLibraryScope(c, library)
+
+	c.Set(userKey, user)
+	c.Next()
+}
+
+// Errors of Authenticate.
+var (
+	ErrUnauthorized = errors.New("unauthorized: wrong username or password")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// Authenticate authenticates the request for the routes with their own
+// credentials, public to the Middleware (e.g. the Subsonic API): by the
+// user of the name (any user if empty) whose Token passes the check.
+// The user must have the role.
+//
+// As the Middleware, it sets the user and the library scope of the
+// request. Without any user configured, everyone passes.
+func Authenticate(c *gin.Context, name string, check func(token string) bool, role string) error {
+	if !enabled() {
+		library, _ := libraryScope(c, nil)
+		setLibraryScope(c, library)
+		return nil
+	}
+
+	user := lookupBy(name, check)
+	if user == nil {
+		return ErrUnauthorized
+	}
+	if !user.can(role) {
+		return fmt.Errorf("%w: %s role required", ErrForbidden, role)
+	}
+	library, err := libraryScope(c, user)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrForbidden, err)
+	}
+	setLibraryScope(c, library)
+
+	c.Set(userKey, user)
+	return nil
+}
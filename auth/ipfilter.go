@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// this file implements the IP allowlist and denylist of the write routes
+// (those requiring more than the listener role), e.g. to restrict uploads
+// and deletions to the internal network, while the reads are proxied to
+// the public (by murecom-gw4reader).
+
+var (
+	allowNets, denyNets []netip.Prefix
+	netsMu              sync.RWMutex
+)
+
+// UseNetworks sets the networks (CIDRs, e.g. "10.0.0.0/8", or IPs) allowed
+// and denied to request the write routes. Empty allow allows any network
+// not denied.
+func UseNetworks(allow, deny []string) error {
+	a, err := parsePrefixes(allow)
+	if err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	d, err := parsePrefixes(deny)
+	if err != nil {
+		return fmt.Errorf("deny: %w", err)
+	}
+
+	netsMu.Lock()
+	defer netsMu.Unlock()
+	allowNets, denyNets = a, d
+	return nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") { // a single IP
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// ipAllowed checks the client IP against the networks: not denied, and
+// allowed if there is an allowlist. Bad IPs are allowed only without
+// any list.
+func ipAllowed(ip string) bool {
+	netsMu.RLock()
+	defer netsMu.RUnlock()
+
+	if len(allowNets) == 0 && len(denyNets) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap() // ::ffff:10.0.0.1 -> 10.0.0.1
+
+	for _, p := range denyNets {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(allowNets) == 0 {
+		return true
+	}
+	for _, p := range allowNets {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"fmt"
+	"musicstore/model"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the library scope of the requests (see
+// model.LibraryOf): selected by the header "X-Library" or the query
+// ?library=, within the Libraries of the user.
+
+// requestLibrary gets the library selected by the request, "" for none.
+func requestLibrary(c *gin.Context) string {
+	if library := strings.TrimSpace(c.GetHeader("X-Library")); library != "" {
+		return library
+	}
+	return c.Query("library")
+}
+
+// libraryScope returns the library to scope the request of the user
+// (nil if the access control is disabled) to, "" for all libraries:
+//
+//   - users of all libraries (no Libraries): the selected one, if any
+//   - others: the selected one, which must be one of their Libraries,
+//     or the first of them by default
+func libraryScope(c *gin.Context, user *User) (string, error) {
+	selected := requestLibrary(c)
+	if user == nil || len(user.Libraries) == 0 {
+		return selected, nil
+	}
+	if selected == "" {
+		return user.Libraries[0], nil
+	}
+	for _, library := range user.Libraries {
+		if library == selected {
+			return selected, nil
+		}
+	}
+	return "", fmt.Errorf("forbidden: no access to the library %q", selected)
+}
+
+// setLibraryScope scopes the request to the library (if any).
+func setLibraryScope(c *gin.Context, library string) {
+	if library != "" {
+		c.Set(model.LibraryContextKey, library)
+	}
+}
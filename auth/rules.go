@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// this file implements the roles required by the routes.
+
+// rule: the route (gin.Context.FullPath, a path.Match pattern with "*"
+// for the store name) requested by the method requires the role.
+type rule struct {
+	Method string
+	Route  string
+	Role   string
+}
+
+// rules are checked in order, before the default ones (see RequiredRole).
+var rules = []rule{
+	// health checks, by the orchestrators and the load balancers
+	{http.MethodGet, "/healthz", RolePublic},
+	{http.MethodGet, "/readyz", RolePublic},
+
+	// the Subsonic API authenticates by itself (see Authenticate)
+	{http.MethodGet, "/rest/*", RolePublic},
+	{http.MethodPost, "/rest/*", RolePublic},
+
+	// the recommendations are read-only
+	{http.MethodPost, "/murecom/trajectory", RoleListener},
+
+	// uploads to the stores
+	{http.MethodPost, "/*/new", RoleUploader},
+	{http.MethodPost, "/*/new/jobs", RoleUploader},
+	{http.MethodPost, "/*/new/uploads", RoleUploader},
+	{http.MethodPatch, "/*/new/uploads/:UploadID", RoleUploader},
+	{http.MethodPost, "/*/new/uploads/:UploadID/commit", RoleUploader},
+	{http.MethodDelete, "/*/new/uploads/:UploadID", RoleUploader},
+}
+
+// RequiredRole returns the role required to request the route by the method:
+//
+//   - /admin/*, /debug/*: admin
+//   - the rules above, e.g. GET /readyz: public, POST /{store}/new: uploader
+//   - other GET and HEAD: listener
+//   - others, e.g. DELETE /tracks/:TrackID, POST /{store}/rescan: admin
+func RequiredRole(method, route string) string {
+	for _, prefix := range []string{"/admin", "/debug"} {
+		if route == prefix || strings.HasPrefix(route, prefix+"/") {
+			return RoleAdmin
+		}
+	}
+	for _, r := range rules {
+		if r.Method != method {
+			continue
+		}
+		if ok, _ := path.Match(r.Route, route); ok {
+			return r.Role
+		}
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RoleListener
+	}
+	return RoleAdmin
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"musicstore/analysis"
+	"musicstore/audiofilestore"
+	"musicstore/metadata"
+	"musicstore/murecom"
+	"musicstore/players"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the subcommands of musicstore. The operational
+// ones (scan, import, export, migrate, fsck) work on the database and
+// the files of the config offline, without the HTTP server.
+//
+// Tracks imported offline are saved with pending analysis jobs, which
+// are picked up by the analysis workers of the next `musicstore serve`
+// (-analyze defer), or run by the command (-analyze now) on the local
+// files, uploaded to emomusic: no HTTP server or public URL is needed.
+
+// command is a subcommand of musicstore.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the server (default)", runServe},
+	{"init", "write a starter config and create the directories", runInit},
+	{"scan", "import new files in the stores, update the changed and remove the missing ones", runScan},
+	{"import", "import audio files, directories or archives into a store", runImport},
+	{"export", "write a backup (tar.gz) of the database and the files", runExport},
+	{"migrate", "create or migrate the tables of the database", runMigrate},
+	{"fsck", "check (and repair) the stores against the database", runFsck},
+	{"worker", "run the analysis jobs dispatched by the server over NATS", runWorker},
+}
+
+// runCommand runs the command of args[0]. Without a command
+// (e.g. `musicstore -config x.yaml`), it serves.
+func runCommand(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+	}
+	printCommands()
+	if name != "help" {
+		os.Exit(2)
+	}
+	return nil
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "Usage: musicstore [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'musicstore [command] -h' for the flags of the command.")
+}
+
+// newFlagSet of the command, with the usage.
+func newFlagSet(name, description string) *flag.FlagSet {
+	set := flag.NewFlagSet("musicstore "+name, flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: musicstore %s [flags]\n%s\n\nFlags:\n", name, description)
+		set.PrintDefaults()
+	}
+	return set
+}
+
+// Modes of the analysis of the tracks imported offline (-analyze).
+const (
+	analyzeDefer = "defer" // by the next musicstore serve
+	analyzeNow   = "now"   // by the command, on the local files
+)
+
+// analyzeFlag adds the -analyze flag of the importing commands.
+func analyzeFlag(set *flag.FlagSet) *string {
+	return set.String("analyze", analyzeDefer,
+		"analysis of the imported tracks: defer (to the next serve) | now (by uploading the files to emomusic)")
+}
+
+// offline opens the database and creates the stores (without watching)
+// of the config, for the commands working without the server.
+// The stores are returned by name.
+//
+// With analyze now, the stores upload the files to emomusic
+// (see EmomusicUploadFile), for runAnalysis.
+func offline(configFile string, analyze string) (map[string]*audiofilestore.AudioFileStore, error) {
+	if analyze != analyzeDefer && analyze != analyzeNow {
+		return nil, fmt.Errorf("unknown -analyze %q: defer | now expected", analyze)
+	}
+
+	cfg := loadConfig(configFile)
+	analysisWorkers = cfg.Emomusic.Workers
+
+	if err := useLogLevels(cfg.Log.Level, cfg.Log.Zones); err != nil {
+		return nil, fmt.Errorf("useLogLevels failed: %w", err)
+	}
+	// the analyzers of the stores are checked against the registry
+	if err := startEmomusicClient(cfg.Emomusic); err != nil {
+		return nil, fmt.Errorf("startEmomusicClient failed: %w", err)
+	}
+	if err := startGenreClassifier(cfg.Genre); err != nil {
+		return nil, fmt.Errorf("startGenreClassifier failed: %w", err)
+	}
+	if err := registerAnalyzers(cfg.Analyzers); err != nil {
+		return nil, fmt.Errorf("registerAnalyzers failed: %w", err)
+	}
+	murecom.UseMoodPresets(cfg.Murecom.Moods)
+	useArtistRules(cfg.Artists)
+
+	dsn, err := cfg.Metadata.dsn()
+	if err != nil {
+		return nil, err
+	}
+	if err := metadata.Open(dsn); err != nil {
+		return nil, err
+	}
+
+	r := gin.New() // never served
+	stores := map[string]*audiofilestore.AudioFileStore{}
+	for _, afsCfg := range cfg.AudioFileStores {
+		afsCfg.Watch = false
+		if analyze == analyzeNow {
+			afsCfg.EmomusicUploadFile = true
+		}
+		// no workers: the jobs are of the server, if running
+		afs, err := newAudioFileStore(afsCfg, r, audiofilestore.WithOffline())
+		if err != nil {
+			return nil, err
+		}
+		stores[afsCfg.Name] = afs
+	}
+	return stores, nil
+}
+
+// workers of the analysis (Emomusic.Workers), for runAnalysis.
+var analysisWorkers int
+
+// runAnalysis runs the pending analysis jobs, if analyze now.
+func runAnalysis(analyze string) error {
+	if analyze != analyzeNow {
+		logger.Info("the analysis is deferred to the next musicstore serve.")
+		return nil
+	}
+
+	start := time.Now()
+	n, err := analysis.Drain(context.Background(), analysisWorkers)
+	logger.WithField("jobs", n).WithField("took", time.Since(start)).Info("analysis done.")
+	if err != nil {
+		return fmt.Errorf("analysis: %w (the remaining jobs are deferred)", err)
+	}
+	return nil
+}
+
+// selectStores returns the store of the name, or all if name is empty.
+func selectStores(stores map[string]*audiofilestore.AudioFileStore, name string) ([]*audiofilestore.AudioFileStore, error) {
+	if name == "" {
+		all := make([]*audiofilestore.AudioFileStore, 0, len(stores))
+		for _, afs := range stores {
+			all = append(all, afs)
+		}
+		return all, nil
+	}
+	afs, ok := stores[name]
+	if !ok {
+		return nil, fmt.Errorf("store not found: %s", name)
+	}
+	return []*audiofilestore.AudioFileStore{afs}, nil
+}
+
+// printJSON writes v to stdout, indented.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// runScan: musicstore scan [-store name] [-dry-run]
+func runScan(args []string) error {
+	set := newFlagSet("scan", "scans the FileDir of the stores: imports the new files,\nupdates the changed ones and removes the tracks of the missing ones.")
+	configFile := set.String("config", "config.yaml", "config file path")
+	store := set.String("store", "", "name of the store to scan (default: all)")
+	dryRun := set.Bool("dry-run", false, "only report what would be imported")
+	analyze := analyzeFlag(set)
+	set.Parse(args)
+
+	stores, err := offline(*configFile, *analyze)
+	if err != nil {
+		return err
+	}
+	selected, err := selectStores(stores, *store)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, afs := range selected {
+		var result any
+		if *dryRun {
+			result, err = afs.DryRun(ctx)
+		} else {
+			result, err = afs.Rescan(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("scan %s: %w", afs.Name, err)
+		}
+		printJSON(map[string]any{"store": afs.Name, "result": result})
+	}
+	if *dryRun {
+		return nil
+	}
+	return runAnalysis(*analyze)
+}
+
+// runImport: musicstore import -store name path...
+func runImport(args []string) error {
+	set := newFlagSet("import [paths...]", "imports the audio files, directories (recursively)\nand archives (.zip, .tar.gz) into the store,\nor the library of another player (-from).")
+	configFile := set.String("config", "config.yaml", "config file path")
+	store := set.String("store", "", "name of the store to import into (default: the only one)")
+	from := set.String("from", "files", "what the paths are: files | itunes (Library.xml) | navidrome (navidrome.db) | beets (library.db)")
+	pathMap := set.String("path-map", "", "old=new: rewrites the file paths in the library of the player,\ne.g. /music=/mnt/nas/music")
+	analyze := analyzeFlag(set)
+	set.Parse(args)
+
+	switch *from {
+	case "files", players.SourceITunes, players.SourceNavidrome, players.SourceBeets:
+	default:
+		return fmt.Errorf("import: unknown -from %q", *from)
+	}
+	mapFrom, mapTo, _ := strings.Cut(*pathMap, "=")
+	if *pathMap != "" && (mapFrom == "" || mapTo == "") {
+		return fmt.Errorf("import: bad -path-map %q: want old=new", *pathMap)
+	}
+	if set.NArg() == 0 {
+		set.Usage()
+		return errors.New("import: no path to import")
+	}
+
+	stores, err := offline(*configFile, *analyze)
+	if err != nil {
+		return err
+	}
+	if *store == "" && len(stores) != 1 {
+		return errors.New("import: -store is required with multiple stores")
+	}
+	selected, err := selectStores(stores, *store)
+	if err != nil {
+		return err
+	}
+	afs := selected[0]
+
+	failed := 0
+	for _, path := range set.Args() {
+		var results []audiofilestore.ImportResult
+		if *from != "files" {
+			lib, err := players.Read(*from, path)
+			if err != nil {
+				return err
+			}
+			if *pathMap != "" {
+				lib.MapPaths(mapFrom, mapTo)
+			}
+			report, err := afs.ImportPlayer(lib)
+			if err != nil {
+				return err
+			}
+			printJSON(map[string]any{"path": path, "report": report})
+			results = report.Tracks
+		} else {
+			results, err = afs.Import(path)
+			if err != nil {
+				return err
+			}
+			printJSON(map[string]any{"path": path, "results": results})
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				failed++
+			}
+		}
+	}
+	if err := runAnalysis(*analyze); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("import: %d files failed", failed)
+	}
+	return nil
+}
+
+// runExport: musicstore export [-files] [-o file]
+func runExport(args []string) error {
+	set := newFlagSet("export", "writes a backup (tar.gz) of the database and the manifest\nof the files in the stores, as POST /admin/backup.")
+	configFile := set.String("config", "config.yaml", "config file path")
+	withFiles := set.Bool("files", false, "include the audio files")
+	output := set.String("o", "", "output file (default: stdout)")
+	set.Parse(args)
+
+	if _, err := offline(*configFile, analyzeDefer); err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	return audiofilestore.WriteBackup(context.Background(), w, *withFiles)
+}
+
+// runMigrate: musicstore migrate
+func runMigrate(args []string) error {
+	set := newFlagSet("migrate", "creates or migrates the tables of the database.")
+	configFile := set.String("config", "config.yaml", "config file path")
+	set.Parse(args)
+
+	cfg := loadConfig(*configFile)
+	dsn, err := cfg.Metadata.dsn()
+	if err != nil {
+		return err
+	}
+	if err := metadata.Migrate(dsn); err != nil {
+		return err
+	}
+	logger.WithField("db", cfg.Metadata.DB).Info("migrate: done.")
+	return nil
+}
+
+// runFsck: musicstore fsck [-store name] [-relink] [-delete-orphans] [-mark-missing]
+func runFsck(args []string) error {
+	set := newFlagSet("fsck", "checks the stores against the database, as GET /admin/fsck,\nand repairs the problems by the flags. It exits with 1 if problems are found.")
+	configFile := set.String("config", "config.yaml", "config file path")
+	store := set.String("store", "", "name of the store to check (default: all)")
+	var opts audiofilestore.FsckRepairOptions
+	set.BoolVar(&opts.Relink, "relink", false, "repair: relink the moved files")
+	set.BoolVar(&opts.DeleteOrphans, "delete-orphans", false, "repair: delete the files of no track")
+	set.BoolVar(&opts.MarkMissing, "mark-missing", false, "repair: mark the tracks of missing files")
+	set.Parse(args)
+
+	if _, err := offline(*configFile, analyzeDefer); err != nil {
+		return err
+	}
+
+	var repair *audiofilestore.FsckRepairOptions
+	if opts.Relink || opts.DeleteOrphans || opts.MarkMissing {
+		repair = &opts
+	}
+	reports, repairs, err := audiofilestore.Fsck(context.Background(), *store, repair)
+	if err != nil {
+		return err
+	}
+	printJSON(map[string]any{"reports": reports, "repairs": repairs})
+
+	problems := 0
+	for _, report := range reports {
+		problems += report.Problems()
+	}
+	if problems > 0 && repair == nil {
+		fmt.Fprintf(os.Stderr, "fsck: %d problems found.\n", problems)
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+// Package client is the Go client of the musicstore API, for the other
+// services (murecom, chorus, ...) to list, upload and recommend tracks
+// without hand-rolling the requests. It has its own models of the
+// responses (see models.go): it doesn't depend on the server (gin, gorm).
+//
+//	c, err := client.New(client.Config{Server: "http://musicstore:8080/", Token: "..."})
+//	tracks, err := c.Murecom(ctx, client.MurecomQuery{Mood: "calm", Limit: 10})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config configures a Client.
+type Config struct {
+	// Server is the base URL of musicstore, with the PathPrefix if any,
+	// default: $MUSICSTORE_SERVER or http://localhost:8080/
+	Server string
+	// Token of the user (see Auth.Users), sent as a Bearer token.
+	Token string
+	// Timeout of a single http request. 0 means no timeout.
+	Timeout time.Duration
+	// Retry of the failed requests, see RetryPolicy.
+	Retry RetryPolicy
+	// HTTPClient overrides the http client, e.g. for a custom transport.
+	// Timeout is ignored if it's given.
+	HTTPClient *http.Client
+}
+
+// RetryPolicy controls the retries of the requests: on network errors,
+// 5xx and 429 responses. The uploads (POST /{store}/new) are not
+// idempotent: they're retried only on 429, refused before being handled. Zero fields are the defaults (3 retries, 1s
+// doubling up to 30s); use a negative MaxRetries to disable retrying.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Client calls the musicstore API. It's safe for concurrent use.
+// Construct it with New.
+type Client struct {
+	server *url.URL
+	token  string
+	http   *http.Client
+	retry  RetryPolicy
+}
+
+// New creates a Client.
+func New(cfg Config) (*Client, error) {
+	server := cfg.Server
+	if server == "" {
+		server = os.Getenv("MUSICSTORE_SERVER")
+	}
+	if server == "" {
+		server = "http://localhost:8080/"
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("New: bad Server: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("New: bad Server %q: want http(s)://host[:port][/prefix]", server)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	retry := cfg.Retry
+	if retry.MaxRetries == 0 {
+		retry.MaxRetries = 3
+	} else if retry.MaxRetries < 0 {
+		retry.MaxRetries = 0
+	}
+	if retry.InitialBackoff == 0 {
+		retry.InitialBackoff = time.Second
+	}
+	if retry.MaxBackoff == 0 {
+		retry.MaxBackoff = 30 * time.Second
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	return &Client{server: u, token: cfg.Token, http: httpClient, retry: retry}, nil
+}
+
+// StatusError is returned when musicstore responds with an error status.
+type StatusError struct {
+	StatusCode int
+	// Message is the "error" of the response body, or the body.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("musicstore: status %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound tells if err is a 404 response, or the 422 "record not
+// found" of the CRUD routes (e.g. GET /tracks/:TrackID).
+func IsNotFound(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusNotFound ||
+		statusErr.StatusCode == http.StatusUnprocessableEntity && statusErr.Message == "record not found"
+}
+
+// request to send: body is called for each attempt, to (re)open it.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   func() (io.Reader, string, error) // body, Content-Type
+	// nonIdempotent requests may have been handled despite a network
+	// error or a 5xx: only retried on 429.
+	nonIdempotent bool
+}
+
+// jsonBody encodes v as the JSON body of a request.
+func jsonBody(v any) func() (io.Reader, string, error) {
+	return func() (io.Reader, string, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+		return bytes.NewReader(b), "application/json", nil
+	}
+}
+
+// do sends the request, with retries, and decodes the JSON response
+// into out (if not nil).
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	backoff := c.retry.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.doOnce(ctx, req, out)
+		if err == nil || !isRetryable(req, err) || attempt >= c.retry.MaxRetries {
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", req.method, req.path, err)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s %s: %w (last error: %v)", req.method, req.path, ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.retry.MaxBackoff {
+			backoff = c.retry.MaxBackoff
+		}
+	}
+}
+
+// doOnce is a single attempt of do.
+func (c *Client) doOnce(ctx context.Context, req request, out any) error {
+	u := *c.server
+	u.Path += req.path
+	u.RawQuery = req.query.Encode()
+
+	var body io.Reader
+	contentType := ""
+	if req.body != nil {
+		var err error
+		if body, contentType, err = req.body(); err != nil {
+			return err
+		}
+		if closer, ok := body.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(b))
+		}
+		return &StatusError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("bad response: %w", err)
+	}
+	return nil
+}
+
+// isRetryable: network errors, 5xx and 429 Too Many Requests, or only
+// 429 if the request is nonIdempotent.
+func isRetryable(req request, err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode >= 500 && !req.nonIdempotent
+	}
+	if req.nonIdempotent {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
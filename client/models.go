@@ -0,0 +1,109 @@
+package client
+
+import "time"
+
+// this file implements the models of the responses: plain structs with
+// the JSON fields of the ones of the server (musicstore/model), so that
+// the client depends on neither the server nor gorm.
+
+// Track of the library, see Track.
+type Track struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UUID          string
+	MusicBrainzID string
+	SpotifyID     string
+	Library       string
+
+	Name          string
+	Artist        string
+	Album         string
+	Genre         string
+	CoverImageURL string
+	AudioFileURL  string
+	AudioFileHash string
+	FileMissing   bool
+	FileSize      int64
+	FileModTime   *time.Time
+
+	Emotion        Emotion
+	AnalysisStatus string // "" (not analyzed) | pending | done | failed
+	AnalyzedAt     *time.Time
+	BPM            float64
+	Loudness       Loudness
+	Cues           Cues
+
+	PlayCount    int
+	Rating       int
+	LastPlayedAt *time.Time
+}
+
+// Emotion of a track, or a point of a Trajectory.
+type Emotion struct {
+	Valence    float64 `json:"valence"`
+	Arousal    float64 `json:"arousal"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Loudness of a track (EBU R128), all zero if unknown.
+type Loudness struct {
+	LUFS       float64 `json:"lufs"`
+	ReplayGain float64 `json:"replay_gain"`
+	Peak       float64 `json:"peak"`
+}
+
+// Cues of a track, in seconds, all zero if unknown.
+type Cues struct {
+	AudioStart float64 `json:"audio_start"`
+	IntroEnd   float64 `json:"intro_end"`
+	OutroStart float64 `json:"outro_start"`
+	AudioEnd   float64 `json:"audio_end"`
+}
+
+// Job in background, e.g. the download of UploadTrackURL.
+type Job struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Kind    string // analysis | download | cover | upload
+	Status  string // pending | running | done | failed
+	TrackID uint
+	Error   string
+
+	Store      string
+	URL        string
+	BytesDone  int64
+	BytesTotal int64 // -1 if unknown
+	Phase      string
+	Results    string // JSON of the tracks of a downloaded archive
+}
+
+// Statuses of the jobs.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Playlist without its items, see PlaylistTracks.
+type Playlist struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Library string
+	Name    string
+	Source  string
+}
+
+// PlaylistItem: the track at the position of the playlist.
+type PlaylistItem struct {
+	ID         uint
+	PlaylistID uint
+	Position   int
+	TrackID    uint
+}
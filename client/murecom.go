@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// this file implements the calls of the recommendations: GET /murecom
+// and POST /murecom/trajectory.
+
+// MurecomQuery of Murecom: an emotion (Valence & Arousal), or a Mood
+// preset, with optional filters. Zero fields are left out.
+type MurecomQuery struct {
+	Valence, Arousal float64
+	Mood             string
+	MinBPM, MaxBPM   float64
+
+	MinConfidence    float64
+	ConfidenceWeight float64
+
+	Limit  int
+	Offset int
+	Cursor string // the nextCursor of the previous page
+
+	// Fields of the tracks to get, see ListOptions.
+	Fields []string
+}
+
+func (q MurecomQuery) values() url.Values {
+	v := url.Values{}
+	setFloat := func(key string, f float64) {
+		if f != 0 {
+			v.Set(key, strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	}
+	if q.Mood != "" {
+		v.Set("Mood", q.Mood)
+	} else {
+		v.Set("Valence", strconv.FormatFloat(q.Valence, 'f', -1, 64))
+		v.Set("Arousal", strconv.FormatFloat(q.Arousal, 'f', -1, 64))
+	}
+	setFloat("MinBPM", q.MinBPM)
+	setFloat("MaxBPM", q.MaxBPM)
+	setFloat("MinConfidence", q.MinConfidence)
+	setFloat("ConfidenceWeight", q.ConfidenceWeight)
+	if q.Limit > 0 {
+		v.Set("Limit", strconv.Itoa(q.Limit))
+	}
+	if q.Offset > 0 {
+		v.Set("Offset", strconv.Itoa(q.Offset))
+	}
+	if q.Cursor != "" {
+		v.Set("Cursor", q.Cursor)
+	}
+	if len(q.Fields) > 0 {
+		v.Set("fields", strings.Join(q.Fields, ","))
+	}
+	return v
+}
+
+// Murecom recommends tracks by emotion. nextCursor is the Cursor of the
+// next page, empty if there are no more.
+func (c *Client) Murecom(ctx context.Context, q MurecomQuery) (tracks []Track, nextCursor string, err error) {
+	var resp struct {
+		Tracks     []Track `json:"tracks"`
+		NextCursor string  `json:"nextCursor"`
+	}
+	err = c.do(ctx, request{method: http.MethodGet, path: "/murecom", query: q.values()}, &resp)
+	return resp.Tracks, resp.NextCursor, err
+}
+
+// Trajectory of emotions to follow, see Client.Trajectory: the Points,
+// or a ramp from Start to End over Duration (seconds).
+type Trajectory struct {
+	Points   []Emotion `json:",omitempty"`
+	Start    *Emotion  `json:",omitempty"`
+	End      *Emotion  `json:",omitempty"`
+	Duration int       `json:",omitempty"`
+	// TrackDuration: assumed seconds per track, default 240.
+	TrackDuration int `json:",omitempty"`
+}
+
+// Trajectory makes a playlist following the emotion trajectory.
+func (c *Client) Trajectory(ctx context.Context, t Trajectory) ([]Track, error) {
+	var resp struct {
+		Tracks []Track `json:"tracks"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: "/murecom/trajectory", body: jsonBody(t)}, &resp)
+	return resp.Tracks, err
+}
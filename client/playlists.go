@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// this file implements the calls of the playlists.
+
+// ListPlaylists lists the playlists, without their items.
+func (c *Client) ListPlaylists(ctx context.Context, opts ListOptions) ([]Playlist, error) {
+	var resp struct{ Playlists []Playlist }
+	err := c.do(ctx, request{method: http.MethodGet, path: "/playlists", query: opts.query()}, &resp)
+	return resp.Playlists, err
+}
+
+// PlaylistTracks gets the tracks of the playlist, in order.
+func (c *Client) PlaylistTracks(ctx context.Context, playlistID uint) ([]Track, error) {
+	var resp struct{ PlaylistItems []PlaylistItem }
+	path := "/playlists/" + strconv.FormatUint(uint64(playlistID), 10) + "/Items"
+	opts := ListOptions{OrderBy: "position"}
+	err := c.do(ctx, request{method: http.MethodGet, path: path, query: opts.query()}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]Track, 0, len(resp.PlaylistItems))
+	for _, item := range resp.PlaylistItems {
+		track, err := c.GetTrack(ctx, strconv.FormatUint(uint64(item.TrackID), 10))
+		if IsNotFound(err) { // deleted since
+			continue
+		}
+		if err != nil {
+			return tracks, err
+		}
+		tracks = append(tracks, *track)
+	}
+	return tracks, nil
+}
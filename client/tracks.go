@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// this file implements the calls of the tracks: listing, getting and
+// uploading them.
+
+// ListOptions pages, orders and filters the lists, see GET /tracks.
+type ListOptions struct {
+	Limit       int
+	Offset      int
+	OrderBy     string // field, e.g. id
+	Desc        bool
+	FilterBy    string // field, e.g. artist
+	FilterValue string
+	// Fields of the tracks to get, e.g. [ID Name Emotion]: the others are
+	// zero. Default: all.
+	Fields []string
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Offset > 0 {
+		q.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.OrderBy != "" {
+		q.Set("order_by", o.OrderBy)
+		q.Set("desc", strconv.FormatBool(o.Desc))
+	}
+	if o.FilterBy != "" {
+		q.Set("filter_by", o.FilterBy)
+		q.Set("filter_value", o.FilterValue)
+	}
+	if len(o.Fields) > 0 {
+		q.Set("fields", strings.Join(o.Fields, ","))
+	}
+	return q
+}
+
+// ListTracks lists the tracks, with the total count of the ones matching
+// the filter (regardless of the paging).
+func (c *Client) ListTracks(ctx context.Context, opts ListOptions) (tracks []Track, total int64, err error) {
+	q := opts.query()
+	q.Set("total", "true")
+
+	var resp struct {
+		Tracks []Track
+		Total  int64 `json:"total"`
+	}
+	err = c.do(ctx, request{method: http.MethodGet, path: "/tracks", query: q}, &resp)
+	return resp.Tracks, resp.Total, err
+}
+
+// GetTrack gets the track by its ID or UUID.
+func (c *Client) GetTrack(ctx context.Context, id string) (*Track, error) {
+	var resp struct{ Track *Track }
+	err := c.do(ctx, request{method: http.MethodGet, path: "/tracks/" + url.PathEscape(id)}, &resp)
+	return resp.Track, err
+}
+
+// AudioURL returns the URL of the audio of the track (by its ID or UUID):
+// GET /tracks/:TrackID/audio, for the players. The Token is not in it.
+func (c *Client) AudioURL(id string) string {
+	u := *c.server
+	u.Path += "/tracks/" + url.PathEscape(id) + "/audio"
+	return u.String()
+}
+
+// UploadTrack uploads the audio file at path to the store: POST
+// /{store}/new. Non-empty Name, Artist, Album and CoverImageURL of meta
+// (optional) override the tags of the file.
+func (c *Client) UploadTrack(ctx context.Context, store string, path string, meta *Track) (*Track, error) {
+	body := func() (io.Reader, string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, "", err
+		}
+		pr, pw := io.Pipe()
+		form := multipart.NewWriter(pw)
+		go func() {
+			defer f.Close()
+			err := writeMetaFields(form, meta)
+			if err == nil {
+				var part io.Writer
+				part, err = form.CreateFormFile("File", filepath.Base(path))
+				if err == nil {
+					_, err = io.Copy(part, f)
+				}
+			}
+			if err == nil {
+				err = form.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, form.FormDataContentType(), nil
+	}
+
+	var resp struct {
+		Track *Track `json:"track"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: "/" + store + "/new", body: body, nonIdempotent: true}, &resp)
+	return resp.Track, err
+}
+
+// UploadTrackURL makes the store download the audio file at audioURL, in
+// background: poll GetJob until the job is done (or failed) for the track.
+func (c *Client) UploadTrackURL(ctx context.Context, store string, audioURL string, meta *Track) (*Job, error) {
+	body := func() (io.Reader, string, error) {
+		pr, pw := io.Pipe()
+		form := multipart.NewWriter(pw)
+		go func() {
+			err := writeMetaFields(form, meta)
+			if err == nil {
+				err = form.WriteField("AudioFileURL", audioURL)
+			}
+			if err == nil {
+				err = form.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, form.FormDataContentType(), nil
+	}
+
+	var resp struct {
+		Job *Job `json:"job"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: "/" + store + "/new", body: body, nonIdempotent: true}, &resp)
+	return resp.Job, err
+}
+
+func writeMetaFields(form *multipart.Writer, meta *Track) error {
+	if meta == nil {
+		return nil
+	}
+	fields := [][2]string{
+		{"Name", meta.Name},
+		{"Artist", meta.Artist},
+		{"Album", meta.Album},
+		{"CoverImageURL", meta.CoverImageURL},
+	}
+	for _, f := range fields {
+		if f[1] == "" {
+			continue
+		}
+		if err := form.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetJob gets the background job (e.g. of UploadTrackURL), with its
+// track if any.
+func (c *Client) GetJob(ctx context.Context, id uint) (*Job, *Track, error) {
+	var resp struct {
+		Job   *Job   `json:"job"`
+		Track *Track `json:"track"`
+	}
+	path := "/jobs/" + strconv.FormatUint(uint64(id), 10)
+	err := c.do(ctx, request{method: http.MethodGet, path: path}, &resp)
+	return resp.Job, resp.Track, err
+}
@@ -1,33 +1,575 @@
 package main
 
 import (
-	"gopkg.in/yaml.v3"
 	"io"
+	"musicstore/auth"
+	"musicstore/metadata"
+	"musicstore/murecom"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type MusicstoreConfig struct {
-	HttpListenAddr  string
+	// HttpListenAddr: host:port, or a unix socket: unix:/run/musicstore.sock
+	HttpListenAddr string
+	// HttpSocketMode (octal, e.g. "0660") and HttpSocketGroup of the
+	// unix socket file, if listening on one.
+	HttpSocketMode  string
+	HttpSocketGroup string
+	HttpServer      HttpServerConfig
+	// PathPrefix mounts the whole API under it, e.g. /musicstore.
+	// It's appended to the BaseUrls of the stores as well.
+	PathPrefix      string
+	TLS             TLSConfig
+	CORS            CORSConfig
 	Metadata        MetadataConfig
 	AudioFileStores []AudioFileStoreConfig
+	Fetch           FetchConfig
+	Scan            ScanConfig
+	Artists         ArtistsConfig
 	Emomusic        EmomusicConfig
+	Genre           GenreConfig
+	Analyzers       []AnalyzerConfig
+	Murecom         MurecomConfig
+	Subsonic        SubsonicConfig
+	ImageProxy      ImageProxyConfig
+	Auth            AuthConfig
+	Debug           DebugConfig
+	Log             LogConfig
+	Health          HealthConfig
+	ErrorReporting  ErrorReportingConfig
+	Webhooks        []WebhookConfig
+	NATS            NATSConfig
+	Shutdown        ShutdownConfig
 }
 
+// Write the config as YAML, with the secrets redacted (see redacted):
+// it's printed on start.
 func (c *MusicstoreConfig) Write(dst io.Writer) error {
-	return yaml.NewEncoder(dst).Encode(&c)
+	return yaml.NewEncoder(dst).Encode(c.redacted())
+}
+
+// redactedValue replaces the secrets in the written config.
+const redactedValue = "REDACTED"
+
+// redacted returns a copy of the config without the secrets: the tokens
+// of the users, the webhook secrets, and the credentials (user info and
+// query) of the URLs and DSNs.
+func (c *MusicstoreConfig) redacted() *MusicstoreConfig {
+	r := *c
+
+	r.Auth.Users = make([]auth.User, len(c.Auth.Users))
+	for i, u := range c.Auth.Users {
+		if u.Token != "" {
+			u.Token = redactedValue
+		}
+		r.Auth.Users[i] = u
+	}
+	r.Webhooks = make([]WebhookConfig, len(c.Webhooks))
+	for i, w := range c.Webhooks {
+		w.URL = redactURL(w.URL)
+		if w.Secret != "" {
+			w.Secret = redactedValue
+		}
+		r.Webhooks[i] = w
+	}
+
+	r.Metadata.DB = redactURL(c.Metadata.DB)
+	r.ErrorReporting.DSN = redactURL(c.ErrorReporting.DSN)
+	r.NATS.URL = redactURL(c.NATS.URL)
+	r.Emomusic.Server = redactURL(c.Emomusic.Server)
+	r.Genre.Server = redactURL(c.Genre.Server)
+	return &r
+}
+
+// redactURL redacts the user info (e.g. user:password@, or the key of a
+// Sentry DSN) and the query values (e.g. ?token=, or the pragmas of
+// a DSN) of the URL.
+func redactURL(s string) string {
+	base, query, hasQuery := strings.Cut(s, "?")
+	if hasQuery {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return base + "?" + redactedValue
+		}
+		for k := range values {
+			values[k] = []string{redactedValue}
+		}
+		base += "?" + values.Encode()
+	}
+
+	u, err := url.Parse(base)
+	if err != nil || u.User == nil {
+		return base
+	}
+	u.User = url.User(redactedValue)
+	return u.String()
+}
+
+// complete fills the values derived from the others, after loading.
+func (c *MusicstoreConfig) complete() {
+	c.defaultBaseUrls()
+	c.prefixBaseUrls()
 }
 
 type MetadataConfig struct {
 	DB string
+	// pragmas of the sqlite database, see metadata.SQLiteOptions.
+	// JournalMode: default wal. BusyTimeout: default "5s".
+	// Synchronous: default normal (full if not wal).
+	// CacheSize: pages if > 0, KiB if < 0, default: of sqlite.
+	JournalMode string
+	BusyTimeout time.Duration
+	Synchronous string
+	CacheSize   int
+}
+
+// dsn of the database, with the pragmas.
+func (c MetadataConfig) dsn() (string, error) {
+	return metadata.DSN(c.DB, metadata.SQLiteOptions{
+		JournalMode: c.JournalMode,
+		BusyTimeout: c.BusyTimeout,
+		Synchronous: c.Synchronous,
+		CacheSize:   c.CacheSize,
+	})
+}
+
+// FetchConfig is the policy of fetching the URLs given by the clients,
+// see audiofilestore.FetchPolicy.
+type FetchConfig struct {
+	// AllowHosts: e.g. ["cdn.example.com", "*.example.org"], any if empty.
+	// Every outbound fetch is checked: include the hosts of the covers
+	// (musicbrainz.org, coverartarchive.org, *.archive.org) and the
+	// ImageProxy.AllowHosts.
+	AllowHosts []string
+	DenyHosts  []string
+	// AllowPrivate addresses (loopback, private, link-local), refused
+	// by default.
+	AllowPrivate bool
+	// MaxRedirects, default 5, negative for none.
+	MaxRedirects int
+	// Timeout of a download, default "30m".
+	Timeout time.Duration
+	// MaxBytes of a download (for stores without MaxUploadBytes),
+	// default 2 GiB.
+	MaxBytes int64
+}
+
+// ScanConfig is the antivirus scanner of the new files,
+// see audiofilestore.ScanPolicy.
+type ScanConfig struct {
+	// Clamd: "unix:/run/clamav/clamd.ctl" or "host:3310".
+	Clamd string
+	// Command, if no Clamd: the file is appended, exit code 1 if infected.
+	Command []string
+	// Quarantine the infected files in {FileDir}/.quarantine, instead
+	// of removing them.
+	Quarantine bool
+	// FailOpen accepts the files if the scanner fails.
+	FailOpen bool
+	// Timeout of a scan, default "5m".
+	Timeout time.Duration
+}
+
+// ArtistsConfig are the rules of normalizing the artist names of the
+// imported tracks, see model.ArtistRules. All off by default. And the
+// separators splitting them into the artists of the tracks.
+type ArtistsConfig struct {
+	// Space: trim and collapse the whitespace.
+	Space bool
+	// Width: full-width ASCII characters to half-width.
+	Width bool
+	// Featuring: the spelling of "feat." / "ft." / "featuring", e.g. "feat.".
+	Featuring string
+	// FoldCase: names differing only in the case are the same artist.
+	FoldCase bool
+	// Separators of the artists of a track in the names, default
+	// model.DefaultArtistSeparators, [] for none.
+	Separators []string
 }
 
 type AudioFileStoreConfig struct {
-	Name           string
-	FileDir        string
+	Name    string
+	FileDir string
+	// BaseUrl of the audio files, default: the url of HttpListenAddr
+	// (https with TLS, on the first ACME host).
 	BaseUrl        string
 	EnableEmomusic bool
 	LoadFromDir    bool
+	// LoadFromDirDryRun: LoadFromDir only logs what it would import,
+	// the duplicates and the filename collisions, without importing.
+	LoadFromDirDryRun bool
+
+	// EmomusicUploadFile uploads audio files to emomusic for analysis,
+	// for stores whose BaseUrl is not reachable by emomusic.
+	EmomusicUploadFile bool
+
+	// Analyzers to run on new tracks, in order: later ones are fallbacks.
+	// Names of built-in (emomusic, stub, heuristic, tempo, genre)
+	// or configured Analyzers.
+	// Default: [emomusic], or [heuristic] without Emomusic.Server
+	Analyzers []string
+
+	// MaxUploadBytes of an upload request, 0 for no limit.
+	MaxUploadBytes int64
+	// AllowedContentTypes of uploaded files, e.g. [audio/*, application/zip].
+	// Default: audio/*, archives and application/octet-stream.
+	AllowedContentTypes []string
+	// CacheControl header of the served audio files,
+	// default: "public, max-age=86400".
+	CacheControl string
+
+	// OnDuplicate: response to uploading an existing track:
+	// error (422, default) | existing (200 with it) | conflict (409 with it)
+	OnDuplicate string
+
+	// CacheMaxBytes of {FileDir}/.cache (HLS segments, waveforms): the
+	// least recently used entries are evicted beyond it.
+	// Default 10 GiB, -1 for no limit.
+	CacheMaxBytes int64
+
+	// TmpTTL: leftover files in {FileDir}/.tmp older than it are removed,
+	// e.g. "24h" (default).
+	TmpTTL time.Duration
+
+	// OnDelete: the files of deleted tracks are
+	// removed (default) | trashed (into {FileDir}/.trash) | kept
+	OnDelete string
+
+	// Watch the FileDir (or the WatchInbox subdirectory of it) for new
+	// files, e.g. synced by rsync, and import them automatically
+	// once they're not changed for WatchDebounce (default "2s").
+	Watch         bool
+	WatchInbox    string
+	WatchDebounce time.Duration
+
+	// ScanWorkers: files processed concurrently by LoadFromDir and rescans
+	// (default 4). ScanWriteRate limits the imports per second (0: no limit).
+	// The emotion analysis of the imported tracks runs in background,
+	// bounded by Emomusic.Workers.
+	ScanWorkers   int
+	ScanWriteRate float64
+
+	// DownloadWorkers: concurrent downloads of the URLs of POST /new
+	// (default 2).
+	DownloadWorkers int
+
+	// Include / Exclude: glob patterns of the files to scan in FileDir,
+	// e.g. Exclude: ["**/demo/**", "*.tmp.mp3"]. "**" matches any dirs,
+	// and a pattern without "/" matches the file name.
+	Include []string
+	Exclude []string
+	// SkipHidden: skip the files and dirs starting with a dot.
+	SkipHidden bool
+	// FollowSymlinks: scan the targets of symlinks, instead of skipping them.
+	FollowSymlinks bool
+
+	// FilenameTemplate names the stored audio files (extension appended):
+	// a Go template over the track, with funcs snake, lower, upper, trunc.
+	// e.g. "{{.ID}}", "{{slice .AudioFileHash 0 16}}",
+	// default: "{{snake .Name}}-{{snake .Artist}}-{{snake .Album}}"
+	FilenameTemplate string
+	// Layout of the stored audio files:
+	// flat (default) | artist/album: {FileDir}/{artist}/{album}/{filename}
+	Layout string
+	// LinkMode: how imported files are put into FileDir:
+	// hardlink (default) | copy | move | symlink.
+	// Hard links (and moves) across filesystems fall back to copies.
+	LinkMode string
+	// OnCollision: if the name of a new file is taken by another track:
+	// hash (default, append -{short hash}) | id (append -{ID}) | error
+	OnCollision string
+
+	// Library of the tracks added by the store, e.g. a household.
+	// Default: "default".
+	Library string
+
+	// FetchCovers of new tracks without one from the Cover Art Archive,
+	// by their MusicBrainz IDs, or searched by the album and the artist.
+	FetchCovers bool
+	// LocalizeCovers: store local copies of the external covers of new
+	// tracks (CoverImageURLs on other hosts rot or block hotlinking),
+	// and use them instead. Unused local covers are removed.
+	LocalizeCovers bool
+
+	// ReadOnly: only serve the files in FileDir, e.g. a shared mount.
+	// Uploads, rescans, the watcher and tag edits are disabled,
+	// and the files of deleted tracks are kept.
+	ReadOnly bool
 }
 
 type EmomusicConfig struct {
 	Server string
+	// ModelVersion of the emomusic deployment, recorded in the emotion
+	// history of tracks, e.g. to roll back a re-analysis by a bad model.
+	ModelVersion string
+	// Workers is the number of concurrent background analysis workers.
+	Workers int
+	// JobTimeout of the analyzers of a job (also on the remote workers),
+	// default "10m", -1 for none.
+	JobTimeout time.Duration
+
+	// Timeout of a request to emomusic, e.g. "2m".
+	Timeout time.Duration
+	// Proxy URL. Default: from HTTP_PROXY / HTTPS_PROXY env.
+	Proxy string
+	// TLS: extra CA certificates (PEM), client certificate (mTLS).
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	// Headers added to every request, e.g. Authorization.
+	Headers map[string]string
+
+	// MaxRetries for failed (5xx, network error) requests. -1 to disable.
+	MaxRetries int
+	// InitialBackoff before the first retry, doubled for each retry
+	// up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// BreakerThreshold consecutive failures trip the circuit breaker,
+	// which fails calls fast for BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// GenreConfig configures the optional genre classifier,
+// used by the "genre" analyzer.
+type GenreConfig struct {
+	// Server of the classifier. Empty to disable.
+	Server string
+	// Timeout of a request, e.g. "1m".
+	Timeout time.Duration
+	// Headers added to every request, e.g. Authorization.
+	Headers map[string]string
+
+	// Threshold is the minimum confidence of a predicted genre, in [0, 1].
+	Threshold float64
+	// MaxGenres to keep per track. 0 means no limit.
+	MaxGenres int
+}
+
+// AuthConfig configures the users of the API and their roles.
+// Empty Users to disable the access control.
+type AuthConfig struct {
+	// Users: Name, Token (for "Authorization: Bearer {token}"),
+	// Role: listener | uploader | admin, and Libraries they can access
+	// (the first one by default, empty for all).
+	Users []auth.User
+	// Anonymous: the role of the requests without a token,
+	// e.g. listener for emomusic to download the audio files.
+	// Empty (default) to reject them (401).
+	Anonymous string
+
+	// AllowNets / DenyNets: CIDRs (or IPs) of the clients allowed / denied
+	// to request the write routes (uploads, deletions, /admin, ...),
+	// e.g. AllowNets: [10.0.0.0/8, 127.0.0.1]. Empty AllowNets allows any.
+	AllowNets []string
+	DenyNets  []string
+	// TrustedProxies: CIDRs of the reverse proxies (e.g. murecom-gw4reader)
+	// whose X-Forwarded-For is trusted for the client IP.
+	// Empty to use the remote address.
+	TrustedProxies []string
+}
+
+// LogConfig configures the logs.
+type LogConfig struct {
+	// Format: text (default) | json, e.g. for log collectors.
+	Format string
+	// Level of the logs: trace | debug | info (default) | warn | error.
+	Level string
+	// Zones: levels of the zones (and their subzones), e.g.
+	// {musicstore/audiofilestore: debug, crud/db: warn}.
+	// Changeable at runtime by PUT /admin/loglevel.
+	Zones map[string]string
+}
+
+// HealthConfig configures the readiness check (GET /readyz).
+type HealthConfig struct {
+	// Emomusic: check that emomusic is reachable as well.
+	Emomusic bool
+}
+
+// ErrorReportingConfig configures the reporting of the panics and the
+// 5xx responses to an error tracker.
+type ErrorReportingConfig struct {
+	// DSN of Sentry (or a compatible tracker), empty to disable, e.g.
+	// https://{key}@o0.ingest.sentry.io/{project}
+	DSN         string
+	Environment string
+}
+
+// WebhookConfig is a target to POST the events of the library to, as
+// GET /events streams.
+type WebhookConfig struct {
+	URL string
+	// Secret to sign the POSTs by: X-Musicstore-Signature is the
+	// sha256={hex HMAC-SHA256 of the body}. Empty to not sign.
+	Secret string
+	// Events to POST: track.created, track.updated, track.deleted,
+	// analysis.completed. All by default.
+	Events []string
+}
+
+// NATSConfig connects musicstore to NATS: to publish the events of the
+// library, and to distribute the analysis jobs to remote workers
+// (musicstore worker).
+type NATSConfig struct {
+	// URL of the server, empty to disable:
+	// nats://[user:password@ | token@]host:4222, or tls://...
+	URL string
+	// Subject prefix, default "musicstore": the events are published to
+	// {Subject}.events.{type}, e.g. musicstore.events.track.created,
+	// and the analysis jobs to {Subject}.jobs.analysis.
+	Subject string
+	// Events: publish the events of the library.
+	Events bool
+	// Jobs: the analysis jobs are run by the remote workers, instead of
+	// the Emomusic.Workers of the server.
+	Jobs bool
+	// MaxInFlight: analysis jobs dispatched to the workers at a time,
+	// default 64.
+	MaxInFlight int
+	// JobTimeout: a job without result in it is dispatched again,
+	// default "10m".
+	JobTimeout time.Duration
+}
+
+// subject of the name under the Subject prefix.
+func (c NATSConfig) subject(name string) string {
+	prefix := c.Subject
+	if prefix == "" {
+		prefix = "musicstore"
+	}
+	return prefix + "." + name
+}
+
+// HttpServerConfig tunes the http.Server. Zero values are the defaults.
+type HttpServerConfig struct {
+	// ReadTimeout of a whole request, including the body (e.g. an
+	// upload): 0 for no limit (default), as uploads from slow clients
+	// may take long.
+	ReadTimeout time.Duration
+	// ReadHeaderTimeout of the headers of a request, default "10s":
+	// connections of clients that never send a request are closed.
+	ReadHeaderTimeout time.Duration
+	// WriteTimeout of a response (e.g. an audio file): 0 for no limit
+	// (default).
+	WriteTimeout time.Duration
+	// IdleTimeout of the keep-alive connections, default "2m".
+	IdleTimeout time.Duration
+	// MaxHeaderBytes of a request, default 1 MiB.
+	MaxHeaderBytes int
+	// MaxMultipartMemory: parts of a multipart form (e.g. an uploaded
+	// file) beyond it are stored in temporary files, default 32 MiB.
+	MaxMultipartMemory int64
+}
+
+// TLSConfig enables HTTPS on the HttpListenAddr.
+// Either the CertFile and the KeyFile, or the ACME should be set.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	ACME     ACMEConfig
+}
+
+// ACMEConfig obtains (and renews) the certificates automatically.
+type ACMEConfig struct {
+	// Hosts to get certificates for, e.g. [music.example.com].
+	// ACME is enabled if not empty.
+	Hosts []string
+	// Email of the account, for the notices of the CA.
+	Email string
+	// CacheDir keeps the account key and the certificates,
+	// default: "./acme-cache".
+	CacheDir string
+	// DirectoryURL of the CA, default: Let's Encrypt. e.g. the staging:
+	// https://acme-staging-v02.api.letsencrypt.org/directory
+	DirectoryURL string
+	// HTTPAddr serves the http-01 challenges, and redirects other
+	// requests to https, default ":80". "-" to disable (then only the
+	// tls-alpn-01 challenges on the HttpListenAddr are used).
+	HTTPAddr string
+}
+
+// CORSConfig enables the CORS headers for the Routes.
+type CORSConfig struct {
+	Enable bool
+	// AllowOrigins, e.g. [https://music.example.com, https://*.example.com],
+	// or ["*"] for all (default).
+	AllowOrigins []string
+	// AllowMethods, default: GET, POST, PUT, PATCH, DELETE, HEAD, OPTIONS.
+	AllowMethods []string
+	// AllowHeaders, default: Origin, Content-Length, Content-Type,
+	// Authorization, X-Request-ID, X-Library.
+	AllowHeaders []string
+	// ExposeHeaders to the scripts, e.g. [X-Request-ID, Content-Range].
+	ExposeHeaders    []string
+	AllowCredentials bool
+	// MaxAge of the preflight results, default "12h".
+	MaxAge time.Duration
+	// Routes: the path prefixes (without the PathPrefix) to enable
+	// CORS for, e.g. [/tracks, /murecom, /audio/audio]. All if empty.
+	Routes []string
+}
+
+// ShutdownConfig configures the graceful shutdown (on SIGINT / SIGTERM).
+type ShutdownConfig struct {
+	// Timeout to wait for the requests (e.g. uploads), imports, scans,
+	// downloads and analysis jobs in progress, default "30s".
+	// Downloads and analysis jobs interrupted are resumed on the next start.
+	Timeout time.Duration
+}
+
+// DebugConfig enables the debugging endpoints.
+type DebugConfig struct {
+	// Pprof mounts the net/http/pprof handlers under /debug/pprof
+	// (admin only), e.g. to profile the memory of long scans.
+	Pprof bool
+}
+
+// SubsonicConfig: the Subsonic API under /rest, for Subsonic clients.
+type SubsonicConfig struct {
+	// Enable the API. Users log in with their Auth.Users Name and Token.
+	Enable bool
+}
+
+// ImageProxyConfig: see imgproxy.Config.
+type ImageProxyConfig struct {
+	// Enable GET /imgproxy?url=...
+	Enable bool
+	// CacheDir of the fetched images, default: "./imgproxy-cache".
+	CacheDir string
+	// AllowHosts: e.g. ["i.scdn.co", "*.mzstatic.com"], none if empty.
+	// The Fetch policy applies too: no private addresses by default.
+	AllowHosts []string
+	// MaxBytes of an image, default 10 MiB.
+	MaxBytes int64
+	// CacheTTL: cached images are fetched again after it, default "168h".
+	CacheTTL time.Duration
+}
+
+type MurecomConfig struct {
+	// Moods are the named presets for GET /murecom?Mood=name.
+	// murecom.DefaultMoodPresets are used if empty.
+	Moods map[string]murecom.MoodPreset
+}
+
+// AnalyzerConfig registers an extra analyzer by Name.
+type AnalyzerConfig struct {
+	Name string
+	// Type: exec | stub
+	Type string
+	// exec: the command to run, the audio file (or url) is appended.
+	// It should print {"valence": 0.5, "arousal": 0.5} to stdout,
+	// optionally with "bpm".
+	Command []string
+	// stub: the emotion to give to every track.
+	Valence    float64
+	Arousal    float64
+	Confidence float64 // default 1
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the CORS config: off by default, as the gateway
+// (murecom-gw4reader) adds the CORS headers, and duplicate headers break
+// the browsers.
+
+// corsMiddleware of the config. The deprecated -cors flag enables it
+// with the defaults.
+func corsMiddleware(cfg CORSConfig) (gin.HandlerFunc, error) {
+	c := cors.Config{
+		AllowOrigins:     cfg.AllowOrigins,
+		AllowMethods:     cfg.AllowMethods,
+		AllowHeaders:     cfg.AllowHeaders,
+		ExposeHeaders:    cfg.ExposeHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		AllowWildcard:    true,
+		MaxAge:           cfg.MaxAge,
+	}
+	if len(c.AllowOrigins) == 0 || (len(c.AllowOrigins) == 1 && c.AllowOrigins[0] == "*") {
+		c.AllowOrigins = nil
+		c.AllowAllOrigins = true
+	}
+	if len(c.AllowMethods) == 0 {
+		c.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+	}
+	if len(c.AllowHeaders) == 0 {
+		c.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type",
+			"Authorization", "X-Request-ID", "X-Library"}
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 12 * time.Hour
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("CORS: %w", err)
+	}
+
+	handler := cors.New(c)
+	if len(cfg.Routes) == 0 {
+		return handler, nil
+	}
+
+	return func(c *gin.Context) {
+		for _, route := range cfg.Routes {
+			if pathUnder(c.Request.URL.Path, route) {
+				handler(c)
+				return
+			}
+		}
+		c.Next()
+	}, nil
+}
+
+// pathUnder checks if the path is the prefix or under it.
+func pathUnder(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/") || prefix == ""
+}
@@ -0,0 +1,121 @@
+package emomusic
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// This file implements a circuit breaker around the emomusic service:
+// after repeated failures, calls fail fast with ErrCircuitOpen for a
+// cooldown period instead of waiting for timeouts. After the cooldown,
+// one trial call is let through: success closes the circuit,
+// failure opens it again.
+
+// ErrCircuitOpen is returned when emomusic calls are not attempted
+// because the service is considered down.
+var ErrCircuitOpen = errors.New("emomusic: circuit breaker is open: service seems down")
+
+// BreakerPolicy controls the circuit breaker.
+type BreakerPolicy struct {
+	// Threshold is the number of consecutive failures that trips the breaker.
+	Threshold int
+	// Cooldown is how long the breaker stays open before a trial call.
+	Cooldown time.Duration
+}
+
+// DefaultBreakerPolicy is used if no policy is given by UseBreakerPolicy.
+var DefaultBreakerPolicy = BreakerPolicy{
+	Threshold: 5,
+	Cooldown:  1 * time.Minute,
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	policy   BreakerPolicy
+	failures int       // consecutive failures
+	openedAt time.Time // zero if closed
+	trialing bool      // a trial call is in flight (half-open)
+}
+
+var breaker = &circuitBreaker{policy: DefaultBreakerPolicy}
+
+// UseBreakerPolicy sets the circuit breaker policy.
+// Zero fields are filled with the values of DefaultBreakerPolicy.
+func UseBreakerPolicy(p BreakerPolicy) {
+	if p.Threshold <= 0 {
+		p.Threshold = DefaultBreakerPolicy.Threshold
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = DefaultBreakerPolicy.Cooldown
+	}
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.policy = p
+}
+
+// CircuitOpen tells if emomusic calls are currently failing fast.
+func CircuitOpen() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.isOpen()
+}
+
+// isOpen: open and not ready for a trial call. b.mu must be held.
+func (b *circuitBreaker) isOpen() bool {
+	return !b.openedAt.IsZero() &&
+		(b.trialing || time.Since(b.openedAt) < b.policy.Cooldown)
+}
+
+// acquire returns ErrCircuitOpen if the call should not be attempted.
+// After the cooldown, it lets one trial call through (half-open).
+func (b *circuitBreaker) acquire() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.isOpen() {
+		return ErrCircuitOpen
+	}
+	if !b.openedAt.IsZero() {
+		b.trialing = true
+	}
+	return nil
+}
+
+// release an acquired call without a result, e.g. canceled: a trial
+// call is let through again.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialing = false
+}
+
+// record the result of an attempted call.
+// Only retryable errors (i.e. the service is unhealthy) count as failures.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasTrial := b.trialing
+	b.trialing = false
+
+	if err == nil || !isRetryable(err) {
+		if !b.openedAt.IsZero() {
+			logger.Info("emomusic circuit breaker closed")
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+
+	b.failures++
+	if wasTrial || b.failures >= b.policy.Threshold {
+		if b.openedAt.IsZero() || wasTrial {
+			logger.WithField("failures", b.failures).
+				WithField("cooldown", b.policy.Cooldown).
+				Warn("emomusic circuit breaker opened")
+		}
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,155 @@
+package emomusic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// This file implements the configurable http client for emomusic.
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	// Server is the base URL of the emomusic server,
+	// default: http://localhost:8000/
+	Server string
+	// Timeout of a single http request. 0 means no timeout.
+	Timeout time.Duration
+	// Proxy URL, e.g. http://proxy:3128.
+	// Default: from the HTTP_PROXY / HTTPS_PROXY environment variables.
+	Proxy string
+
+	// CAFile is a PEM file of CA certificates to trust,
+	// in addition to the system ones.
+	CAFile string
+	// CertFile & KeyFile: client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables the server certificate verification.
+	InsecureSkipVerify bool
+
+	// Headers are added to every request, e.g. {Authorization: Bearer xxx}.
+	Headers map[string]string
+}
+
+// Client calls the emomusic API.
+// Construct it with NewClient.
+type Client struct {
+	server  string
+	http    *http.Client
+	headers http.Header
+}
+
+// NewClient creates a Client.
+func NewClient(cfg ClientConfig) (*Client, error) {
+	server := cfg.Server
+	if server == "" {
+		server = "http://localhost:8000/"
+	}
+	if _, err := url.Parse(server); err != nil {
+		return nil, fmt.Errorf("NewClient: bad Server: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("NewClient: bad Proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %w", err)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	headers := make(http.Header, len(cfg.Headers))
+	for k, v := range cfg.Headers {
+		headers.Set(k, v)
+	}
+
+	return &Client{
+		server:  server,
+		http:    &http.Client{Timeout: cfg.Timeout, Transport: transport},
+		headers: headers,
+	}, nil
+}
+
+func newTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CAFile failed: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CAFile")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate failed: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// endpoint returns the URL of the API path on the server.
+func (c *Client) endpoint(path string) (string, error) {
+	return url.JoinPath(c.server, path)
+}
+
+// do sends the request with the configured headers.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+	return c.http.Do(req)
+}
+
+// ErrNotConfigured is returned by the package level functions if no
+// client is set by Use.
+var ErrNotConfigured = errors.New("emomusic: client not configured")
+
+var (
+	defaultClient   *Client
+	defaultClientMu sync.RWMutex
+)
+
+// Use the client for the package level AnalyzeURI & AnalyzeFile.
+func Use(client *Client) {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+	defaultClient = client
+}
+
+// getDefaultClient returns the client set by Use, or ErrNotConfigured.
+func getDefaultClient() (*Client, error) {
+	defaultClientMu.RLock()
+	defer defaultClientMu.RUnlock()
+	if defaultClient == nil {
+		return nil, ErrNotConfigured
+	}
+	return defaultClient, nil
+}
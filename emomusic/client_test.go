@@ -0,0 +1,41 @@
+package emomusic
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNotConfigured(t *testing.T) {
+	Use(nil)
+	ctx := context.Background()
+	if _, err := AnalyzeFileContext(ctx, "a.mp3"); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("AnalyzeFileContext() error = %v, want ErrNotConfigured", err)
+	}
+	if _, err := AnalyzeURIContext(ctx, "http://localhost/a.mp3"); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("AnalyzeURIContext() error = %v, want ErrNotConfigured", err)
+	}
+	if err := Ping(ctx); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("Ping() error = %v, want ErrNotConfigured", err)
+	}
+}
+
+func TestNewClientServer(t *testing.T) {
+	t.Setenv("EMOMUSIC_SERVER", "http://from-env:8000/")
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{"", "http://localhost:8000/"}, // not the environment
+		{"http://emomusic:8000/", "http://emomusic:8000/"},
+	}
+	for _, tt := range tests {
+		c, err := NewClient(ClientConfig{Server: tt.server})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.server != tt.want {
+			t.Errorf("NewClient(%q).server = %q, want %q", tt.server, c.server, tt.want)
+		}
+	}
+}
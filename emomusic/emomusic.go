@@ -2,65 +2,76 @@ package emomusic
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"mime/multipart"
 	"musicstore/model"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+
+	"github.com/cdfmlr/crud/log"
 )
 
 // This file implements an API client for the emomusic API.
 
-// emomusicServerURL returns the emomusic server address.
-func emomusicServerURL() string {
-	s := os.Getenv("EMOMUSIC_SERVER")
-	if s == "" {
-		s = "http://localhost:8000/"
-	}
+var logger = log.ZoneLogger("musicstore/emomusic")
 
-	return s
+// POST {EMOMUSIC_SERVER}/predictmp3 with -F "file=@{mp3Filepath}"
+//
+// The emotion may come with a confidence, if emomusic reports it.
+//
+// Uploads the local file to emomusic. Use it when emomusic can not
+// reach the file by URL, i.e. AnalyzeURI does not work.
+//
+// Failed calls are retried according to the RetryPolicy.
+func AnalyzeFile(mp3Filepath string) (model.Emotion, error) {
+	return AnalyzeFileContext(context.Background(), mp3Filepath)
 }
 
-// emomusicPredictmp3URL returns the emomusic API address.
-func emomusicPredictmp3URL() string {
-	r, err := url.JoinPath(emomusicServerURL(), "predictmp3")
+// AnalyzeFileContext is AnalyzeFile, canceled (with the retries) when
+// the ctx is done.
+func AnalyzeFileContext(ctx context.Context, mp3Filepath string) (model.Emotion, error) {
+	c, err := getDefaultClient()
 	if err != nil {
-		panic(err)
+		return model.Emotion{}, err
 	}
-	return r
+	return c.AnalyzeFileContext(ctx, mp3Filepath)
 }
 
-func emomusicPredicturiURL() string {
-	r, err := url.JoinPath(emomusicServerURL(), "predicturi")
-	if err != nil {
-		panic(err)
-	}
-	return r
+// AnalyzeFile: see the package level AnalyzeFile.
+func (c *Client) AnalyzeFile(mp3Filepath string) (model.Emotion, error) {
+	return c.AnalyzeFileContext(context.Background(), mp3Filepath)
+}
 
+// AnalyzeFileContext: see the package level AnalyzeFileContext.
+func (c *Client) AnalyzeFileContext(ctx context.Context, mp3Filepath string) (model.Emotion, error) {
+	var emotion model.Emotion
+	err := withRetry(ctx, "AnalyzeFile", func() (err error) {
+		emotion, err = c.analyzeFile(ctx, mp3Filepath)
+		return err
+	})
+	return emotion, err
 }
 
-// DO NOT USE THIS FUNCTION. IT'S BUGGY.
-// 
-// FIXME: 422 Unprocessable Entity
-func AnalyzeFile(mp3Filepath string) (model.Emotion, error) {
+// analyzeFile is a single attempt of AnalyzeFile.
+func (c *Client) analyzeFile(ctx context.Context, mp3Filepath string) (model.Emotion, error) {
 	// build body
-	form, err := predictmp3RequestForm(mp3Filepath)
+	form, contentType, err := predictmp3RequestForm(mp3Filepath)
 	if err != nil {
 		return model.Emotion{}, err
 	}
 
 	// build request
-	client := &http.Client{}
-	req, err := predictmp3Request(form)
+	req, err := c.predictmp3Request(ctx, form, contentType)
 	if err != nil {
 		return model.Emotion{}, err
 	}
 
 	// send request
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return model.Emotion{}, err
 	}
@@ -69,7 +80,7 @@ func AnalyzeFile(mp3Filepath string) (model.Emotion, error) {
 	// check response
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return model.Emotion{}, fmt.Errorf("failed to call emomusic: status (%v) != 200: %s", resp.StatusCode, string(body))
+		return model.Emotion{}, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	// parse response
@@ -83,47 +94,93 @@ func AnalyzeFile(mp3Filepath string) (model.Emotion, error) {
 }
 
 // -F "file=@{mp3Filepath}"
-func predictmp3RequestForm(mp3Filepath string) (*bytes.Buffer, error) {
-	form := new(bytes.Buffer)
+//
+// contentType is "multipart/form-data; boundary=...",
+// the boundary must be sent in the Content-Type header.
+func predictmp3RequestForm(mp3Filepath string) (form *bytes.Buffer, contentType string, err error) {
+	form = new(bytes.Buffer)
 
 	writer := multipart.NewWriter(form)
 
-	fw, err := writer.CreateFormFile("file", mp3Filepath)
+	fw, err := writer.CreateFormFile("file", filepath.Base(mp3Filepath))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	fd, err := os.Open(mp3Filepath)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer fd.Close()
 
 	_, err = io.Copy(fw, fd)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	writer.Close()
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
 
-	return form, nil
+	return form, writer.FormDataContentType(), nil
 }
 
 // POST {EMOMUSIC_SERVER}/predictmp3 with {form}
-func predictmp3Request(form *bytes.Buffer) (*http.Request, error) {
-	req, err := http.NewRequest("POST", emomusicPredictmp3URL(), form)
+func (c *Client) predictmp3Request(ctx context.Context, form *bytes.Buffer, contentType string) (*http.Request, error) {
+	endpoint, err := c.endpoint("predictmp3")
 	if err != nil {
 		return nil, err
 	}
-	// req.Header.Set("Content-Type", "multipart/form-data")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
 
 	return req, nil
 }
 
 // GET {EMOMUSIC_SERVER}/predicturi?mp3={urlToMp3}
+//
+// Failed calls are retried according to the RetryPolicy.
 func AnalyzeURI(urlToMp3 string) (model.Emotion, error) {
+	return AnalyzeURIContext(context.Background(), urlToMp3)
+}
+
+// AnalyzeURIContext is AnalyzeURI, canceled (with the retries) when the
+// ctx is done.
+func AnalyzeURIContext(ctx context.Context, urlToMp3 string) (model.Emotion, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return model.Emotion{}, err
+	}
+	return c.AnalyzeURIContext(ctx, urlToMp3)
+}
+
+// AnalyzeURI: see the package level AnalyzeURI.
+func (c *Client) AnalyzeURI(urlToMp3 string) (model.Emotion, error) {
+	return c.AnalyzeURIContext(context.Background(), urlToMp3)
+}
+
+// AnalyzeURIContext: see the package level AnalyzeURIContext.
+func (c *Client) AnalyzeURIContext(ctx context.Context, urlToMp3 string) (model.Emotion, error) {
+	var emotion model.Emotion
+	err := withRetry(ctx, "AnalyzeURI", func() (err error) {
+		emotion, err = c.analyzeURI(ctx, urlToMp3)
+		return err
+	})
+	return emotion, err
+}
+
+// analyzeURI is a single attempt of AnalyzeURI.
+func (c *Client) analyzeURI(ctx context.Context, urlToMp3 string) (model.Emotion, error) {
 	// build query
-	fullUrl, err := url.Parse(emomusicPredicturiURL())
+	endpoint, err := c.endpoint("predicturi")
+	if err != nil {
+		return model.Emotion{}, err
+	}
+	fullUrl, err := url.Parse(endpoint)
 	if err != nil {
 		return model.Emotion{}, err
 	}
@@ -133,7 +190,11 @@ func AnalyzeURI(urlToMp3 string) (model.Emotion, error) {
 	fullUrl.RawQuery = params.Encode()
 
 	// send http request
-	resp, err := http.Get(fullUrl.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", fullUrl.String(), nil)
+	if err != nil {
+		return model.Emotion{}, err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return model.Emotion{}, err
 	}
@@ -141,7 +202,7 @@ func AnalyzeURI(urlToMp3 string) (model.Emotion, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return model.Emotion{}, fmt.Errorf("failed to call emomusic: status (%v) != 200: %s", resp.StatusCode, string(body))
+		return model.Emotion{}, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	// parse response
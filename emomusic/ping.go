@@ -0,0 +1,42 @@
+package emomusic
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// This file implements the reachability check of emomusic,
+// e.g. for the readiness of musicstore.
+
+// Ping checks if the emomusic server is reachable, by the default client.
+func Ping(ctx context.Context) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	return c.Ping(ctx)
+}
+
+// Ping: see the package level Ping.
+// Any response but a 5xx means reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	if CircuitOpen() {
+		return fmt.Errorf("Ping: %w", ErrCircuitOpen)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server, nil)
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("Ping: %s", resp.Status)
+	}
+	return nil
+}
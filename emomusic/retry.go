@@ -0,0 +1,141 @@
+package emomusic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// This file implements retries (with exponential backoff)
+// for the calls to the emomusic API.
+
+// RetryPolicy controls the retries of emomusic calls.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry.
+	// It doubles for each retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is used if no policy is given by UseRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+var (
+	retryPolicy   = DefaultRetryPolicy
+	retryPolicyMu sync.RWMutex
+)
+
+// UseRetryPolicy sets the retry policy for emomusic calls.
+// Zero fields are filled with the values of DefaultRetryPolicy,
+// except MaxRetries: use a negative MaxRetries to disable retrying.
+func UseRetryPolicy(p RetryPolicy) {
+	if p.MaxRetries == 0 {
+		p.MaxRetries = DefaultRetryPolicy.MaxRetries
+	} else if p.MaxRetries < 0 {
+		p.MaxRetries = 0
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+
+	retryPolicyMu.Lock()
+	defer retryPolicyMu.Unlock()
+	retryPolicy = p
+}
+
+func currentRetryPolicy() RetryPolicy {
+	retryPolicyMu.RLock()
+	defer retryPolicyMu.RUnlock()
+	return retryPolicy
+}
+
+// StatusError is returned when emomusic responds with a non-200 status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to call emomusic: status (%v) != 200: %s", e.StatusCode, e.Body)
+}
+
+// isRetryable tells if retrying may help:
+//
+//   - network errors (including timeouts): retryable
+//   - 5xx and 429 Too Many Requests: retryable
+//   - other status (4xx): permanent
+//   - anything else (e.g. bad response body): permanent
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// withRetry calls call until it succeeds, fails permanently,
+// or the retries are used up. The last error is returned.
+// It stops (between the attempts, or waiting for the next one)
+// when the ctx is done: the call should be canceled by the ctx.
+//
+// Each attempt goes through the circuit breaker: when it's open,
+// ErrCircuitOpen is returned without calling. Attempts canceled by
+// the ctx are not recorded: they tell nothing about the service.
+func withRetry(ctx context.Context, name string, call func() error) error {
+	policy := currentRetryPolicy()
+	backoff := policy.InitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := breaker.acquire(); err != nil {
+			return err
+		}
+		err := call()
+		if ctx.Err() != nil {
+			breaker.release()
+			return err
+		}
+		breaker.record(err)
+
+		if err == nil || !isRetryable(err) || attempt >= policy.MaxRetries {
+			return err
+		}
+
+		logger.WithField("call", name).
+			WithField("attempt", attempt+1).
+			WithField("backoff", backoff).
+			WithError(err).
+			Warn("emomusic call failed, retrying")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package errreport reports the errors (panics and 5xx responses of the
+// HTTP handlers) to an error tracker, e.g. Sentry (see NewSentry), with
+// the context of the requests.
+//
+// Use a Reporter by Use, and the Middleware in the router.
+package errreport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/gin-gonic/gin"
+)
+
+var logger = log.ZoneLogger("musicstore/errreport")
+
+// Event is an error to report.
+type Event struct {
+	Time    time.Time
+	Level   string // "error", or "fatal" for panics
+	Message string
+	Stack   string // of the panic, if any
+
+	// the request, if any
+	Method    string
+	URL       string
+	Route     string
+	Status    int
+	RequestID string
+	ClientIP  string
+	UserAgent string
+}
+
+// Reporter reports the events. Report should not block for long.
+type Reporter interface {
+	Report(ctx context.Context, event *Event)
+}
+
+var (
+	reporter   Reporter
+	reporterMu sync.RWMutex
+)
+
+// Use the reporter. nil to disable the reporting.
+func Use(r Reporter) {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+	reporter = r
+}
+
+// Report the event by the reporter in use, if any.
+func Report(ctx context.Context, event *Event) {
+	reporterMu.RLock()
+	r := reporter
+	reporterMu.RUnlock()
+
+	if r == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Level == "" {
+		event.Level = "error"
+	}
+	r.Report(ctx, event)
+}
+
+// requestIDKey: the request ID in the gin.Context, set by the request ID
+// middleware of musicstore (and crud).
+const requestIDKey = "request_id"
+
+// requestEvent makes the event of the request.
+func requestEvent(c *gin.Context, status int, message string) *Event {
+	return &Event{
+		Message:   message,
+		Method:    c.Request.Method,
+		URL:       redactedURL(c.Request.URL),
+		Route:     c.FullPath(),
+		Status:    status,
+		RequestID: c.GetString(requestIDKey),
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
+
+// credentialParams are the query params of credentials, never reported:
+// the access_token of the API, and the password (p), token (t) and salt
+// (s) of the Subsonic API, and the like.
+var credentialParams = map[string]bool{
+	"access_token": true, "token": true, "password": true, "secret": true,
+	"api_key": true, "apikey": true, "key": true, "signature": true,
+	"p": true, "t": true, "s": true,
+}
+
+// redactedURL is the URL of the request, with the values of the
+// credential query params redacted.
+func redactedURL(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for k := range query {
+		if credentialParams[strings.ToLower(k)] {
+			query[k] = []string{"REDACTED"}
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+	r := *u
+	r.RawQuery = query.Encode()
+	return r.String()
+}
+
+// Middleware reports the panics (re-panicked, for gin.Recovery to respond)
+// and the 5xx responses of the handlers, with the c.Errors if any.
+// It should be used right after gin.Recovery.
+func Middleware(c *gin.Context) {
+	defer func() {
+		if p := recover(); p != nil {
+			event := requestEvent(c, http.StatusInternalServerError, fmt.Sprintf("panic: %v", p))
+			event.Level = "fatal"
+			event.Stack = string(debug.Stack())
+			Report(c, event)
+			panic(p)
+		}
+	}()
+
+	c.Next()
+
+	if status := c.Writer.Status(); status >= http.StatusInternalServerError {
+		message := fmt.Sprintf("HTTP %d: %s %s", status, c.Request.Method, c.FullPath())
+		if len(c.Errors) > 0 {
+			message += ": " + c.Errors.String()
+		}
+		Report(c, requestEvent(c, status, message))
+	}
+}
@@ -0,0 +1,192 @@
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// this file implements a Reporter sending the events to Sentry (or any
+// tracker compatible with its envelope API, e.g. GlitchTip), by a DSN:
+//
+//	https://{public key}@{host}/{project ID}
+//
+// See https://develop.sentry.dev/sdk/envelopes/
+
+const (
+	sentryQueueSize = 64
+	sentryTimeout   = 10 * time.Second
+)
+
+// SentryConfig configures the Sentry reporter.
+type SentryConfig struct {
+	DSN         string
+	Environment string // e.g. production
+	Release     string // e.g. the version of musicstore
+}
+
+// Sentry reports the events to Sentry in background.
+// Events are dropped if the queue is full.
+type Sentry struct {
+	endpoint string // the envelope API
+	auth     string // X-Sentry-Auth header
+	cfg      SentryConfig
+	server   string // host name
+
+	http  *http.Client
+	queue chan *Event
+}
+
+// NewSentry parses the DSN and starts the sender.
+func NewSentry(cfg SentryConfig) (*Sentry, error) {
+	dsn, err := url.Parse(cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("NewSentry: bad DSN: %w", err)
+	}
+	key := dsn.User.Username()
+	project := strings.Trim(dsn.Path, "/")
+	if key == "" || project == "" || dsn.Host == "" {
+		return nil, errors.New("NewSentry: bad DSN: want {scheme}://{key}@{host}/{project}")
+	}
+
+	// {scheme}://{host}/{path prefix}/api/{project}/envelope/
+	prefix := ""
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/envelope/", dsn.Scheme, dsn.Host, prefix, project)
+
+	server, _ := os.Hostname()
+	s := &Sentry{
+		endpoint: endpoint,
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=musicstore/%s, sentry_key=%s", cfg.Release, key),
+		cfg:      cfg,
+		server:   server,
+		http:     &http.Client{Timeout: sentryTimeout},
+		queue:    make(chan *Event, sentryQueueSize),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Report queues the event to send.
+func (s *Sentry) Report(ctx context.Context, event *Event) {
+	select {
+	case s.queue <- event:
+	default:
+		logger.WithField("message", event.Message).Warn("Sentry: queue is full, event dropped")
+	}
+}
+
+func (s *Sentry) run() {
+	for event := range s.queue {
+		if err := s.send(event); err != nil {
+			logger.WithError(err).WithField("message", event.Message).
+				Warn("Sentry: send failed")
+		}
+	}
+}
+
+func (s *Sentry) send(event *Event) error {
+	body, err := s.envelope(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// envelope of the event: the headers of the envelope and of the item,
+// and the payload, each in a line.
+func (s *Sentry) envelope(event *Event) ([]byte, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	eventID := hex.EncodeToString(id)
+
+	payload, err := json.Marshal(s.payload(eventID, event))
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(map[string]any{
+		"event_id": eventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339),
+	})
+	item, _ := json.Marshal(map[string]any{
+		"type":         "event",
+		"length":       len(payload),
+		"content_type": "application/json",
+	})
+
+	var b bytes.Buffer
+	for _, line := range [][]byte{header, item, payload} {
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// payload of the event, in the Sentry event format.
+func (s *Sentry) payload(eventID string, event *Event) map[string]any {
+	p := map[string]any{
+		"event_id":    eventID,
+		"timestamp":   event.Time.UTC().Format(time.RFC3339),
+		"level":       event.Level,
+		"platform":    "go",
+		"logger":      "musicstore",
+		"server_name": s.server,
+		"message":     map[string]string{"formatted": event.Message},
+	}
+	if s.cfg.Environment != "" {
+		p["environment"] = s.cfg.Environment
+	}
+	if s.cfg.Release != "" {
+		p["release"] = s.cfg.Release
+	}
+
+	extra := map[string]any{}
+	if event.Stack != "" {
+		extra["stack"] = event.Stack
+	}
+	if event.Method != "" {
+		p["request"] = map[string]any{
+			"method":  event.Method,
+			"url":     event.URL,
+			"headers": map[string]string{"User-Agent": event.UserAgent},
+			"env":     map[string]string{"REMOTE_ADDR": event.ClientIP},
+		}
+		p["tags"] = map[string]string{
+			"route":      event.Route,
+			"status":     fmt.Sprint(event.Status),
+			"request_id": event.RequestID,
+		}
+		p["transaction"] = event.Method + " " + event.Route
+	}
+	if len(extra) > 0 {
+		p["extra"] = extra
+	}
+	return p
+}
@@ -0,0 +1,72 @@
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSentryEnvelope(t *testing.T) {
+	type request struct {
+		path, auth, contentType string
+		body                    []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.URL.Path, r.Header.Get("X-Sentry-Auth"), r.Header.Get("Content-Type"), body}
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "://", "://key@", 1) + "/sentry/42"
+	s, err := NewSentry(SentryConfig{DSN: dsn, Environment: "test", Release: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Report(context.Background(), &Event{
+		Time: time.Now(), Level: "error", Message: "boom",
+		Method: "GET", URL: "/tracks", Route: "/tracks", Status: 500,
+	})
+
+	var req request
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event sent")
+	}
+	if req.path != "/sentry/api/42/envelope/" {
+		t.Errorf("path = %q, want /sentry/api/42/envelope/", req.path)
+	}
+	if !strings.Contains(req.auth, "sentry_key=key") {
+		t.Errorf("X-Sentry-Auth = %q, want the sentry_key", req.auth)
+	}
+	if req.contentType != "application/x-sentry-envelope" {
+		t.Errorf("Content-Type = %q", req.contentType)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(req.body, []byte("\n")), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("envelope = %q, want 3 lines", req.body)
+	}
+	var header, item, payload map[string]any
+	for i, v := range []*map[string]any{&header, &item, &payload} {
+		if err := json.Unmarshal(lines[i], v); err != nil {
+			t.Fatalf("line %d %q: %v", i, lines[i], err)
+		}
+	}
+	if item["type"] != "event" || item["length"] != float64(len(lines[2])) {
+		t.Errorf("item header = %v, want an event of length %d", item, len(lines[2]))
+	}
+	if header["event_id"] == "" || header["event_id"] != payload["event_id"] {
+		t.Errorf("event_id = %v in the header, %v in the payload", header["event_id"], payload["event_id"])
+	}
+	if payload["release"] != "v1" || payload["transaction"] != "GET /tracks" {
+		t.Errorf("payload = %v", payload)
+	}
+}
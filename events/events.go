@@ -0,0 +1,244 @@
+// Package events publishes the lifecycle events of the library (tracks
+// created, updated, deleted, analyzed) to the subscribers, e.g. the
+// Server-Sent Events stream of GET /events, and the webhooks.
+//
+// Recent events are kept in memory, so that a subscriber can resume after
+// the last event it got (see Subscribe). Event IDs increase across restarts
+// (they start from the time of the start), but the events of the last run
+// are lost.
+package events
+
+import (
+	"context"
+	"musicstore/metadata"
+	"musicstore/model"
+	"sync"
+	"time"
+
+	"github.com/cdfmlr/crud/log"
+)
+
+var logger = log.ZoneLogger("musicstore/events")
+
+// Types of the events.
+const (
+	TrackCreated = "track.created"
+	TrackUpdated = "track.updated"
+	TrackDeleted = "track.deleted"
+	// AnalysisCompleted: an analysis job of the track is finished, see
+	// the AnalysisStatus of the track for the result.
+	AnalysisCompleted = "analysis.completed"
+)
+
+func isType(t string) bool {
+	switch t {
+	case TrackCreated, TrackUpdated, TrackDeleted, AnalysisCompleted:
+		return true
+	}
+	return false
+}
+
+// Event is a lifecycle event.
+type Event struct {
+	ID    uint64
+	Type  string
+	Time  time.Time
+	Track *model.Track `json:",omitempty"`
+}
+
+const (
+	// backlogSize: the number of the recent events kept for resuming.
+	backlogSize = 1024
+	// subscriberBuffer: events to a slow subscriber beyond it are dropped,
+	// and the subscriber is closed, to resume by the last event.
+	subscriberBuffer = 256
+)
+
+// Subscription receives the events published after Subscribe.
+// C is closed on Shutdown, or if the subscriber is too slow.
+type Subscription struct {
+	C <-chan Event
+
+	c chan Event
+}
+
+// bus of the events.
+type bus struct {
+	mu          sync.Mutex
+	lastID      uint64
+	backlog     []Event // ring buffer, the latest at (next - 1)
+	next        int
+	subscribers map[*Subscription]bool
+	closed      bool
+}
+
+var defaultBus = &bus{
+	lastID:      uint64(time.Now().UnixMilli()) << 10,
+	subscribers: map[*Subscription]bool{},
+}
+
+// Start publishes the events of the tracks.
+// It should be called after metadata.Start.
+func Start() {
+	publishOn := func(typ string) metadata.TrackHook {
+		return func(ctx context.Context, track *model.Track) {
+			Publish(typ, track)
+		}
+	}
+	metadata.OnTrackCreated(publishOn(TrackCreated))
+	metadata.OnTrackUpdated(publishOn(TrackUpdated))
+	metadata.OnTrackDeleted(publishOn(TrackDeleted))
+}
+
+// Publish an event of the track.
+func Publish(typ string, track *model.Track) {
+	defaultBus.publish(typ, track)
+}
+
+func (b *bus) publish(typ string, track *model.Track) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.lastID++
+	e := Event{ID: b.lastID, Type: typ, Time: time.Now(), Track: track}
+
+	if len(b.backlog) < backlogSize {
+		b.backlog = append(b.backlog, e)
+	} else {
+		b.backlog[b.next] = e
+	}
+	b.next = (b.next + 1) % backlogSize
+
+	for s := range b.subscribers {
+		select {
+		case s.c <- e:
+		default: // too slow: it resumes by the Last-Event-ID
+			logger.Warn("publish: subscriber is too slow, closed")
+			b.unsubscribe(s)
+		}
+	}
+}
+
+// Subscribe to the events after the lastID (0 for the new events only).
+// The missed events kept are returned. complete is false if some events
+// after the lastID are not kept any more (or were of the last run).
+func Subscribe(lastID uint64) (sub *Subscription, missed []Event, complete bool) {
+	return defaultBus.subscribe(lastID)
+}
+
+func (b *bus) subscribe(lastID uint64) (*Subscription, []Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan Event, subscriberBuffer)
+	sub := &Subscription{C: c, c: c}
+	if b.closed {
+		close(c)
+		return sub, nil, true
+	}
+	b.subscribers[sub] = true
+
+	if lastID == 0 || lastID >= b.lastID {
+		return sub, nil, true
+	}
+
+	// the backlog, oldest first
+	ordered := b.backlog
+	if len(b.backlog) == backlogSize {
+		ordered = append(append([]Event{}, b.backlog[b.next:]...), b.backlog[:b.next]...)
+	}
+
+	var missed []Event
+	for _, e := range ordered {
+		if e.ID > lastID {
+			missed = append(missed, e)
+		}
+	}
+	complete := len(ordered) > 0 && ordered[0].ID <= lastID+1
+	return sub, missed, complete
+}
+
+// Follow calls deliver for the events published from now on, one by one,
+// until stop is closed or Shutdown. A slow deliver does not block the
+// publishers: the events published meanwhile are resumed from the backlog.
+func Follow(stop <-chan struct{}, deliver func(Event)) {
+	var lastID uint64
+	for {
+		sub, missed, complete := Subscribe(lastID)
+		if lastID != 0 && !complete {
+			logger.Warn("Follow: some events are lost")
+		}
+		for _, e := range missed {
+			if isStopped(stop) {
+				break
+			}
+			deliver(e)
+			lastID = e.ID
+		}
+
+	receive:
+		for {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					break receive
+				}
+				deliver(e)
+				lastID = e.ID
+			case <-stop:
+				Unsubscribe(sub)
+				return
+			}
+		}
+
+		// C is closed if deliver is too slow: resume from the backlog,
+		// unless shutting down.
+		if isStopped(stop) || defaultBus.isClosed() {
+			return
+		}
+	}
+}
+
+func isStopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unsubscribe stops the events to the subscription, and closes its C.
+func Unsubscribe(sub *Subscription) {
+	defaultBus.mu.Lock()
+	defer defaultBus.mu.Unlock()
+	defaultBus.unsubscribe(sub)
+}
+
+func (b *bus) unsubscribe(sub *Subscription) {
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+func (b *bus) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Shutdown closes all the subscriptions, e.g. to end the event streams
+// before the server shuts down.
+func Shutdown() {
+	defaultBus.mu.Lock()
+	defer defaultBus.mu.Unlock()
+
+	defaultBus.closed = true
+	for sub := range defaultBus.subscribers {
+		defaultBus.unsubscribe(sub)
+	}
+}
@@ -0,0 +1,123 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heartbeatInterval: a comment is sent to idle streams, to keep the
+// connections through the proxies.
+const heartbeatInterval = 15 * time.Second
+
+// RegisterRoutes registers:
+//
+//   - GET /events: the Server-Sent Events stream of the events
+func RegisterRoutes(r gin.IRouter) {
+	r.GET("/events", GetEvents)
+}
+
+// GetEvents handles: GET /events
+//
+// It streams the events as Server-Sent Events: the event name is the Type
+// (e.g. track.created), the data is the Event in JSON, the id is the ID.
+//
+// Reconnecting with the header Last-Event-ID (or the query lastEventId)
+// resumes after that event. If the events since then are not kept any
+// more, a "reset" event is sent first: reload the state.
+//
+// Query:
+//
+//   - types: comma-separated types to stream, e.g. track.created,track.deleted. All by default.
+//
+// Only the events of the tracks in the library of the request are sent.
+//
+// Response:
+//
+//   - 200: OK: text/event-stream
+//   - 400: Bad Request: {error: "bad Last-Event-ID"}
+func GetEvents(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad Last-Event-ID"})
+			return
+		}
+		lastID = id
+	}
+
+	types := map[string]bool{}
+	for _, t := range strings.Split(c.Query("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	library := model.LibraryOf(c)
+	wanted := func(e Event) bool {
+		if len(types) > 0 && !types[e.Type] {
+			return false
+		}
+		return library == "" || e.Track == nil || e.Track.Library == "" || e.Track.Library == library
+	}
+
+	sub, missed, complete := Subscribe(lastID)
+	defer Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // nginx: do not buffer the stream
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range missed {
+		if wanted(e) {
+			writeEvent(w, e)
+		}
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return // shutting down, or too slow: the client reconnects
+			}
+			if !wanted(e) {
+				continue
+			}
+			writeEvent(w, e)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-c.Request.Context().Done():
+			return
+		}
+		w.Flush()
+	}
+}
+
+// writeEvent in the SSE format.
+func writeEvent(w gin.ResponseWriter, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		logger.WithError(err).Error("writeEvent: Marshal failed")
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
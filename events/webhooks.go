@@ -0,0 +1,200 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// this file implements the webhooks: the events are POSTed to the
+// targets configured, signed by their secrets.
+//
+// A POST has the Event in JSON as the body, and the headers:
+//
+//	X-Musicstore-Event: track.created
+//	X-Musicstore-Delivery: {event ID}
+//	X-Musicstore-Timestamp: {unix seconds of the attempt}
+//	X-Musicstore-Signature: sha256={hex HMAC-SHA256 of "{timestamp}.{body}" by the secret}
+//
+// The timestamp is signed with the body against replays: receivers
+// should reject the timestamps off by more than WebhookTolerance,
+// see VerifyWebhook.
+
+const (
+	webhookTimeout = 10 * time.Second
+	// webhookAttempts to deliver an event, with the delays doubled from
+	// webhookRetryDelay in between. The event is dropped after them.
+	webhookAttempts   = 4
+	webhookRetryDelay = time.Second
+)
+
+// WebhookTolerance of the timestamps of the webhooks: a delivery signed
+// earlier (or later, by clock skews) is rejected by VerifyWebhook.
+const WebhookTolerance = 5 * time.Minute
+
+// Errors of VerifyWebhook.
+var (
+	ErrWebhookSignature = errors.New("webhook: bad signature")
+	ErrWebhookTimestamp = errors.New("webhook: timestamp out of tolerance")
+)
+
+// Webhook is a target to POST the events to.
+type Webhook struct {
+	URL string
+	// Secret to sign the bodies, empty to not sign.
+	Secret string
+	// Types of the events to POST, all by default.
+	Types []string
+}
+
+// CheckWebhook returns an error if the webhook is invalid.
+func CheckWebhook(w Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("CheckWebhook: bad URL %q: %w", w.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("CheckWebhook: bad URL %q: want http(s)://host/...", w.URL)
+	}
+	for _, t := range w.Types {
+		if !isType(t) {
+			return fmt.Errorf("CheckWebhook: unknown event type %q", t)
+		}
+	}
+	return nil
+}
+
+var (
+	webhooksMu sync.Mutex
+	// stopWebhooks stops the senders in use.
+	stopWebhooks = func() {}
+)
+
+// UseWebhooks POSTs the events published from now on to the webhooks,
+// replacing the ones in use. nil to disable.
+func UseWebhooks(hooks []Webhook) error {
+	for _, h := range hooks {
+		if err := CheckWebhook(h); err != nil {
+			return err
+		}
+	}
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+
+	stopWebhooks()
+
+	stop := make(chan struct{})
+	client := &http.Client{Timeout: webhookTimeout}
+	for _, h := range hooks {
+		s := &webhookSender{Webhook: h, http: client, stop: stop, types: map[string]bool{}}
+		for _, t := range h.Types {
+			s.types[t] = true
+		}
+		go Follow(stop, s.deliver)
+	}
+	stopWebhooks = func() { close(stop) }
+	return nil
+}
+
+// webhookSender delivers the events to a webhook, one by one.
+type webhookSender struct {
+	Webhook
+	types map[string]bool // empty for all
+	http  *http.Client
+	stop  chan struct{}
+}
+
+// deliver the event, with retries.
+func (s *webhookSender) deliver(e Event) {
+	if len(s.types) > 0 && !s.types[e.Type] {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		logger.WithError(err).Error("webhook: Marshal failed")
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = s.post(e, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-s.stop:
+			return
+		}
+	}
+	logger.WithField("webhook", s.URL).WithField("event", e.ID).
+		WithError(err).Warn("webhook: delivery failed, event dropped")
+}
+
+func (s *webhookSender) post(e Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Musicstore-Event", e.Type)
+	req.Header.Set("X-Musicstore-Delivery", fmt.Sprint(e.ID))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Musicstore-Timestamp", timestamp)
+	if s.Secret != "" {
+		req.Header.Set("X-Musicstore-Signature", "sha256="+sign(s.Secret, timestamp, body))
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// sign the timestamp and the body: hex HMAC-SHA256 of "{timestamp}.{body}"
+// by the secret.
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a delivery of a webhook, by the headers and the
+// body received, for the receivers in Go: the signature must be of the
+// secret, and the timestamp within the WebhookTolerance of now.
+func VerifyWebhook(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Musicstore-Timestamp")
+	signature, ok := strings.CutPrefix(header.Get("X-Musicstore-Signature"), "sha256=")
+	if !ok || !hmac.Equal([]byte(signature), []byte(sign(secret, timestamp, body))) {
+		return ErrWebhookSignature
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrWebhookTimestamp, timestamp)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > WebhookTolerance || d < -WebhookTolerance {
+		return fmt.Errorf("%w: %s", ErrWebhookTimestamp, d)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package events
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header, body}
+	}))
+	defer server.Close()
+
+	s := &webhookSender{Webhook: Webhook{URL: server.URL, Secret: "s3cret"}, http: server.Client()}
+	if err := s.post(Event{ID: 1, Type: "track.created"}, []byte(`{"ID":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	d := <-deliveries
+	sent := time.Now()
+
+	tests := []struct {
+		name    string
+		secret  string
+		body    string
+		now     time.Time
+		edit    func(h http.Header)
+		wantErr error
+	}{
+		{name: "ok", secret: "s3cret", body: `{"ID":1}`, now: sent},
+		{name: "within the tolerance", secret: "s3cret", body: `{"ID":1}`, now: sent.Add(WebhookTolerance - time.Minute)},
+		{name: "replayed later", secret: "s3cret", body: `{"ID":1}`, now: sent.Add(WebhookTolerance + time.Minute), wantErr: ErrWebhookTimestamp},
+		{name: "from the future", secret: "s3cret", body: `{"ID":1}`, now: sent.Add(-WebhookTolerance - time.Minute), wantErr: ErrWebhookTimestamp},
+		{name: "other secret", secret: "other", body: `{"ID":1}`, now: sent, wantErr: ErrWebhookSignature},
+		{name: "body changed", secret: "s3cret", body: `{"ID":2}`, now: sent, wantErr: ErrWebhookSignature},
+		{
+			name: "timestamp changed", secret: "s3cret", body: `{"ID":1}`, now: sent.Add(time.Hour),
+			edit:    func(h http.Header) { h.Set("X-Musicstore-Timestamp", "9999999999") },
+			wantErr: ErrWebhookSignature,
+		},
+		{
+			name: "not signed", secret: "s3cret", body: `{"ID":1}`, now: sent,
+			edit:    func(h http.Header) { h.Del("X-Musicstore-Signature") },
+			wantErr: ErrWebhookSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := d.header.Clone()
+			if tt.edit != nil {
+				tt.edit(header)
+			}
+			err := VerifyWebhook(tt.secret, header, []byte(tt.body), tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyWebhook() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if string(d.body) != `{"ID":1}` || d.header.Get("X-Musicstore-Event") != "track.created" {
+		t.Errorf("delivery = %s %v", d.body, d.header)
+	}
+}
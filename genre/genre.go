@@ -0,0 +1,207 @@
+// Package genre is an API client for a genre classification service.
+//
+// The service is optional: it predicts the genres of tracks without
+// genre tags (see analysis.GenreAnalyzer).
+//
+// API:
+//
+//	POST {server}/predict -F "file=@{audio file}"
+//	GET  {server}/predicturi?uri={url to the audio}
+//
+// Both respond with the genres and their confidence, in [0, 1]:
+//
+//	[{"genre": "rock", "confidence": 0.83}, {"genre": "pop", "confidence": 0.12}]
+package genre
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Prediction is a predicted genre.
+type Prediction struct {
+	Genre      string  `json:"genre"`
+	Confidence float64 `json:"confidence"`
+}
+
+// ErrNotConfigured is returned by the package level functions if no
+// client is set by Use.
+var ErrNotConfigured = errors.New("genre: classifier not configured")
+
+// StatusError is returned for non-200 responses.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("genre: unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	// Server is the base URL of the classifier, required.
+	Server string
+	// Timeout of a single http request. 0 means no timeout.
+	Timeout time.Duration
+	// Headers are added to every request, e.g. {Authorization: Bearer xxx}.
+	Headers map[string]string
+}
+
+// Client calls the classifier API.
+// Construct it with NewClient.
+type Client struct {
+	server  string
+	http    *http.Client
+	headers http.Header
+}
+
+// NewClient creates a Client.
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if cfg.Server == "" {
+		return nil, errors.New("NewClient: Server is required")
+	}
+	if _, err := url.Parse(cfg.Server); err != nil {
+		return nil, fmt.Errorf("NewClient: bad Server: %w", err)
+	}
+
+	headers := make(http.Header, len(cfg.Headers))
+	for k, v := range cfg.Headers {
+		headers.Set(k, v)
+	}
+
+	return &Client{
+		server:  cfg.Server,
+		http:    &http.Client{Timeout: cfg.Timeout},
+		headers: headers,
+	}, nil
+}
+
+var (
+	defaultClient   *Client
+	defaultClientMu sync.RWMutex
+)
+
+// Use the client for the package level ClassifyFile & ClassifyURI.
+func Use(client *Client) {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+	defaultClient = client
+}
+
+func getDefaultClient() (*Client, error) {
+	defaultClientMu.RLock()
+	defer defaultClientMu.RUnlock()
+	if defaultClient == nil {
+		return nil, ErrNotConfigured
+	}
+	return defaultClient, nil
+}
+
+// ClassifyFile uploads the local audio file to the classifier.
+// The request is canceled when the ctx is done.
+func ClassifyFile(ctx context.Context, path string) ([]Prediction, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.ClassifyFile(ctx, path)
+}
+
+// ClassifyURI lets the classifier download the audio from the URL.
+// The request is canceled when the ctx is done.
+func ClassifyURI(ctx context.Context, uri string) ([]Prediction, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.ClassifyURI(ctx, uri)
+}
+
+// ClassifyFile: see the package level ClassifyFile.
+func (c *Client) ClassifyFile(ctx context.Context, path string) ([]Prediction, error) {
+	form := new(bytes.Buffer)
+	writer := multipart.NewWriter(form)
+
+	fw, err := writer.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	if _, err := io.Copy(fw, fd); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	endpoint, err := url.JoinPath(c.server, "predict")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return c.do(req)
+}
+
+// ClassifyURI: see the package level ClassifyURI.
+func (c *Client) ClassifyURI(ctx context.Context, uri string) ([]Prediction, error) {
+	endpoint, err := url.JoinPath(c.server, "predicturi")
+	if err != nil {
+		return nil, err
+	}
+	endpoint += "?uri=" + url.QueryEscape(uri)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// do sends the request with the configured headers,
+// and parses the predictions.
+func (c *Client) do(req *http.Request) ([]Prediction, error) {
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var predictions []Prediction
+	if err := json.NewDecoder(resp.Body).Decode(&predictions); err != nil {
+		return nil, err
+	}
+	return predictions, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"musicstore/audiofilestore"
+	"musicstore/emomusic"
+	"musicstore/metadata"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the health checks for the orchestrators and the
+// load balancers:
+//
+//	GET /healthz: liveness: the process is up
+//	GET /readyz: readiness: started, the DB reachable, the stores mounted
+//	             (and emomusic reachable, if Health.Emomusic)
+
+// healthCheckTimeout of each check of the readiness.
+const healthCheckTimeout = 2 * time.Second
+
+// started is set once all the services are started, including the
+// initial scans (LoadFromDir) of the stores.
+var started atomic.Bool
+
+// registerHealthRoutes registers the health check routes. They are
+// public (see auth.RequiredRole), and should be registered first, to
+// respond while the services are starting.
+func registerHealthRoutes(r gin.IRouter, checkEmomusic bool) {
+	r.GET("/healthz", getHealthz)
+	r.GET("/readyz", func(c *gin.Context) {
+		getReadyz(c, checkEmomusic)
+	})
+}
+
+// getHealthz handles: GET /healthz
+//
+// Response:
+//
+//   - 200: OK: {status: "ok"}
+func getHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// getReadyz handles: GET /readyz
+//
+// Response: the results of the checks, "ok" or the error:
+//
+//   - 200: OK: {status: "ready", checks: {startup: "ok", db: "ok", stores: "ok", emomusic: "ok"}}
+//   - 503: Service Unavailable: {status: "not ready", checks: {startup: "starting", stores: {main: "..."}, ...}}
+func getReadyz(c *gin.Context, checkEmomusic bool) {
+	checks := gin.H{}
+	ready := true
+	fail := func(name string, result any) {
+		checks[name] = result
+		ready = false
+	}
+
+	if started.Load() {
+		checks["startup"] = "ok"
+	} else {
+		fail("startup", "starting")
+	}
+
+	ctx, cancel := context.WithTimeout(c, healthCheckTimeout)
+	defer cancel()
+	if err := metadata.Ping(ctx); err != nil {
+		fail("db", err.Error())
+	} else {
+		checks["db"] = "ok"
+	}
+
+	if errs := audiofilestore.HealthCheck(); len(errs) > 0 {
+		stores := gin.H{}
+		for name, err := range errs {
+			stores[name] = err.Error()
+		}
+		fail("stores", stores)
+	} else {
+		checks["stores"] = "ok"
+	}
+
+	if checkEmomusic {
+		ctx, cancel := context.WithTimeout(c, healthCheckTimeout)
+		defer cancel()
+		if err := emomusic.Ping(ctx); err != nil {
+			fail("emomusic", err.Error())
+		} else {
+			checks["emomusic"] = "ok"
+		}
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+}
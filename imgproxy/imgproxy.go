@@ -0,0 +1,327 @@
+// Package imgproxy fetches, caches and re-serves remote images, e.g. the
+// CoverImageURLs on other hosts, so that web clients get them from the
+// musicstore: no mixed content (http images on https pages), no CORS or
+// hotlinking issues.
+//
+// API:
+//
+//	GET /imgproxy?url={url of the image}
+//
+// Only http(s) images (by the content) of the allowed hosts (none by
+// default), up to MaxBytes, are proxied. They're cached in CacheDir for CacheTTL, and
+// the stale ones are served if the remote fails.
+package imgproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"musicstore/audiofilestore"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/gin-gonic/gin"
+)
+
+var logger = log.ZoneLogger("musicstore/imgproxy")
+
+// Defaults of the Config.
+const (
+	DefaultMaxBytes = 10 << 20 // 10 MiB
+	DefaultCacheTTL = 7 * 24 * time.Hour
+	DefaultTimeout  = 30 * time.Second
+
+	// cacheControl of the served images.
+	cacheControl = "public, max-age=86400"
+)
+
+type Config struct {
+	// CacheDir keeps the fetched images.
+	CacheDir string
+	// AllowHosts: the hosts of the images to proxy, e.g. "i.scdn.co",
+	// or "*.example.com" for the subdomains. None if empty.
+	AllowHosts []string
+	// MaxBytes of an image. DefaultMaxBytes if 0.
+	MaxBytes int64
+	// CacheTTL: cached images older than it are fetched again.
+	// DefaultCacheTTL if 0.
+	CacheTTL time.Duration
+	// Timeout of fetching an image. DefaultTimeout if 0.
+	Timeout time.Duration
+	// Fetch GETs the URL, with the private addresses and the redirects
+	// checked, e.g. audiofilestore.Fetch. Required: a plain http.Client
+	// would fetch whatever the DNS names point to.
+	Fetch func(ctx context.Context, url string) (*http.Response, error)
+	// Done stops the sweeper of the CacheDir when closed.
+	Done <-chan struct{}
+}
+
+var (
+	errNotAllowed = errors.New("host not allowed")
+	errNotImage   = errors.New("not an image")
+	errTooLarge   = errors.New("image too large")
+)
+
+// proxy of the images, by the Config.
+type proxy struct {
+	Config
+
+	mu    sync.Mutex
+	locks map[string]*fileLock // of the cache files being fetched
+}
+
+// fileLock of a cache file, removed from the locks by the last holder.
+type fileLock struct {
+	sync.Mutex
+	refs int // holding or waiting, guarded by proxy.mu
+}
+
+// RegisterRoutes registers GET /imgproxy, and starts the sweeper of the
+// expired images in the CacheDir.
+func RegisterRoutes(r gin.IRouter, cfg Config) error {
+	if cfg.CacheDir == "" {
+		return errors.New("imgproxy: no CacheDir")
+	}
+	if cfg.Fetch == nil {
+		return errors.New("imgproxy: no Fetch")
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0755); err != nil {
+		return fmt.Errorf("imgproxy: MkdirAll failed: %w", err)
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = DefaultCacheTTL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	for _, pattern := range cfg.AllowHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("imgproxy: bad AllowHosts pattern %q: %w", pattern, err)
+		}
+	}
+
+	if len(cfg.AllowHosts) == 0 {
+		logger.Warn("no AllowHosts: every image is refused")
+	}
+
+	p := &proxy{
+		Config: cfg,
+		locks:  map[string]*fileLock{},
+	}
+	go p.sweep()
+
+	r.GET("/imgproxy", p.GetImage)
+	return nil
+}
+
+// GetImage handles: GET /imgproxy?url={url}
+//
+// Response:
+//
+//   - 200: OK: the image (or 304: Not Modified)
+//   - 400: Bad Request: {error: "..."}, not an http(s) URL
+//   - 403: Forbidden: {error: "host not allowed"}, or a private address
+//   - 413: Request Entity Too Large: {error: "image too large"}
+//   - 415: Unsupported Media Type: {error: "not an image"}
+//   - 502: Bad Gateway: {error: "..."}, failed to fetch it
+func (p *proxy) GetImage(c *gin.Context) {
+	u, err := url.Parse(c.Query("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url: not an http(s) URL"})
+		return
+	}
+	if !p.allowed(u.Hostname()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": errNotAllowed.Error()})
+		return
+	}
+
+	file, err := p.cached(c, u.String())
+	switch {
+	case errors.Is(err, audiofilestore.ErrFetchNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errNotImage):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", cacheControl)
+	c.Header("X-Content-Type-Options", "nosniff")
+	// the content type is sniffed: the cache files have no extensions
+	http.ServeContent(c.Writer, c.Request, "", st.ModTime(), f)
+}
+
+// allowed checks the host by the AllowHosts.
+func (p *proxy) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range p.AllowHosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cached returns the cache file of the image at the URL, fetching it if
+// not cached or expired. A stale one is returned if the fetch fails.
+func (p *proxy) cached(c *gin.Context, u string) (string, error) {
+	sum := sha256.Sum256([]byte(u))
+	file := filepath.Join(p.CacheDir, hex.EncodeToString(sum[:]))
+
+	unlock := p.lock(file)
+	defer unlock()
+
+	st, err := os.Stat(file)
+	if err == nil && time.Since(st.ModTime()) < p.CacheTTL {
+		return file, nil
+	}
+
+	if ferr := p.fetch(c, u, file); ferr != nil {
+		if err == nil { // stale
+			logger.WithField("url", u).WithError(ferr).Warn("fetch failed: serve the stale one")
+			return file, nil
+		}
+		return "", ferr
+	}
+	return file, nil
+}
+
+// fetch the image at the URL into the file.
+func (p *proxy) fetch(c *gin.Context, u string, file string) error {
+	ctx, cancel := context.WithTimeout(c, p.Timeout)
+	defer cancel()
+
+	resp, err := p.Fetch(ctx, u)
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch: unexpected status: %s", resp.Status)
+	}
+	if resp.ContentLength > p.MaxBytes {
+		return fmt.Errorf("%w: %d bytes", errTooLarge, resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, p.MaxBytes+1))
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	if int64(len(data)) > p.MaxBytes {
+		return fmt.Errorf("%w: more than %d bytes", errTooLarge, p.MaxBytes)
+	}
+	// by the content: the Content-Type of the remote can't be trusted
+	if ct := http.DetectContentType(data); !strings.HasPrefix(ct, "image/") {
+		return fmt.Errorf("%w: %s", errNotImage, ct)
+	}
+
+	// write then rename: never serve a partial file
+	tmp, err := os.CreateTemp(p.CacheDir, ".fetch-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// lock the cache file: one fetch of an image at a time.
+func (p *proxy) lock(file string) (unlock func()) {
+	p.mu.Lock()
+	l, ok := p.locks[file]
+	if !ok {
+		l = &fileLock{}
+		p.locks[file] = l
+	}
+	l.refs++
+	p.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(p.locks, file)
+		}
+	}
+}
+
+// sweep removes the images not fetched for two CacheTTLs (i.e. expired,
+// and not requested since then) from the CacheDir, hourly, until Done.
+func (p *proxy) sweep() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		p.sweepOnce()
+		select {
+		case <-ticker.C:
+		case <-p.Done:
+			return
+		}
+	}
+}
+
+// sweepOnce: see sweep.
+func (p *proxy) sweepOnce() {
+	entries, err := os.ReadDir(p.CacheDir)
+	if err != nil {
+		logger.WithError(err).Warn("sweep: ReadDir failed")
+		return
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < 2*p.CacheTTL {
+			continue
+		}
+		if os.Remove(filepath.Join(p.CacheDir, entry.Name())) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		logger.WithField("removed", removed).Info("sweep: expired images removed")
+	}
+}
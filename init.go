@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"musicstore/metadata"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// this file implements the `musicstore init` mode: a starter config.yaml
+// with comments, the audio directory and, optionally, the sqlite DB.
+
+// initOptions of `musicstore init`.
+type initOptions struct {
+	Dir      string // where the files are created
+	Config   string // config file name, in Dir
+	Addr     string // HttpListenAddr
+	BaseUrl  string // of the audio store
+	AudioDir string // FileDir of the audio store, in Dir
+	DB       string // sqlite DB file, in Dir
+	SqliteDB bool   // create the DB (tables) now
+	Force    bool   // overwrite an existing config
+}
+
+// runInit parses the args of `musicstore init` and runs it.
+func runInit(args []string) error {
+	var opts initOptions
+
+	set := newFlagSet("init", "writes a starter config and creates the directories to run musicstore with it.")
+	set.StringVar(&opts.Dir, "dir", ".", "directory to initialize")
+	set.StringVar(&opts.Config, "config", "config.yaml", "config file to write, in the dir")
+	set.StringVar(&opts.Addr, "addr", "127.0.0.1:8080", "http listen address")
+	set.StringVar(&opts.BaseUrl, "base-url", "", "base url of the audio files (default: http://{addr})")
+	set.StringVar(&opts.AudioDir, "audio", "audio", "audio directory, in the dir")
+	set.StringVar(&opts.DB, "db", "musicstore.db", "sqlite database file, in the dir")
+	set.BoolVar(&opts.SqliteDB, "sqlite", false, "create the sqlite database now")
+	set.BoolVar(&opts.Force, "force", false, "overwrite the existing config file")
+	set.Parse(args)
+
+	if opts.BaseUrl == "" {
+		opts.BaseUrl = "http://" + opts.Addr
+	}
+	return initLayout(opts)
+}
+
+// initLayout creates the config, the audio directory and the DB in opts.Dir.
+func initLayout(opts initOptions) error {
+	if err := os.MkdirAll(filepath.Join(opts.Dir, opts.AudioDir), 0o755); err != nil {
+		return fmt.Errorf("init: create audio dir failed: %w", err)
+	}
+
+	configPath := filepath.Join(opts.Dir, opts.Config)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if opts.Force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(configPath, flags, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("init: %s exists (use -force to overwrite it)", configPath)
+	}
+	if err != nil {
+		return fmt.Errorf("init: create config failed: %w", err)
+	}
+	defer f.Close()
+
+	if err := starterConfig.Execute(f, opts); err != nil {
+		return fmt.Errorf("init: write config failed: %w", err)
+	}
+	logger.WithField("file", configPath).Info("init: config written.")
+
+	if opts.SqliteDB {
+		dbPath := filepath.Join(opts.Dir, opts.DB)
+		if err := metadata.Migrate(dbPath); err != nil {
+			return fmt.Errorf("init: create database failed: %w", err)
+		}
+		logger.WithField("file", dbPath).Info("init: database created.")
+	}
+
+	fmt.Printf("\nmusicstore initialized in %s. Start it by:\n\n"+
+		"\tcd %s && musicstore -config %s\n\n"+
+		"and put audio files into %s, or upload them to %s/audio/new.\n",
+		opts.Dir, opts.Dir, opts.Config, opts.AudioDir, opts.BaseUrl)
+	return nil
+}
+
+// starterConfig is a minimal config with the commonly changed options.
+// See example-config.yaml for all of them.
+var starterConfig = template.Must(template.New("config.yaml").Parse(
+	`# musicstore config, generated by "musicstore init".
+# See example-config.yaml in the musicstore repo for all the options.
+
+# address to listen on
+HttpListenAddr: {{.Addr}}
+
+Metadata:
+  # sqlite database file, created if not exists
+  DB: ./{{.DB}}
+
+AudioFileStores:
+    # the files are served at {BaseUrl}/{Name}/{file},
+    # and uploaded to POST {BaseUrl}/{Name}/new
+  - Name: audio
+    FileDir: ./{{.AudioDir}}
+    # BaseUrl must start with proto://, and be reachable by the clients
+    # (and emomusic, unless EmomusicUploadFile)
+    BaseUrl: {{.BaseUrl}}
+    # import the files already in FileDir on start
+    LoadFromDir: true
+    # import the files dropped into FileDir later
+    Watch: true
+    # send the tracks to emomusic for emotion analysis
+    EnableEmomusic: true
+    EmomusicUploadFile: false
+
+Emomusic:
+  # emotion analysis server. Leave it empty to analyze by the
+  # built-in heuristic analyzer (WAV natively, others need ffmpeg).
+  Server: ""
+  Workers: 2
+
+Log:
+  # panic | fatal | error | warn | info | debug | trace
+  Level: info
+  # text | json
+  Format: text
+
+# Auth:
+#   # with users configured, requests need a token
+#   # (Authorization: Bearer {token} or ?access_token={token})
+#   Users:
+#     - Name: admin
+#       Token: change-me
+#       Role: admin  # listener | uploader | admin
+#   # role of the requests without a token
+#   Anonymous: listener
+`))
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// this file implements listening on the HttpListenAddr: a TCP address,
+// or a unix domain socket ("unix:/run/musicstore.sock"), e.g. behind a
+// local reverse proxy, without opening a TCP port.
+
+const unixAddrPrefix = "unix:"
+
+// unixSocketPath of the addr, if it's a unix socket.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixAddrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixAddrPrefix), true
+}
+
+// listen on the addr. The socket file of a unix socket is created with
+// the mode (octal, e.g. "0660") and the group, if set. A stale socket
+// file (of a crashed run) is removed first. The file is removed when the
+// listener is closed.
+func listen(addr string, mode string, group string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if st, err := os.Lstat(path); err == nil {
+		if st.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("listen: %s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen: %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("listen: remove stale socket failed: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := chmodSocket(path, mode, group); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// chmodSocket sets the mode and the group of the socket file.
+func chmodSocket(path string, mode string, group string) error {
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("bad HttpSocketMode %q: %w", mode, err)
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			return fmt.Errorf("chmod socket failed: %w", err)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return fmt.Errorf("bad HttpSocketGroup %q: %w", group, err)
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return errors.New("HttpSocketGroup: gid is not a number, unsupported on this platform")
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("chown socket failed: %w", err)
+		}
+	}
+	return nil
+}
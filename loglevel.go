@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// this file implements the levels of the zone loggers (log.ZoneLogger):
+// a default level, and per zone ones, changeable at runtime by
+// PUT /admin/loglevel.
+//
+// The zone loggers share the same logrus.Logger, so the Logger is set to
+// the most verbose level, and the entries below the level of their zones
+// are dropped by the formatter.
+
+// DefaultLogLevel of the zones without a level.
+const DefaultLogLevel = logrus.InfoLevel
+
+// zoneLevels is the logrus.Formatter filtering the entries by the levels.
+type zoneLevels struct {
+	mu    sync.RWMutex
+	def   logrus.Level
+	zones map[string]logrus.Level
+
+	next logrus.Formatter
+}
+
+var logLevels = &zoneLevels{def: DefaultLogLevel, zones: map[string]logrus.Level{}}
+
+// useLogLevels sets the default level and the levels of the zones, e.g.
+// {"musicstore/audiofilestore": "debug", "crud/db": "warn"}: a zone
+// applies to its subzones (e.g. "crud" to "crud/http") as well.
+// The levels set before are replaced.
+// It should be called after useLogFormat.
+func useLogLevels(def string, zones map[string]string) error {
+	if def == "" {
+		def = DefaultLogLevel.String()
+	}
+	if err := logLevels.reset(def, zones); err != nil {
+		return err
+	}
+
+	if log.Logger.Formatter != logLevels { // not yet
+		logLevels.next = log.Logger.Formatter
+		log.Logger.SetFormatter(logLevels)
+	}
+	return nil
+}
+
+// reset the levels to the default one and the zones.
+func (z *zoneLevels) reset(def string, zones map[string]string) error {
+	parsed := map[string]logrus.Level{}
+	for zone, level := range zones {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return fmt.Errorf("zone %q: %w", zone, err)
+		}
+		parsed[zone] = l
+	}
+
+	z.mu.Lock()
+	z.zones = parsed
+	z.mu.Unlock()
+
+	return z.set("", def)
+}
+
+// set the level of the zone ("" for the default one).
+// An empty level removes the level of the zone.
+func (z *zoneLevels) set(zone, level string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if level == "" && zone != "" {
+		delete(z.zones, zone)
+	} else {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return fmt.Errorf("zone %q: %w", zone, err)
+		}
+		if zone == "" {
+			z.def = l
+		} else {
+			z.zones[zone] = l
+		}
+	}
+
+	// the most verbose one passes the Logger
+	max := z.def
+	for _, l := range z.zones {
+		if l > max {
+			max = l
+		}
+	}
+	log.Logger.SetLevel(max)
+	return nil
+}
+
+// level of the zone: of the longest matching zone, or the default.
+func (z *zoneLevels) level(zone string) logrus.Level {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	for {
+		if l, ok := z.zones[zone]; ok {
+			return l
+		}
+		i := strings.LastIndex(zone, "/")
+		if i < 0 {
+			return z.def
+		}
+		zone = zone[:i]
+	}
+}
+
+// Format the entry by the next formatter, or drops it (nothing written)
+// if it's below the level of its zone.
+func (z *zoneLevels) Format(entry *logrus.Entry) ([]byte, error) {
+	zone, _ := entry.Data["zone"].(string)
+	if entry.Level > z.level(zone) {
+		return nil, nil
+	}
+	return z.next.Format(entry)
+}
+
+// LogLevels are the levels of the zones.
+type LogLevels struct {
+	Default string
+	Zones   map[string]string
+}
+
+func (z *zoneLevels) snapshot() LogLevels {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	levels := LogLevels{Default: z.def.String(), Zones: map[string]string{}}
+	for zone, l := range z.zones {
+		levels.Zones[zone] = l.String()
+	}
+	return levels
+}
+
+// LogLevelRequest changes the level of a zone.
+type LogLevelRequest struct {
+	// Zone, e.g. musicstore/audiofilestore. Empty for the default level.
+	Zone string
+	// Level: trace | debug | info | warn | error. Empty to remove the
+	// level of the Zone: it follows the default (or its parent zone) again.
+	Level string
+}
+
+// registerLogLevelRoutes registers GET and PUT /admin/loglevel.
+func registerLogLevelRoutes(r gin.IRouter) {
+	r.GET("/admin/loglevel", getLogLevel)
+	r.PUT("/admin/loglevel", putLogLevel)
+}
+
+// getLogLevel handles: GET /admin/loglevel
+//
+// Response:
+//
+//   - 200: OK: {levels: {Default: "info", Zones: {"crud/db": "warn", ...}}}
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"levels": logLevels.snapshot()})
+}
+
+// putLogLevel handles: PUT /admin/loglevel
+//
+// Body (JSON): LogLevelRequest, e.g.
+//
+//   - {"Level": "debug"}: the default level
+//   - {"Zone": "musicstore/audiofilestore", "Level": "debug"}
+//   - {"Zone": "musicstore/audiofilestore"}: remove the level of the zone
+//
+// Response:
+//
+//   - 200: OK: {levels: {Default: "info", Zones: {...}}}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "..."}: unknown level
+func putLogLevel(c *gin.Context) {
+	req := new(LogLevelRequest)
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := logLevels.set(req.Zone, req.Level); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	levels := logLevels.snapshot()
+	logger.WithContext(c).WithField("levels", levels).Warn("log levels changed")
+	c.JSON(http.StatusOK, gin.H{"levels": levels})
+}
@@ -2,9 +2,23 @@ package main
 
 import (
 	"context"
-	"flag"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"musicstore/analysis"
 	"musicstore/audiofilestore"
+	"musicstore/auth"
+	"musicstore/emomusic"
+	"musicstore/errreport"
+	"musicstore/events"
+	"musicstore/genre"
+	"musicstore/imgproxy"
 	"musicstore/metadata"
+	"musicstore/model"
+	"musicstore/murecom"
+	"musicstore/nats"
+	"musicstore/subsonic"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,50 +27,117 @@ import (
 
 	"github.com/cdfmlr/crud/config"
 	"github.com/cdfmlr/crud/log"
-	"github.com/cdfmlr/crud/router"
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 var logger = log.ZoneLogger("musicstore")
 
+// flags of musicstore serve
 var (
-	configFile = flag.String("config", "config.yaml", "config file path")
-	dryRun     = flag.Bool("dry-run", false, "print config and exit")
-	corsEnable = flag.Bool("cors", false, "enable cors")
+	configFile string
+	dryRun     bool
+	corsEnable bool
+	watchCfg   bool
 )
 
 func main() {
-	flag.Parse()
-	cfg := loadConfig(*configFile)
-	srv := startServices(cfg)
-	gracefulShoutdown(srv)
+	if err := runCommand(os.Args[1:]); err != nil {
+		logger.Fatal(err)
+	}
 }
 
-func loadConfig(configFile string) *MusicstoreConfig {
-	var cfg MusicstoreConfig
-	config.Init(&cfg, config.FromFile(configFile))
+// runServe runs the server: `musicstore serve`, or `musicstore` with
+// no command.
+func runServe(args []string) error {
+	set := newFlagSet("serve", "runs the server.")
+	set.StringVar(&configFile, "config", "config.yaml", "config file path")
+	set.BoolVar(&dryRun, "dry-run", false, "print config and exit")
+	set.BoolVar(&corsEnable, "cors", false, "enable cors (deprecated: the CORS config)")
+	set.BoolVar(&watchCfg, "watch-config", false, "reload config on changes of the file (as on SIGHUP)")
+	set.Parse(args)
 
-	logger.Info("config loaded.")
+	cfg := loadConfig(configFile)
 	cfg.Write(os.Stdout)
+	if dryRun {
+		return nil
+	}
+
+	srv, r := startServices(cfg)
 
-	if *dryRun {
-		os.Exit(0)
+	rl := &reloader{path: configFile, cfg: cfg, r: r}
+	if watchCfg {
+		if err := rl.watch(); err != nil {
+			return fmt.Errorf("watch config failed: %w", err)
+		}
 	}
+	gracefulShoutdown(srv, cfg.Shutdown.Timeout, rl.reload)
+	return nil
+}
+
+func loadConfig(configFile string) *MusicstoreConfig {
+	var cfg MusicstoreConfig
+	config.Init(&cfg, config.FromFile(configFile))
+	cfg.complete()
 
+	logger.Info("config loaded.")
 	return &cfg
 }
 
-func startServices(cfg *MusicstoreConfig) *http.Server {
-	logger.Info("starting musicstore...")
+func startServices(cfg *MusicstoreConfig) (*http.Server, *gin.Engine) {
+	info := buildInfo()
+	logger.WithField("version", info.Version).WithField("commit", info.Commit).
+		WithField("buildTime", info.BuildTime).Info("starting musicstore...")
 
-	r := router.NewRouter()
+	if err := useLogFormat(cfg.Log.Format); err != nil {
+		logger.Fatalf("useLogFormat failed: %v", err)
+	}
+	if err := useLogLevels(cfg.Log.Level, cfg.Log.Zones); err != nil {
+		logger.Fatalf("useLogLevels failed: %v", err)
+	}
+	if err := startErrorReporting(cfg.ErrorReporting, info.Version); err != nil {
+		logger.Fatalf("startErrorReporting failed: %v", err)
+	}
+	r := newRouter()
+	if cfg.HttpServer.MaxMultipartMemory > 0 {
+		r.MaxMultipartMemory = cfg.HttpServer.MaxMultipartMemory
+	}
 
 	// CORS here is not needed, murecom-gw4reader now proxies audio files requests.
 	// duplicate CORS headers will cause problems.
-	if *corsEnable {
-		logger.Info("CORS is enabled.")
-		r.Use(cors.Default())
+	if corsEnable && !cfg.CORS.Enable {
+		logger.Warn("the -cors flag is deprecated: use the CORS config.")
+		cfg.CORS.Enable = true
+	}
+	if cfg.CORS.Enable {
+		corsHandler, err := corsMiddleware(cfg.CORS)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.WithField("routes", cfg.CORS.Routes).Info("CORS is enabled.")
+		r.Use(corsHandler)
+	}
+
+	// before any route is registered: r.Use only applies to the later ones
+	if err := auth.UseUsers(cfg.Auth.Users, cfg.Auth.Anonymous); err != nil {
+		logger.Fatalf("auth.UseUsers failed: %v", err)
+	}
+	if len(cfg.Auth.Users) > 0 {
+		logger.WithField("users", len(cfg.Auth.Users)).Info("access control is enabled.")
+	}
+	if err := auth.UseNetworks(cfg.Auth.AllowNets, cfg.Auth.DenyNets); err != nil {
+		logger.Fatalf("auth.UseNetworks failed: %v", err)
+	}
+	if err := r.SetTrustedProxies(cfg.Auth.TrustedProxies); err != nil {
+		logger.Fatalf("SetTrustedProxies failed: %v", err)
+	}
+	r.Use(auth.Middleware)
+
+	registerHealthRoutes(r, cfg.Health.Emomusic)
+	registerVersionRoutes(r, cfg)
+
+	if cfg.Debug.Pprof {
+		logger.Warn("pprof is enabled: /debug/pprof")
+		registerPprof(r)
 	}
 
 	// so, the odd thing here is that, we ListenAndServe first,
@@ -65,88 +146,472 @@ func startServices(cfg *MusicstoreConfig) *http.Server {
 	// this is because, to LoadFromDir (a.k.a. AddTracksFromDir) in
 	// startAudioFileStore(), we need expose the uri to audio files,
 	// so that emomusic can download and analyze them.
-	srv := startHttpServer(cfg.HttpListenAddr, r)
+	if err := cfg.TLS.check(); err != nil {
+		logger.Fatal(err)
+	}
+	l, err := listen(cfg.HttpListenAddr, cfg.HttpSocketMode, cfg.HttpSocketGroup)
+	if err != nil {
+		logger.Fatalf("listen: %v", err)
+	}
+	srv := startHttpServer(l, cfg.HttpServer, cfg.TLS, withPathPrefix(cfg.PathPrefix, r))
+
+	if err := startEmomusicClient(cfg.Emomusic); err != nil {
+		logger.Fatalf("startEmomusicClient failed: %v", err)
+	}
 
-	if cfg.Emomusic.Server != "" {
-		os.Setenv("EMOMUSIC_SERVER", cfg.Emomusic.Server)
+	if err := startGenreClassifier(cfg.Genre); err != nil {
+		logger.Fatalf("startGenreClassifier failed: %v", err)
 	}
 
-	metadata.Start(cfg.Metadata.DB, r)
+	if err := registerAnalyzers(cfg.Analyzers); err != nil {
+		logger.Fatalf("registerAnalyzers failed: %v", err)
+	}
+
+	murecom.UseMoodPresets(cfg.Murecom.Moods)
+	useArtistRules(cfg.Artists) // before the artists are backfilled
 
+	dsn, err := cfg.Metadata.dsn()
+	if err != nil {
+		logger.Fatalf("bad Metadata config: %v", err)
+	}
+	metadata.Start(dsn, r)
+	conn, err := startNATS(cfg.NATS)
+	if err != nil {
+		logger.Fatalf("startNATS failed: %v", err)
+	}
+	if cfg.NATS.Jobs {
+		if err := startRemoteAnalysis(conn, cfg.NATS, r); err != nil {
+			logger.Fatalf("startRemoteAnalysis failed: %v", err)
+		}
+	} else {
+		useJobTimeout(cfg.Emomusic.JobTimeout)
+		analysis.Start(cfg.Emomusic.Workers, r)
+	}
+	events.Start()
+	events.RegisterRoutes(r)
+	if err := startWebhooks(cfg.Webhooks); err != nil {
+		logger.Fatalf("startWebhooks failed: %v", err)
+	}
+	srv.RegisterOnShutdown(events.Shutdown) // end the streams
+
+	if err := useFetchPolicy(cfg.Fetch); err != nil {
+		logger.Fatalf("useFetchPolicy failed: %v", err)
+	}
+	useScanPolicy(cfg.Scan)
 	for _, afsCfg := range cfg.AudioFileStores {
 		if err := startAudioFileStore(afsCfg, r); err != nil {
 			logger.Fatalf("startAudioFileStore failed: %v", err)
 		}
 	}
+	audiofilestore.RegisterAdminRoutes(r)
+	if cfg.Subsonic.Enable {
+		subsonic.RegisterRoutes(r)
+		logger.Info("Subsonic API is enabled: /rest")
+	}
+	if cfg.ImageProxy.Enable {
+		done := make(chan struct{})
+		srv.RegisterOnShutdown(func() { close(done) })
+		if err := startImageProxy(cfg.ImageProxy, r, done); err != nil {
+			logger.Fatalf("startImageProxy failed: %v", err)
+		}
+	}
+	registerLogLevelRoutes(r)
+	registerDocsRoutes(r)
 
-	return srv
+	started.Store(true)
+	logger.Info("musicstore started.")
+
+	return srv, r
 }
 
-func corsSetting(r *gin.Engine) {
-	r.Use(cors.New(cors.Config{
-		AllowAllOrigins:  true,
-		AllowMethods:     []string{"*"},
-		AllowHeaders:     []string{"*"},
-		ExposeHeaders:    []string{"*"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+func startEmomusicClient(cfg EmomusicConfig) error {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+
+	// $EMOMUSIC_SERVER of the older deployments, if not configured
+	server := cfg.Server
+	if server == "" {
+		server = os.Getenv("EMOMUSIC_SERVER")
+	}
+
+	client, err := emomusic.NewClient(emomusic.ClientConfig{
+		Server:             server,
+		Timeout:            timeout,
+		Proxy:              cfg.Proxy,
+		CAFile:             cfg.CAFile,
+		CertFile:           cfg.CertFile,
+		KeyFile:            cfg.KeyFile,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		Headers:            cfg.Headers,
+	})
+	if err != nil {
+		return err
+	}
+	emomusic.Use(client)
+	analysis.Register("emomusic", analysis.EmomusicAnalyzer{ModelVersion: cfg.ModelVersion})
+
+	emomusic.UseRetryPolicy(emomusic.RetryPolicy{
+		MaxRetries:     cfg.MaxRetries,
+		InitialBackoff: cfg.InitialBackoff,
+		MaxBackoff:     cfg.MaxBackoff,
+	})
+	emomusic.UseBreakerPolicy(emomusic.BreakerPolicy{
+		Threshold: cfg.BreakerThreshold,
+		Cooldown:  cfg.BreakerCooldown,
+	})
+
+	if server == "" {
+		// no emomusic: fall back to the local estimation
+		analysis.UseDefaultAnalyzers([]string{"heuristic"})
+		logger.Warn("no emomusic server configured: using the heuristic analyzer by default.")
+	} else {
+		analysis.UseDefaultAnalyzers([]string{"emomusic"}) // may be reloaded
+	}
+
+	return nil
+}
+
+// useFetchPolicy sets the audiofilestore.FetchPolicy by the config.
+func useFetchPolicy(cfg FetchConfig) error {
+	return audiofilestore.UseFetchPolicy(audiofilestore.FetchPolicy{
+		AllowHosts:   cfg.AllowHosts,
+		DenyHosts:    cfg.DenyHosts,
+		AllowPrivate: cfg.AllowPrivate,
+		MaxRedirects: cfg.MaxRedirects,
+		Timeout:      cfg.Timeout,
+		MaxBytes:     cfg.MaxBytes,
+	})
+}
+
+// useScanPolicy sets the audiofilestore.ScanPolicy by the config.
+func useScanPolicy(cfg ScanConfig) {
+	audiofilestore.UseScanPolicy(audiofilestore.ScanPolicy{
+		Clamd:      cfg.Clamd,
+		Command:    cfg.Command,
+		Quarantine: cfg.Quarantine,
+		FailOpen:   cfg.FailOpen,
+		Timeout:    cfg.Timeout,
+	})
 }
 
-func startHttpServer(addr string, r http.Handler) *http.Server {
+// startImageProxy registers GET /imgproxy.
+// Its sweeper stops when done is closed.
+func startImageProxy(cfg ImageProxyConfig, r gin.IRouter, done <-chan struct{}) error {
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "./imgproxy-cache"
+	}
+
+	err := imgproxy.RegisterRoutes(r, imgproxy.Config{
+		CacheDir:   cacheDir,
+		AllowHosts: cfg.AllowHosts,
+		MaxBytes:   cfg.MaxBytes,
+		CacheTTL:   cfg.CacheTTL,
+		Fetch:      audiofilestore.Fetch, // by the Fetch policy: no private addresses
+		Done:       done,
+	})
+	if err != nil {
+		return err
+	}
+	logger.WithField("CacheDir", cacheDir).Info("image proxy is enabled: /imgproxy")
+	return nil
+}
+
+// startGenreClassifier registers the "genre" analyzer,
+// if the genre classifier is configured.
+func startGenreClassifier(cfg GenreConfig) error {
+	if cfg.Server == "" {
+		return nil
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	client, err := genre.NewClient(genre.ClientConfig{
+		Server:  cfg.Server,
+		Timeout: timeout,
+		Headers: cfg.Headers,
+	})
+	if err != nil {
+		return err
+	}
+	genre.Use(client)
+
+	analysis.Register("genre", analysis.GenreAnalyzer{
+		Threshold: cfg.Threshold,
+		MaxGenres: cfg.MaxGenres,
+	})
+	return nil
+}
+
+// startErrorReporting reports the errors to Sentry, if the DSN is set.
+func startErrorReporting(cfg ErrorReportingConfig, release string) error {
+	if cfg.DSN == "" {
+		return nil
+	}
+	sentry, err := errreport.NewSentry(errreport.SentryConfig{
+		DSN:         cfg.DSN,
+		Environment: cfg.Environment,
+		Release:     release,
+	})
+	if err != nil {
+		return err
+	}
+	errreport.Use(sentry)
+	logger.Info("error reporting is enabled.")
+	return nil
+}
+
+// startWebhooks POSTs the events to the webhooks, replacing the ones in use.
+func startWebhooks(cfgs []WebhookConfig) error {
+	hooks := make([]events.Webhook, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		hooks = append(hooks, events.Webhook{URL: cfg.URL, Secret: cfg.Secret, Types: cfg.Events})
+	}
+	if err := events.UseWebhooks(hooks); err != nil {
+		return err
+	}
+	if len(hooks) > 0 {
+		logger.Infof("webhooks are enabled: %d targets.", len(hooks))
+	}
+	return nil
+}
+
+// startNATS connects to the NATS server, and publishes the events to it,
+// if enabled. nil is returned if NATS is not used.
+func startNATS(cfg NATSConfig) (*nats.Conn, error) {
+	if cfg.URL == "" {
+		if cfg.Events || cfg.Jobs {
+			return nil, errors.New("NATS.URL is required by NATS.Events or NATS.Jobs")
+		}
+		return nil, nil
+	}
+	conn, err := nats.Dial(cfg.URL, "musicstore")
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Events {
+		go events.Follow(nil, func(e events.Event) {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if err := conn.Publish(cfg.subject("events."+e.Type), "", data); err != nil {
+				logger.WithError(err).WithField("event", e.ID).Warn("NATS: publish event failed")
+			}
+		})
+	}
+	logger.WithField("url", cfg.URL).Info("NATS is connected.")
+	return conn, nil
+}
+
+// useJobTimeout bounds the analyzers of a job: 0 is the default, < 0 is
+// unbounded.
+func useJobTimeout(d time.Duration) {
+	if d > 0 {
+		analysis.JobTimeout = d
+	} else if d < 0 {
+		analysis.JobTimeout = 0
+	}
+}
+
+// startRemoteAnalysis dispatches the analysis jobs to the remote workers.
+func startRemoteAnalysis(conn *nats.Conn, cfg NATSConfig, r gin.IRouter) error {
+	if cfg.MaxInFlight == 0 {
+		cfg.MaxInFlight = 64
+	}
+	if cfg.JobTimeout == 0 {
+		cfg.JobTimeout = 10 * time.Minute
+	}
+	return analysis.StartRemote(conn, analysis.RemoteConfig{
+		Subject:     cfg.subject("jobs.analysis"),
+		MaxInFlight: cfg.MaxInFlight,
+		Timeout:     cfg.JobTimeout,
+	}, r)
+}
+
+func registerAnalyzers(cfgs []AnalyzerConfig) error {
+	for _, cfg := range cfgs {
+		switch cfg.Type {
+		case "exec":
+			analysis.Register(cfg.Name, analysis.ExecAnalyzer{Command: cfg.Command})
+		case "stub":
+			analysis.Register(cfg.Name, analysis.StubAnalyzer{
+				Emotion: model.Emotion{Valence: cfg.Valence, Arousal: cfg.Arousal, Confidence: cfg.Confidence},
+			})
+		default:
+			return fmt.Errorf("analyzer %q: unknown Type %q", cfg.Name, cfg.Type)
+		}
+	}
+	return nil
+}
+
+func startHttpServer(l net.Listener, httpCfg HttpServerConfig, tlsCfg TLSConfig, r http.Handler) *http.Server {
+	addr := l.Addr().String()
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: r,
+		Addr:              addr,
+		Handler:           r,
+		ReadTimeout:       httpCfg.ReadTimeout,
+		ReadHeaderTimeout: httpCfg.ReadHeaderTimeout,
+		WriteTimeout:      httpCfg.WriteTimeout,
+		IdleTimeout:       httpCfg.IdleTimeout,
+		MaxHeaderBytes:    httpCfg.MaxHeaderBytes,
+	}
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = 10 * time.Second
+	}
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = 2 * time.Minute
 	}
 
 	go func() {
 		// service connections
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsCfg.enabled() {
+			err = serveTLS(srv, l, tlsCfg)
+		} else {
+			err = srv.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("listen: %s\n", err)
 		}
 	}()
 
-	logger.Infof("server started at %s", addr)
+	logger.WithField("tls", tlsCfg.enabled()).Infof("server started at %s", addr)
 
 	return srv
 }
 
+// useArtistRules sets the model.ArtistRules of the imports by the config.
+func useArtistRules(c ArtistsConfig) {
+	model.UseArtistRules(model.ArtistRules{
+		Space:      c.Space,
+		Width:      c.Width,
+		Featuring:  c.Featuring,
+		FoldCase:   c.FoldCase,
+		Separators: c.Separators,
+	})
+}
+
 func startAudioFileStore(afsCfg AudioFileStoreConfig, r gin.IRouter) error {
-	afs := audiofilestore.NewAudioFileStore(
-		afsCfg.Name, afsCfg.FileDir, afsCfg.BaseUrl, afsCfg.EnableEmomusic, r)
+	afs, err := newAudioFileStore(afsCfg, r)
+	if err != nil {
+		return err
+	}
 
 	if afsCfg.LoadFromDir {
-		if err := afs.AddTracksFromDir(); err != nil {
+		if err := afs.AddTracksFromDir(afsCfg.LoadFromDirDryRun); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func gracefulShoutdown(srv *http.Server) {
+// newAudioFileStore checks the config, and creates the store.
+func newAudioFileStore(afsCfg AudioFileStoreConfig, r gin.IRouter, extra ...audiofilestore.AudioFileStoreOption) (*audiofilestore.AudioFileStore, error) {
+	if afsCfg.BaseUrl == "" {
+		return nil, fmt.Errorf("AudioFileStore %q: BaseUrl is required", afsCfg.Name)
+	}
+	if err := analysis.CheckAnalyzers(afsCfg.Analyzers); err != nil {
+		return nil, fmt.Errorf("AudioFileStore %q: %w", afsCfg.Name, err)
+	}
+	if err := audiofilestore.CheckLinkMode(afsCfg.LinkMode); err != nil {
+		return nil, fmt.Errorf("AudioFileStore %q: %w", afsCfg.Name, err)
+	}
+	if err := audiofilestore.CheckOnCollision(afsCfg.OnCollision); err != nil {
+		return nil, fmt.Errorf("AudioFileStore %q: %w", afsCfg.Name, err)
+	}
+	if err := audiofilestore.CheckLayout(afsCfg.Layout); err != nil {
+		return nil, fmt.Errorf("AudioFileStore %q: %w", afsCfg.Name, err)
+	}
+	if err := audiofilestore.CheckFilenameTemplate(afsCfg.FilenameTemplate); err != nil {
+		return nil, fmt.Errorf("AudioFileStore %q: %w", afsCfg.Name, err)
+	}
+	if err := audiofilestore.CheckPatterns(append(afsCfg.Include, afsCfg.Exclude...)...); err != nil {
+		return nil, fmt.Errorf("AudioFileStore %q: %w", afsCfg.Name, err)
+	}
+
+	options := []audiofilestore.AudioFileStoreOption{
+		audiofilestore.WithEmomusicUploadFile(afsCfg.EmomusicUploadFile),
+		audiofilestore.WithAnalyzers(afsCfg.Analyzers...),
+		audiofilestore.WithMaxUploadBytes(afsCfg.MaxUploadBytes),
+		audiofilestore.WithAllowedContentTypes(afsCfg.AllowedContentTypes...),
+		audiofilestore.WithCacheControl(afsCfg.CacheControl),
+		audiofilestore.WithOnDuplicate(afsCfg.OnDuplicate),
+		audiofilestore.WithTmpTTL(afsCfg.TmpTTL),
+		audiofilestore.WithCacheMaxBytes(afsCfg.CacheMaxBytes),
+		audiofilestore.WithOnDelete(afsCfg.OnDelete),
+		audiofilestore.WithScanWorkers(afsCfg.ScanWorkers, afsCfg.ScanWriteRate),
+		audiofilestore.WithDownloadWorkers(afsCfg.DownloadWorkers),
+		audiofilestore.WithFilenameTemplate(afsCfg.FilenameTemplate),
+		audiofilestore.WithLayout(afsCfg.Layout),
+		audiofilestore.WithLinkMode(afsCfg.LinkMode),
+		audiofilestore.WithOnCollision(afsCfg.OnCollision),
+		audiofilestore.WithLibrary(afsCfg.Library),
+		audiofilestore.WithReadOnly(afsCfg.ReadOnly),
+		audiofilestore.WithFetchCovers(afsCfg.FetchCovers, afsCfg.LocalizeCovers),
+		audiofilestore.WithScanFilter(audiofilestore.ScanFilter{
+			Include:        afsCfg.Include,
+			Exclude:        afsCfg.Exclude,
+			SkipHidden:     afsCfg.SkipHidden,
+			FollowSymlinks: afsCfg.FollowSymlinks,
+		}),
+	}
+	if afsCfg.Watch {
+		options = append(options, audiofilestore.WithWatch(afsCfg.WatchInbox, afsCfg.WatchDebounce))
+	}
+	options = append(options, extra...)
+
+	afs := audiofilestore.NewAudioFileStore(
+		afsCfg.Name, afsCfg.FileDir, afsCfg.BaseUrl, afsCfg.EnableEmomusic, r,
+		options...)
+	return afs, nil
+}
+
+// gracefulShoutdown waits for SIGINT or SIGTERM to shut the server down,
+// calling reload on every SIGHUP meanwhile.
+//
+// The requests, imports, scans, downloads and analysis jobs in progress
+// are waited for, until the timeout (default 30s).
+func gracefulShoutdown(srv *http.Server, timeout time.Duration, reload func()) {
 	// https://gin-gonic.com/docs/examples/graceful-restart-or-stop/
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 5 seconds.
+	// Wait for interrupt signal to gracefully shutdown the server.
 	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscanll.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	// kill -HUP reloads the config
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	<-quit
+	for sig := range quit {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reload()
+	}
+	signal.Stop(quit) // a second ^C kills
 	logger.Println("Shutdown Server ...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		logger.Fatal("Server Shutdown:", err)
+		logger.WithError(err).Error("Server Shutdown")
+	}
+	if err := audiofilestore.Shutdown(ctx); err != nil {
+		logger.WithError(err).Warn("audiofilestore Shutdown")
 	}
-	// catching ctx.Done(). timeout of 200 ms.
-	select {
-	case <-ctx.Done():
-		logger.Println("timeout of 200 ms.")
+	if err := analysis.Shutdown(ctx); err != nil {
+		logger.WithError(err).Warn("analysis Shutdown")
 	}
 	logger.Println("Server exiting")
 }
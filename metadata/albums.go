@@ -0,0 +1,88 @@
+package metadata
+
+import (
+	"context"
+	"musicstore/model"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/cdfmlr/crud/service"
+)
+
+// this file aggregates the tracks into the artists and the albums (by
+// their Artist and Album tags), e.g. for the browsing of the Subsonic API.
+
+// ArtistStats is an artist of the tracks.
+type ArtistStats struct {
+	Artist string
+	Albums int64
+	Tracks int64
+}
+
+// ListArtists lists the artists of the tracks (matching the options, if
+// any) in the scope of the ctx, by name.
+func ListArtists(ctx context.Context, options ...service.QueryOption) ([]ArtistStats, error) {
+	query := orm.DB.WithContext(ctx).Model(&model.Track{})
+	for _, option := range options {
+		query = option(query)
+	}
+
+	var artists []ArtistStats
+	err := query.
+		Select("artist, COUNT(DISTINCT album) AS albums, COUNT(*) AS tracks").
+		Group("artist").Order("artist").
+		Scan(&artists).Error
+	return artists, err
+}
+
+// AlbumStats is an album of the tracks: of the same Album and Artist.
+type AlbumStats struct {
+	Album  string
+	Artist string
+	Genre  string // of any track
+	Tracks int64
+	// Duration: the sum of the Cues.AudioEnd (0 if not analyzed) of the
+	// tracks, in seconds.
+	Duration float64
+	// CoverTrackID: a track with a CoverImageURL, 0 if none.
+	CoverTrackID uint
+	// LastTrackID: the last track added.
+	LastTrackID uint
+}
+
+// Orders of ListAlbums.
+const (
+	AlbumsByName   = "name"   // Album, Artist
+	AlbumsByArtist = "artist" // Artist, Album
+	AlbumsNewest   = "newest" // the last track added, newest first
+	AlbumsRandom   = "random"
+)
+
+// ListAlbums lists the albums of the tracks (matching the options, if
+// any, e.g. service.WithPage) in the scope of the ctx, in the order.
+func ListAlbums(ctx context.Context, order string, options ...service.QueryOption) ([]AlbumStats, error) {
+	query := orm.DB.WithContext(ctx).Model(&model.Track{})
+	for _, option := range options {
+		query = option(query)
+	}
+
+	switch order {
+	case AlbumsByArtist:
+		query = query.Order("artist").Order("album")
+	case AlbumsNewest:
+		query = query.Order("last_track_id DESC")
+	case AlbumsRandom:
+		query = query.Order("RANDOM()")
+	default:
+		query = query.Order("album").Order("artist")
+	}
+
+	var albums []AlbumStats
+	err := query.
+		Select("album, artist, MAX(genre) AS genre, COUNT(*) AS tracks, " +
+			"SUM(cue_audio_end) AS duration, " +
+			"COALESCE(MAX(CASE WHEN cover_image_url <> '' THEN id END), 0) AS cover_track_id, " +
+			"MAX(id) AS last_track_id").
+		Group("album, artist").
+		Scan(&albums).Error
+	return albums, err
+}
@@ -7,8 +7,11 @@ package metadata
 import (
 	"context"
 	"musicstore/model"
+	"strings"
 
+	"github.com/cdfmlr/crud/orm"
 	"github.com/cdfmlr/crud/service"
+	"gorm.io/gorm"
 )
 
 // TrackExists checks if the track exists in the metadata database.
@@ -29,6 +32,154 @@ func TrackExists(ctx context.Context, track *model.Track) bool {
 	return cnt > 0
 }
 
+// FindDuplicateTrack finds an existing track duplicating the track:
+// with the same Name and Artist, or the same AudioFileHash (if any).
+// It returns nil if there is none.
+func FindDuplicateTrack(ctx context.Context, track *model.Track) (*model.Track, error) {
+	query := orm.DB.WithContext(ctx)
+	if track.AudioFileHash != "" {
+		query = query.Where("((name = ? AND artist = ?) OR audio_file_hash = ?)",
+			track.Name, track.Artist, track.AudioFileHash)
+	} else {
+		query = query.Where("name = ? AND artist = ?", track.Name, track.Artist)
+	}
+
+	var tracks []*model.Track
+	if err := query.Limit(1).Find(&tracks).Error; err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, nil
+	}
+	return tracks[0], nil
+}
+
+// CanonicalArtist finds the spelling of the artist in the existing tracks,
+// differing only in the case (of ASCII letters), for the FoldCase of the
+// model.ArtistRules. It returns "" if there is none.
+func CanonicalArtist(ctx context.Context, artist string) (string, error) {
+	var artists []string
+	err := orm.DB.WithContext(ctx).Model(&model.Track{}).
+		Where("artist = ? COLLATE NOCASE", artist).
+		Order("id").Limit(1).Pluck("artist", &artists).Error
+	if err != nil || len(artists) == 0 {
+		return "", err
+	}
+	return artists[0], nil
+}
+
+// GetTracks gets the tracks matching the query options, e.g. all tracks.
+func GetTracks(ctx context.Context, options ...service.QueryOption) ([]*model.Track, error) {
+	query := orm.DB.WithContext(ctx)
+	for _, option := range options {
+		query = option(query)
+	}
+
+	var tracks []*model.Track
+	err := query.Find(&tracks).Error
+	return tracks, err
+}
+
+// UpdateTrackFile updates only the audio file fields (AudioFileURL,
+// AudioFileHash, FileSize, FileModTime, FileMissing) of the track,
+// leaving other fields untouched.
+func UpdateTrackFile(ctx context.Context, track *model.Track) error {
+	return orm.DB.WithContext(ctx).Model(track).
+		Select("audio_file_url", "audio_file_hash", "file_size", "file_mod_time", "file_missing").
+		Updates(track).Error
+}
+
+// UpdateTrackFromFile updates the fields read from a changed audio file:
+// the tags (Name, Artist, Album, Genre), the audio file fields (see
+// UpdateTrackFile), and the AnalysisStatus (to re-analyze it).
+func UpdateTrackFromFile(ctx context.Context, track *model.Track) error {
+	return orm.DB.WithContext(ctx).Model(track).
+		Select("name", "artist", "album", "genre",
+			"audio_file_url", "audio_file_hash", "file_size", "file_mod_time", "file_missing",
+			"analysis_status").
+		Updates(track).Error
+}
+
+// UpdateTrackTags updates the tags (Name, Artist, Album, Genre) and the
+// audio file fields (AudioFileHash, FileSize, FileModTime) of the track
+// in a transaction. It's committed only if apply (e.g. replacing the
+// audio file with the retagged one) succeeds.
+func UpdateTrackTags(ctx context.Context, track *model.Track, apply func() error) error {
+	return orm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(track).
+			Select("name", "artist", "album", "genre",
+				"audio_file_hash", "file_size", "file_mod_time").
+			Updates(track).Error
+		if err != nil {
+			return err
+		}
+		return apply()
+	})
+}
+
+// UpdateTrackFields updates the track with the non-zero fields of the
+// changes, e.g. the columns of an imported catalog.
+func UpdateTrackFields(ctx context.Context, track *model.Track, changes *model.Track) error {
+	return orm.DB.WithContext(ctx).Model(track).Updates(changes).Error
+}
+
+// IsFileURLShared checks if any track other than the one (by ID) refers
+// to the file URL, as its audio file or cover image.
+func IsFileURLShared(ctx context.Context, trackID uint, fileUrl string) (bool, error) {
+	cnt, err := service.Count[model.Track](ctx,
+		service.Where("id <> ? AND (audio_file_url = ? OR cover_image_url = ?)",
+			trackID, fileUrl, fileUrl))
+	return cnt > 0, err
+}
+
+// CountTracksWithFileURLPrefix counts the tracks whose audio files are
+// under the URL prefix, e.g. served by a store.
+func CountTracksWithFileURLPrefix(ctx context.Context, prefix string) (int64, error) {
+	return service.Count[model.Track](ctx, FileURLPrefix(prefix))
+}
+
+// FileURLPrefix selects the tracks whose audio files are under the
+// URL prefix, e.g. for GetTracks.
+func FileURLPrefix(prefix string) service.QueryOption {
+	return service.Where("audio_file_url LIKE ? ESCAPE '\\'", likeEscaper.Replace(prefix)+"%")
+}
+
+// GetCoverImageURLs gets the set of the CoverImageURLs containing the
+// part (e.g. "/covers/"), of the tracks (including the soft-deleted ones).
+func GetCoverImageURLs(ctx context.Context, part string) (map[string]bool, error) {
+	var urls []string
+	err := orm.DB.WithContext(ctx).Unscoped().Model(&model.Track{}).
+		Where("cover_image_url LIKE ? ESCAPE '\\'", "%"+likeEscaper.Replace(part)+"%").
+		Distinct().Pluck("cover_image_url", &urls).Error
+
+	set := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		set[u] = true
+	}
+	return set, err
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// UpdateAnalysisStatus updates only the AnalysisStatus of the track.
+func UpdateAnalysisStatus(ctx context.Context, track *model.Track) error {
+	return orm.DB.WithContext(ctx).Model(track).
+		Select("analysis_status").Updates(track).Error
+}
+
+// PurgeTrack deletes the track permanently (not soft-deleted),
+// e.g. to roll back a failed import.
+func PurgeTrack(ctx context.Context, track *model.Track) error {
+	return orm.DB.WithContext(ctx).Unscoped().Delete(track).Error
+}
+
+// CreateTracks creates the tracks by INSERTs of batchSize rows, in a
+// transaction, e.g. for the imports of many files.
+func CreateTracks(ctx context.Context, tracks []*model.Track, batchSize int) error {
+	return orm.DB.WithContext(ctx).CreateInBatches(tracks, batchSize).Error
+}
+
 func CreateTrack(ctx context.Context, track *model.Track) error {
 	err := service.Create(ctx, track, service.IfNotExist())
 	return err
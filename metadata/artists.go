@@ -0,0 +1,207 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+	"strconv"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/cdfmlr/crud/service"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// this file keeps the artists of the tracks (model.TrackArtist, split
+// from their Artist) in sync with the tracks, so that the tracks can be
+// found by any of their artists, e.g. the featured ones.
+
+// registerTrackArtists keeps the artists in sync by the track hooks.
+func registerTrackArtists() {
+	// in bulk: a batch of CreateTracks gets its artists in one insert
+	OnTracksCreated(func(ctx context.Context, tracks []*model.Track) {
+		if err := setTracksArtists(ctx, tracks); err != nil {
+			logger.WithField("tracks", len(tracks)).WithError(err).
+				Error("setTracksArtists failed")
+		}
+	})
+	// the hooked track may be stale (see OnTrackUpdated): re-read
+	OnTrackUpdated(func(ctx context.Context, track *model.Track) {
+		if err := syncTrackArtists(ctx, track.ID); err != nil {
+			logger.WithField("ID", track.ID).WithError(err).
+				Error("syncTrackArtists failed")
+		}
+	})
+	OnTrackDeleted(func(ctx context.Context, track *model.Track) {
+		err := orm.DB.WithContext(ctx).Unscoped().
+			Where("track_id = ?", track.ID).Delete(&model.TrackArtist{}).Error
+		if err != nil {
+			logger.WithField("ID", track.ID).WithError(err).
+				Error("delete TrackArtists failed")
+		}
+	})
+}
+
+// setTrackArtists replaces the artists of the track by the ones split
+// from the artist name. The old ones are derived: deleted for good.
+func setTrackArtists(ctx context.Context, trackID uint, artist string) error {
+	return setTracksArtists(ctx, []*model.Track{{BasicModel: orm.BasicModel{ID: trackID}, Artist: artist}})
+}
+
+// trackArtistsBatchSize: of the tracks (and their artists) per statement.
+const trackArtistsBatchSize = 500
+
+// setTracksArtists replaces the artists of the tracks by the ones split
+// from their Artist, in bulk: a statement per trackArtistsBatchSize.
+func setTracksArtists(ctx context.Context, tracks []*model.Track) error {
+	for start := 0; start < len(tracks); start += trackArtistsBatchSize {
+		end := start + trackArtistsBatchSize
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+
+		var ids []uint
+		var artists []model.TrackArtist
+		for _, track := range tracks[start:end] {
+			ids = append(ids, track.ID)
+			for _, artist := range model.SplitArtists(track.Artist) {
+				artist.TrackID = track.ID
+				artists = append(artists, artist)
+			}
+		}
+
+		err := orm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Unscoped().Where("track_id IN ?", ids).Delete(&model.TrackArtist{}).Error; err != nil {
+				return err
+			}
+			if len(artists) == 0 {
+				return nil
+			}
+			return tx.CreateInBatches(&artists, trackArtistsBatchSize).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncTrackArtists updates the artists of the track, if its Artist has
+// changed since they're split.
+func syncTrackArtists(ctx context.Context, trackID uint) error {
+	var names []string
+	err := orm.DB.WithContext(ctx).Model(&model.Track{}).
+		Where("id = ?", trackID).Pluck("artist", &names).Error
+	if err != nil || len(names) == 0 {
+		return err // or deleted
+	}
+
+	have, err := GetTrackArtists(ctx, trackID)
+	if err != nil {
+		return err
+	}
+	want := model.SplitArtists(names[0])
+	if len(have) == len(want) {
+		same := true
+		for i := range want {
+			if have[i].Name != want[i].Name || have[i].Role != want[i].Role {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+	return setTrackArtists(ctx, trackID, names[0])
+}
+
+// backfillTrackArtists splits the artists of the tracks created before
+// they're introduced (or restored from an older snapshot).
+func backfillTrackArtists() error {
+	var tracks []*model.Track
+	err := orm.DB.Select("id", "artist").
+		Where("artist != '' AND id NOT IN (SELECT track_id FROM track_artists)").
+		Find(&tracks).Error
+	if err != nil {
+		return err
+	}
+
+	if err := setTracksArtists(context.Background(), tracks); err != nil {
+		return err
+	}
+
+	if len(tracks) > 0 {
+		logger.WithField("tracks", len(tracks)).Info("backfillTrackArtists: artists split")
+	}
+	return nil
+}
+
+// GetTrackArtists gets the artists of the track, in the order of its Artist.
+func GetTrackArtists(ctx context.Context, trackID uint) ([]model.TrackArtist, error) {
+	var artists []model.TrackArtist
+	err := orm.DB.WithContext(ctx).
+		Where("track_id = ?", trackID).Order("position").Find(&artists).Error
+	return artists, err
+}
+
+// ByArtist is the query option of the tracks by any of their artists (see
+// model.SplitArtists), case-insensitively, e.g. the tracks featuring an
+// artist as well. With a role (model.ArtistRoleMain or Featured), only
+// the tracks of the artist in the role.
+func ByArtist(name, role string) service.QueryOption {
+	return func(tx *gorm.DB) *gorm.DB {
+		artists := orm.DB.Model(&model.TrackArtist{}).Select("track_id").
+			Where("name = ? COLLATE NOCASE", name)
+		if role != "" {
+			artists = artists.Where("role = ?", role)
+		}
+		return tx.Where("id IN (?)", artists)
+	}
+}
+
+// parseArtistRole checks the role query of the artists.
+func parseArtistRole(role string) (string, error) {
+	switch role {
+	case "", model.ArtistRoleMain, model.ArtistRoleFeatured:
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q: %s or %s", role, model.ArtistRoleMain, model.ArtistRoleFeatured)
+}
+
+// GetArtistsOfTrack handles: GET /tracks/:TrackID/artists
+//
+// The artists of the track, split from its Artist, e.g. of "A & B feat. C":
+// A and B (main), C (featured).
+//
+// Response:
+//
+//   - 200: OK: {artists: [{Name: "A", Role: "main", Position: 0}, ...]}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "record not found"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func GetArtistsOfTrack(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("TrackID"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// in the library of the request
+	cnt, err := service.Count[model.Track](c, service.Where("id = ?", id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if cnt == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": gorm.ErrRecordNotFound.Error()})
+		return
+	}
+	artists, err := GetTrackArtists(c, uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"artists": artists})
+}
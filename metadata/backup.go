@@ -0,0 +1,145 @@
+package metadata
+
+// This file provides the snapshot and restore of the database (SQLite).
+
+import (
+	"context"
+	"fmt"
+	"musicstore/model"
+
+	"github.com/cdfmlr/crud/orm"
+	"gorm.io/gorm"
+)
+
+// models are the models of the database, in the order of restore.
+var models = []any{&model.Track{}, &model.Job{}, &model.EmotionCache{}, &model.EmotionRecord{},
+	&model.Playlist{}, &model.PlaylistItem{}, &model.TrackArtist{}}
+
+// SnapshotDB writes a consistent copy of the database into the new file
+// dst, by VACUUM INTO, without stopping the writers.
+func SnapshotDB(ctx context.Context, dst string) error {
+	return orm.DB.WithContext(ctx).Exec("VACUUM INTO ?", dst).Error
+}
+
+// RestoreDB replaces the data of the database by the one of the snapshot
+// (see SnapshotDB) at src, in a transaction.
+//
+// Columns missing from the snapshot (e.g. taken by an older version) get
+// their defaults. The rows are copied as they are: no hooks (e.g.
+// OnTrackDeleted) are called. The data derived from the tracks that an
+// older snapshot may lack (the UUIDs, the artists and the AnalysisStatus)
+// is backfilled.
+func RestoreDB(ctx context.Context, src string) error {
+	if err := restoreDB(ctx, src); err != nil {
+		return err
+	}
+	if err := backfillAnalysisStatus(); err != nil {
+		return fmt.Errorf("RestoreDB: %w", err)
+	}
+	if err := backfillTrackUUIDs(); err != nil {
+		return fmt.Errorf("RestoreDB: backfillTrackUUIDs failed: %w", err)
+	}
+	if err := backfillTrackArtists(); err != nil {
+		return fmt.Errorf("RestoreDB: backfillTrackArtists failed: %w", err)
+	}
+	return nil
+}
+
+// restoreDB: see RestoreDB.
+func restoreDB(ctx context.Context, src string) error {
+	// ATTACH is per connection
+	return orm.DB.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("ATTACH DATABASE ? AS snapshot", src).Error; err != nil {
+			return fmt.Errorf("RestoreDB: ATTACH failed: %w", err)
+		}
+		defer conn.Exec("DETACH DATABASE snapshot")
+
+		return conn.Transaction(func(tx *gorm.DB) error {
+			for _, m := range models {
+				if err := restoreTable(tx, m); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// CheckSnapshot checks the snapshot at src before RestoreDB: an intact
+// SQLite database, with the tracks.
+func CheckSnapshot(ctx context.Context, src string) error {
+	return orm.DB.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("ATTACH DATABASE ? AS snapshot", src).Error; err != nil {
+			return fmt.Errorf("CheckSnapshot: ATTACH failed: %w", err)
+		}
+		defer conn.Exec("DETACH DATABASE snapshot")
+
+		var check []string
+		if err := conn.Raw("PRAGMA snapshot.quick_check").Scan(&check).Error; err != nil {
+			return fmt.Errorf("CheckSnapshot: quick_check failed: %w", err)
+		}
+		if len(check) != 1 || check[0] != "ok" {
+			return fmt.Errorf("CheckSnapshot: corrupted: %v", check)
+		}
+
+		stmt := &gorm.Statement{DB: conn}
+		if err := stmt.Parse(&model.Track{}); err != nil {
+			return fmt.Errorf("CheckSnapshot: Parse model failed: %w", err)
+		}
+		var tables int64
+		err := conn.Raw("SELECT count(*) FROM snapshot.sqlite_master WHERE type = 'table' AND name = ?",
+			stmt.Schema.Table).Scan(&tables).Error
+		if err != nil {
+			return fmt.Errorf("CheckSnapshot: %w", err)
+		}
+		if tables == 0 {
+			return fmt.Errorf("CheckSnapshot: no %s table", stmt.Schema.Table)
+		}
+		return nil
+	})
+}
+
+// restoreTable replaces the rows of the table of the model
+// by the ones in the attached snapshot.
+func restoreTable(tx *gorm.DB, m any) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(m); err != nil {
+		return fmt.Errorf("RestoreDB: Parse model failed: %w", err)
+	}
+	table := stmt.Schema.Table
+
+	var snapshotColumns []string
+	err := tx.Raw("SELECT name FROM pragma_table_info(?, 'snapshot')", table).
+		Scan(&snapshotColumns).Error
+	if err != nil {
+		return fmt.Errorf("RestoreDB: table_info of %s failed: %w", table, err)
+	}
+
+	// the columns of both
+	inSnapshot := make(map[string]bool, len(snapshotColumns))
+	for _, c := range snapshotColumns {
+		inSnapshot[c] = true
+	}
+	var columns string
+	for _, c := range stmt.Schema.DBNames {
+		if inSnapshot[c] {
+			if columns != "" {
+				columns += ", "
+			}
+			columns += fmt.Sprintf("%q", c)
+		}
+	}
+
+	if err := tx.Exec(fmt.Sprintf("DELETE FROM main.%q", table)).Error; err != nil {
+		return fmt.Errorf("RestoreDB: clear %s failed: %w", table, err)
+	}
+	if columns == "" {
+		return nil // not in the snapshot
+	}
+	err = tx.Exec(fmt.Sprintf("INSERT INTO main.%q (%s) SELECT %s FROM snapshot.%q",
+		table, columns, columns, table)).Error
+	if err != nil {
+		return fmt.Errorf("RestoreDB: copy %s failed: %w", table, err)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"musicstore/model"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/gin-gonic/gin"
+)
+
+// this file finds the tracks that are likely the same recording, for a
+// librarian to review before cleaning up. Nothing is changed here.
+
+// Methods of finding duplicates.
+const (
+	// DuplicatesByHash: the same audio file content (AudioFileHash).
+	DuplicatesByHash = "hash"
+	// DuplicatesByMusicBrainz: the same MusicBrainz recording ID, e.g.
+	// looked up by the acoustic fingerprint (AcoustID) of the files.
+	DuplicatesByMusicBrainz = "musicbrainz"
+	// DuplicatesByName: the same name and artist, normalized (see
+	// normalizeTitle), scored by the durations and the loudness.
+	DuplicatesByName = "name"
+)
+
+// DuplicateGroup is a group of tracks likely to be the same recording.
+type DuplicateGroup struct {
+	Method string
+	Key    string // the hash, the MusicBrainz ID or the normalized "artist - name"
+	// Score: the similarity in [0, 1], 1 for the same content.
+	Score  float64
+	Tracks []*model.Track
+}
+
+// FindDuplicates groups the tracks in the scope of the ctx by the methods
+// (all if none), the most similar groups first. Groups with scores less
+// than minScore are left out, and so are the ones of the same tracks as
+// a higher scored group.
+func FindDuplicates(ctx context.Context, minScore float64, methods ...string) ([]DuplicateGroup, error) {
+	if len(methods) == 0 {
+		methods = []string{DuplicatesByHash, DuplicatesByMusicBrainz, DuplicatesByName}
+	}
+
+	var tracks []*model.Track
+	if err := orm.DB.WithContext(ctx).Order("id").Find(&tracks).Error; err != nil {
+		return nil, fmt.Errorf("FindDuplicates: query tracks failed: %w", err)
+	}
+
+	var groups []DuplicateGroup
+	for _, method := range methods {
+		var key func(*model.Track) string
+		switch method {
+		case DuplicatesByHash:
+			key = func(t *model.Track) string { return t.AudioFileHash }
+		case DuplicatesByMusicBrainz:
+			key = func(t *model.Track) string { return t.MusicBrainzID }
+		case DuplicatesByName:
+			key = func(t *model.Track) string {
+				name := normalizeTitle(t.Name)
+				if name == "" {
+					return ""
+				}
+				return normalizeTitle(t.Artist) + " - " + name
+			}
+		default:
+			return nil, fmt.Errorf("FindDuplicates: unknown method %q", method)
+		}
+
+		for k, group := range groupTracks(tracks, key) {
+			g := DuplicateGroup{Method: method, Key: k, Tracks: group}
+			g.Score = g.score()
+			if g.Score >= minScore {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Score != groups[j].Score {
+			return groups[i].Score > groups[j].Score
+		}
+		return groups[i].Tracks[0].ID < groups[j].Tracks[0].ID
+	})
+
+	// the same tracks found by multiple methods: the highest scored one
+	seen := map[string]bool{}
+	deduped := groups[:0]
+	for _, g := range groups {
+		ids := make([]string, len(g.Tracks))
+		for i, t := range g.Tracks {
+			ids[i] = strconv.FormatUint(uint64(t.ID), 10)
+		}
+		set := strings.Join(ids, ",")
+		if !seen[set] {
+			seen[set] = true
+			deduped = append(deduped, g)
+		}
+	}
+	return deduped, nil
+}
+
+// groupTracks groups the tracks (ordered by ID) by the non-empty keys,
+// leaving out the groups of single tracks.
+func groupTracks(tracks []*model.Track, key func(*model.Track) string) map[string][]*model.Track {
+	groups := map[string][]*model.Track{}
+	for _, t := range tracks {
+		if k := key(t); k != "" {
+			groups[k] = append(groups[k], t)
+		}
+	}
+	for k, g := range groups {
+		if len(g) < 2 {
+			delete(groups, k)
+		}
+	}
+	return groups
+}
+
+// score of the group:
+//
+//   - hash: 1, the same content
+//   - musicbrainz: 0.95, the same recording, maybe in other encodings
+//   - name: 0.7, and by the analyzed tracks: +0.2 if the durations are
+//     within 2 seconds (or -0.3 if they are over 15 seconds apart: live
+//     versions, edits, ...), +0.1 if the loudness is within 1 LU.
+func (g DuplicateGroup) score() float64 {
+	switch g.Method {
+	case DuplicatesByHash:
+		return 1
+	case DuplicatesByMusicBrainz:
+		return 0.95
+	}
+
+	score := 0.7
+	if spread, ok := spreadOf(g.Tracks, func(t *model.Track) float64 { return t.Cues.AudioEnd }); ok {
+		if spread <= 2 {
+			score += 0.2
+		} else if spread > 15 {
+			score -= 0.3
+		}
+	}
+	if spread, ok := spreadOf(g.Tracks, func(t *model.Track) float64 { return t.Loudness.LUFS }); ok && spread <= 1 {
+		score += 0.1
+	}
+	return math.Round(score*100) / 100
+}
+
+// spreadOf returns max - min of the values of the tracks, ok if all of
+// them are known (non-zero).
+func spreadOf(tracks []*model.Track, value func(*model.Track) float64) (spread float64, ok bool) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, t := range tracks {
+		v := value(t)
+		if v == 0 {
+			return 0, false
+		}
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	return hi - lo, true
+}
+
+// decorations of the titles ignored by normalizeTitle:
+// (feat. X), [Remastered 2011], - Radio Edit, ...
+var titleDecorations = regexp.MustCompile(`(?i)\s*[(\[][^)\]]*(feat\.?|ft\.|remaster|version|edit|mono|stereo)[^)\]]*[)\]]|\s+-\s+[^-]*(remaster|version|edit)[^-]*$`)
+
+// normalizeTitle: "The Beatles" -> "beatles", "Let It Be (Remastered
+// 2009)" -> "let it be", for comparing the names and artists.
+func normalizeTitle(s string) string {
+	s = titleDecorations.ReplaceAllString(s, "")
+	s = strings.ToLower(s)
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return r
+		}
+		return ' '
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	s = strings.TrimPrefix(s, "the ")
+	return s
+}
+
+// GetDuplicates handles: GET /admin/duplicates
+//
+// Query:
+//
+//   - method: hash | musicbrainz | name, comma-separated, default: all
+//   - min_score: float64, [0, 1], default 0
+//
+// Response:
+//
+//   - 200: OK: {groups: [{Method: "name", Key: "artist - name", Score: 0.9,
+//     Tracks: [{...}, ...]}, ...]}: the most similar first
+//   - 400: Bad Request: {error: "bad request"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func GetDuplicates(c *gin.Context) {
+	var methods []string
+	if m := c.Query("method"); m != "" {
+		methods = strings.Split(m, ",")
+	}
+	for _, m := range methods {
+		switch m {
+		case DuplicatesByHash, DuplicatesByMusicBrainz, DuplicatesByName:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown method %q", m)})
+			return
+		}
+	}
+
+	minScore := 0.0
+	if s := c.Query("min_score"); s != "" {
+		var err error
+		if minScore, err = strconv.ParseFloat(s, 64); err != nil || minScore < 0 || minScore > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "min_score should be a number in [0, 1]"})
+			return
+		}
+	}
+
+	groups, err := FindDuplicates(c, minScore, methods...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": groups})
+}
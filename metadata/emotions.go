@@ -0,0 +1,121 @@
+package metadata
+
+// This file provides APIs on the emotion history (model.EmotionRecord).
+
+import (
+	"context"
+	"errors"
+	"musicstore/model"
+	"time"
+
+	"github.com/cdfmlr/crud/orm"
+	"gorm.io/gorm"
+)
+
+// GetEmotionHistory gets the emotion records of the track, latest first.
+func GetEmotionHistory(ctx context.Context, trackID uint) ([]*model.EmotionRecord, error) {
+	var records []*model.EmotionRecord
+	err := orm.DB.WithContext(ctx).
+		Where("track_id = ?", trackID).
+		Order("id DESC").
+		Find(&records).Error
+	return records, err
+}
+
+// EmotionRecordFilter selects emotion records. Fields are combined with
+// AND, zero fields are ignored.
+type EmotionRecordFilter struct {
+	Analyzer     string
+	ModelVersion string
+	JobIDs       []uint
+	TrackIDs     []uint
+	Since        *time.Time // records created at or after
+}
+
+func (f EmotionRecordFilter) IsZero() bool {
+	return f.Analyzer == "" && f.ModelVersion == "" &&
+		len(f.JobIDs) == 0 && len(f.TrackIDs) == 0 && f.Since == nil
+}
+
+func (f EmotionRecordFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.Analyzer != "" {
+		query = query.Where("analyzer = ?", f.Analyzer)
+	}
+	if f.ModelVersion != "" {
+		query = query.Where("model_version = ?", f.ModelVersion)
+	}
+	if len(f.JobIDs) > 0 {
+		query = query.Where("job_id IN ?", f.JobIDs)
+	}
+	if len(f.TrackIDs) > 0 {
+		query = query.Where("track_id IN ?", f.TrackIDs)
+	}
+	if f.Since != nil {
+		query = query.Where("created_at >= ?", *f.Since)
+	}
+	return query
+}
+
+// RollbackEmotions deletes (soft) the emotion records matching the
+// filter, and restores the emotions of the affected tracks to their
+// latest remaining records.
+// Tracks without remaining records are marked as model.AnalysisFailed,
+// so that they are not recommended until re-analyzed.
+//
+// It returns the IDs of the affected tracks.
+func RollbackEmotions(ctx context.Context, filter EmotionRecordFilter) ([]uint, error) {
+	if filter.IsZero() {
+		return nil, errors.New("RollbackEmotions: empty filter")
+	}
+
+	var trackIDs []uint
+	err := orm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := filter.apply(tx.Model(&model.EmotionRecord{})).
+			Distinct().Pluck("track_id", &trackIDs).Error
+		if err != nil {
+			return err
+		}
+		if len(trackIDs) == 0 {
+			return nil
+		}
+
+		err = filter.apply(tx.Model(&model.EmotionRecord{})).
+			Delete(&model.EmotionRecord{}).Error
+		if err != nil {
+			return err
+		}
+
+		for _, id := range trackIDs {
+			if err := restoreLatestEmotion(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return trackIDs, err
+}
+
+// restoreLatestEmotion sets the emotion of the track to its latest record.
+func restoreLatestEmotion(tx *gorm.DB, trackID uint) error {
+	var records []*model.EmotionRecord
+	err := tx.Where("track_id = ?", trackID).
+		Order("id DESC").Limit(1).
+		Find(&records).Error
+	if err != nil {
+		return err
+	}
+
+	track := &model.Track{}
+	track.ID = trackID
+	if len(records) == 0 {
+		track.AnalysisStatus = model.AnalysisFailed
+	} else {
+		track.Emotion = records[0].Emotion
+		track.AnalysisStatus = model.AnalysisDone
+		track.AnalyzedAt = &records[0].CreatedAt
+	}
+
+	return tx.Model(track).
+		Select("valence", "arousal", "confidence", "analysis_status", "analyzed_at").
+		Updates(track).Error
+}
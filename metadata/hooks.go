@@ -0,0 +1,150 @@
+package metadata
+
+// This file provides the hooks on the lifecycle of tracks,
+// e.g. removing the audio file of a deleted track.
+
+import (
+	"context"
+	"musicstore/model"
+	"sync"
+
+	"github.com/cdfmlr/crud/orm"
+	"gorm.io/gorm"
+)
+
+// TrackHook is called on a lifecycle event of the track.
+type TrackHook func(ctx context.Context, track *model.Track)
+
+// TracksHook is called once on a lifecycle event of the tracks of a
+// statement, e.g. of a batch of CreateTracks.
+type TracksHook func(ctx context.Context, tracks []*model.Track)
+
+// trackHooks of an event.
+type trackHooks struct {
+	mu         sync.RWMutex
+	hooks      []TrackHook
+	batchHooks []TracksHook
+}
+
+func (h *trackHooks) add(hook TrackHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, hook)
+}
+
+func (h *trackHooks) addBatch(hook TracksHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batchHooks = append(h.batchHooks, hook)
+}
+
+func (h *trackHooks) run(ctx context.Context, tracks []*model.Track) {
+	h.mu.RLock()
+	hooks, batchHooks := h.hooks, h.batchHooks
+	h.mu.RUnlock()
+
+	saved := make([]*model.Track, 0, len(tracks))
+	for _, track := range tracks {
+		if track.ID != 0 {
+			saved = append(saved, track)
+		}
+	}
+	if len(saved) == 0 {
+		return
+	}
+
+	for _, hook := range batchHooks {
+		hook(ctx, saved)
+	}
+	for _, track := range saved {
+		for _, hook := range hooks {
+			hook(ctx, track)
+		}
+	}
+}
+
+var trackCreatedHooks, trackUpdatedHooks, trackDeletedHooks trackHooks
+
+// OnTrackCreated registers a hook called after a track is created,
+// once the creation is committed.
+func OnTrackCreated(hook TrackHook) {
+	trackCreatedHooks.add(hook)
+}
+
+// OnTracksCreated registers a hook called once after the tracks of a
+// statement are created (e.g. a batch of CreateTracks), once the creation
+// is committed: for the hooks doing better in bulk than per track.
+func OnTracksCreated(hook TracksHook) {
+	trackCreatedHooks.addBatch(hook)
+}
+
+// OnTrackUpdated registers a hook called after a track is updated
+// (including the analysis results), once the update is committed.
+//
+// The track passed to hooks is the model of the update: for the updates
+// of some fields (e.g. Model(track).Updates(changes)), the other fields
+// may be stale.
+func OnTrackUpdated(hook TrackHook) {
+	trackUpdatedHooks.add(hook)
+}
+
+// OnTrackDeleted registers a hook called after a track is deleted
+// (including DELETE /tracks/:TrackID), once the deletion is committed.
+//
+// The track passed to hooks is the deleted one, with all its fields.
+// Deleting by conditions (without loading the tracks) runs no hooks.
+func OnTrackDeleted(hook TrackHook) {
+	trackDeletedHooks.add(hook)
+}
+
+// registerTrackHooks registers the gorm callbacks running the hooks.
+func registerTrackHooks() {
+	callbacks := orm.DB.Callback()
+	errs := []error{
+		callbacks.Create().After("gorm:commit_or_rollback_transaction").
+			Register("musicstore:track_created", trackCallback(&trackCreatedHooks)),
+		callbacks.Update().After("gorm:commit_or_rollback_transaction").
+			Register("musicstore:track_updated", trackCallback(&trackUpdatedHooks)),
+		callbacks.Delete().After("gorm:commit_or_rollback_transaction").
+			Register("musicstore:track_deleted", trackCallback(&trackDeletedHooks)),
+	}
+	for _, err := range errs {
+		if err != nil {
+			logger.WithError(err).Error("registerTrackHooks: Register failed")
+		}
+	}
+}
+
+// trackCallback runs the hooks on the tracks of a successful statement.
+func trackCallback(hooks *trackHooks) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Error != nil || db.Statement.RowsAffected == 0 {
+			return
+		}
+		if tracks := statementTracks(db.Statement); len(tracks) > 0 {
+			hooks.run(db.Statement.Context, tracks)
+		}
+	}
+}
+
+// statementTracks gets the tracks of the statement: the Dest, or the Model
+// (e.g. of Model(track).Updates(map)).
+func statementTracks(stmt *gorm.Statement) []*model.Track {
+	for _, v := range []any{stmt.Dest, stmt.Model} {
+		switch v := v.(type) {
+		case *model.Track:
+			return []*model.Track{v}
+		case []*model.Track:
+			return v
+		case *[]*model.Track:
+			return *v
+		case *[]model.Track:
+			tracks := make([]*model.Track, len(*v))
+			for i := range *v {
+				tracks[i] = &(*v)[i]
+			}
+			return tracks
+		}
+	}
+	return nil
+}
@@ -1,18 +1,402 @@
 package metadata
 
 import (
+	"errors"
+	"fmt"
 	"musicstore/model"
 	"musicstore/murecom"
+	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/cdfmlr/crud/controller"
+	"github.com/cdfmlr/crud/orm"
 	"github.com/cdfmlr/crud/router"
+	"github.com/cdfmlr/crud/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/gin-gonic/gin"
 )
 
 func registerRoutes(r gin.IRouter) {
-	// basic CRUDs
-	router.Crud[model.Track](r, "/tracks")
+	// /tracks/:TrackID accepts UUIDs: of all the routes registered after
+	r.Use(resolveTrackUUID)
+
+	// basic CRUDs, and the listing with sparse fields
+	r.GET("/tracks", GetTrackList)
+	r.GET("/tracks/recent", GetRecentTracks)
+	tracks := r.Group("/tracks")
+	tracks.GET("/:TrackID", controller.GetByIDHandler[model.Track]("TrackID"))
+	tracks.POST("", controller.CreateHandler[model.Track]())
+	tracks.PUT("/:TrackID", controller.UpdateHandler[model.Track]("TrackID"))
+	tracks.DELETE("/:TrackID", controller.DeleteHandler[model.Track]("TrackID"))
+	tracks.GET("/:TrackID/artists", GetArtistsOfTrack)
+
+	// background jobs: read-only, scoped by the library
+	r.GET("/jobs", GetJobList)
+	r.GET("/jobs/:JobID", GetJob)
+
+	// libraries
+	r.GET("/libraries", GetLibraries)
+
+	// playlists, with the items: GET /playlists/:PlaylistID/Items
+	router.Crud[model.Playlist](r, "/playlists",
+		router.GetNested[model.Playlist, model.PlaylistItem]("Items"))
+
+	// duplicates: the report (admin, by the auth rules), and merging
+	r.GET("/admin/duplicates", GetDuplicates)
+	r.POST("/tracks/:TrackID/merge", PostMergeTracks)
 
 	// murecom
 	r.GET("/murecom", murecom.GetMurecom)
+	r.POST("/murecom/trajectory", murecom.PostTrajectory)
+}
+
+// GetJobList handles: GET /jobs
+//
+// As the CRUD listing (limit, offset, order_by, desc, filter_by,
+// filter_value, preload, total), of the jobs in the library scope of the
+// request (see jobScope).
+//
+// Response:
+//
+//   - 200: OK: {Jobs: [{...}, ...], total: 42}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"}
+func GetJobList(c *gin.Context) {
+	var req controller.GetRequestOptions
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var filters []service.QueryOption
+	if scope := jobScope(c); scope != nil {
+		filters = append(filters, scope)
+	}
+	if req.FilterBy != "" && req.FilterValue != "" {
+		filters = append(filters, service.FilterBy(req.FilterBy, req.FilterValue))
+	}
+	options := append([]service.QueryOption{}, filters...)
+	if req.Limit > 0 {
+		options = append(options, service.WithPage(req.Limit, req.Offset))
+	}
+	if req.OrderBy != "" {
+		options = append(options, service.OrderBy(req.OrderBy, req.Descending))
+	}
+	for _, field := range req.Preload {
+		options = append(options, service.Preload(field))
+	}
+
+	var jobs []*model.Job
+	if err := service.GetMany[model.Job](c, &jobs, options...); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := gin.H{"Jobs": jobs}
+	if req.Total {
+		total, err := service.Count[model.Job](c, filters...)
+		if err != nil {
+			resp["totalError"] = err.Error()
+		} else {
+			resp["total"] = total
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetJob handles: GET /jobs/:JobID
+//
+// The job must be in the library scope of the request (see jobScope).
+//
+// Response:
+//
+//   - 200: OK: {job: {...}, track: {...}}
+//     track is the track of the job (e.g. downloaded), if any.
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "record not found"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func GetJob(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("JobID"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var options []service.QueryOption
+	if scope := jobScope(c); scope != nil {
+		options = append(options, scope)
+	}
+
+	var job model.Job
+	err = service.GetByID[model.Job](c, uint(id), &job, options...)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := gin.H{"job": job}
+	if job.TrackID != 0 {
+		track, err := GetTrack(c, job.TrackID)
+		if err == nil {
+			resp["track"] = track
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetLibraries handles: GET /libraries
+//
+// It lists the libraries the request can see (see auth), with the number
+// of tracks in each.
+//
+// Response:
+//
+//   - 200: OK: {libraries: [{Library: "default", Tracks: 42}, ...]}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func GetLibraries(c *gin.Context) {
+	libraries, err := ListLibraries(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"libraries": libraries})
+}
+
+// GetTrackList handles: GET /tracks
+//
+// As the CRUD listing (limit, offset, order_by, desc, filter_by,
+// filter_value, preload, total), and the query fields: the
+// comma-separated fields of the tracks to respond, e.g.
+// fields=ID,Name,Artist,Emotion. Only the columns of them are queried.
+//
+// And sort=created_at|name|artist|play_count|valence&order=asc|desc:
+// ordered in SQL (by the indexes, see createIndexes), before the order_by.
+//
+// And artist=name&role=main|featured: the tracks of the artist (any of
+// the artists of a track, see ByArtist), in the role if given.
+//
+// Response:
+//
+//   - 200: OK: {Tracks: [{...}, ...], total: 42}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"}
+func GetTrackList(c *gin.Context) {
+	fields, err := model.ParseTrackFields(c.Query("fields"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sort, err := trackSort(c.Query("sort"), c.Query("order"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	role, err := parseArtistRole(c.Query("role"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	artist := c.Query("artist")
+	if len(fields) == 0 && sort == nil && artist == "" {
+		controller.GetListHandler[model.Track]()(c)
+		return
+	}
+
+	var req controller.GetRequestOptions
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var filters []service.QueryOption
+	if req.FilterBy != "" && req.FilterValue != "" {
+		filters = append(filters, service.FilterBy(req.FilterBy, req.FilterValue))
+	}
+	if artist != "" {
+		filters = append(filters, ByArtist(artist, role))
+	}
+	var options []service.QueryOption
+	if len(fields) > 0 {
+		columns, err := trackColumns(fields)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		options = append(options, func(tx *gorm.DB) *gorm.DB { return tx.Select(columns) })
+	}
+	options = append(options, filters...)
+	if req.Limit > 0 {
+		options = append(options, service.WithPage(req.Limit, req.Offset))
+	}
+	if sort != nil {
+		options = append(options, sort)
+	}
+	if req.OrderBy != "" {
+		options = append(options, service.OrderBy(req.OrderBy, req.Descending))
+	}
+	for _, field := range req.Preload {
+		options = append(options, service.Preload(field))
+	}
+
+	var tracks []*model.Track
+	if err := service.GetMany[model.Track](c, &tracks, options...); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := gin.H{"Tracks": tracks}
+	if len(fields) > 0 {
+		resp["Tracks"] = model.SparseTracks(tracks, fields)
+	}
+	if req.Total {
+		total, err := service.Count[model.Track](c, filters...)
+		if err != nil {
+			resp["totalError"] = err.Error()
+		} else {
+			resp["total"] = total
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// trackSorts: the columns to order the tracks by, of the sort query,
+// each followed by the id to be stable across pages.
+var trackSorts = map[string][]string{
+	"created_at": {"created_at"},
+	"name":       {"name", "artist"},
+	"artist":     {"artist", "album", "name"},
+	"play_count": {"play_count"},
+	"valence":    {"valence"},
+}
+
+// trackSort returns the QueryOption ordering the tracks by the sort and
+// the order (asc by default), or nil if no sort.
+func trackSort(sort, order string) (service.QueryOption, error) {
+	if sort == "" {
+		return nil, nil
+	}
+	columns, ok := trackSorts[sort]
+	if !ok {
+		return nil, fmt.Errorf("bad sort %q: want created_at, name, artist, play_count or valence", sort)
+	}
+	var desc bool
+	switch order {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return nil, fmt.Errorf("bad order %q: want asc or desc", order)
+	}
+
+	return func(tx *gorm.DB) *gorm.DB {
+		for _, column := range append(columns, "id") {
+			tx = tx.Order(clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: desc})
+		}
+		return tx
+	}, nil
+}
+
+// maxRecentDays and maxRecentLimit of GetRecentTracks.
+const (
+	maxRecentDays  = 366
+	maxRecentLimit = 500
+)
+
+// RecentRequest is the query of GetRecentTracks.
+type RecentRequest struct {
+	Days   int    `form:"days"`   // default 7
+	Limit  int    `form:"limit"`  // default 50
+	Fields string `form:"fields"` // as GET /tracks
+}
+
+// GetRecentTracks handles: GET /tracks/recent?days=7&limit=50&fields=...
+//
+// It lists the tracks added in the last days, newest first, e.g. for a
+// "New in your library" shelf. Ordered by the CreatedAt, with the ID as
+// the tie-breaker, using the index on (library, created_at).
+//
+// Response:
+//
+//   - 200: OK: {Tracks: [{...}, ...]}
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"}
+func GetRecentTracks(c *gin.Context) {
+	req := RecentRequest{Days: 7, Limit: 50}
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Days < 1 || req.Days > maxRecentDays || req.Limit < 1 || req.Limit > maxRecentLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf(
+			"days: want 1 to %d, limit: want 1 to %d", maxRecentDays, maxRecentLimit)})
+		return
+	}
+	fields, err := model.ParseTrackFields(req.Fields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -req.Days)
+	options := []service.QueryOption{
+		func(tx *gorm.DB) *gorm.DB { return tx.Where("created_at >= ?", since) },
+		service.OrderBy("created_at", true),
+		service.OrderBy("id", true),
+		service.WithPage(req.Limit, 0),
+	}
+	if len(fields) > 0 {
+		columns, err := trackColumns(fields)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		options = append(options, func(tx *gorm.DB) *gorm.DB { return tx.Select(columns) })
+	}
+
+	var tracks []*model.Track
+	if err := service.GetMany[model.Track](c, &tracks, options...); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if len(fields) > 0 {
+		c.JSON(http.StatusOK, gin.H{"Tracks": model.SparseTracks(tracks, fields)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Tracks": tracks})
+}
+
+// trackColumns returns the columns of the fields of the tracks (see
+// model.ParseTrackFields): the embedded ones (e.g. Emotion) have several.
+// The id is always queried.
+func trackColumns(fields []string) ([]string, error) {
+	stmt := &gorm.Statement{DB: orm.DB}
+	if err := stmt.Parse(&model.Track{}); err != nil {
+		return nil, fmt.Errorf("trackColumns: Parse failed: %w", err)
+	}
+
+	wanted := map[string]bool{"ID": true}
+	for _, f := range fields {
+		wanted[f] = true
+	}
+	var columns []string
+	for _, f := range stmt.Schema.Fields {
+		if f.DBName == "" || len(f.BindNames) == 0 {
+			continue
+		}
+		name := f.BindNames[0] // of the field of the Track
+		if name == "BasicModel" && len(f.BindNames) > 1 {
+			name = f.BindNames[1]
+		}
+		if wanted[name] {
+			columns = append(columns, f.DBName)
+		}
+	}
+	return columns, nil
 }
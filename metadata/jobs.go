@@ -0,0 +1,206 @@
+package metadata
+
+// This file provides APIs on the background jobs (model.Job),
+// the track fields updated by them, and the emotion cache.
+
+import (
+	"context"
+	"musicstore/model"
+	"time"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/cdfmlr/crud/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CreateJob saves a new job.
+func CreateJob(ctx context.Context, job *model.Job) error {
+	return service.Create(ctx, job, service.IfNotExist())
+}
+
+// CreateJobs saves new jobs in batches.
+func CreateJobs(ctx context.Context, jobs []*model.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	return orm.DB.WithContext(ctx).CreateInBatches(jobs, 500).Error
+}
+
+// ClaimJob marks the oldest pending job of the kind (and matching the
+// options, if any) as running, and returns it.
+// It returns nil if there is no pending job.
+//
+// It is safe to be called by concurrent workers:
+// a job is claimed by only one of them.
+func ClaimJob(ctx context.Context, kind string, options ...service.QueryOption) (*model.Job, error) {
+	for {
+		query := orm.DB.WithContext(ctx).
+			Where("kind = ? AND status = ?", kind, model.JobPending)
+		for _, option := range options {
+			query = option(query)
+		}
+
+		var jobs []*model.Job
+		err := query.Order("id").Limit(1).Find(&jobs).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(jobs) == 0 {
+			return nil, nil
+		}
+
+		job := jobs[0]
+		result := orm.DB.WithContext(ctx).Model(job).
+			Where("status = ?", model.JobPending).
+			Update("status", model.JobRunning)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			job.Status = model.JobRunning
+			return job, nil
+		}
+		// claimed by another worker: try the next one
+	}
+}
+
+// GetLastJobs gets the last job of the kind for each track: trackID -> job.
+func GetLastJobs(ctx context.Context, kind string) (map[uint]*model.Job, error) {
+	lastIDs := orm.DB.Model(&model.Job{}).
+		Select("MAX(id)").
+		Where("kind = ?", kind).
+		Group("track_id")
+
+	var jobs []*model.Job
+	err := orm.DB.WithContext(ctx).
+		Where("id IN (?)", lastIDs).
+		Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[uint]*model.Job, len(jobs))
+	for _, job := range jobs {
+		m[job.TrackID] = job
+	}
+	return m, nil
+}
+
+// FinishJob marks the job as done, or failed if err is not nil.
+// The TrackID and Results of the job are saved as well.
+func FinishJob(ctx context.Context, job *model.Job, err error) error {
+	job.Status = model.JobDone
+	job.Error = ""
+	if err != nil {
+		job.Status = model.JobFailed
+		job.Error = err.Error()
+	}
+
+	return orm.DB.WithContext(ctx).Model(job).
+		Select("status", "error", "track_id", "results").
+		Updates(job).Error
+}
+
+// UpdateJobProgress saves the BytesDone, BytesTotal and Phase of the job.
+func UpdateJobProgress(ctx context.Context, job *model.Job) error {
+	return orm.DB.WithContext(ctx).Model(job).
+		Select("bytes_done", "bytes_total", "phase").
+		Updates(job).Error
+}
+
+// RequeueJob marks the running job as pending again, to be retried later.
+func RequeueJob(ctx context.Context, job *model.Job) error {
+	job.Status = model.JobPending
+	return orm.DB.WithContext(ctx).Model(job).
+		Update("status", model.JobPending).Error
+}
+
+// RequeueRunningJobs marks running jobs of the kind (and matching the
+// options, if any) as pending again.
+// Call it at startup to pick up jobs interrupted by the last shutdown.
+func RequeueRunningJobs(ctx context.Context, kind string, options ...service.QueryOption) error {
+	query := orm.DB.WithContext(ctx).Model(&model.Job{}).
+		Where("kind = ? AND status = ?", kind, model.JobRunning)
+	for _, option := range options {
+		query = option(query)
+	}
+	return query.Update("status", model.JobPending).Error
+}
+
+// FailStaleJobs marks the pending and running jobs of the kind (and
+// matching the options, if any) not updated since before as failed,
+// with the reason. It returns the number of them.
+func FailStaleJobs(ctx context.Context, kind string, before time.Time, reason string, options ...service.QueryOption) (int64, error) {
+	query := orm.DB.WithContext(ctx).Model(&model.Job{}).
+		Where("kind = ? AND status IN ? AND updated_at < ?",
+			kind, []string{model.JobPending, model.JobRunning}, before)
+	for _, option := range options {
+		query = option(query)
+	}
+	result := query.Updates(map[string]any{"status": model.JobFailed, "error": reason})
+	return result.RowsAffected, result.Error
+}
+
+// GetTrack gets a track by ID.
+func GetTrack(ctx context.Context, id uint) (*model.Track, error) {
+	var track model.Track
+	err := service.GetByID[model.Track](ctx, id, &track)
+	return &track, err
+}
+
+// GetTrackIDs gets the IDs of the tracks matching the query options.
+func GetTrackIDs(ctx context.Context, options ...service.QueryOption) ([]uint, error) {
+	query := orm.DB.WithContext(ctx).Model(&model.Track{})
+	for _, option := range options {
+		query = option(query)
+	}
+
+	var ids []uint
+	err := query.Pluck("id", &ids).Error
+	return ids, err
+}
+
+// UpdateTrackAnalysis updates only the analysis results (emotion, BPM,
+// loudness, cues, genre) and the analysis status (and time) of the track, leaving other
+// fields untouched.
+//
+// If record is not nil, it's added to the emotion history of the track
+// in the same transaction.
+func UpdateTrackAnalysis(ctx context.Context, track *model.Track, record *model.EmotionRecord) error {
+	return orm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if record != nil {
+			record.TrackID = track.ID
+			if err := tx.Create(record).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(track).
+			Select("valence", "arousal", "confidence", "bpm",
+				"loudness_lufs", "loudness_replay_gain", "loudness_peak",
+				"cue_audio_start", "cue_intro_end", "cue_outro_start", "cue_audio_end",
+				"genre", "analysis_status", "analyzed_at").
+			Updates(track).Error
+	})
+}
+
+// GetCachedEmotion gets the cached result of the audio content hash
+// by the analyzer. It returns nil if it is not cached.
+func GetCachedEmotion(ctx context.Context, hash string, analyzer string) (*model.EmotionCache, error) {
+	var caches []*model.EmotionCache
+	err := orm.DB.WithContext(ctx).
+		Where("hash = ? AND analyzer = ?", hash, analyzer).Limit(1).
+		Find(&caches).Error
+	if err != nil || len(caches) == 0 {
+		return nil, err
+	}
+	return caches[0], nil
+}
+
+// CacheEmotion saves (or replaces) the cached result of the
+// (Hash, Analyzer).
+func CacheEmotion(ctx context.Context, cache *model.EmotionCache) error {
+	return orm.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(cache).Error
+}
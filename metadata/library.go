@@ -0,0 +1,80 @@
+package metadata
+
+import (
+	"context"
+	"musicstore/model"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/cdfmlr/crud/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// this file scopes the queries of the tracks (and the playlists) by the
+// library of the context (see model.LibraryOf): a scoped request sees
+// (and updates, deletes) only the tracks in its library.
+//
+// Raw SQL is not scoped: filter it by model.LibraryOf explicitly.
+
+// registerLibraryScope registers the gorm callbacks scoping the queries.
+func registerLibraryScope() {
+	callbacks := orm.DB.Callback()
+	errs := []error{
+		callbacks.Query().Before("gorm:query").Register("musicstore:library_scope", libraryScopeCallback),
+		callbacks.Row().Before("gorm:row").Register("musicstore:library_scope", libraryScopeCallback),
+		callbacks.Update().Before("gorm:update").Register("musicstore:library_scope", libraryScopeCallback),
+		callbacks.Delete().Before("gorm:delete").Register("musicstore:library_scope", libraryScopeCallback),
+	}
+	for _, err := range errs {
+		if err != nil {
+			logger.WithError(err).Error("registerLibraryScope: Register failed")
+		}
+	}
+}
+
+func libraryScopeCallback(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+	if table := db.Statement.Schema.Table; table != "tracks" && table != "playlists" {
+		return
+	}
+	library := model.LibraryOf(db.Statement.Context)
+	if library == "" {
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "library"}, Value: library},
+	}})
+}
+
+// jobScope returns the QueryOption scoping the jobs by the library of the
+// ctx: a scoped request sees only the jobs of the tracks in its library,
+// not the ones without a track (e.g. downloads in progress).
+// nil if not scoped.
+func jobScope(ctx context.Context) service.QueryOption {
+	library := model.LibraryOf(ctx)
+	if library == "" {
+		return nil
+	}
+	return func(tx *gorm.DB) *gorm.DB {
+		tracks := orm.DB.Model(&model.Track{}).Select("id").Where("library = ?", library)
+		return tx.Where("track_id IN (?)", tracks)
+	}
+}
+
+// LibraryStats is the number of tracks in a library.
+type LibraryStats struct {
+	Library string
+	Tracks  int64
+}
+
+// ListLibraries lists the libraries (with tracks) in the scope of the ctx.
+func ListLibraries(ctx context.Context) ([]LibraryStats, error) {
+	var stats []LibraryStats
+	err := orm.DB.WithContext(ctx).Model(&model.Track{}).
+		Select("library, COUNT(*) AS tracks").
+		Group("library").Order("library").
+		Scan(&stats).Error
+	return stats, err
+}
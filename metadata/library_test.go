@@ -0,0 +1,100 @@
+package metadata
+
+import (
+	"encoding/json"
+	"musicstore/model"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/gin-gonic/gin"
+)
+
+func TestJobScope(t *testing.T) {
+	db := migrateTestDB(t)
+	saved := orm.DB
+	orm.DB = db
+	t.Cleanup(func() { orm.DB = saved })
+
+	// jobs by the library of their tracks, 0 for no track
+	jobs := map[string]uint{"default": 0, "kids": 0, "": 0}
+	for _, library := range []string{"default", "kids", ""} {
+		job := model.Job{Kind: model.JobKindDownload}
+		if library != "" {
+			track := model.Track{Name: library, Library: library}
+			if err := db.Create(&track).Error; err != nil {
+				t.Fatal(err)
+			}
+			job.TrackID = track.ID
+		}
+		if err := db.Create(&job).Error; err != nil {
+			t.Fatal(err)
+		}
+		jobs[library] = job.ID
+	}
+
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		library string // scope, "" for all
+		want    []uint
+	}{
+		{"", []uint{jobs["default"], jobs["kids"], jobs[""]}},
+		{"default", []uint{jobs["default"]}},
+		{"kids", []uint{jobs["kids"]}},
+		{"other", nil},
+	}
+	for _, tt := range tests {
+		t.Run("library "+tt.library, func(t *testing.T) {
+			r := gin.New()
+			r.Use(func(c *gin.Context) {
+				if tt.library != "" {
+					c.Set(model.LibraryContextKey, tt.library)
+				}
+			})
+			r.GET("/jobs", GetJobList)
+			r.GET("/jobs/:JobID", GetJob)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/jobs?total=true", nil))
+			var resp struct {
+				Jobs  []model.Job
+				Total int
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("GET /jobs: %v: %s", err, w.Body)
+			}
+			var got []uint
+			for _, job := range resp.Jobs {
+				got = append(got, job.ID)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if len(got) != len(tt.want) || resp.Total != len(tt.want) {
+				t.Fatalf("GET /jobs = %v (total %d), want %v", got, resp.Total, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("GET /jobs = %v, want %v", got, tt.want)
+				}
+			}
+
+			in := map[uint]bool{}
+			for _, id := range tt.want {
+				in[id] = true
+			}
+			for _, id := range jobs {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest("GET", "/jobs/"+strconv.Itoa(int(id)), nil))
+				want := http.StatusNotFound
+				if in[id] {
+					want = http.StatusOK
+				}
+				if w.Code != want {
+					t.Errorf("GET /jobs/%d = %d, want %d", id, w.Code, want)
+				}
+			}
+		})
+	}
+}
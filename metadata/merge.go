@@ -0,0 +1,173 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+	"strconv"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// this file merges duplicate tracks (e.g. found by GET /admin/duplicates)
+// into a canonical one.
+
+type filesKeptKey struct{}
+
+// WithFilesKept returns a context deleting tracks without their files:
+// the stores leave the files of the tracks deleted in it, regardless of
+// their OnDelete.
+func WithFilesKept(ctx context.Context) context.Context {
+	return context.WithValue(ctx, filesKeptKey{}, true)
+}
+
+// FilesKept checks if the files of the tracks deleted in the ctx are to
+// be kept, see WithFilesKept.
+func FilesKept(ctx context.Context) bool {
+	kept, _ := ctx.Value(filesKeptKey{}).(bool)
+	return kept
+}
+
+// MergeTracks merges the duplicates into the canonical track (all by ID,
+// in the scope of the ctx):
+//
+//   - the play counts are summed up, and the highest rating and the
+//     latest play are kept;
+//   - the empty tags and IDs (Album, Genre, CoverImageURL, MusicBrainzID,
+//     SpotifyID) of the canonical track are filled from the duplicates;
+//   - the playlist items of the duplicates refer to the canonical track;
+//
+// then the duplicates are deleted, with their files (by the OnDelete of
+// their stores) unless deleteFiles is false.
+func MergeTracks(ctx context.Context, canonicalID uint, duplicateIDs []uint, deleteFiles bool) (*model.Track, error) {
+	seen := map[uint]bool{}
+	ids := make([]uint, 0, len(duplicateIDs))
+	for _, id := range duplicateIDs {
+		if id == canonicalID {
+			return nil, fmt.Errorf("MergeTracks: track %d merged into itself", id)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	duplicateIDs = ids
+
+	canonical, err := GetTrack(ctx, canonicalID)
+	if err != nil {
+		return nil, fmt.Errorf("MergeTracks: GetTrack failed: %w", err)
+	}
+	var duplicates []*model.Track
+	if err := orm.DB.WithContext(ctx).Where("id IN ?", duplicateIDs).Find(&duplicates).Error; err != nil {
+		return nil, fmt.Errorf("MergeTracks: query duplicates failed: %w", err)
+	}
+	if len(duplicates) != len(duplicateIDs) {
+		return nil, fmt.Errorf("MergeTracks: %w: %d of %d duplicates found",
+			gorm.ErrRecordNotFound, len(duplicates), len(duplicateIDs))
+	}
+
+	for _, d := range duplicates {
+		canonical.PlayCount += d.PlayCount
+		if d.Rating > canonical.Rating {
+			canonical.Rating = d.Rating
+		}
+		if d.LastPlayedAt != nil && (canonical.LastPlayedAt == nil || d.LastPlayedAt.After(*canonical.LastPlayedAt)) {
+			canonical.LastPlayedAt = d.LastPlayedAt
+		}
+		for _, f := range []struct{ dst, src *string }{
+			{&canonical.Album, &d.Album},
+			{&canonical.Genre, &d.Genre},
+			{&canonical.CoverImageURL, &d.CoverImageURL},
+			{&canonical.MusicBrainzID, &d.MusicBrainzID},
+			{&canonical.SpotifyID, &d.SpotifyID},
+		} {
+			if *f.dst == "" {
+				*f.dst = *f.src
+			}
+		}
+	}
+
+	err = orm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(canonical).
+			Select("play_count", "rating", "last_played_at",
+				"album", "genre", "cover_image_url", "music_brainz_id", "spotify_id").
+			Updates(canonical).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&model.PlaylistItem{}).
+			Where("track_id IN ?", duplicateIDs).
+			Update("track_id", canonical.ID).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("MergeTracks: update failed: %w", err)
+	}
+
+	// after the commit: the CoverImageURL taken from a duplicate is
+	// shared by the canonical track now, and kept on its deletion.
+	deleteCtx := ctx
+	if !deleteFiles {
+		deleteCtx = WithFilesKept(ctx)
+	}
+	if err := orm.DB.WithContext(deleteCtx).Delete(&duplicates).Error; err != nil {
+		return canonical, fmt.Errorf("MergeTracks: delete duplicates failed: %w", err)
+	}
+
+	logger.WithContext(ctx).WithField("track", canonical.ID).
+		WithField("duplicates", duplicateIDs).WithField("deleteFiles", deleteFiles).
+		Info("MergeTracks: merged")
+	return canonical, nil
+}
+
+// PostMergeTracksRequest is the body of POST /tracks/:TrackID/merge.
+type PostMergeTracksRequest struct {
+	IDs         []uint `binding:"required,min=1"` // of the duplicates
+	DeleteFiles bool
+}
+
+// PostMergeTracks handles: POST /tracks/:TrackID/merge
+//
+// Body (JSON): {"IDs": [2, 3], "DeleteFiles": true}
+//
+// The tracks of the IDs are merged into the track :TrackID, and deleted,
+// see MergeTracks.
+//
+// Response:
+//
+//   - 200: OK: {track: {...}}: the merged track
+//   - 400: Bad Request: {error: "bad request"}
+//   - 404: Not Found: {error: "record not found"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func PostMergeTracks(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("TrackID"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req PostMergeTracksRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, dup := range req.IDs {
+		if dup == uint(id) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "IDs should not include the track itself"})
+			return
+		}
+	}
+
+	track, err := MergeTracks(c, uint(id), req.IDs, req.DeleteFiles)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"track": track})
+}
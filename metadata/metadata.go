@@ -3,6 +3,9 @@
 package metadata
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"musicstore/model"
 
 	"github.com/cdfmlr/crud/log"
@@ -20,14 +23,45 @@ var logger = log.ZoneLogger("musicstore/metadata")
 // There should be only one metadata module in a program.
 // The metadata module should be run before audiofilestore modules.
 func Start(dbDSN string, router gin.IRouter) {
-	// orm.ConnectDB(orm.DBDriverSqlite, "musicstore.db")
-	connectDB(dbDSN)
-
-	orm.RegisterModel(&model.Track{})
+	if err := Open(dbDSN); err != nil {
+		logger.WithError(err).Error("Start: Open failed")
+	}
 
 	registerRoutes(router)
 }
 
+// Open the database of the metadata module, without routes,
+// e.g. for the CLI commands working offline.
+func Open(dbDSN string) error {
+	// orm.ConnectDB(orm.DBDriverSqlite, "musicstore.db")
+	if err := connectDB(dbDSN); err != nil {
+		return fmt.Errorf("Open: connectDB failed: %w", err)
+	}
+	if err := addTrackUUIDColumn(); err != nil {
+		return fmt.Errorf("Open: %w", err)
+	}
+
+	if err := orm.RegisterModel(models...); err != nil {
+		return fmt.Errorf("Open: RegisterModel failed: %w", err)
+	}
+	if err := createIndexes(); err != nil {
+		return fmt.Errorf("Open: %w", err)
+	}
+	if err := backfillAnalysisStatus(); err != nil {
+		return fmt.Errorf("Open: %w", err)
+	}
+	registerTrackHooks()
+	registerLibraryScope()
+	registerTrackArtists()
+	if err := backfillTrackUUIDs(); err != nil {
+		logger.WithError(err).Error("backfillTrackUUIDs failed")
+	}
+	if err := backfillTrackArtists(); err != nil {
+		logger.WithError(err).Error("backfillTrackArtists failed")
+	}
+	return nil
+}
+
 // TODO: crud should support custom driver
 func connectDB(dsn string) error {
 	var err error
@@ -36,3 +70,96 @@ func connectDB(dsn string) error {
 	})
 	return err
 }
+
+// createIndexes creates the indexes that can't be declared by the tags of
+// the models, e.g. the ones of the embedded fields, or the ones with
+// COLLATE NOCASE.
+func createIndexes() error {
+	indexes := []struct {
+		name, table, columns string
+	}{
+		// murecom: valence and arousal BETWEEN. Not a tag of the Emotion,
+		// which is embedded in other models as well.
+		{"idx_tracks_valence_arousal", "tracks", "valence, arousal"},
+
+		// the sorts of the track listings in a library (see trackSorts),
+		// and GET /tracks/recent by the created_at of the BasicModel
+		{"idx_tracks_library_created_at", "tracks", "library, created_at"},
+		{"idx_tracks_library_name", "tracks", "library, name, artist"},
+		{"idx_tracks_library_artist", "tracks", "library, artist, album, name"},
+		{"idx_tracks_library_play_count", "tracks", "library, play_count"},
+		{"idx_tracks_library_valence", "tracks", "library, valence"},
+
+		// the same sorts across the libraries, after the deleted_at IS NULL
+		// of the soft deletes: without it the equality on
+		// idx_tracks_deleted_at is preferred, and sorted.
+		{"idx_tracks_sort_created_at", "tracks", "deleted_at, created_at"},
+		{"idx_tracks_sort_name", "tracks", "deleted_at, name, artist"},
+		{"idx_tracks_sort_artist", "tracks", "deleted_at, artist, album, name"},
+		{"idx_tracks_sort_play_count", "tracks", "deleted_at, play_count"},
+		{"idx_tracks_sort_valence", "tracks", "deleted_at, valence"},
+
+		// the CanonicalArtist of the imports, case-insensitive
+		{"idx_tracks_library_artist_nocase", "tracks", "library, artist COLLATE NOCASE"},
+		// the tracks of an artist (ByArtist), case-insensitive
+		{"idx_track_artists_name", "track_artists", "name COLLATE NOCASE, role"},
+	}
+	for _, index := range indexes {
+		err := orm.DB.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", index.name, index.table, index.columns)).Error
+		if err != nil {
+			return fmt.Errorf("createIndexes: %s failed: %w", index.name, err)
+		}
+	}
+	return nil
+}
+
+// backfillAnalysisStatus sets the AnalysisStatus of the tracks created
+// before it was added: the column is added as NULL, which no comparison
+// (e.g. the analysis_status NOT IN of murecom) matches.
+func backfillAnalysisStatus() error {
+	// raw: no hooks, all the tracks (deleted ones and of any library)
+	result := orm.DB.Exec("UPDATE tracks SET analysis_status = ? WHERE analysis_status IS NULL", model.AnalysisNone)
+	if result.Error != nil {
+		return fmt.Errorf("backfillAnalysisStatus failed: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		logger.WithField("tracks", result.RowsAffected).Info("backfillAnalysisStatus: status set")
+	}
+	return nil
+}
+
+// Ping checks if the database is reachable.
+func Ping(ctx context.Context) error {
+	if orm.DB == nil {
+		return errors.New("Ping: not connected")
+	}
+	db, err := orm.DB.DB()
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	return db.PingContext(ctx)
+}
+
+// Migrate creates or migrates the tables of the models in the database
+// at dbDSN, without starting the metadata module.
+func Migrate(dbDSN string) error {
+	if err := connectDB(dbDSN); err != nil {
+		return fmt.Errorf("Migrate: connectDB failed: %w", err)
+	}
+	if err := addTrackUUIDColumn(); err != nil {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	if err := orm.RegisterModel(models...); err != nil {
+		return fmt.Errorf("Migrate: RegisterModel failed: %w", err)
+	}
+	if err := createIndexes(); err != nil {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	if err := backfillAnalysisStatus(); err != nil {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+	if db, err := orm.DB.DB(); err == nil {
+		db.Close()
+	}
+	return nil
+}
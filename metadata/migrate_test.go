@@ -0,0 +1,114 @@
+package metadata
+
+import (
+	"musicstore/model"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// baselineSchema is the tracks table of the first versions.
+const baselineSchema = "CREATE TABLE `tracks` (`id` integer,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime," +
+	"`name` text,`artist` text,`album` text,`cover_image_url` text,`audio_file_url` text,`valence` real,`arousal` real,PRIMARY KEY (`id`))"
+
+// baselineTracks are tracks inserted by the first versions.
+const baselineTracks = "INSERT INTO tracks (id, created_at, updated_at, name, artist, valence, arousal) VALUES " +
+	"(1, '2023-01-01', '2023-01-01', 'a', 'b', 0.5, 0.5), (2, '2023-01-01', '2023-01-01', 'c', 'd', 0.1, 0.9)"
+
+// migrateTestDB creates the database by the statements, and migrates it.
+// It returns the migrated database.
+func migrateTestDB(t *testing.T, setup ...string) *gorm.DB {
+	dsn := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, dsn)
+	for _, stmt := range setup {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("setup %q failed: %v", stmt, err)
+		}
+	}
+	closeTestDB(db)
+
+	if err := Migrate(dsn); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	db = openTestDB(t, dsn)
+	t.Cleanup(func() { closeTestDB(db) })
+	return db
+}
+
+func openTestDB(t *testing.T, dsn string) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func closeTestDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func TestMigrateTrackUUID(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []string
+	}{
+		{name: "new database"},
+		{name: "baseline", setup: []string{baselineSchema, baselineTracks}},
+		{name: "baseline without tracks", setup: []string{baselineSchema}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := migrateTestDB(t, tt.setup...)
+			if !db.Migrator().HasColumn(&model.Track{}, "UUID") {
+				t.Fatal("no uuid column")
+			}
+			if err := db.Exec("UPDATE tracks SET uuid = 'x' WHERE id = 1").Error; err != nil {
+				t.Fatal(err)
+			}
+			err := db.Exec("INSERT INTO tracks (id, uuid) VALUES (3, 'y'), (4, 'y')").Error
+			if err == nil {
+				t.Error("duplicate uuids inserted, want the column unique")
+			}
+		})
+	}
+}
+
+func TestMigrateAnalysisStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []string
+	}{
+		{name: "baseline", setup: []string{baselineSchema, baselineTracks}},
+		{
+			// by the versions adding the column without a default
+			name:  "analysis_status added as NULL",
+			setup: []string{baselineSchema, "ALTER TABLE `tracks` ADD `analysis_status` text", baselineTracks},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := migrateTestDB(t, tt.setup...)
+			// by an older version, without the column
+			if err := db.Exec("INSERT INTO tracks (id, name) VALUES (3, 'e')").Error; err != nil {
+				t.Fatal(err)
+			}
+
+			var nulls, matched int64
+			db.Model(&model.Track{}).Where("analysis_status IS NULL").Count(&nulls)
+			if nulls != 0 {
+				t.Errorf("tracks of NULL analysis_status = %d, want 0", nulls)
+			}
+			// as murecom and the trajectories
+			db.Model(&model.Track{}).Where("analysis_status NOT IN ?",
+				[]string{model.AnalysisPending, model.AnalysisFailed}).Count(&matched)
+			if matched != 3 {
+				t.Errorf("tracks matched by analysis_status NOT IN = %d, want 3", matched)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package metadata
+
+import (
+	"context"
+	"musicstore/model"
+
+	"github.com/cdfmlr/crud/orm"
+	"gorm.io/gorm"
+)
+
+// This file provides APIs on the playlists, and the listening stats of
+// the tracks, e.g. for the importers of other players' libraries.
+
+// SavePlaylist creates the playlist with its items, or replaces the one
+// of the same Source (in the library of the ctx) if any, e.g. on
+// re-imports.
+func SavePlaylist(ctx context.Context, playlist *model.Playlist) error {
+	return orm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if playlist.Source != "" {
+			var existing []*model.Playlist
+			err := tx.Where("source = ?", playlist.Source).Limit(1).Find(&existing).Error
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				playlist.ID = existing[0].ID
+				playlist.Library = existing[0].Library
+				err := tx.Where("playlist_id = ?", playlist.ID).Delete(&model.PlaylistItem{}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Save(playlist).Error
+	})
+}
+
+// UpdateTrackStats updates only the listening stats (PlayCount, Rating,
+// LastPlayedAt) of the track.
+func UpdateTrackStats(ctx context.Context, track *model.Track) error {
+	return orm.DB.WithContext(ctx).Model(track).
+		Select("play_count", "rating", "last_played_at").
+		Updates(track).Error
+}
+
+// FindTrackByFile finds the track of the audio file: by the URL, or by
+// the content hash, whichever is not empty. It returns nil if none.
+func FindTrackByFile(ctx context.Context, fileUrl string, hash string) (*model.Track, error) {
+	query := orm.DB.WithContext(ctx)
+	switch {
+	case fileUrl != "" && hash != "":
+		query = query.Where("(audio_file_url = ? OR audio_file_hash = ?)", fileUrl, hash)
+	case fileUrl != "":
+		query = query.Where("audio_file_url = ?", fileUrl)
+	case hash != "":
+		query = query.Where("audio_file_hash = ?", hash)
+	default:
+		return nil, nil
+	}
+
+	var tracks []*model.Track
+	if err := query.Limit(1).Find(&tracks).Error; err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, nil
+	}
+	return tracks[0], nil
+}
@@ -0,0 +1,99 @@
+package metadata
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// this file tunes the sqlite database by the pragmas in the DSN, which
+// the driver runs on every new connection.
+//
+// The defaults (WAL, a busy timeout) let the readers go on while a track
+// is written, and the writers (e.g. the uploads during a scan) wait for
+// each other instead of failing with "database is locked".
+
+// SQLiteOptions are the pragmas of the database. Zero values are the
+// defaults.
+type SQLiteOptions struct {
+	// JournalMode: delete | truncate | persist | memory | wal | off,
+	// default wal.
+	JournalMode string
+	// BusyTimeout: how long to wait for a lock, default 5s.
+	BusyTimeout time.Duration
+	// Synchronous: off | normal | full | extra, default normal (safe with
+	// WAL; full otherwise).
+	Synchronous string
+	// CacheSize: pages if > 0, or KiB if < 0, as PRAGMA cache_size.
+	// 0: the default of sqlite (2 MiB).
+	CacheSize int
+}
+
+var (
+	journalModes = []string{"delete", "truncate", "persist", "memory", "wal", "off"}
+	synchronous  = []string{"off", "normal", "full", "extra"}
+)
+
+// DSN returns the data source name of the database file with the pragmas.
+// The DSN is returned as is if it has pragmas already (_pragma=...).
+func DSN(file string, opts SQLiteOptions) (string, error) {
+	if strings.Contains(file, "_pragma=") {
+		return file, nil
+	}
+
+	journalMode := strings.ToLower(opts.JournalMode)
+	if journalMode == "" {
+		journalMode = "wal"
+	}
+	if !contains(journalModes, journalMode) {
+		return "", fmt.Errorf("DSN: bad JournalMode %q: want one of %v", opts.JournalMode, journalModes)
+	}
+
+	sync := strings.ToLower(opts.Synchronous)
+	if sync == "" {
+		sync = "normal"
+		if journalMode != "wal" {
+			sync = "full"
+		}
+	}
+	if !contains(synchronous, sync) {
+		return "", fmt.Errorf("DSN: bad Synchronous %q: want one of %v", opts.Synchronous, synchronous)
+	}
+
+	busyTimeout := opts.BusyTimeout
+	if busyTimeout == 0 {
+		busyTimeout = 5 * time.Second
+	}
+	if busyTimeout < 0 {
+		return "", fmt.Errorf("DSN: bad BusyTimeout %v", opts.BusyTimeout)
+	}
+
+	pragmas := []string{
+		fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()),
+		fmt.Sprintf("journal_mode(%s)", journalMode),
+		fmt.Sprintf("synchronous(%s)", sync),
+	}
+	if opts.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("cache_size(%d)", opts.CacheSize))
+	}
+
+	dsn := file
+	sep := "?"
+	if strings.Contains(file, "?") {
+		sep = "&"
+	}
+	for _, p := range pragmas {
+		dsn += sep + "_pragma=" + p
+		sep = "&"
+	}
+	return dsn, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package metadata
+
+import (
+	"context"
+	"musicstore/model"
+	"time"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/cdfmlr/crud/service"
+)
+
+// this file implements the statistics of the tracks, for dashboards
+// (see GET /stats).
+
+// TrackStats are the totals of a set of tracks.
+type TrackStats struct {
+	Tracks  int64
+	Artists int64 // distinct non-empty Artists
+	Albums  int64 // distinct non-empty (Album, Artist)s
+	// Hours of audio, by the AudioEnd cues (tracks without are not counted),
+	// and Bytes of the audio files.
+	Hours float64
+	Bytes int64
+
+	// tracks missing the cover image, the emotion (not analyzed yet,
+	// or failed), or the duration (the AudioEnd cue)
+	MissingCover    int64
+	MissingEmotion  int64
+	MissingDuration int64
+}
+
+// ImportsOfDay: the number of tracks created on the Day (YYYY-MM-DD).
+type ImportsOfDay struct {
+	Day    string
+	Tracks int64
+}
+
+// GetTrackStats counts the tracks selected by the options
+// (all the tracks of the library of the ctx if none).
+func GetTrackStats(ctx context.Context, options ...service.QueryOption) (*TrackStats, error) {
+	query := orm.DB.WithContext(ctx).Model(&model.Track{})
+	for _, option := range options {
+		query = option(query)
+	}
+
+	stats := &TrackStats{}
+	err := query.Select(`COUNT(*) AS tracks,
+		COUNT(DISTINCT NULLIF(artist, '')) AS artists,
+		COUNT(DISTINCT CASE WHEN album <> '' THEN album || '/' || artist END) AS albums,
+		COALESCE(SUM(cue_audio_end), 0) / 3600.0 AS hours,
+		COALESCE(SUM(file_size), 0) AS bytes,
+		COALESCE(SUM(CASE WHEN cover_image_url = '' OR cover_image_url IS NULL THEN 1 ELSE 0 END), 0) AS missing_cover,
+		COALESCE(SUM(CASE WHEN analysis_status = ? THEN 0 ELSE 1 END), 0) AS missing_emotion,
+		COALESCE(SUM(CASE WHEN cue_audio_end > 0 THEN 0 ELSE 1 END), 0) AS missing_duration`,
+		model.AnalysisDone).
+		Scan(stats).Error
+	return stats, err
+}
+
+// GetImportsByDay counts the tracks created by day, since the time.
+// Days without imports are omitted.
+func GetImportsByDay(ctx context.Context, since time.Time) ([]ImportsOfDay, error) {
+	imports := []ImportsOfDay{}
+	err := orm.DB.WithContext(ctx).Model(&model.Track{}).
+		Select("DATE(created_at) AS day, COUNT(*) AS tracks").
+		Where("created_at >= ?", since).
+		Group("DATE(created_at)").Order("day").
+		Scan(&imports).Error
+	return imports, err
+}
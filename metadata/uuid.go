@@ -0,0 +1,99 @@
+package metadata
+
+// This file implements the UUIDs of the tracks (model.Track.UUID):
+// the tracks can be referred by their UUIDs in the routes.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/model"
+	"net/http"
+	"strconv"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// addTrackUUIDColumn adds the uuid column to the tracks table of an
+// older version, before the AutoMigrate: which would add it as UNIQUE,
+// and SQLite can't. The AutoMigrate makes it unique then, rebuilding
+// the table.
+func addTrackUUIDColumn() error {
+	m := orm.DB.Migrator()
+	if !m.HasTable(&model.Track{}) || m.HasColumn(&model.Track{}, "UUID") {
+		return nil
+	}
+	if err := orm.DB.Exec("ALTER TABLE `tracks` ADD `uuid` text").Error; err != nil {
+		return fmt.Errorf("addTrackUUIDColumn failed: %w", err)
+	}
+	return nil
+}
+
+// backfillTrackUUIDs generates the UUIDs of the tracks created before
+// they're introduced.
+func backfillTrackUUIDs() error {
+	var ids []uint
+	err := orm.DB.Model(&model.Track{}).
+		Where("uuid IS NULL OR uuid = ''").Pluck("id", &ids).Error
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err := orm.DB.Model(&model.Track{}).Where("id = ?", id).
+			Update("uuid", uuid.NewString()).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(ids) > 0 {
+		logger.WithField("tracks", len(ids)).Info("backfillTrackUUIDs: UUIDs generated")
+	}
+	return nil
+}
+
+// GetTrackIDByUUID gets the ID of the track by its UUID.
+func GetTrackIDByUUID(ctx context.Context, trackUUID string) (uint, error) {
+	var ids []uint
+	err := orm.DB.WithContext(ctx).Model(&model.Track{}).
+		Where("uuid = ?", trackUUID).Limit(1).Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, gorm.ErrRecordNotFound
+	}
+	return ids[0], nil
+}
+
+// resolveTrackUUID is a middleware replacing the TrackID param of the
+// routes by the ID of the track, if it's a UUID. So that all the routes
+// of the tracks accept either, e.g.
+//
+//	GET /tracks/1
+//	GET /tracks/6f1c2c5e-5b0e-4b8e-9a57-3f8b6f0e4b1d
+func resolveTrackUUID(c *gin.Context) {
+	for i, p := range c.Params {
+		if p.Key != "TrackID" {
+			continue
+		}
+		if _, err := uuid.Parse(p.Value); err != nil {
+			return // an ID, or else: left to the handler
+		}
+
+		id, err := GetTrackIDByUUID(c, p.Value)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Params[i].Value = strconv.FormatUint(uint64(id), 10)
+	}
+}
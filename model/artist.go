@@ -0,0 +1,191 @@
+package model
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cdfmlr/crud/orm"
+)
+
+// this file implements the normalization of the artist names of the
+// imported tracks, so that the spellings of the same artist (e.g.
+// "ARTIST feat. X" and "Artist ft. X") don't make parallel artists, and
+// the duplicate checks (by the name and the artist) see them the same.
+//
+// And the artists of a track: split from its Artist, e.g. "A & B feat. C"
+// is by A and B, featuring C.
+
+// TrackArtist is an artist of a track, split from the Artist of it
+// (see SplitArtists). Kept in sync with the tracks by the metadata.
+type TrackArtist struct {
+	orm.BasicModel
+
+	TrackID  uint `gorm:"index"`
+	Name     string
+	Role     string // ArtistRoleMain | ArtistRoleFeatured
+	Position int    // in the Artist of the track, from 0
+}
+
+// Roles of the artists of a track.
+const (
+	ArtistRoleMain     = "main"
+	ArtistRoleFeatured = "featured"
+)
+
+// DefaultArtistSeparators are the ArtistRules.Separators if nil.
+// Not "/" or "," alone: "AC/DC", "Earth, Wind & Fire" stay as they are.
+var DefaultArtistSeparators = []string{";", " / ", " & ", " x ", " vs. "}
+
+// ArtistRules are the rules of normalizing the artist names.
+// The zero value leaves the names as they are.
+type ArtistRules struct {
+	// Space trims the whitespace and collapses the runs of it.
+	Space bool
+	// Width converts the full-width ASCII letters, digits, symbols and
+	// spaces to the half-width ones, e.g. "Ａｒｔｉｓｔ" to "Artist".
+	Width bool
+	// Featuring: the spelling of "feat." / "ft." / "featuring" in the
+	// names, e.g. "feat.", or "" to leave them as they are.
+	Featuring string
+	// FoldCase: names differing only in the case (of ASCII letters) are
+	// the same artist, spelled as the first imported one.
+	FoldCase bool
+
+	// Separators of the artists in a name, e.g. "A & B" is by A and B:
+	// DefaultArtistSeparators if nil, none if empty. The featured
+	// artists ("feat.", "ft.", ...) are split anyway.
+	Separators []string
+}
+
+var (
+	artistRules   ArtistRules
+	artistRulesMu sync.RWMutex
+)
+
+// UseArtistRules sets the rules of normalizing the artist names.
+func UseArtistRules(r ArtistRules) {
+	artistRulesMu.Lock()
+	defer artistRulesMu.Unlock()
+	artistRules = r
+}
+
+// CurrentArtistRules returns the rules set by UseArtistRules.
+func CurrentArtistRules() ArtistRules {
+	artistRulesMu.RLock()
+	defer artistRulesMu.RUnlock()
+	return artistRules
+}
+
+// featuringRe matches the spellings of "featuring", followed by a name.
+var featuringRe = regexp.MustCompile(`(?i)\b(?:featuring|feat|ft)\b\.?\s+`)
+
+// NormalizeArtist normalizes the artist name by the ArtistRules, except
+// the FoldCase: the spelling is kept, see ArtistKey.
+func NormalizeArtist(artist string) string {
+	r := CurrentArtistRules()
+	if r.Width {
+		artist = strings.Map(halfWidth, artist)
+	}
+	if r.Space {
+		artist = strings.Join(strings.Fields(artist), " ")
+	}
+	if r.Featuring != "" {
+		artist = featuringRe.ReplaceAllLiteralString(artist, r.Featuring+" ")
+	}
+	return artist
+}
+
+// ArtistKey is the normalized artist name, case folded if FoldCase:
+// the artists of the same key are the same.
+func ArtistKey(artist string) string {
+	artist = NormalizeArtist(artist)
+	if CurrentArtistRules().FoldCase {
+		artist = asciiLower(artist)
+	}
+	return artist
+}
+
+// featuringSplitRe matches the start of the featured artists in a name,
+// e.g. " feat. " or " (ft. ".
+var featuringSplitRe = regexp.MustCompile(`(?i)\s*[(\[]?\s*\b(?:featuring|feat|ft)\b\.?\s+`)
+
+// SplitArtists splits the artist name (the Artist of a track) into the
+// artists: the main ones, separated by the Separators, and the featured
+// ones after "feat." (or "ft.", ...). The same artist (by ArtistKey) is
+// listed once, by the first role of it.
+func SplitArtists(artist string) []TrackArtist {
+	separators := CurrentArtistRules().Separators
+	if separators == nil {
+		separators = DefaultArtistSeparators
+	}
+
+	var artists []TrackArtist
+	seen := map[string]bool{}
+	add := func(section, role string) {
+		names := []string{section}
+		for _, sep := range separators {
+			var split []string
+			for _, name := range names {
+				split = append(split, splitFold(name, sep)...)
+			}
+			names = split
+		}
+		for _, name := range names {
+			name = strings.TrimSpace(strings.Trim(strings.TrimSpace(name), "()[]"))
+			key := ArtistKey(name)
+			if key == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			artists = append(artists, TrackArtist{Name: name, Role: role, Position: len(artists)})
+		}
+	}
+
+	sections := featuringSplitRe.Split(artist, -1)
+	add(sections[0], ArtistRoleMain)
+	for _, section := range sections[1:] {
+		add(section, ArtistRoleFeatured)
+	}
+	return artists
+}
+
+// splitFold splits s by the separator, case-insensitively (of ASCII
+// letters, e.g. " x " and " X ").
+func splitFold(s, sep string) []string {
+	if sep == "" {
+		return []string{s}
+	}
+	lower, sep := asciiLower(s), asciiLower(sep)
+	var parts []string
+	for {
+		i := strings.Index(lower, sep)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s, lower = s[i+len(sep):], lower[i+len(sep):]
+	}
+}
+
+// halfWidth maps the full-width forms of the ASCII characters (U+FF01 to
+// U+FF5E), and the ideographic space, to the ASCII ones.
+func halfWidth(r rune) rune {
+	switch {
+	case r >= 0xFF01 && r <= 0xFF5E:
+		return r - 0xFEE0
+	case r == 0x3000:
+		return ' '
+	}
+	return r
+}
+
+// asciiLower lowers the ASCII letters only, as the NOCASE of SQLite.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
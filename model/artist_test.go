@@ -0,0 +1,85 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeArtist(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  ArtistRules
+		artist string
+		want   string
+	}{
+		{name: "zero rules keep the name", artist: " A  ft. B ", want: " A  ft. B "},
+		{name: "space", rules: ArtistRules{Space: true}, artist: "  A \t B  ", want: "A B"},
+		{name: "width", rules: ArtistRules{Width: true}, artist: "Ａｒｔｉｓｔ　１", want: "Artist 1"},
+		{name: "featuring", rules: ArtistRules{Featuring: "feat."}, artist: "A ft. B", want: "A feat. B"},
+		{name: "featuring spelled out", rules: ArtistRules{Featuring: "feat."}, artist: "A FEATURING B", want: "A feat. B"},
+		{name: "featuring without dot", rules: ArtistRules{Featuring: "feat."}, artist: "A Feat B", want: "A feat. B"},
+		{name: "featuring in a word", rules: ArtistRules{Featuring: "feat."}, artist: "Daft Punk", want: "Daft Punk"},
+		{name: "fold case keeps the spelling", rules: ArtistRules{FoldCase: true}, artist: "ARTIST", want: "ARTIST"},
+		{
+			name:   "all",
+			rules:  ArtistRules{Space: true, Width: true, Featuring: "feat."},
+			artist: " Ａ  ｆｔ． B ",
+			want:   "A feat. B",
+		},
+	}
+	defer UseArtistRules(CurrentArtistRules())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			UseArtistRules(tt.rules)
+			if got := NormalizeArtist(tt.artist); got != tt.want {
+				t.Errorf("NormalizeArtist(%q) = %q, want %q", tt.artist, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitArtists(t *testing.T) {
+	main := func(names ...string) []TrackArtist {
+		var artists []TrackArtist
+		for _, name := range names {
+			artists = append(artists, TrackArtist{Name: name, Role: ArtistRoleMain, Position: len(artists)})
+		}
+		return artists
+	}
+	featured := func(artists []TrackArtist, names ...string) []TrackArtist {
+		for _, name := range names {
+			artists = append(artists, TrackArtist{Name: name, Role: ArtistRoleFeatured, Position: len(artists)})
+		}
+		return artists
+	}
+
+	tests := []struct {
+		name   string
+		rules  ArtistRules
+		artist string
+		want   []TrackArtist
+	}{
+		{name: "one", artist: "A", want: main("A")},
+		{name: "empty", artist: "", want: nil},
+		{name: "separators", artist: "A & B; C / D x E vs. F", want: main("A", "B", "C", "D", "E", "F")},
+		{name: "no split in names", artist: "AC/DC, Earth, Wind & Fire", want: main("AC/DC, Earth, Wind", "Fire")},
+		{name: "separator case folded", artist: "A X B", want: main("A", "B")},
+		{name: "featured", artist: "A feat. B & C", want: featured(main("A"), "B", "C")},
+		{name: "featured in parens", artist: "A (ft. B)", want: featured(main("A"), "B")},
+		{name: "featured in brackets", artist: "A [featuring B]", want: featured(main("A"), "B")},
+		{name: "listed once, by the first role", artist: "A & B feat. A", want: main("A", "B")},
+		{name: "custom separators", rules: ArtistRules{Separators: []string{","}}, artist: "A, B & C", want: main("A", "B & C")},
+		{name: "no separators", rules: ArtistRules{Separators: []string{}}, artist: "A & B ft. C", want: featured(main("A & B"), "C")},
+		{name: "fold case dedups", rules: ArtistRules{FoldCase: true}, artist: "abc & ABC", want: main("abc")},
+		{name: "not fold case", artist: "abc & ABC", want: main("abc", "ABC")},
+	}
+	defer UseArtistRules(CurrentArtistRules())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			UseArtistRules(tt.rules)
+			if got := SplitArtists(tt.artist); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitArtists(%q) = %+v, want %+v", tt.artist, got, tt.want)
+			}
+		})
+	}
+}
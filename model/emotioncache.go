@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// EmotionCache caches the emotion analysis result of an audio content
+// by an analyzer, so that re-imported audio files skip the emomusic
+// round-trip.
+type EmotionCache struct {
+	Hash     string  `gorm:"primaryKey"` // SHA-256 of the audio file, hex
+	Analyzer string  `gorm:"primaryKey"` // name of the analyzer
+	Emotion  Emotion `gorm:"embedded"`
+	BPM      float64 // 0 if not provided by the analyzer
+
+	ModelVersion string // version of the analyzer model, if known
+	CreatedAt    time.Time
+}
@@ -0,0 +1,18 @@
+package model
+
+import "github.com/cdfmlr/crud/orm"
+
+// EmotionRecord is an emotion analysis result of a track.
+// Every analysis adds a record; Track.Emotion is the one of the latest.
+//
+// Records of a bad (re-)analysis run can be deleted (soft) to roll the
+// tracks back to their previous records.
+type EmotionRecord struct {
+	orm.BasicModel
+
+	TrackID      uint    `gorm:"index"`
+	Emotion      Emotion `gorm:"embedded"`
+	Analyzer     string  // name of the analyzer providing the emotion
+	ModelVersion string  // reported or configured version of the analyzer model
+	JobID        uint    // the analysis job
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// this file implements the sparse fields of the tracks in the responses:
+// ?fields=ID,Name,Artist,Emotion keeps the list views from pulling the
+// fields they don't show for thousands of tracks.
+
+// trackFields are the names of the (JSON) fields of a Track, including
+// the ones of the embedded orm.BasicModel.
+var trackFields = func() []string {
+	var names []string
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				collect(f.Type)
+			} else if f.IsExported() {
+				names = append(names, f.Name)
+			}
+		}
+	}
+	collect(reflect.TypeOf(Track{}))
+	return names
+}()
+
+// ParseTrackFields parses the comma-separated field names (case
+// insensitive) of the tracks, e.g. "id,Name,artist", into the names of
+// the fields: [ID Name Artist]. Empty s for all the fields: nil.
+func ParseTrackFields(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		field := ""
+		for _, f := range trackFields {
+			if strings.EqualFold(f, name) {
+				field = f
+				break
+			}
+		}
+		if field == "" {
+			return nil, fmt.Errorf("unknown field of tracks: %q", name)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// SparseTracks returns the tracks with only the fields (see
+// ParseTrackFields) for the responses, or the tracks as they are if no
+// fields.
+func SparseTracks(tracks []*Track, fields []string) any {
+	if len(fields) == 0 {
+		return tracks
+	}
+	sparse := make([]map[string]any, len(tracks))
+	for i, t := range tracks {
+		v := reflect.ValueOf(t).Elem()
+		m := make(map[string]any, len(fields))
+		for _, f := range fields {
+			m[f] = v.FieldByName(f).Interface()
+		}
+		sparse[i] = m
+	}
+	return sparse
+}
@@ -0,0 +1,64 @@
+package model
+
+import "github.com/cdfmlr/crud/orm"
+
+// Job is a background task working on a track,
+// e.g. the emotion analysis of a newly added track,
+// the download of a new track from a URL, or of its cover.
+type Job struct {
+	orm.BasicModel
+
+	Kind    string
+	Status  string
+	TrackID uint
+	Error   string
+
+	// FilePath is the local audio file of the track, for jobs that
+	// work on the file directly (instead of the AudioFileURL).
+	FilePath string
+
+	// Analyzers are the comma-separated names of the analyzers
+	// to run for an analysis job. Empty for the defaults.
+	Analyzers string
+
+	// Refresh ignores cached results, e.g. for re-analysis
+	// with an upgraded emomusic model.
+	Refresh bool
+
+	// Download (and upload) jobs: the AudioFileStore (by name) downloads the URL,
+	// and adds it as a track (TrackID) with the Metadata (JSON of
+	// model.Track) overridden. Cover jobs: the store fetching the cover.
+	Store      string
+	URL        string
+	Metadata   string
+	BytesDone  int64
+	BytesTotal int64 // -1 if unknown
+	// Phase of an upload job: receiving -> analyzing -> linking.
+	Phase string
+	// Results (JSON) of the tracks in a downloaded archive.
+	Results string
+}
+
+// Kinds of jobs.
+const (
+	JobKindAnalysis = "analysis"
+	JobKindDownload = "download"
+	JobKindCover    = "cover"
+	// upload: the progress of an upload by POST /{store}/new?job={ID}
+	JobKindUpload = "upload"
+)
+
+// Phases of upload jobs.
+const (
+	JobPhaseReceiving = "receiving" // the request body
+	JobPhaseAnalyzing = "analyzing" // sniffing, scanning, reading the tags
+	JobPhaseLinking   = "linking"   // hashing, checking, linking & saving
+)
+
+// Statuses of jobs: pending -> running -> done | failed
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
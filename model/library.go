@@ -0,0 +1,31 @@
+package model
+
+import "context"
+
+// this file implements the libraries: independent catalogs hosted by one
+// musicstore, e.g. for different households. Every track is in a library,
+// and the queries of the tracks are scoped by the library in the context
+// (see metadata).
+
+// DefaultLibrary of the tracks not added to a specific library,
+// including those added before the libraries were introduced.
+const DefaultLibrary = "default"
+
+// LibraryContextKey keys the library scope in a context.
+//
+// It's a string to work with gin.Context as well: c.Set(LibraryContextKey, "kids").
+const LibraryContextKey = "musicstore/model.library"
+
+// WithLibrary returns a copy of the ctx scoped to the library.
+func WithLibrary(ctx context.Context, library string) context.Context {
+	return context.WithValue(ctx, LibraryContextKey, library)
+}
+
+// LibraryOf returns the library scope of the ctx, "" for none: all libraries.
+func LibraryOf(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	library, _ := ctx.Value(LibraryContextKey).(string)
+	return library
+}
@@ -1,6 +1,12 @@
 package model
 
-import "github.com/cdfmlr/crud/orm"
+import (
+	"time"
+
+	"github.com/cdfmlr/crud/orm"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
 
 // copy from murecom-chorus-1/unistructs/models.go
 // with TrackText & TrackEmotion removed
@@ -9,18 +15,94 @@ import "github.com/cdfmlr/crud/orm"
 type Track struct {
 	orm.BasicModel
 
-	Name          string
-	Artist        string
+	// UUID is the stable ID of the track across musicstore instances,
+	// generated on creation. The (auto-increment) ID is local.
+	UUID string `gorm:"uniqueIndex"`
+	// external IDs, if known
+	MusicBrainzID string `gorm:"index"` // MusicBrainz recording ID
+	SpotifyID     string `gorm:"index"`
+
+	// Library of the track (see library.go), set on creation.
+	Library string `gorm:"index;default:default"`
+
+	// indexed together: duplicates are found by the name and the artist
+	Name          string `gorm:"index:idx_tracks_name_artist"`
+	Artist        string `gorm:"index:idx_tracks_name_artist"`
 	Album         string
+	Genre         string // genre tag of the file, or predicted genres, comma-separated
 	CoverImageURL string
-	AudioFileURL  string
+	AudioFileURL  string `gorm:"index"`
+	AudioFileHash string `gorm:"index"`         // SHA-256 of the audio file, hex
+	FileMissing   bool   `gorm:"default:false"` // the audio file is missing from the store, see fsck
+	// size and modification time of the audio file when (re)imported:
+	// unchanged files are skipped by rescans.
+	FileSize    int64
+	FileModTime *time.Time
 
-	Emotion Emotion `gorm:"embedded"`
+	Emotion        Emotion `gorm:"embedded"`
+	AnalysisStatus string  `gorm:"default:''"` // AnalysisNone | AnalysisPending | AnalysisDone | AnalysisFailed
+	AnalyzedAt     *time.Time
+	BPM            float64  // tempo in beats per minute, 0 if unknown
+	Loudness       Loudness `gorm:"embedded;embeddedPrefix:loudness_"`
+	Cues           Cues     `gorm:"embedded;embeddedPrefix:cue_"`
+
+	// listening stats, e.g. imported from iTunes
+	PlayCount    int
+	Rating       int // in [0, 100]: 20 per star, 0 if unrated
+	LastPlayedAt *time.Time
 
 	// emmm, 就当作文档型数据库吧
 }
 
+// BeforeCreate generates the UUID of the new track, and puts it in the
+// library of the context (or the DefaultLibrary), if not given.
+func (t *Track) BeforeCreate(tx *gorm.DB) error {
+	if t.UUID == "" {
+		t.UUID = uuid.NewString()
+	}
+	if t.Library == "" {
+		t.Library = LibraryOf(tx.Statement.Context)
+	}
+	if t.Library == "" {
+		t.Library = DefaultLibrary
+	}
+	return nil
+}
+
 type Emotion struct {
 	Valence float64 `json:"valence"`
 	Arousal float64 `json:"arousal"`
+	// Confidence of the analysis in [0, 1]. Analyzers not reporting it
+	// get 1, and so do the tracks analyzed before it was recorded.
+	Confidence float64 `json:"confidence" gorm:"default:1"`
 }
+
+// Loudness of the audio (EBU R128), for clients to normalize the volume.
+// All zero if unknown.
+type Loudness struct {
+	LUFS float64 `json:"lufs"` // integrated loudness
+	// ReplayGain is the track gain in dB, to the ReplayGain 2.0
+	// reference level (-18 LUFS).
+	ReplayGain float64 `json:"replay_gain"`
+	Peak       float64 `json:"peak"` // sample peak, linear in [0, 1]
+}
+
+// Cues are the offsets of the parts of the audio, in seconds, for clients
+// to skip the silence and to crossfade: the audio is heard in
+// [AudioStart, AudioEnd], with the quiet intro and outro in
+// [AudioStart, IntroEnd] and [OutroStart, AudioEnd].
+// All zero if unknown.
+type Cues struct {
+	AudioStart float64 `json:"audio_start"` // end of the leading silence
+	IntroEnd   float64 `json:"intro_end"`   // = AudioStart if no quiet intro
+	OutroStart float64 `json:"outro_start"` // = AudioEnd if no quiet outro
+	AudioEnd   float64 `json:"audio_end"`   // start of the trailing silence
+}
+
+// States of the emotion analysis of a Track.
+const (
+	AnalysisNone    = ""        // not analyzed: emomusic is disabled
+	AnalysisPending = "pending" // waiting for (or in) analysis
+	AnalysisDone    = "done"
+	AnalysisFailed  = "failed"
+)
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"github.com/cdfmlr/crud/orm"
+	"gorm.io/gorm"
+)
+
+// Playlist is an ordered list of tracks, e.g. imported from iTunes.
+type Playlist struct {
+	orm.BasicModel
+
+	Library string `gorm:"index;default:default"`
+	Name    string
+	// Source identifies the imported playlist, e.g. itunes:{persistent ID}
+	// or navidrome:{id}, to update it on re-imports. Empty for others.
+	Source string `gorm:"index"`
+
+	Items []PlaylistItem `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// BeforeCreate puts the new playlist in the library of the context
+// (or the DefaultLibrary), if not given.
+func (p *Playlist) BeforeCreate(tx *gorm.DB) error {
+	if p.Library == "" {
+		p.Library = LibraryOf(tx.Statement.Context)
+	}
+	if p.Library == "" {
+		p.Library = DefaultLibrary
+	}
+	return nil
+}
+
+// PlaylistItem is a track in a playlist, at the Position (from 0).
+type PlaylistItem struct {
+	orm.BasicModel
+
+	PlaylistID uint `gorm:"index"`
+	Position   int
+	TrackID    uint `gorm:"index"`
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,35 +12,68 @@ import (
 // this file implements a Track contributor that
 // read track metadata from a audio file.
 //
-// This function only fills the Name, Artist and Album fields of the Track.
+// Tags of MP3 (ID3), M4A, FLAC and OGG (Vorbis, Opus) are read.
+// Files without tags (e.g. WAV) are named by the file.
+//
+// This function only fills the Name, Artist, Album and Genre fields of the Track.
 // The CoverImageURL and AudioFileURL fields are left blank.
 func TrackFromAudioFile(path string) (*Track, error) {
-	// open file
+	tags, err := ReadFileTags(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// construct track
+	track := &Track{
+		Name:   tags.Name,
+		Artist: tags.Artist,
+		Album:  tags.Album,
+		Genre:  tags.Genre,
+		// CoverImageURL: "",
+		// AudioFileURL: "",
+	}
+
+	if track.Name == "" {
+		track.Name = nameFromPath(path)
+	}
+
+	return track, nil
+}
+
+// FileTags are the tags of an audio file, by the fields of Track.
+type FileTags struct {
+	Name   string
+	Artist string
+	Album  string
+	Genre  string
+}
+
+// ReadFileTags reads the tags of the audio file as they are:
+// files without tags (e.g. a WAV, or an untagged FLAC) get empty ones.
+func ReadFileTags(path string) (*FileTags, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	// read metadata
 	m, err := tag.ReadFrom(f)
+	if errors.Is(err, tag.ErrNoTagsFound) {
+		return &FileTags{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// construct track
-	track := &Track{
+	return &FileTags{
 		Name:   m.Title(),
 		Artist: m.Artist(),
 		Album:  m.Album(),
-		// CoverImageURL: "",
-		// AudioFileURL: "",
-	}
-
-	if track.Name == "" {
-		track.Name = strings.TrimSuffix(
-			filepath.Base(path), filepath.Ext(path))
-	}
+		Genre:  m.Genre(),
+	}, nil
+}
 
-	return track, nil
+// nameFromPath is the base name of the file without the extension.
+func nameFromPath(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
 }
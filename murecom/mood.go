@@ -0,0 +1,82 @@
+package murecom
+
+// this file implements named mood presets for murecom:
+// GET /murecom?Mood=calm instead of guessing valence/arousal numbers.
+
+import (
+	"musicstore/model"
+	"strings"
+	"sync"
+)
+
+// Range is a closed interval [Min, Max].
+type Range struct {
+	Min float64
+	Max float64
+}
+
+// Region is a rectangle in the valence-arousal space.
+type Region struct {
+	Valence Range
+	Arousal Range
+}
+
+// MoodPreset maps a mood name to a valence/arousal region.
+// Tracks in the region are retrieved, and ranked by the distance
+// to the center of the region.
+type MoodPreset struct {
+	Valence Range
+	Arousal Range
+}
+
+// Region of the preset.
+func (m MoodPreset) Region() Region {
+	return Region{Valence: m.Valence, Arousal: m.Arousal}
+}
+
+// Center of the region.
+func (m MoodPreset) Center() model.Emotion {
+	return model.Emotion{
+		Valence: (m.Valence.Min + m.Valence.Max) / 2,
+		Arousal: (m.Arousal.Min + m.Arousal.Max) / 2,
+	}
+}
+
+// DefaultMoodPresets are used if no presets are configured.
+var DefaultMoodPresets = map[string]MoodPreset{
+	"calm":        {Valence: Range{0.5, 1.0}, Arousal: Range{0.0, 0.4}},
+	"energetic":   {Valence: Range{0.5, 1.0}, Arousal: Range{0.6, 1.0}},
+	"melancholic": {Valence: Range{0.0, 0.4}, Arousal: Range{0.0, 0.4}},
+	"happy":       {Valence: Range{0.6, 1.0}, Arousal: Range{0.4, 0.8}},
+}
+
+var (
+	moodPresets   = DefaultMoodPresets
+	moodPresetsMu sync.RWMutex
+)
+
+// UseMoodPresets replaces the mood presets.
+// Names are case-insensitive. An empty presets map is ignored.
+func UseMoodPresets(presets map[string]MoodPreset) {
+	if len(presets) == 0 {
+		return
+	}
+
+	m := make(map[string]MoodPreset, len(presets))
+	for name, preset := range presets {
+		m[strings.ToLower(name)] = preset
+	}
+
+	moodPresetsMu.Lock()
+	defer moodPresetsMu.Unlock()
+	moodPresets = m
+}
+
+// lookupMood finds the preset by name (case-insensitive).
+func lookupMood(name string) (MoodPreset, bool) {
+	moodPresetsMu.RLock()
+	defer moodPresetsMu.RUnlock()
+
+	preset, ok := moodPresets[strings.ToLower(name)]
+	return preset, ok
+}
@@ -3,23 +3,37 @@ package murecom
 // this file implement a controller for recommending music by emotion.
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"musicstore/model"
 	"net/http"
+	"strconv"
 
 	"github.com/cdfmlr/crud/log"
 	"github.com/cdfmlr/crud/orm"
 	"github.com/gin-gonic/gin"
 )
 
+var logger = log.ZoneLogger("musicstore/murecom")
+
 type MurecomRequest struct {
 	model.Emotion
-	Limit int
+	Mood   string
+	MinBPM float64
+	MaxBPM float64
+
+	MinConfidence    float64
+	ConfidenceWeight float64
+
+	Limit  int
+	Offset int
+	Cursor string
 }
 
 type MurecomResponse struct {
-	Tracks []*model.Track
+	Tracks     []*model.Track
+	NextCursor string
 }
 
 // GetMurecom handles: GET /murecom
@@ -28,11 +42,28 @@ type MurecomResponse struct {
 //
 //   - Valence: float64, [0, 1]
 //   - Arousal: float64, [0, 1]
+//   - Mood: string, a preset name (e.g. calm, energetic, melancholic, happy),
+//     alternative to Valence & Arousal. See MoodPreset.
+//   - MinBPM, MaxBPM: float64, >= 0, optional: only tracks with a known
+//     tempo in [MinBPM, MaxBPM], e.g. 160 to 180 for running
+//   - MinConfidence: float64, [0, 1], default 0: exclude tracks with a less
+//     confident emotion analysis
+//   - ConfidenceWeight: float64, [0, 1], default 0: down-weight less
+//     confident tracks, see murecom
 //   - Limit: int, [1, 100], default 3
+//   - Offset: int, >= 0, default 0: skip the first Offset results
+//   - Cursor: string, the nextCursor from a previous response.
+//     Mutually exclusive with Offset.
+//   - fields: comma-separated fields of the tracks to respond, e.g.
+//     ID,Name,Artist,Emotion. Default: all.
+//
+// Results are ordered deterministically, so that paging with
+// Offset or Cursor gets "the next Limit after the ones I already got".
 //
 // Response:
 //
-//   - 200: OK: {tracks: [{track1}, {track2}, ...}]}
+//   - 200: OK: {tracks: [{track1}, {track2}, ...}], nextCursor: "..."}
+//     nextCursor is empty if there are no more results.
 //   - 400: Bad Request: {error: "bad request"}
 //   - 422: Unprocessable Entity: {error: "unprocessable entity"}
 //   - 500: Internal Server Error: {error: "internal server error"}
@@ -47,21 +78,47 @@ func GetMurecom(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
+	fields, err := model.ParseTrackFields(c.Query("fields"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	region := windowAround(req.Emotion)
+	if req.Mood != "" {
+		preset, _ := lookupMood(req.Mood) // validated
+		req.Emotion = preset.Center()
+		region = preset.Region()
+	}
 
-	tracks, err := murecom(req.Emotion, req.Limit)
+	tempo := Range{Min: req.MinBPM, Max: req.MaxBPM}
+	confidence := confidenceOptions{Min: req.MinConfidence, Weight: req.ConfidenceWeight}
+	tracks, err := murecom(req.Emotion, region, tempo, confidence, model.LibraryOf(c), req.Limit, req.Offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"tracks": tracks})
+	nextCursor := ""
+	if len(tracks) == req.Limit {
+		nextCursor = encodeCursor(req.Offset + req.Limit)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tracks": model.SparseTracks(tracks, fields), "nextCursor": nextCursor})
 }
 
 func validateMurecomRequest(c *gin.Context, req *MurecomRequest) error {
 	_, hasValence := c.GetQuery("Valence")
 	_, hasArousal := c.GetQuery("Arousal")
-	if !hasValence && !hasArousal {
-		return errors.New("emotion query (Valence and Arousal) are required")
+	if req.Mood != "" {
+		if hasValence || hasArousal {
+			return errors.New("query Mood and emotion (Valence and Arousal) are mutually exclusive")
+		}
+		if _, ok := lookupMood(req.Mood); !ok {
+			return fmt.Errorf("unknown Mood: %q", req.Mood)
+		}
+	} else if !hasValence && !hasArousal {
+		return errors.New("emotion query (Valence and Arousal) or Mood are required")
 	}
 
 	if req.Valence < 0 || req.Valence > 1 {
@@ -70,44 +127,156 @@ func validateMurecomRequest(c *gin.Context, req *MurecomRequest) error {
 	if req.Arousal < 0 || req.Arousal > 1 {
 		return errors.New("arousal should be in [0, 1]")
 	}
+	if req.MinBPM < 0 || req.MaxBPM < 0 {
+		return errors.New("query MinBPM and MaxBPM should be >= 0")
+	}
+	if req.MaxBPM != 0 && req.MinBPM > req.MaxBPM {
+		return errors.New("query MinBPM should be <= MaxBPM")
+	}
+	if req.MinConfidence < 0 || req.MinConfidence > 1 {
+		return errors.New("query MinConfidence should be in [0, 1]")
+	}
+	if req.ConfidenceWeight < 0 || req.ConfidenceWeight > 1 {
+		return errors.New("query ConfidenceWeight should be in [0, 1]")
+	}
 	if req.Limit == 0 { // default
 		req.Limit = 3
 	} else if req.Limit < 1 || req.Limit > 100 {
 		return errors.New("query Limit should be in [1, 100]")
 	}
+	if req.Offset < 0 {
+		return errors.New("query Offset should be >= 0")
+	}
+	if req.Cursor != "" {
+		if req.Offset != 0 {
+			return errors.New("query Offset and Cursor are mutually exclusive")
+		}
+		offset, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return err
+		}
+		req.Offset = offset
+	}
 	return nil
 }
 
+// encodeCursor encodes the offset into an opaque cursor string.
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.Itoa(offset)))
+}
+
+// decodeCursor decodes the offset from a cursor made by encodeCursor.
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("invalid Cursor")
+	}
+	offset, err := strconv.Atoi(string(b))
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid Cursor")
+	}
+	return offset, nil
+}
+
+// retrievalWindow is the half-width of the region retrieved around
+// a raw (Valence, Arousal) query.
+const retrievalWindow = 0.3
+
+// windowAround returns the retrieval region around the emotion:
+// abs(valence - ?) <= retrievalWindow && abs(arousal - ?) <= retrievalWindow
+func windowAround(emotion model.Emotion) Region {
+	return Region{
+		Valence: Range{Min: emotion.Valence - retrievalWindow, Max: emotion.Valence + retrievalWindow},
+		Arousal: Range{Min: emotion.Arousal - retrievalWindow, Max: emotion.Arousal + retrievalWindow},
+	}
+}
+
+// notAnalyzed are the analysis statuses of tracks without a meaningful
+// emotion. Such tracks are never recommended.
+var notAnalyzed = []string{model.AnalysisPending, model.AnalysisFailed}
+
+// confidenceOptions of the murecom:
+// Min confidence to retrieve, and Weight of the confidence in scoring.
+type confidenceOptions struct {
+	Min    float64
+	Weight float64
+}
+
 // murecom is the core of the murecom API.
 // It returns a list of tracks that match the emotion.
 //
 // The algorithm is:
 //
-//   - Retrieval: abs(valence - ?) < 0.3 && abs(arousal - ?) < 0.3
-//   - Scoring: distance(valence, arousal) = sqrt((valence - ?)^2 + (arousal - ?)^2)
+//   - Retrieval: tracks in the library (all libraries if empty),
+//     in the region (see windowAround for raw emotions),
+//     and in the tempo range, if not zero (a zero Max means no upper bound)
+//     and confidence >= confidence.Min, excluding the tracks whose audio
+//     files are missing (see audiofilestore fsck)
+//   - Scoring: distance(valence, arousal) = sqrt((valence - ?)^2 + (arousal - ?)^2),
+//     plus confidence.Weight * (1 - confidence): the less confident, the farther
 //   - Re-ranking: N/A
-//   - Limit: limit
+//   - Limit: limit, offset
+//
+// Ties in distance are broken by id, making the order (and thus the
+// pagination) deterministic.
 //
 // It's implemented by some SQL magic.
-func murecom(emotion model.Emotion, limit int) ([]*model.Track, error) {
-	fmt.Println("[DBG] murecom: emotion =", emotion, ", limit =", limit)
+func murecom(emotion model.Emotion, region Region, tempo Range, confidence confidenceOptions, library string, limit int, offset int) ([]*model.Track, error) {
+	logger.WithField("emotion", emotion).WithField("region", region).
+		WithField("tempo", tempo).WithField("confidence", confidence).
+		WithField("library", library).WithField("limit", limit).
+		WithField("offset", offset).Debug("murecom: retrieving")
 	// build SQL
+	tempoFilter := ""
+	if tempo.Min > 0 || tempo.Max > 0 {
+		tempoFilter = "AND bpm > 0 AND bpm >= ?"
+		if tempo.Max > 0 {
+			tempoFilter += " AND bpm <= ?"
+		}
+	}
+	libraryFilter := ""
+	if library != "" {
+		libraryFilter = "AND library = ?"
+	}
 	sql := `
 		SELECT * FROM tracks
 		WHERE
-			ABS(valence - ?) < 0.3
-			AND ABS(arousal - ?) < 0.3
+			valence BETWEEN ? AND ?
+			AND arousal BETWEEN ? AND ?
+			AND analysis_status NOT IN ?
+			AND confidence >= ?
+			AND NOT file_missing
+			` + tempoFilter + `
+			` + libraryFilter + `
 		ORDER BY 
-			SQRT(POW(valence - ?, 2) + POW(arousal - ?, 2))
-		LIMIT ?
+			SQRT(POW(valence - ?, 2) + POW(arousal - ?, 2)) + ? * (1 - confidence),
+			id
+		LIMIT ? OFFSET ?
 	`
+	args := []any{
+		region.Valence.Min, region.Valence.Max, // WHERE
+		region.Arousal.Min, region.Arousal.Max,
+		notAnalyzed,
+		confidence.Min,
+	}
+	if tempoFilter != "" {
+		args = append(args, tempo.Min)
+		if tempo.Max > 0 {
+			args = append(args, tempo.Max)
+		}
+	}
+	if libraryFilter != "" {
+		args = append(args, library)
+	}
+	args = append(args,
+		emotion.Valence, emotion.Arousal, confidence.Weight, // ORDER BY
+		limit, offset, // LIMIT OFFSET
+	)
+
 	// execute SQL
 	tracks := make([]*model.Track, 0)
-	err := orm.DB.Raw(sql,
-		emotion.Valence, emotion.Arousal, // WHERE
-		emotion.Valence, emotion.Arousal, // ORDER BY
-		limit, // LIMIT
-	).Scan(&tracks).Error
+	err := orm.DB.Raw(sql, args...).Scan(&tracks).Error
 
 	if err != nil {
 		log.Logger.Error(err)
@@ -0,0 +1,193 @@
+package murecom
+
+// this file implement a controller for generating playlists that follow
+// an emotion trajectory, e.g. ramping a reader from tense to calm.
+
+import (
+	"context"
+	"errors"
+	"math"
+	"musicstore/model"
+	"net/http"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/cdfmlr/crud/orm"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+// defaultTrackDuration is the assumed length (in seconds) of a track,
+// used to convert a trajectory Duration into a number of tracks.
+const defaultTrackDuration = 240
+
+// maxTrajectoryTracks limits the length of a generated playlist.
+const maxTrajectoryTracks = 200
+
+type TrajectoryRequest struct {
+	// Points is an explicit sequence of emotions to follow.
+	// One track is picked for each point.
+	Points []model.Emotion
+
+	// Or, Start & End emotions and a Duration (in seconds):
+	// the trajectory is a linear ramp from Start to End.
+	Start    *model.Emotion
+	End      *model.Emotion
+	Duration int
+
+	// TrackDuration is the assumed length (in seconds) of a track.
+	// Default: defaultTrackDuration.
+	TrackDuration int
+}
+
+type TrajectoryResponse struct {
+	Tracks []*model.Track
+}
+
+// PostTrajectory handles: POST /murecom/trajectory
+//
+// Body (JSON), one of:
+//
+//   - {"Points": [{"valence": 0.1, "arousal": 0.9}, ...]}
+//   - {"Start": {"valence": 0.1, "arousal": 0.9}, "End": {...}, "Duration": 1800}
+//
+// Optional: "TrackDuration": assumed seconds per track, default 240.
+// And the query fields, as GET /murecom.
+//
+// Response:
+//
+//   - 200: OK: {tracks: [{track1}, {track2}, ...}]}: ordered playlist
+//   - 400: Bad Request: {error: "bad request"}
+//   - 422: Unprocessable Entity: {error: "unprocessable entity"}
+//   - 500: Internal Server Error: {error: "internal server error"}
+func PostTrajectory(c *gin.Context) {
+	req := new(TrajectoryRequest)
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fields, err := model.ParseTrackFields(c.Query("fields"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	points, err := trajectoryPoints(req)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	tracks, err := trajectory(c, points)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tracks": model.SparseTracks(tracks, fields)})
+}
+
+// trajectoryPoints validates the request and expands it into
+// the sequence of emotions to follow.
+func trajectoryPoints(req *TrajectoryRequest) ([]model.Emotion, error) {
+	points := req.Points
+
+	if len(points) == 0 {
+		if req.Start == nil || req.End == nil {
+			return nil, errors.New("either Points or Start & End are required")
+		}
+		if req.Duration <= 0 {
+			return nil, errors.New("Duration (seconds) should be positive")
+		}
+		trackDuration := req.TrackDuration
+		if trackDuration == 0 {
+			trackDuration = defaultTrackDuration
+		} else if trackDuration < 0 {
+			return nil, errors.New("TrackDuration (seconds) should be positive")
+		}
+
+		n := int(math.Ceil(float64(req.Duration) / float64(trackDuration)))
+		if n > maxTrajectoryTracks {
+			n = maxTrajectoryTracks
+		}
+		points = interpolateEmotions(*req.Start, *req.End, n)
+	}
+
+	if len(points) > maxTrajectoryTracks {
+		return nil, errors.New("too many points in the trajectory")
+	}
+	for _, p := range points {
+		if p.Valence < 0 || p.Valence > 1 || p.Arousal < 0 || p.Arousal > 1 {
+			return nil, errors.New("valence and arousal should be in [0, 1]")
+		}
+	}
+
+	return points, nil
+}
+
+// interpolateEmotions returns n points evenly spaced from start to end
+// (both included, if n > 1).
+func interpolateEmotions(start, end model.Emotion, n int) []model.Emotion {
+	if n <= 1 {
+		return []model.Emotion{start}
+	}
+
+	points := make([]model.Emotion, n)
+	for i := range points {
+		t := float64(i) / float64(n-1)
+		points[i] = model.Emotion{
+			Valence: start.Valence + (end.Valence-start.Valence)*t,
+			Arousal: start.Arousal + (end.Arousal-start.Arousal)*t,
+		}
+	}
+	return points
+}
+
+// trajectory picks the nearest not-yet-picked track for each point.
+// Points without any available track are skipped.
+// Tracks are picked from the library of the ctx (see model.LibraryOf).
+func trajectory(ctx context.Context, points []model.Emotion) ([]*model.Track, error) {
+	tracks := make([]*model.Track, 0, len(points))
+	picked := make([]uint, 0, len(points))
+
+	for _, p := range points {
+		track, err := nearestTrack(ctx, p, picked)
+		if err != nil {
+			log.Logger.Error(err)
+			return nil, err
+		}
+		if track == nil {
+			continue
+		}
+		tracks = append(tracks, track)
+		picked = append(picked, track.ID)
+	}
+
+	return tracks, nil
+}
+
+// nearestTrack returns the track nearest to the emotion, excluding
+// the tracks with the given IDs. It returns nil if there is no track.
+func nearestTrack(ctx context.Context, emotion model.Emotion, exclude []uint) (*model.Track, error) {
+	query := orm.DB.WithContext(ctx).Model(&model.Track{}).
+		Where("analysis_status NOT IN ?", notAnalyzed)
+	if len(exclude) > 0 {
+		query = query.Where("id NOT IN ?", exclude)
+	}
+
+	tracks := make([]*model.Track, 0, 1)
+	err := query.
+		Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:  "SQRT(POW(valence - ?, 2) + POW(arousal - ?, 2))",
+			Vars: []any{emotion.Valence, emotion.Arousal},
+		}}).
+		Limit(1).
+		Find(&tracks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tracks) == 0 {
+		return nil, nil
+	}
+	return tracks[0], nil
+}
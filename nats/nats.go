@@ -0,0 +1,460 @@
+// Package nats is a minimal client of the NATS core protocol: publish, and
+// (queue) subscribe, reconnecting on failures. See
+// https://docs.nats.io/reference/reference-protocols/nats-protocol
+//
+// It's at-most-once, as the core NATS: messages published while
+// disconnected fail, and messages to a slow subscriber are dropped.
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdfmlr/crud/log"
+)
+
+var logger = log.ZoneLogger("musicstore/nats")
+
+const (
+	defaultPort = "4222"
+	dialTimeout = 5 * time.Second
+	// pendingLimit: messages to a subscriber beyond it are dropped.
+	pendingLimit = 1024
+	// reconnect delays: doubled from minReconnectDelay up to maxReconnectDelay.
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+	// writeTimeout of a flush: a stuck server can't block the publishers
+	// (holding the lock) for long. The connection is dropped then.
+	writeTimeout = 5 * time.Second
+	// the server is PINGed every pingInterval: the connection is dropped
+	// (and reconnected) if maxPingsOut PINGs are not PONGed.
+	pingInterval = 2 * time.Minute
+	maxPingsOut  = 2
+)
+
+var (
+	ErrNotConnected = errors.New("nats: not connected")
+	ErrClosed       = errors.New("nats: connection closed")
+)
+
+// Msg is a message received.
+type Msg struct {
+	Subject string
+	Reply   string
+	Data    []byte
+}
+
+// Conn to a NATS server.
+type Conn struct {
+	url  *url.URL
+	name string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	w        *bufio.Writer // nil while disconnected
+	subs     map[uint64]*Subscription
+	nextSID  uint64
+	pingsOut int // PINGs not PONGed yet
+	closed   bool
+}
+
+// Dial connects to the server at the URL:
+//
+//	nats://[user:password@ | token@]host[:4222]
+//
+// tls:// for TLS (also used if the server requires it).
+// The name identifies the client in the monitoring of the server.
+func Dial(rawURL string, name string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: bad URL %q: %w", rawURL, err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" || u.Hostname() == "" {
+		return nil, fmt.Errorf("Dial: bad URL %q: want nats://host:port", rawURL)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	c := &Conn{url: u, name: name, subs: map[uint64]*Subscription{}}
+	r, err := c.connect()
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %w", err)
+	}
+	go c.readLoop(r)
+	go c.pingLoop()
+	return c, nil
+}
+
+// serverInfo: the INFO of the server.
+type serverInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// connect to the server, and subscribe the subscriptions again.
+func (c *Conn) connect() (*bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", c.url.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read INFO failed: %w", err)
+	}
+	var info serverInfo
+	if op, args := parseOp(line); op != "INFO" || json.Unmarshal([]byte(args), &info) != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting: %q", line)
+	}
+
+	if info.TLSRequired || c.url.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: c.url.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	options := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     c.name,
+		"lang":     "go",
+		"version":  "musicstore",
+		"protocol": 1,
+	}
+	if user := c.url.User; user != nil {
+		if password, ok := user.Password(); ok {
+			options["user"], options["pass"] = user.Username(), password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\nPING\r\n", connect)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("read PONG failed: %w", err)
+		}
+		op, args := parseOp(line)
+		if op == "PONG" {
+			break
+		}
+		if op == "-ERR" {
+			conn.Close()
+			return nil, fmt.Errorf("server error: %s", args)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	for _, sub := range c.subs {
+		sub.writeSub(w)
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conn, c.w, c.pingsOut = conn, w, 0
+	return r, nil
+}
+
+// flushLocked flushes the writes in writeTimeout. The connection is
+// dropped on failures: reconnected by the readLoop.
+func (c *Conn) flushLocked() error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := c.w.Flush(); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// pingLoop PINGs the server every pingInterval, and drops the connection
+// if the PINGs are not PONGed, until Close.
+func (c *Conn) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		if c.w != nil {
+			if c.pingsOut >= maxPingsOut {
+				logger.WithField("pingsOut", c.pingsOut).Warn("pingLoop: stale connection, dropped")
+				c.conn.Close()
+			} else {
+				c.pingsOut++
+				c.w.WriteString("PING\r\n")
+				c.flushLocked()
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// readLoop reads the messages, and reconnects on failures, until Close.
+func (c *Conn) readLoop(r *bufio.Reader) {
+	for {
+		err := c.read(r)
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.conn.Close()
+		c.conn, c.w = nil, nil
+		c.mu.Unlock()
+
+		logger.WithError(err).Warn("readLoop: disconnected, reconnecting")
+		r = c.reconnect()
+		if r == nil {
+			return // closed
+		}
+		logger.Info("readLoop: reconnected")
+	}
+}
+
+// reconnect until connected or closed (nil returned).
+func (c *Conn) reconnect() *bufio.Reader {
+	delay := minReconnectDelay
+	for {
+		time.Sleep(delay)
+		r, err := c.connect()
+		if err == nil {
+			return r
+		}
+		if errors.Is(err, ErrClosed) {
+			return nil
+		}
+		logger.WithError(err).Debug("reconnect: failed")
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// read the ops from the server until an error.
+func (c *Conn) read(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		op, args := parseOp(line)
+		switch op {
+		case "MSG": // MSG <subject> <sid> [reply-to] <#bytes>
+			f := strings.Fields(args)
+			if len(f) != 3 && len(f) != 4 {
+				return fmt.Errorf("bad MSG: %q", line)
+			}
+			sid, err1 := strconv.ParseUint(f[1], 10, 64)
+			size, err2 := strconv.Atoi(f[len(f)-1])
+			if err1 != nil || err2 != nil || size < 0 {
+				return fmt.Errorf("bad MSG: %q", line)
+			}
+			data := make([]byte, size+2) // with the trailing \r\n
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			msg := &Msg{Subject: f[0], Data: data[:size]}
+			if len(f) == 4 {
+				msg.Reply = f[2]
+			}
+			c.deliver(sid, msg)
+		case "PING":
+			c.write("PONG\r\n")
+		case "PONG":
+			c.mu.Lock()
+			c.pingsOut = 0
+			c.mu.Unlock()
+		case "-ERR":
+			logger.WithField("error", args).Warn("read: server error")
+		case "+OK", "INFO":
+		default:
+			return fmt.Errorf("unexpected op: %q", line)
+		}
+	}
+}
+
+// parseOp splits the line into the op (upper case) and the args.
+func parseOp(line string) (op, args string) {
+	line = strings.TrimRight(line, "\r\n")
+	op, args, _ = strings.Cut(line, " ")
+	return strings.ToUpper(op), strings.TrimSpace(args)
+}
+
+func (c *Conn) deliver(sid uint64, msg *Msg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sub, ok := c.subs[sid]
+	if !ok {
+		return // unsubscribed
+	}
+	select {
+	case sub.msgs <- msg:
+	default:
+		logger.WithField("subject", sub.subject).Warn("deliver: slow subscriber, message dropped")
+	}
+}
+
+// write the protocol text, flushed.
+func (c *Conn) write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil {
+		return ErrNotConnected
+	}
+	c.w.WriteString(s)
+	return c.flushLocked()
+}
+
+// Publish the data to the subject, with the reply subject if not empty.
+func (c *Conn) Publish(subject string, reply string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.w == nil {
+		return ErrNotConnected
+	}
+
+	if reply != "" {
+		fmt.Fprintf(c.w, "PUB %s %s %d\r\n", subject, reply, len(data))
+	} else {
+		fmt.Fprintf(c.w, "PUB %s %d\r\n", subject, len(data))
+	}
+	c.w.Write(data)
+	c.w.WriteString("\r\n")
+	return c.flushLocked()
+}
+
+// Close the connection. The subscriptions are ended.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for sid, sub := range c.subs {
+		delete(c.subs, sid)
+		close(sub.msgs)
+	}
+	if c.conn != nil {
+		if c.w != nil {
+			c.flushLocked()
+		}
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// Subscription to a subject.
+type Subscription struct {
+	conn    *Conn
+	sid     uint64
+	subject string
+	queue   string
+	msgs    chan *Msg
+}
+
+// Subscribe to the subject (wildcards * and > allowed). If the queue is
+// not empty, a message is delivered to only one of the subscribers of
+// the queue group, e.g. to distribute the work.
+//
+// The handler is called for the messages in order, in a goroutine of the
+// subscription.
+func (c *Conn) Subscribe(subject string, queue string, handler func(msg *Msg)) (*Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	c.nextSID++
+	sub := &Subscription{
+		conn:    c,
+		sid:     c.nextSID,
+		subject: subject,
+		queue:   queue,
+		msgs:    make(chan *Msg, pendingLimit),
+	}
+	if c.w != nil {
+		sub.writeSub(c.w)
+		if err := c.flushLocked(); err != nil {
+			return nil, fmt.Errorf("Subscribe: %w", err)
+		}
+	} // else: subscribed on reconnect
+	c.subs[sub.sid] = sub
+
+	go func() {
+		for msg := range sub.msgs {
+			handler(msg)
+		}
+	}()
+	return sub, nil
+}
+
+// writeSub writes the SUB of the subscription, unflushed.
+func (s *Subscription) writeSub(w *bufio.Writer) {
+	if s.queue != "" {
+		fmt.Fprintf(w, "SUB %s %s %d\r\n", s.subject, s.queue, s.sid)
+	} else {
+		fmt.Fprintf(w, "SUB %s %d\r\n", s.subject, s.sid)
+	}
+}
+
+// Unsubscribe ends the subscription.
+func (s *Subscription) Unsubscribe() error {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.subs[s.sid]; !ok {
+		return nil
+	}
+	delete(c.subs, s.sid)
+	close(s.msgs)
+
+	if c.w == nil {
+		return nil
+	}
+	fmt.Fprintf(c.w, "UNSUB %d\r\n", s.sid)
+	return c.flushLocked()
+}
@@ -0,0 +1,333 @@
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer speaks the server side of the protocol to the client under
+// test: the handshake is done by the accept loop, the rest by the tests.
+type fakeServer struct {
+	ln      net.Listener
+	connErr string // if not empty, the CONNECTs are answered with the -ERR
+	conns   chan *fakeConn
+}
+
+// fakeConn is a client connected to the fakeServer.
+type fakeConn struct {
+	net.Conn
+	r       *bufio.Reader
+	connect map[string]any // options of the CONNECT
+}
+
+func newFakeServer(t *testing.T, connErr string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, connErr: connErr, conns: make(chan *fakeConn, 4)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			if fc := s.handshake(t, conn); fc != nil {
+				s.conns <- fc
+			}
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+// handshake: INFO, CONNECT, PING -> PONG (or the -ERR).
+func (s *fakeServer) handshake(t *testing.T, conn net.Conn) *fakeConn {
+	fc := &fakeConn{Conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+
+	line, err := fc.r.ReadString('\n')
+	if op, args := parseOp(line); err != nil || op != "CONNECT" || json.Unmarshal([]byte(args), &fc.connect) != nil {
+		t.Errorf("handshake: want CONNECT, got %q (%v)", line, err)
+		conn.Close()
+		return nil
+	}
+	if line, err := fc.r.ReadString('\n'); err != nil || line != "PING\r\n" {
+		t.Errorf("handshake: want PING, got %q (%v)", line, err)
+		conn.Close()
+		return nil
+	}
+	if s.connErr != "" {
+		io.WriteString(conn, "-ERR '"+s.connErr+"'\r\n")
+		conn.Close()
+		return nil
+	}
+	io.WriteString(conn, "PONG\r\n")
+	conn.SetDeadline(time.Time{})
+	return fc
+}
+
+// accept waits for the next client connected.
+func (s *fakeServer) accept(t *testing.T) *fakeConn {
+	t.Helper()
+	select {
+	case fc := <-s.conns:
+		return fc
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept: no client connected")
+		return nil
+	}
+}
+
+// expect reads the next line from the client, which must be the want.
+func (fc *fakeConn) expect(t *testing.T, want string) {
+	t.Helper()
+	fc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := fc.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expect %q: %v", want, err)
+	}
+	if got := strings.TrimRight(line, "\r\n"); got != want {
+		t.Fatalf("expect %q: got %q", want, got)
+	}
+}
+
+func (fc *fakeConn) send(t *testing.T, s string) {
+	t.Helper()
+	if _, err := io.WriteString(fc, s); err != nil {
+		t.Fatalf("send %q: %v", s, err)
+	}
+}
+
+// receive waits for a message delivered to the channel.
+func receive(t *testing.T, msgs chan *Msg) *Msg {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive: no message delivered")
+		return nil
+	}
+}
+
+func TestDialURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{"http://localhost:4222", "want nats://host:port"},
+		{"nats://", "want nats://host:port"},
+		{"nats://%zz", "bad URL"},
+		{"nats://127.0.0.1:1", "Dial: "}, // refused
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			_, err := Dial(tt.url, "test")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Dial(%q) error = %v, want %q", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDialConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string // user info of the URL
+		want    map[string]any
+		connErr string
+	}{
+		{
+			name: "no auth",
+			want: map[string]any{"name": "test", "verbose": false},
+		},
+		{
+			name: "token",
+			user: "s3cret@",
+			want: map[string]any{"auth_token": "s3cret"},
+		},
+		{
+			name: "user and password",
+			user: "alice:pw@",
+			want: map[string]any{"user": "alice", "pass": "pw"},
+		},
+		{
+			name:    "-ERR rejects the CONNECT",
+			connErr: "Authorization Violation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t, tt.connErr)
+			c, err := Dial(strings.Replace(s.url(), "://", "://"+tt.user, 1), "test")
+			if tt.connErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.connErr) {
+					t.Fatalf("Dial() error = %v, want %q", err, tt.connErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer c.Close()
+
+			fc := s.accept(t)
+			for k, v := range tt.want {
+				if fc.connect[k] != v {
+					t.Errorf("CONNECT %s = %v, want %v", k, fc.connect[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	s := newFakeServer(t, "")
+	c, err := Dial(s.url(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fc := s.accept(t)
+
+	msgs := make(chan *Msg, 4)
+	sub, err := c.Subscribe("jobs.>", "workers", func(msg *Msg) { msgs <- msg })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.expect(t, "SUB jobs.> workers 1")
+
+	if err := c.Publish("results.1", "", []byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	fc.expect(t, "PUB results.1 4")
+	fc.expect(t, "done")
+	if err := c.Publish("jobs.1", "results.1", []byte("")); err != nil {
+		t.Fatal(err)
+	}
+	fc.expect(t, "PUB jobs.1 results.1 0")
+	fc.expect(t, "")
+
+	fc.send(t, "MSG jobs.1 1 results.1 5\r\nhello\r\n")
+	if msg := receive(t, msgs); msg.Subject != "jobs.1" || msg.Reply != "results.1" || string(msg.Data) != "hello" {
+		t.Errorf("MSG = %+v, want jobs.1 results.1 hello", msg)
+	}
+	// payloads may contain the line breaks
+	fc.send(t, "MSG jobs.2 1 4\r\na\r\nb\r\n")
+	if msg := receive(t, msgs); msg.Subject != "jobs.2" || msg.Reply != "" || string(msg.Data) != "a\r\nb" {
+		t.Errorf("MSG = %+v, want jobs.2 a\\r\\nb", msg)
+	}
+
+	// answered, and the connection is kept
+	fc.send(t, "PING\r\n")
+	fc.expect(t, "PONG")
+	fc.send(t, "-ERR 'Permissions Violation for Publish to results.1'\r\n")
+	fc.send(t, "MSG jobs.3 1 2\r\nok\r\n")
+	if msg := receive(t, msgs); msg.Subject != "jobs.3" {
+		t.Errorf("MSG after -ERR = %+v, want jobs.3", msg)
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	fc.expect(t, "UNSUB 1")
+	fc.send(t, "MSG jobs.4 1 2\r\nno\r\nPING\r\n")
+	fc.expect(t, "PONG")
+	select {
+	case msg := <-msgs:
+		t.Errorf("MSG after Unsubscribe delivered: %+v", msg)
+	default:
+	}
+
+	c.Close()
+	if err := c.Publish("x", "", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		drop func(t *testing.T, fc *fakeConn)
+	}{
+		{"connection closed", func(t *testing.T, fc *fakeConn) { fc.Close() }},
+		{"bad op", func(t *testing.T, fc *fakeConn) { fc.send(t, "BOGUS\r\n") }},
+		{"bad MSG", func(t *testing.T, fc *fakeConn) { fc.send(t, "MSG jobs.1 x 2\r\nok\r\n") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t, "")
+			c, err := Dial(s.url(), "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			fc := s.accept(t)
+
+			msgs := make(chan *Msg, 4)
+			if _, err := c.Subscribe("jobs.*", "", func(msg *Msg) { msgs <- msg }); err != nil {
+				t.Fatal(err)
+			}
+			fc.expect(t, "SUB jobs.* 1")
+
+			tt.drop(t, fc)
+
+			// subscribed again on the new connection
+			fc = s.accept(t)
+			fc.expect(t, "SUB jobs.* 1")
+			fc.send(t, "MSG jobs.1 1 5\r\nagain\r\n")
+			if msg := receive(t, msgs); string(msg.Data) != "again" {
+				t.Errorf("MSG after reconnect = %+v, want again", msg)
+			}
+			if err := c.Publish("results.1", "", []byte("ok")); err != nil {
+				t.Errorf("Publish after reconnect error = %v", err)
+			}
+			fc.expect(t, "PUB results.1 2")
+		})
+	}
+}
+
+func TestPublishDisconnected(t *testing.T) {
+	s := newFakeServer(t, "")
+	c, err := Dial(s.url(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fc := s.accept(t)
+
+	// the server is gone: reconnecting fails until Close
+	s.ln.Close()
+	fc.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := c.Publish("x", "", []byte("lost"))
+		if errors.Is(err, ErrNotConnected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Publish while disconnected error = %v, want ErrNotConnected", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Close()
+	if err := c.Publish("x", "", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish after Close error = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"musicstore/auth"
+	"musicstore/model"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the OpenAPI 3 spec of the API (GET /openapi.json)
+// and the interactive docs of it (GET /docs, Swagger UI).
+//
+// The spec is generated from the registered routes on request, so the
+// routes of the stores mounted at runtime are included. The details
+// (query params, form fields, bodies) are from apiDocs: keep them in sync
+// with the doc comments of the handlers.
+
+// apiDoc documents a route.
+type apiDoc struct {
+	Summary string
+	Query   []apiParam
+	// Form: fields of a multipart/form-data body, Type "file" for files.
+	Form []apiParam
+	// JSON: an example of the JSON body.
+	JSON string
+	// Responses: status -> description. 200 by default.
+	Responses map[int]string
+}
+
+// apiParam is a query param or a form field.
+type apiParam struct {
+	Name        string
+	Type        string // string | integer | number | boolean | file
+	Description string
+	Required    bool
+}
+
+// apiDocs by "METHOD route". Routes of the stores are "/*/..." (path.Match
+// patterns), as in the auth rules.
+var apiDocs = map[string]apiDoc{
+	"GET /tracks": {
+		Summary: "List tracks",
+		Query: []apiParam{
+			{Name: "limit", Type: "integer"},
+			{Name: "offset", Type: "integer"},
+			{Name: "order_by", Type: "string", Description: "field to order by, e.g. id"},
+			{Name: "desc", Type: "boolean"},
+			{Name: "sort", Type: "string", Description: "created_at, name, artist, play_count or valence"},
+			{Name: "order", Type: "string", Description: "of the sort: asc (default) or desc"},
+			{Name: "filter_by", Type: "string", Description: "field to filter by, e.g. artist"},
+			{Name: "filter_value", Type: "string"},
+			{Name: "total", Type: "boolean", Description: "respond the total count as well"},
+			{Name: "fields", Type: "string", Description: "comma-separated fields of the tracks to respond, e.g. ID,Name,Artist,Emotion"},
+			{Name: "artist", Type: "string", Description: "tracks by the artist, featured or not (case-insensitive)"},
+			{Name: "role", Type: "string", Description: "of the artist: main or featured"},
+		},
+	},
+	"GET /tracks/recent": {
+		Summary: "Tracks added in the last days, newest first",
+		Query: []apiParam{
+			{Name: "days", Type: "integer", Description: "default 7, up to 366"},
+			{Name: "limit", Type: "integer", Description: "default 50, up to 500"},
+			{Name: "fields", Type: "string", Description: "comma-separated fields of the tracks to respond"},
+		},
+	},
+	"GET /tracks/:TrackID":    {Summary: "Get a track (by ID or UUID)"},
+	"POST /tracks":            {Summary: "Create a track (metadata only)", JSON: `{"Name": "...", "Artist": "...", "AudioFileURL": "..."}`},
+	"PUT /tracks/:TrackID":    {Summary: "Update a track", JSON: `{"Name": "...", "Artist": "..."}`},
+	"DELETE /tracks/:TrackID": {Summary: "Delete a track (and its file, by the OnDelete of the store)"},
+	"POST /tracks/import": {
+		Summary: "Import track metadata from a CSV or JSON catalog",
+		Query: []apiParam{
+			{Name: "format", Type: "string", Description: "csv | json, default: by the file extension or the Content-Type"},
+			{Name: "Store", Type: "string", Description: "store to download the FetchURLs into"},
+		},
+		Form: []apiParam{{Name: "File", Type: "file", Description: "the catalog (or the catalog as the body)", Required: true}},
+	},
+	"POST /tracks/:TrackID/merge": {
+		Summary: "Merge duplicate tracks into the track: play stats, playlist items; the duplicates are deleted",
+		JSON:    `{"IDs": [2, 3], "DeleteFiles": true}`,
+	},
+	"GET /tracks/:TrackID/tags":    {Summary: "Get the tags in the audio file of the track"},
+	"GET /tracks/:TrackID/artists": {Summary: "Artists of the track (main and featured), split from its Artist"},
+	"PATCH /tracks/:TrackID/tags": {
+		Summary: "Edit the tags of the track and its audio file",
+		Query:   []apiParam{{Name: "preview", Type: "boolean", Description: "only respond the diff"}},
+		JSON:    `{"Artist": "foo", "Album": "bar"}`,
+	},
+	"PUT /tracks/:TrackID/cover": {
+		Summary: "Upload the cover image of the track, or fetch it from a URL (JSON); scaled down to 1200px",
+		Form:    []apiParam{{Name: "file", Type: "file", Description: "the image: JPEG, PNG or GIF"}},
+		JSON:    `{"URL": "https://example.com/cover.jpg"}`,
+	},
+	"GET /tracks/:TrackID/audio":     {Summary: "Audio file of the track, from the store holding it (or a redirect to a remote file)"},
+	"HEAD /tracks/:TrackID/audio":    {Summary: "Headers of the audio file of the track"},
+	"GET /tracks/:TrackID/emotions":  {Summary: "Emotion history of the track, latest first"},
+	"GET /tracks/:TrackID/hls/:File": {Summary: "HLS playlist (index.m3u8) and segments of the track"},
+	"GET /tracks/:TrackID/waveform": {
+		Summary: "Waveform peaks of the track",
+		Query: []apiParam{
+			{Name: "points", Type: "integer", Description: "number of peaks, up to 4096, default 1000"},
+			{Name: "format", Type: "string", Description: "json (default) | binary"},
+		},
+	},
+	"POST /admin/covers/fetch": {
+		Summary: "Fetch the missing covers of tracks from the Cover Art Archive (or local copies of the external ones) in background",
+		JSON:    `{"All": true, "External": false}`,
+	},
+	"PATCH /admin/stores/:name": {
+		Summary: "Change the options of a running store, e.g. turn on the emotion analysis (of the unanalyzed tracks too)",
+		JSON:    `{"EnableEmomusic": true, "AnalyzeUnanalyzed": true}`,
+	},
+	"GET /admin/quarantine":                   {Summary: "List the files failed to be imported, in the quarantine of the stores"},
+	"POST /admin/quarantine/:store/:ID/retry": {Summary: "Import a quarantined file again"},
+	"DELETE /admin/quarantine/:store/:ID":     {Summary: "Discard a quarantined file"},
+	"POST /admin/stores/:name/migrate": {
+		Summary: "Move the audio files of tracks (all of the store if no IDs) to another store",
+		JSON:    `{"To": "bigdisk", "IDs": [1, 2, 3], "Limit": 0}`,
+	},
+	"GET /stores":                      {Summary: "List the mounted stores, with their track counts"},
+	"GET /jobs":                        {Summary: "List background jobs (analyses, downloads)"},
+	"GET /jobs/:JobID":                 {Summary: "Get a background job"},
+	"GET /libraries":                   {Summary: "List the libraries"},
+	"GET /playlists":                   {Summary: "List the playlists"},
+	"GET /playlists/:PlaylistID/Items": {Summary: "Tracks (TrackID, Position) of the playlist"},
+	"GET /murecom": {
+		Summary: "Recommend tracks by emotion (notice the capitalized params)",
+		Query: []apiParam{
+			{Name: "Valence", Type: "number", Description: "[0, 1]"},
+			{Name: "Arousal", Type: "number", Description: "[0, 1]"},
+			{Name: "Mood", Type: "string", Description: "a preset name, alternative to Valence & Arousal"},
+			{Name: "MinBPM", Type: "number"},
+			{Name: "MaxBPM", Type: "number"},
+			{Name: "MinConfidence", Type: "number", Description: "[0, 1], default 0"},
+			{Name: "ConfidenceWeight", Type: "number", Description: "[0, 1], default 0"},
+			{Name: "Limit", Type: "integer", Description: "[1, 100], default 3"},
+			{Name: "Offset", Type: "integer"},
+			{Name: "Cursor", Type: "string", Description: "nextCursor of the previous response"},
+			{Name: "fields", Type: "string", Description: "comma-separated fields of the tracks to respond, e.g. ID,Name,Emotion"},
+		},
+	},
+	"POST /murecom/trajectory": {
+		Summary: "Playlist following an emotion trajectory",
+		Query:   []apiParam{{Name: "fields", Type: "string", Description: "comma-separated fields of the tracks to respond"}},
+		JSON:    `{"Start": {"valence": 0.1, "arousal": 0.9}, "End": {"valence": 0.8, "arousal": 0.2}, "Duration": 1800, "TrackDuration": 240}`,
+	},
+	"POST /reanalyze":         {Summary: "Re-analyze tracks in background", JSON: `{"IDs": [1, 2, 3]}`},
+	"POST /emotions/rollback": {Summary: "Remove emotion records, e.g. of a bad model version", JSON: `{"ModelVersion": "v2"}`},
+	"GET /rest/:method": {
+		Summary: "Subsonic API (ping, getArtists, getAlbumList2, search3, stream, getCoverArt, ...), authenticated by u & p, or u & t & s",
+		Query: []apiParam{
+			{Name: "u", Type: "string", Description: "user name"},
+			{Name: "f", Type: "string", Description: "xml (default) | json"},
+		},
+	},
+	"POST /rest/:method": {Summary: "Subsonic API, with the parameters in the form body"},
+	"GET /stats": {
+		Summary: "Statistics of the tracks: totals, by store, and imports by day",
+		Query:   []apiParam{{Name: "days", Type: "integer", Description: "of the import activity, default 30, up to 366"}},
+	},
+	"GET /imgproxy": {
+		Summary: "Remote image (e.g. a cover on another host), fetched and cached",
+		Query:   []apiParam{{Name: "url", Type: "string", Description: "http(s) URL of the image", Required: true}},
+	},
+
+	"GET /*/audio/*filepath":  {Summary: "Audio file of the store (Range requests supported)"},
+	"HEAD /*/audio/*filepath": {Summary: "Headers of the audio file"},
+	"POST /*/new": {
+		Summary: "Upload new tracks (files, archives) or import from a URL",
+		Query: []apiParam{
+			{Name: "OnDuplicate", Type: "string", Description: "error | existing | conflict"},
+			{Name: "job", Type: "integer", Description: "upload job (POST /{store}/new/jobs) to report the progress to"},
+		},
+		Form: []apiParam{
+			{Name: "File", Type: "file", Description: "audio file or archive (.zip, .tar.gz); repeatable"},
+			{Name: "AudioFileURL", Type: "string", Description: "download from the URL instead, in background (202)"},
+			{Name: "Name", Type: "string"},
+			{Name: "Artist", Type: "string"},
+			{Name: "Album", Type: "string"},
+			{Name: "CoverImageURL", Type: "string"},
+		},
+		Responses: map[int]string{200: "the track, or the results of the files", 202: "the download job"},
+	},
+	"POST /*/new/jobs": {
+		Summary:   "Create an upload job, to follow the progress of a POST /new?job={ID} by GET /jobs/:JobID",
+		Responses: map[int]string{201: "the upload job"},
+	},
+	"POST /*/new/uploads": {
+		Summary:   "Start a resumable upload",
+		JSON:      `{"Filename": "audio.mp3", "Size": 12345678}`,
+		Responses: map[int]string{201: "the upload"},
+	},
+	"PATCH /*/new/uploads/:UploadID":       {Summary: "Append a chunk (raw body, Upload-Offset header) to the upload"},
+	"POST /*/new/uploads/:UploadID/commit": {Summary: "Import the completed upload as a track"},
+	"DELETE /*/new/uploads/:UploadID":      {Summary: "Abort the upload"},
+	"POST /*/rescan": {
+		Summary: "Import the new or changed files in the FileDir of the store",
+		Query:   []apiParam{{Name: "dryRun", Type: "boolean"}},
+	},
+	"GET /*/scan/progress": {Summary: "Progress of the running scan of the store"},
+
+	"GET /events": {
+		Summary: "Server-Sent Events of the library (track.created, track.updated, track.deleted, analysis.completed)",
+		Query: []apiParam{
+			{Name: "types", Type: "string", Description: "comma-separated types, all by default"},
+			{Name: "lastEventId", Type: "string", Description: "resume after the event, as the Last-Event-ID header"},
+		},
+		Responses: map[int]string{200: "text/event-stream"},
+	},
+
+	"GET /admin/duplicates": {
+		Summary: "Groups of tracks likely to be the same recording, with similarity scores",
+		Query: []apiParam{
+			{Name: "method", Type: "string", Description: "hash | musicbrainz | name, comma-separated, default: all"},
+			{Name: "min_score", Type: "number", Description: "[0, 1], default 0"},
+		},
+	},
+	"GET /admin/fsck":         {Summary: "Check the stores against the database", Query: []apiParam{{Name: "Store", Type: "string"}}},
+	"POST /admin/fsck/repair": {Summary: "Repair the problems found by fsck", JSON: `{"Store": "", "Relink": true, "DeleteOrphans": false, "MarkMissing": true}`},
+	"POST /admin/backup": {
+		Summary: "Backup (tar.gz) of the database and the files",
+		Query:   []apiParam{{Name: "files", Type: "boolean", Description: "include the audio files"}},
+	},
+	"POST /admin/restore":    {Summary: "Restore a backup", Form: []apiParam{{Name: "File", Type: "file", Required: true}}},
+	"GET /admin/loglevel":    {Summary: "Log levels of the zones"},
+	"PUT /admin/loglevel":    {Summary: "Set the log level of a zone", JSON: `{"Zone": "musicstore/audiofilestore", "Level": "debug"}`},
+	"GET /healthz":           {Summary: "Liveness"},
+	"GET /readyz":            {Summary: "Readiness: database, stores (and emomusic)", Responses: map[int]string{200: "ready", 503: "not ready"}},
+	"GET /version":           {Summary: "Build info and enabled features"},
+	"GET /openapi.json":      {Summary: "This OpenAPI spec"},
+	"GET /docs":              {Summary: "Interactive docs (Swagger UI)"},
+	"GET /debug/pprof/*name": {Summary: "pprof profiles"},
+}
+
+// docOf the route, by the exact key or a pattern.
+func docOf(method, route string) (apiDoc, bool) {
+	if doc, ok := apiDocs[method+" "+route]; ok {
+		return doc, true
+	}
+	for key, doc := range apiDocs {
+		m, pattern, _ := strings.Cut(key, " ")
+		if m != method || !strings.HasPrefix(pattern, "/*/") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, route); ok {
+			return doc, true
+		}
+	}
+	return apiDoc{}, false
+}
+
+// openAPISpec of the routes.
+func openAPISpec(routes gin.RoutesInfo, info BuildInfo, prefix string) map[string]any {
+	paths := map[string]map[string]any{}
+	for _, route := range routes {
+		p, params := openAPIPath(route.Path)
+		if paths[p] == nil {
+			paths[p] = map[string]any{}
+		}
+		paths[p][strings.ToLower(route.Method)] = openAPIOperation(route.Method, route.Path, params)
+	}
+
+	if prefix == "" {
+		prefix = "/"
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "musicstore",
+			"version":     info.Version,
+			"description": "musicstore = audiofilestore + crud(metadata) + murecom",
+		},
+		"servers": []any{map[string]any{"url": prefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearer":      map[string]any{"type": "http", "scheme": "bearer"},
+				"accessToken": map[string]any{"type": "apiKey", "in": "query", "name": "access_token"},
+			},
+			"schemas": map[string]any{
+				"Track":         schemaOf(reflect.TypeOf(model.Track{})),
+				"Job":           schemaOf(reflect.TypeOf(model.Job{})),
+				"EmotionRecord": schemaOf(reflect.TypeOf(model.EmotionRecord{})),
+				"Error": map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"error": map[string]any{"type": "string"}},
+				},
+			},
+		},
+		"security": []any{
+			map[string]any{"bearer": []string{}},
+			map[string]any{"accessToken": []string{}},
+		},
+	}
+}
+
+// openAPIPath converts the gin route to the OpenAPI path:
+// /tracks/:TrackID -> /tracks/{TrackID}, and returns the params.
+func openAPIPath(route string) (string, []string) {
+	var params []string
+	segments := strings.Split(route, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			params = append(params, s[1:])
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func openAPIOperation(method, route string, pathParams []string) map[string]any {
+	doc, ok := docOf(method, route)
+	if !ok {
+		doc.Summary = method + " " + route
+	}
+
+	tag := strings.SplitN(strings.TrimPrefix(route, "/"), "/", 2)[0]
+	if isStoreRoute(route) {
+		tag = "stores"
+	}
+
+	role := auth.RequiredRole(method, route)
+	op := map[string]any{
+		"summary":     doc.Summary,
+		"tags":        []string{tag},
+		"operationId": method + " " + route,
+	}
+	if role == auth.RolePublic {
+		op["security"] = []any{}
+		op["description"] = "Public."
+	} else {
+		op["description"] = "Requires the role: " + role + "."
+	}
+
+	var params []any
+	for _, name := range pathParams {
+		params = append(params, map[string]any{
+			"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, q := range doc.Query {
+		params = append(params, map[string]any{
+			"name": q.Name, "in": "query", "required": q.Required,
+			"description": q.Description, "schema": map[string]any{"type": q.Type},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if len(doc.Form) > 0 {
+		props := map[string]any{}
+		var required []string
+		for _, f := range doc.Form {
+			schema := map[string]any{"type": f.Type, "description": f.Description}
+			if f.Type == "file" {
+				schema = map[string]any{"type": "string", "format": "binary", "description": f.Description}
+			}
+			props[f.Name] = schema
+			if f.Required {
+				required = append(required, f.Name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		op["requestBody"] = map[string]any{
+			"content": map[string]any{"multipart/form-data": map[string]any{"schema": schema}},
+		}
+	} else if doc.JSON != "" {
+		op["requestBody"] = map[string]any{
+			"content": map[string]any{"application/json": map[string]any{
+				"schema":  map[string]any{"type": "object"},
+				"example": json.RawMessage(doc.JSON),
+			}},
+		}
+	}
+
+	responses := map[string]any{
+		"default": map[string]any{
+			"description": "error",
+			"content": map[string]any{"application/json": map[string]any{
+				"schema": map[string]any{"$ref": "#/components/schemas/Error"},
+			}},
+		},
+	}
+	if len(doc.Responses) == 0 {
+		doc.Responses = map[int]string{http.StatusOK: "OK"}
+	}
+	for status, description := range doc.Responses {
+		responses[strconv.Itoa(status)] = map[string]any{"description": description}
+	}
+	op["responses"] = responses
+	return op
+}
+
+// isStoreRoute: the routes of the stores are /{store}/...,
+// the first segment is not a known one.
+func isStoreRoute(route string) bool {
+	first := strings.SplitN(strings.TrimPrefix(route, "/"), "/", 2)[0]
+	for key := range apiDocs {
+		_, pattern, _ := strings.Cut(key, " ")
+		if strings.SplitN(strings.TrimPrefix(pattern, "/"), "/", 2)[0] == first {
+			return false
+		}
+	}
+	return true
+}
+
+// schemaOf the type, as the encoding/json encodes it.
+func schemaOf(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(reflect.TypeOf((*json.Marshaler)(nil)).Elem()) {
+		return map[string]any{} // custom: any
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		addFields(t, props)
+		return map[string]any{"type": "object", "properties": props}
+	}
+	return map[string]any{}
+}
+
+// addFields of the struct (and its embedded structs) to the props.
+func addFields(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			addFields(ft, props)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type)
+	}
+}
+
+// registerDocsRoutes registers:
+//
+//   - GET /openapi.json: the OpenAPI spec
+//   - GET /docs: Swagger UI of the spec
+//
+// It should be called with the engine, whose routes are documented.
+func registerDocsRoutes(r *gin.Engine) {
+	info := buildInfo()
+
+	r.GET("/openapi.json", func(c *gin.Context) {
+		routes := r.Routes()
+		sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+		c.JSON(http.StatusOK, openAPISpec(routes, info, c.GetHeader("X-Forwarded-Prefix")))
+	})
+	r.GET("/docs", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUI))
+	})
+}
+
+// swaggerUI page, loading the spec relatively: works under a PathPrefix.
+const swaggerUI = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>musicstore API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui", persistAuthorization: true});
+  </script>
+</body>
+</html>
+`
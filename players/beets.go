@@ -0,0 +1,74 @@
+package players
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// this file reads the sqlite library of beets (library.db, see the
+// `library` option of beets). The play counts, ratings and last played
+// times are the flexible attributes written by the mpdstats plugin:
+// play_count, rating (0-1) and last_played (unix time). beets has no
+// playlists in the library: the playlist plugin reads m3u files.
+
+// ReadBeets reads the beets library file.
+func ReadBeets(path string) (*Library, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadBeets: open failed: %w", err)
+	}
+	defer closeDB(db)
+
+	var items []struct {
+		ID                          int
+		Path                        []byte // beets stores the paths as bytes
+		Title, Artist, Album, Genre string
+	}
+	err = db.Raw(`SELECT id, path, title, artist, album, genre
+		FROM items ORDER BY id`).Scan(&items).Error
+	if err != nil {
+		return nil, fmt.Errorf("ReadBeets: query items failed: %w", err)
+	}
+
+	var attributes []struct {
+		EntityID   int
+		Key, Value string
+	}
+	err = db.Raw(`SELECT entity_id, key, value FROM item_attributes
+		WHERE key IN ('play_count', 'rating', 'last_played')`).Scan(&attributes).Error
+	if err != nil {
+		return nil, fmt.Errorf("ReadBeets: query item_attributes failed: %w", err)
+	}
+	attrs := map[int]map[string]string{} // entity_id -> key -> value
+	for _, a := range attributes {
+		if attrs[a.EntityID] == nil {
+			attrs[a.EntityID] = map[string]string{}
+		}
+		attrs[a.EntityID][a.Key] = a.Value
+	}
+
+	lib := &Library{Source: SourceBeets}
+	for _, item := range items {
+		track := Track{
+			ID:     strconv.Itoa(item.ID),
+			Name:   item.Title,
+			Artist: item.Artist,
+			Album:  item.Album,
+			Genre:  item.Genre,
+			Path:   string(item.Path),
+		}
+		a := attrs[item.ID]
+		track.PlayCount, _ = strconv.Atoi(a["play_count"])
+		if rating, err := strconv.ParseFloat(a["rating"], 64); err == nil {
+			track.Rating = int(math.Round(rating * 100))
+		}
+		if played, err := strconv.ParseFloat(a["last_played"], 64); err == nil && played > 0 {
+			t := time.Unix(int64(played), 0)
+			track.LastPlayed = &t
+		}
+		lib.Tracks = append(lib.Tracks, track)
+	}
+	return lib, nil
+}
@@ -0,0 +1,227 @@
+package players
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// this file reads the library XML of iTunes (or Music.app, by File >
+// Library > Export Library...). The built-in playlists (the library
+// itself, Music, Podcasts, ...), the smart ones and the folders are left
+// out.
+
+// ReadITunes reads the library XML file.
+func ReadITunes(path string) (*Library, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadITunes: %w", err)
+	}
+	defer f.Close()
+	return parseITunes(f)
+}
+
+func parseITunes(r io.Reader) (*Library, error) {
+	root, err := decodePlist(xml.NewDecoder(r))
+	if err != nil {
+		return nil, fmt.Errorf("ReadITunes: %w", err)
+	}
+	dict, ok := root.(map[string]any)
+	if !ok {
+		return nil, errors.New("ReadITunes: not an iTunes library: the root is not a dict")
+	}
+
+	lib := &Library{Source: SourceITunes}
+	var ids []int // of the tracks, to sort them
+	tracks, _ := dict["Tracks"].(map[string]any)
+	for _, v := range tracks {
+		t, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		id := intOf(t["Track ID"])
+		track := Track{
+			ID:        strconv.Itoa(id),
+			Name:      stringOf(t["Name"]),
+			Artist:    stringOf(t["Artist"]),
+			Album:     stringOf(t["Album"]),
+			Genre:     stringOf(t["Genre"]),
+			PlayCount: intOf(t["Play Count"]),
+			Rating:    intOf(t["Rating"]),
+		}
+		if t["Rating Computed"] == true { // derived from the album rating
+			track.Rating = 0
+		}
+		if d, ok := t["Play Date UTC"].(time.Time); ok {
+			track.LastPlayed = &d
+		}
+		if location := stringOf(t["Location"]); location != "" {
+			track.Path = pathOfLocation(location)
+		}
+		lib.Tracks = append(lib.Tracks, track)
+		ids = append(ids, id)
+	}
+	sort.Sort(byIDs{lib.Tracks, ids})
+
+	playlists, _ := dict["Playlists"].([]any)
+	for _, v := range playlists {
+		p, ok := v.(map[string]any)
+		if !ok || isBuiltin(p) {
+			continue
+		}
+		playlist := Playlist{
+			ID:   stringOf(p["Playlist Persistent ID"]),
+			Name: stringOf(p["Name"]),
+		}
+		items, _ := p["Playlist Items"].([]any)
+		for _, item := range items {
+			if i, ok := item.(map[string]any); ok {
+				playlist.TrackIDs = append(playlist.TrackIDs, strconv.Itoa(intOf(i["Track ID"])))
+			}
+		}
+		lib.Playlists = append(lib.Playlists, playlist)
+	}
+	return lib, nil
+}
+
+// byIDs sorts the tracks by their (int) IDs.
+type byIDs struct {
+	tracks []Track
+	ids    []int
+}
+
+func (s byIDs) Len() int           { return len(s.tracks) }
+func (s byIDs) Less(i, j int) bool { return s.ids[i] < s.ids[j] }
+func (s byIDs) Swap(i, j int) {
+	s.tracks[i], s.tracks[j] = s.tracks[j], s.tracks[i]
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+}
+
+// isBuiltin checks if the playlist is a built-in (Master, or of a
+// Distinguished Kind), smart one, or a folder.
+func isBuiltin(p map[string]any) bool {
+	return p["Master"] == true || p["Distinguished Kind"] != nil ||
+		p["Smart Info"] != nil || p["Folder"] == true
+}
+
+// pathOfLocation: file://localhost/Users/me/Music/a%20b.mp3 -> /Users/me/Music/a b.mp3.
+// Windows: file://localhost/C:/Users/... -> C:\Users\...
+func pathOfLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	path := u.Path
+	if runtime.GOOS == "windows" {
+		path = strings.TrimPrefix(path, "/")
+	}
+	return filepath.FromSlash(path)
+}
+
+func stringOf(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func intOf(v any) int {
+	i, _ := v.(int64)
+	return int(i)
+}
+
+// decodePlist decodes the XML property list into: map[string]any (dict),
+// []any (array), string, int64 (integer), float64 (real), bool,
+// time.Time (date) and []byte (data, kept encoded).
+func decodePlist(d *xml.Decoder) (any, error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local == "plist" {
+				continue
+			}
+			return decodeValue(d, start)
+		}
+	}
+}
+
+// decodeValue of the element started.
+func decodeValue(d *xml.Decoder, start xml.StartElement) (any, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := map[string]any{}
+		var key string
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				if tok.Name.Local == "key" {
+					if err := d.DecodeElement(&key, &tok); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				v, err := decodeValue(d, tok)
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = v
+			case xml.EndElement:
+				return dict, nil
+			}
+		}
+	case "array":
+		array := []any{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				v, err := decodeValue(d, tok)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, v)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return nil, err
+	}
+	switch start.Name.Local {
+	case "integer":
+		return strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(text), 64)
+	case "date":
+		return time.Parse(time.RFC3339, strings.TrimSpace(text))
+	case "data":
+		return []byte(text), nil
+	default: // string
+		return text, nil
+	}
+}
@@ -0,0 +1,90 @@
+package players
+
+import (
+	"fmt"
+	"time"
+)
+
+// this file reads the sqlite database of Navidrome (navidrome.db, in its
+// data folder). Navidrome keeps the play counts and ratings per user: the
+// counts of all the users are summed up, and the highest rating is taken.
+
+// ReadNavidrome reads the Navidrome database file.
+func ReadNavidrome(path string) (*Library, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadNavidrome: open failed: %w", err)
+	}
+	defer closeDB(db)
+
+	var files []struct {
+		ID, Path, Title, Artist, Album, Genre string
+		PlayCount                             int
+		Rating                                int    // stars: 0-5
+		PlayDate                              string // datetime, or empty
+	}
+	err = db.Raw(`SELECT f.id, f.path, f.title, f.artist, f.album, f.genre,
+			COALESCE(SUM(a.play_count), 0) AS play_count,
+			COALESCE(MAX(a.rating), 0) AS rating,
+			COALESCE(MAX(a.play_date), '') AS play_date
+		FROM media_file f
+		LEFT JOIN annotation a ON a.item_id = f.id AND a.item_type = 'media_file'
+		GROUP BY f.id
+		ORDER BY f.path`).Scan(&files).Error
+	if err != nil {
+		return nil, fmt.Errorf("ReadNavidrome: query media_file failed: %w", err)
+	}
+
+	lib := &Library{Source: SourceNavidrome}
+	for _, f := range files {
+		lib.Tracks = append(lib.Tracks, Track{
+			ID:         f.ID,
+			Name:       f.Title,
+			Artist:     f.Artist,
+			Album:      f.Album,
+			Genre:      f.Genre,
+			Path:       f.Path,
+			PlayCount:  f.PlayCount,
+			Rating:     f.Rating * 20,
+			LastPlayed: parseNavidromeTime(f.PlayDate),
+		})
+	}
+
+	var playlists []struct{ ID, Name string }
+	err = db.Raw(`SELECT id, name FROM playlist ORDER BY name`).Scan(&playlists).Error
+	if err != nil {
+		return nil, fmt.Errorf("ReadNavidrome: query playlist failed: %w", err)
+	}
+	for _, p := range playlists {
+		playlist := Playlist{ID: p.ID, Name: p.Name}
+		err := db.Raw(`SELECT media_file_id FROM playlist_tracks
+			WHERE playlist_id = ? ORDER BY id`, p.ID).Scan(&playlist.TrackIDs).Error
+		if err != nil {
+			return nil, fmt.Errorf("ReadNavidrome: query playlist_tracks of %q failed: %w", p.Name, err)
+		}
+		lib.Playlists = append(lib.Playlists, playlist)
+	}
+	return lib, nil
+}
+
+// navidromeTimeLayouts: the datetimes are written by the Go sqlite driver
+// of Navidrome, or read back as time.Time (RFC 3339).
+var navidromeTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+}
+
+func parseNavidromeTime(s string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	for _, layout := range navidromeTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	logger.WithField("time", s).Warn("parseNavidromeTime: unknown format, ignored")
+	return nil
+}
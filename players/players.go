@@ -0,0 +1,98 @@
+// Package players reads the libraries of other music players, to import
+// them into musicstore: the tracks with their files, play counts and
+// ratings, and the playlists. Supported: iTunes (or Music.app) library
+// XML, Navidrome and beets databases.
+package players
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+var logger = log.ZoneLogger("musicstore/players")
+
+// Sources of the libraries.
+const (
+	SourceITunes    = "itunes"
+	SourceNavidrome = "navidrome"
+	SourceBeets     = "beets"
+)
+
+// Read the library of the source at path.
+func Read(source string, path string) (*Library, error) {
+	switch source {
+	case SourceITunes:
+		return ReadITunes(path)
+	case SourceNavidrome:
+		return ReadNavidrome(path)
+	case SourceBeets:
+		return ReadBeets(path)
+	}
+	return nil, fmt.Errorf("Read: unknown source %q: want %s, %s or %s",
+		source, SourceITunes, SourceNavidrome, SourceBeets)
+}
+
+// Library of a player.
+type Library struct {
+	Source    string
+	Tracks    []Track
+	Playlists []Playlist
+}
+
+// Track of the library.
+type Track struct {
+	ID     string // in the player: referred by the playlists
+	Name   string
+	Artist string
+	Album  string
+	Genre  string
+	// Path of the file. Empty for the streams.
+	Path      string
+	PlayCount int
+	// Rating in [0, 100]: 20 per star, 0 if unrated.
+	Rating     int
+	LastPlayed *time.Time
+}
+
+// Playlist of the library.
+type Playlist struct {
+	ID       string // in the player
+	Name     string
+	TrackIDs []string // in order
+}
+
+// MapPaths replaces the prefix from of the paths of the tracks with to,
+// e.g. for a library of another host: /music -> /mnt/nas/music.
+func (l *Library) MapPaths(from, to string) {
+	from = filepath.Clean(from)
+	for i := range l.Tracks {
+		p := l.Tracks[i].Path
+		if p == from || strings.HasPrefix(p, from+string(filepath.Separator)) {
+			l.Tracks[i].Path = filepath.Join(to, strings.TrimPrefix(p, from))
+		}
+	}
+}
+
+// openDB opens the sqlite database of a player read-only.
+func openDB(path string) (*gorm.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return gorm.Open(sqlite.Open("file:"+path+"?mode=ro"), &gorm.Config{
+		Logger: log.Logger4Gorm,
+	})
+}
+
+// closeDB closes the database opened by openDB.
+func closeDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/pprof"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file mounts the net/http/pprof handlers under /debug/pprof,
+// if enabled by Debug.Pprof. They require the admin role (see auth).
+
+// registerPprof registers:
+//
+//	GET /debug/pprof/: index of the profiles
+//	GET /debug/pprof/{heap, goroutine, allocs, ...}: named profiles
+//	GET /debug/pprof/profile?seconds=30: CPU profile
+//	GET /debug/pprof/trace?seconds=5: execution trace
+//	GET /debug/pprof/cmdline, GET|POST /debug/pprof/symbol
+func registerPprof(r gin.IRouter) {
+	handler := func(c *gin.Context) {
+		switch c.Param("name") {
+		case "/cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "/profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "/symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "/trace":
+			pprof.Trace(c.Writer, c.Request)
+		default: // the index, and the named profiles by the path
+			pprof.Index(c.Writer, c.Request)
+		}
+	}
+	r.GET("/debug/pprof/*name", handler)
+	r.POST("/debug/pprof/*name", handler)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// this file implements mounting the whole API under a path prefix
+// (PathPrefix, e.g. /musicstore), to be reverse-proxied alongside other
+// services on one host.
+//
+// The routes are registered without the prefix: it's stripped from the
+// requests before routing, so the auth rules, the access logs and the
+// routes of the stores work on the same paths with or without it.
+
+// cleanPathPrefix returns the prefix as "/a/b", or "" for no prefix.
+func cleanPathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// withPathPrefix serves the requests under the prefix by h, with the
+// prefix stripped. Other requests are 404.
+//
+// X-Forwarded-Prefix is set for gin, to redirect (e.g. the trailing
+// slashes) with the prefix.
+func withPathPrefix(prefix string, h http.Handler) http.Handler {
+	prefix = cleanPathPrefix(prefix)
+	if prefix == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if len(p) == len(r.URL.Path) || (p != "" && p[0] != '/') {
+			http.NotFound(w, r) // not under the prefix, e.g. /musicstorex
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = ""
+		r2.Header = r.Header.Clone()
+		r2.Header.Set("X-Forwarded-Prefix", prefix)
+
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// prefixBaseUrls appends the PathPrefix to the BaseUrls of the stores
+// (unless they end with it already), so that the AudioFileURLs are
+// under the prefix.
+func (c *MusicstoreConfig) prefixBaseUrls() {
+	prefix := cleanPathPrefix(c.PathPrefix)
+	if prefix == "" {
+		return
+	}
+	for i := range c.AudioFileStores {
+		base := strings.TrimSuffix(c.AudioFileStores[i].BaseUrl, "/")
+		if base == "" || strings.HasSuffix(base, prefix) {
+			continue
+		}
+		c.AudioFileStores[i].BaseUrl = base + prefix
+	}
+}
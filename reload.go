@@ -0,0 +1,169 @@
+package main
+
+import (
+	"musicstore/audiofilestore"
+	"musicstore/auth"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cdfmlr/crud/config"
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the reloading of the config, on SIGHUP (see
+// gracefulShoutdown) or on changes of the file (-watch-config), without
+// dropping the HTTP listener:
+//
+//   - AudioFileStores: the new ones are mounted, the removed ones are
+//     unmounted, and the changed ones are remounted
+//   - Emomusic: the client (server, TLS, retries...) is replaced
+//   - Log: the levels are updated
+//   - Auth: the users and the networks are updated
+//   - Webhooks: the targets are replaced
+//   - Fetch, Scan: the policies are replaced, for the next fetches
+//     (the ones in progress go on by the old one) and scans
+//
+// Others (HttpListenAddr, PathPrefix, TLS, Metadata, NATS, ...) need a restart.
+
+// watchConfigDebounce: changes of the config file within it are
+// reloaded once, e.g. editors writing the file in several steps.
+const watchConfigDebounce = time.Second
+
+type reloader struct {
+	mu   sync.Mutex
+	path string
+	cfg  *MusicstoreConfig // in effect
+	r    gin.IRouter
+}
+
+// reload the config from the file. The old config is kept (in effect)
+// if the new one can't be read.
+func (rl *reloader) reload() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	logger.WithField("file", rl.path).Info("reload: reloading config...")
+
+	var cfg MusicstoreConfig
+	if err := config.Init(&cfg, config.FromFile(rl.path)); err != nil {
+		logger.WithError(err).Error("reload: read config failed: the old config is kept")
+		return
+	}
+	cfg.complete()
+	old := rl.cfg
+
+	if err := useLogLevels(cfg.Log.Level, cfg.Log.Zones); err != nil {
+		logger.WithError(err).Error("reload: useLogLevels failed")
+	}
+
+	if !reflect.DeepEqual(old.Emomusic, cfg.Emomusic) {
+		if err := startEmomusicClient(cfg.Emomusic); err != nil {
+			logger.WithError(err).Error("reload: startEmomusicClient failed")
+		}
+	}
+
+	if !reflect.DeepEqual(old.Auth, cfg.Auth) {
+		if err := auth.UseUsers(cfg.Auth.Users, cfg.Auth.Anonymous); err != nil {
+			logger.WithError(err).Error("reload: auth.UseUsers failed")
+		}
+		if err := auth.UseNetworks(cfg.Auth.AllowNets, cfg.Auth.DenyNets); err != nil {
+			logger.WithError(err).Error("reload: auth.UseNetworks failed")
+		}
+	}
+
+	if !reflect.DeepEqual(old.Webhooks, cfg.Webhooks) {
+		if err := startWebhooks(cfg.Webhooks); err != nil {
+			logger.WithError(err).Error("reload: startWebhooks failed")
+		}
+	}
+
+	if !reflect.DeepEqual(old.Fetch, cfg.Fetch) {
+		if err := useFetchPolicy(cfg.Fetch); err != nil {
+			logger.WithError(err).Error("reload: useFetchPolicy failed")
+		}
+	}
+	if !reflect.DeepEqual(old.Scan, cfg.Scan) {
+		useScanPolicy(cfg.Scan)
+	}
+
+	rl.reloadStores(old.AudioFileStores, cfg.AudioFileStores)
+
+	if cfg.HttpListenAddr != old.HttpListenAddr || cfg.Metadata != old.Metadata ||
+		!reflect.DeepEqual(cfg.TLS, old.TLS) || cfg.PathPrefix != old.PathPrefix || cfg.NATS != old.NATS {
+		logger.Warn("reload: HttpListenAddr, PathPrefix, TLS, Metadata and NATS changes need a restart")
+	}
+
+	rl.cfg = &cfg
+	logger.WithField("stores", audiofilestore.StoreNames()).Info("reload: config reloaded.")
+}
+
+// reloadStores unmounts the removed and changed stores,
+// and then mounts the new and changed ones.
+func (rl *reloader) reloadStores(olds, news []AudioFileStoreConfig) {
+	oldByName := map[string]AudioFileStoreConfig{}
+	for _, c := range olds {
+		oldByName[c.Name] = c
+	}
+	newByName := map[string]AudioFileStoreConfig{}
+	for _, c := range news {
+		newByName[c.Name] = c
+	}
+
+	for name, oldCfg := range oldByName {
+		if newCfg, ok := newByName[name]; !ok || !reflect.DeepEqual(oldCfg, newCfg) {
+			audiofilestore.Unmount(name)
+		}
+	}
+	for _, newCfg := range news {
+		if oldCfg, ok := oldByName[newCfg.Name]; ok && reflect.DeepEqual(oldCfg, newCfg) {
+			continue
+		}
+		if err := startAudioFileStore(newCfg, rl.r); err != nil {
+			logger.WithField("store", newCfg.Name).WithError(err).
+				Error("reload: startAudioFileStore failed")
+		}
+	}
+}
+
+// watch the config file, and reload it on changes.
+// The dir is watched: editors often replace the file.
+func (rl *reloader) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(rl.path)); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(rl.path) &&
+					event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					debounce = time.After(watchConfigDebounce)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.WithError(err).Warn("watch config: fsnotify error")
+			case <-debounce:
+				debounce = nil
+				rl.reload()
+			}
+		}
+	}()
+
+	logger.WithField("file", rl.path).Info("watching the config file for changes.")
+	return nil
+}
@@ -0,0 +1,250 @@
+// Package sound decodes audio files and computes simple features
+// (energy, brightness, tempo) from the samples, without any service.
+//
+// WAV files are decoded natively. Other formats are decoded by ffmpeg,
+// if it is available on the PATH.
+package sound
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SampleRate of the decoded PCM.
+const SampleRate = 22050
+
+// PCM is mono samples in [-1, 1] at SampleRate.
+type PCM []float32
+
+// Duration of the PCM in seconds.
+func (p PCM) Duration() float64 {
+	return float64(len(p)) / SampleRate
+}
+
+// ErrUnsupported is returned if the file can not be decoded:
+// it's not a WAV file and ffmpeg is not available.
+var ErrUnsupported = errors.New("sound: unsupported format (ffmpeg not found)")
+
+// Decode the audio file (or URL, by ffmpeg) into mono PCM at SampleRate.
+// Only the first maxSeconds are decoded, if maxSeconds > 0.
+// ffmpeg is killed when ctx is done.
+func Decode(ctx context.Context, path string, maxSeconds float64) (PCM, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".wav" {
+		pcm, err := decodeWAVFile(path, maxSeconds)
+		if err == nil {
+			return truncate(pcm, maxSeconds), nil
+		}
+		// e.g. compressed wav: try ffmpeg
+	}
+	return decodeFFmpeg(ctx, path, maxSeconds)
+}
+
+func truncate(pcm PCM, maxSeconds float64) PCM {
+	if maxSeconds > 0 {
+		if n := int(maxSeconds * SampleRate); n < len(pcm) {
+			return pcm[:n]
+		}
+	}
+	return pcm
+}
+
+// decodeFFmpeg: ffmpeg -i path -f s16le -ac 1 -ar SampleRate -
+func decodeFFmpeg(ctx context.Context, path string, maxSeconds float64) (PCM, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	args := []string{"-v", "error", "-i", path}
+	if maxSeconds > 0 {
+		args = append(args, "-t", strconv.FormatFloat(maxSeconds, 'f', -1, 64))
+	}
+	args = append(args, "-f", "s16le", "-ac", "1", "-ar", strconv.Itoa(SampleRate), "-")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sound: ffmpeg failed: %w: %s", err, stderr.String())
+	}
+
+	pcm := make(PCM, len(out)/2)
+	for i := range pcm {
+		pcm[i] = float32(int16(binary.LittleEndian.Uint16(out[2*i:]))) / 32768
+	}
+	return pcm, nil
+}
+
+func decodeWAVFile(path string, maxSeconds float64) (PCM, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeWAV(f, maxSeconds)
+}
+
+// wavFormat is the "fmt " chunk of a WAV file.
+type wavFormat struct {
+	AudioFormat   uint16 // 1: PCM, 3: IEEE float
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+}
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+
+	// maxWAVFormatSize: the "fmt " chunk is 16, 18 or 40 bytes. Its size
+	// is read from the file: a larger one is refused, not allocated.
+	maxWAVFormatSize = 64
+)
+
+// decodeWAV decodes PCM (8/16/24/32 bit) and float (32 bit) WAV.
+// Only the data of the first maxSeconds is read, if maxSeconds > 0.
+func decodeWAV(r io.Reader, maxSeconds float64) (PCM, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("sound: not a WAV file")
+	}
+
+	var format *wavFormat
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("sound: no data chunk: %w", err)
+		}
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size > maxWAVFormatSize {
+				return nil, fmt.Errorf("sound: bad WAV fmt chunk of %d bytes", size)
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return nil, err
+			}
+			format = new(wavFormat)
+			if err := binary.Read(bytes.NewReader(chunk), binary.LittleEndian, format); err != nil {
+				return nil, err
+			}
+			if format.AudioFormat == wavFormatExtensible && len(chunk) >= 26 {
+				// the real format is the first 2 bytes of the SubFormat GUID
+				format.AudioFormat = binary.LittleEndian.Uint16(chunk[24:26])
+			}
+		case "data":
+			if format == nil {
+				return nil, errors.New("sound: data chunk before fmt chunk")
+			}
+			if maxSeconds > 0 && format.BlockAlign > 0 {
+				frames := int64(maxSeconds*float64(format.SampleRate)) + 1
+				if n := frames * int64(format.BlockAlign); n < size {
+					size = n
+				}
+			}
+			data, err := io.ReadAll(io.LimitReader(r, size))
+			if err != nil {
+				return nil, err
+			}
+			return wavSamples(format, data)
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if size%2 == 1 { // chunks are word aligned
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// wavSamples converts the data chunk into mono PCM at SampleRate.
+func wavSamples(format *wavFormat, data []byte) (PCM, error) {
+	channels := int(format.Channels)
+	width := int(format.BitsPerSample) / 8
+	if channels == 0 || width == 0 || format.SampleRate == 0 {
+		return nil, errors.New("sound: bad WAV format")
+	}
+
+	var sample func(b []byte) float32
+	switch {
+	case format.AudioFormat == wavFormatPCM && width == 1:
+		sample = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }
+	case format.AudioFormat == wavFormatPCM && width == 2:
+		sample = func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format.AudioFormat == wavFormatPCM && width == 3:
+		sample = func(b []byte) float32 {
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			return float32(v) / (1 << 23)
+		}
+	case format.AudioFormat == wavFormatPCM && width == 4:
+		sample = func(b []byte) float32 { return float32(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format.AudioFormat == wavFormatFloat && width == 4:
+		sample = func(b []byte) float32 { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }
+	default:
+		return nil, fmt.Errorf("sound: unsupported WAV format %d with %d bits", format.AudioFormat, format.BitsPerSample)
+	}
+
+	frameSize := channels * width
+	frames := len(data) / frameSize
+	mono := make(PCM, frames)
+	for i := 0; i < frames; i++ {
+		var sum float32
+		for ch := 0; ch < channels; ch++ {
+			off := i*frameSize + ch*width
+			sum += sample(data[off : off+width])
+		}
+		mono[i] = sum / float32(channels)
+	}
+
+	return resample(mono, int(format.SampleRate), SampleRate), nil
+}
+
+// resample by linear interpolation.
+func resample(pcm PCM, from, to int) PCM {
+	if from == to || len(pcm) == 0 {
+		return pcm
+	}
+
+	n := int(int64(len(pcm)) * int64(to) / int64(from))
+	out := make(PCM, n)
+	ratio := float64(from) / float64(to)
+	for i := range out {
+		pos := float64(i) * ratio
+		j := int(pos)
+		if j+1 >= len(pcm) {
+			out[i] = pcm[len(pcm)-1]
+			continue
+		}
+		frac := float32(pos - float64(j))
+		out[i] = pcm[j]*(1-frac) + pcm[j+1]*frac
+	}
+	return out
+}
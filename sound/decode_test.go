@@ -0,0 +1,231 @@
+package sound
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// wavChunk is a chunk of a WAV file built by the tests.
+type wavChunk struct {
+	id   string
+	data []byte
+	size int64 // of the header, len(data) if 0
+}
+
+// buildWAV builds a RIFF/WAVE file of the chunks.
+func buildWAV(chunks ...wavChunk) []byte {
+	var body bytes.Buffer
+	body.WriteString("WAVE")
+	for _, c := range chunks {
+		size := c.size
+		if size == 0 {
+			size = int64(len(c.data))
+		}
+		body.WriteString(c.id)
+		binary.Write(&body, binary.LittleEndian, uint32(size))
+		body.Write(c.data)
+		if len(c.data)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+// fmtChunk of the format, with the extensible SubFormat if sub != 0.
+func fmtChunk(format, channels uint16, rate uint32, bits uint16, sub uint16) wavChunk {
+	var b bytes.Buffer
+	align := channels * bits / 8
+	binary.Write(&b, binary.LittleEndian, wavFormat{
+		AudioFormat:   format,
+		Channels:      channels,
+		SampleRate:    rate,
+		ByteRate:      rate * uint32(align),
+		BlockAlign:    align,
+		BitsPerSample: bits,
+	})
+	if sub != 0 {
+		binary.Write(&b, binary.LittleEndian, uint16(22)) // cbSize
+		binary.Write(&b, binary.LittleEndian, bits)       // valid bits
+		binary.Write(&b, binary.LittleEndian, uint32(0))  // channel mask
+		binary.Write(&b, binary.LittleEndian, sub)
+		b.Write(make([]byte, 14)) // the rest of the GUID
+	}
+	return wavChunk{id: "fmt ", data: b.Bytes()}
+}
+
+// samples of the values, little endian, as written by write.
+func samples(write func(b *bytes.Buffer, v float64), values ...float64) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		write(&b, v)
+	}
+	return b.Bytes()
+}
+
+func pcm8(b *bytes.Buffer, v float64) { b.WriteByte(byte(v*128 + 128)) }
+
+func pcm16(b *bytes.Buffer, v float64) {
+	binary.Write(b, binary.LittleEndian, int16(v*(1<<15)))
+}
+
+func pcm24(b *bytes.Buffer, v float64) {
+	x := int32(v * (1 << 23))
+	b.Write([]byte{byte(x), byte(x >> 8), byte(x >> 16)})
+}
+
+func float32le(b *bytes.Buffer, v float64) {
+	binary.Write(b, binary.LittleEndian, math.Float32bits(float32(v)))
+}
+
+func TestDecodeWAV(t *testing.T) {
+	tests := []struct {
+		name       string
+		wav        []byte
+		maxSeconds float64
+		want       []float32 // nil: only the length is checked
+		wantLen    int
+		wantErr    bool
+	}{
+		{
+			name: "pcm16 mono",
+			wav: buildWAV(fmtChunk(wavFormatPCM, 1, SampleRate, 16, 0),
+				wavChunk{id: "data", data: samples(pcm16, 0, 0.5, -0.5, -1)}),
+			want: []float32{0, 0.5, -0.5, -1},
+		},
+		{
+			name: "pcm8 stereo is averaged",
+			wav: buildWAV(fmtChunk(wavFormatPCM, 2, SampleRate, 8, 0),
+				wavChunk{id: "data", data: samples(pcm8, 0.5, -0.5, 0.5, 0.5)}),
+			want: []float32{0, 0.5},
+		},
+		{
+			name: "pcm24 mono",
+			wav: buildWAV(fmtChunk(wavFormatPCM, 1, SampleRate, 24, 0),
+				wavChunk{id: "data", data: samples(pcm24, 0.25, -0.25)}),
+			want: []float32{0.25, -0.25},
+		},
+		{
+			name: "float32 extensible",
+			wav: buildWAV(fmtChunk(wavFormatExtensible, 1, SampleRate, 32, wavFormatFloat),
+				wavChunk{id: "data", data: samples(float32le, 0.75, -0.125)}),
+			want: []float32{0.75, -0.125},
+		},
+		{
+			name: "odd sized chunk before fmt is skipped",
+			wav: buildWAV(wavChunk{id: "LIST", data: []byte("abc")},
+				fmtChunk(wavFormatPCM, 1, SampleRate, 16, 0),
+				wavChunk{id: "data", data: samples(pcm16, 0.5)}),
+			want: []float32{0.5},
+		},
+		{
+			name: "resampled to SampleRate",
+			wav: buildWAV(fmtChunk(wavFormatPCM, 1, 2*SampleRate, 16, 0),
+				wavChunk{id: "data", data: samples(pcm16, make([]float64, 2*SampleRate)...)}),
+			wantLen: SampleRate,
+		},
+		{
+			name: "maxSeconds limits the data read",
+			wav: buildWAV(fmtChunk(wavFormatPCM, 1, SampleRate, 16, 0),
+				wavChunk{id: "data", data: samples(pcm16, make([]float64, 3*SampleRate)...)}),
+			maxSeconds: 1,
+			wantLen:    SampleRate + 1,
+		},
+		{
+			name:    "not RIFF",
+			wav:     []byte("RIFX\x00\x00\x00\x00WAVE"),
+			wantErr: true,
+		},
+		{
+			name: "data before fmt",
+			wav: buildWAV(wavChunk{id: "data", data: samples(pcm16, 0)},
+				fmtChunk(wavFormatPCM, 1, SampleRate, 16, 0)),
+			wantErr: true,
+		},
+		{
+			name:    "huge fmt chunk is refused",
+			wav:     buildWAV(wavChunk{id: "fmt ", data: make([]byte, 16), size: 1 << 31}),
+			wantErr: true,
+		},
+		{
+			name:    "no data chunk",
+			wav:     buildWAV(fmtChunk(wavFormatPCM, 1, SampleRate, 16, 0)),
+			wantErr: true,
+		},
+		{
+			name: "unsupported bits",
+			wav: buildWAV(fmtChunk(wavFormatFloat, 1, SampleRate, 16, 0),
+				wavChunk{id: "data", data: samples(pcm16, 0)}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcm, err := decodeWAV(bytes.NewReader(tt.wav), tt.maxSeconds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeWAV() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.want == nil {
+				if len(pcm) != tt.wantLen {
+					t.Fatalf("decodeWAV() got %d samples, want %d", len(pcm), tt.wantLen)
+				}
+				return
+			}
+			if len(pcm) != len(tt.want) {
+				t.Fatalf("decodeWAV() = %v, want %v", pcm, tt.want)
+			}
+			for i := range pcm {
+				if math.Abs(float64(pcm[i]-tt.want[i])) > 1e-3 {
+					t.Fatalf("decodeWAV() = %v, want %v", pcm, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.wav")
+	wav := buildWAV(fmtChunk(wavFormatPCM, 1, SampleRate, 16, 0),
+		wavChunk{id: "data", data: samples(pcm16, make([]float64, 2*SampleRate)...)})
+	if err := os.WriteFile(path, wav, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		maxSeconds float64
+		wantLen    int
+		wantErr    bool
+	}{
+		{name: "whole", ctx: context.Background(), wantLen: 2 * SampleRate},
+		{name: "truncated", ctx: context.Background(), maxSeconds: 0.5, wantLen: SampleRate / 2},
+		{name: "canceled", ctx: canceled, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcm, err := Decode(tt.ctx, path, tt.maxSeconds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(pcm) != tt.wantLen {
+				t.Fatalf("Decode() got %d samples, want %d", len(pcm), tt.wantLen)
+			}
+		})
+	}
+}
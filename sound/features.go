@@ -0,0 +1,110 @@
+package sound
+
+import "math"
+
+// frameSize & hopSize (in samples) of the short-time analysis.
+const (
+	frameSize = 1024
+	hopSize   = 512
+)
+
+// RMS is the root mean square of the samples.
+func (p PCM) RMS() float64 {
+	if len(p) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range p {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(p)))
+}
+
+// Decibels converts an amplitude into dBFS. It's -inf for silence.
+func Decibels(amplitude float64) float64 {
+	return 20 * math.Log10(amplitude)
+}
+
+// ZeroCrossingRate is the fraction of adjacent samples with
+// different signs, a rough measure of brightness / noisiness.
+func (p PCM) ZeroCrossingRate() float64 {
+	if len(p) < 2 {
+		return 0
+	}
+	crossings := 0
+	for i := 1; i < len(p); i++ {
+		if (p[i-1] >= 0) != (p[i] >= 0) {
+			crossings++
+		}
+	}
+	return float64(crossings) / float64(len(p)-1)
+}
+
+// frameEnergies returns the RMS of each frame (hopSize apart).
+func (p PCM) frameEnergies() []float64 {
+	if len(p) < frameSize {
+		return nil
+	}
+	n := (len(p)-frameSize)/hopSize + 1
+	energies := make([]float64, n)
+	for i := range energies {
+		energies[i] = p[i*hopSize : i*hopSize+frameSize].RMS()
+	}
+	return energies
+}
+
+// Tempo estimates the tempo in BPM, in [minBPM, maxBPM],
+// by the autocorrelation of the onset strength envelope.
+// It returns 0 if the audio is too short or has no clear beat.
+func (p PCM) Tempo() float64 {
+	const minBPM, maxBPM = 60, 200
+
+	energies := p.frameEnergies()
+
+	// onset strength: increases of the log energy
+	onsets := make([]float64, len(energies))
+	for i := 1; i < len(energies); i++ {
+		d := math.Log1p(1000*energies[i]) - math.Log1p(1000*energies[i-1])
+		if d > 0 {
+			onsets[i] = d
+		}
+	}
+
+	framesPerSecond := float64(SampleRate) / hopSize
+	minLag := int(framesPerSecond * 60 / maxBPM)
+	maxLag := int(framesPerSecond * 60 / minBPM)
+	if len(onsets) < 2*maxLag {
+		return 0
+	}
+
+	bestLag, best := 0, 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		var sum float64
+		for i := lag; i < len(onsets); i++ {
+			sum += onsets[i] * onsets[i-lag]
+		}
+		sum /= float64(len(onsets) - lag)
+		if sum > best {
+			bestLag, best = lag, sum
+		}
+	}
+	if bestLag == 0 {
+		return 0
+	}
+
+	return 60 * framesPerSecond / float64(bestLag)
+}
+
+// Peaks divides the PCM into n buckets, and returns the max absolute
+// sample value of each, in [0, 1]: the waveform to render.
+// It returns fewer buckets if the PCM is shorter than n samples.
+func (p PCM) Peaks(n int) []float64 {
+	if n > len(p) {
+		n = len(p)
+	}
+	peaks := make([]float64, n)
+	for i := range peaks {
+		peaks[i] = p[i*len(p)/n : (i+1)*len(p)/n].Peak()
+	}
+	return peaks
+}
@@ -0,0 +1,129 @@
+package sound
+
+import "math"
+
+// ReplayGainReference is the reference loudness of ReplayGain 2.0 in LUFS:
+// the track gain is ReplayGainReference - Loudness.
+const ReplayGainReference = -18
+
+// Gating of the integrated loudness (EBU R128).
+const (
+	loudnessBlock        = 0.4 // seconds
+	loudnessStep         = 0.1 // seconds: blocks overlap by 75%
+	loudnessAbsoluteGate = -70 // LUFS
+	loudnessRelativeGate = -10 // LU below the (absolutely gated) loudness
+)
+
+// dualMono weights the mono PCM as both channels of a stereo source,
+// which most of the music is: a stereo track measures as loud as it
+// should after the mixdown (see Decode), if the channels are alike.
+const dualMono = 2
+
+// Loudness is the integrated loudness (ITU-R BS.1770 / EBU R128) of the
+// PCM in LUFS: K-weighted, and gated in 400 ms blocks.
+// It's -inf for silence or audio shorter than a block.
+func (p PCM) Loudness() float64 {
+	weighted := kWeighting(p)
+
+	blockLen := int(loudnessBlock * SampleRate)
+	step := int(loudnessStep * SampleRate)
+	if len(weighted) < blockLen {
+		return math.Inf(-1)
+	}
+
+	// mean square of each block
+	var powers []float64
+	for start := 0; start+blockLen <= len(weighted); start += step {
+		var sum float64
+		for _, s := range weighted[start : start+blockLen] {
+			sum += s * s
+		}
+		powers = append(powers, dualMono*sum/float64(blockLen))
+	}
+
+	gated := func(threshold float64) float64 {
+		var sum float64
+		n := 0
+		for _, z := range powers {
+			if blockLoudness(z) > threshold {
+				sum += z
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return sum / float64(n)
+	}
+
+	z := gated(loudnessAbsoluteGate)
+	if z == 0 {
+		return math.Inf(-1)
+	}
+	z = gated(math.Max(loudnessAbsoluteGate, blockLoudness(z)+loudnessRelativeGate))
+	if z == 0 {
+		return math.Inf(-1)
+	}
+	return blockLoudness(z)
+}
+
+func blockLoudness(meanSquare float64) float64 {
+	return -0.691 + 10*math.Log10(meanSquare)
+}
+
+// Peak is the max absolute sample value of the PCM, in [0, 1].
+func (p PCM) Peak() float64 {
+	var peak float64
+	for _, s := range p {
+		peak = math.Max(peak, math.Abs(float64(s)))
+	}
+	return peak
+}
+
+// kWeighting filters the PCM by the K-weighting of BS.1770: a high shelf
+// (the head) and a high pass (RLB), for the SampleRate.
+func kWeighting(p PCM) []float64 {
+	// the filters defined at 48 kHz, recomputed for the rate (as libebur128)
+	const rate = float64(SampleRate)
+
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / rate)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1, b1: -2, b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	out := make([]float64, len(p))
+	for i, s := range p {
+		out[i] = highPass.filter(shelf.filter(float64(s)))
+	}
+	return out
+}
+
+// biquad is a second order IIR filter (direct form I), a0 normalized to 1.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
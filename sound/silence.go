@@ -0,0 +1,93 @@
+package sound
+
+import (
+	"math"
+	"sort"
+)
+
+// Thresholds of the silence and the quiet parts, in 100 ms frames.
+const (
+	cueFrame          = 0.1 // seconds
+	silenceThreshold  = -60 // dBFS: frames quieter than it are silent
+	quietBelowTypical = 20  // dB: frames this much quieter than the typical level are quiet
+	typicalPercentile = 0.9 // the typical (loud) level among the non-silent frames
+	// minQuietPart: shorter quiet intros and outros are not reported,
+	// e.g. a soft first note.
+	minQuietPart = 2 // seconds
+)
+
+// Cues are the offsets (in seconds) of the parts of the audio:
+//
+//	0 .. AudioStart: leading silence
+//	AudioStart .. IntroEnd: quiet intro
+//	OutroStart .. AudioEnd: quiet outro (fade out)
+//	AudioEnd .. Duration: trailing silence
+//
+// IntroEnd == AudioStart if there is no (long enough) quiet intro, and
+// OutroStart == AudioEnd if no quiet outro.
+type Cues struct {
+	AudioStart float64
+	IntroEnd   float64
+	OutroStart float64
+	AudioEnd   float64
+}
+
+// Cues detects the leading and trailing silence and the quiet intro and
+// outro of the PCM. ok is false if it's all silent.
+func (p PCM) Cues() (cues Cues, ok bool) {
+	frameLen := int(cueFrame * SampleRate)
+	n := len(p) / frameLen
+	if n == 0 {
+		return Cues{}, false
+	}
+
+	levels := make([]float64, n) // dBFS
+	var loud []float64
+	for i := range levels {
+		levels[i] = Decibels(p[i*frameLen : (i+1)*frameLen].RMS())
+		if levels[i] > silenceThreshold {
+			loud = append(loud, levels[i])
+		}
+	}
+	if len(loud) == 0 {
+		return Cues{}, false
+	}
+
+	sort.Float64s(loud)
+	typical := loud[int(typicalPercentile*float64(len(loud)-1))]
+	quiet := math.Max(typical-quietBelowTypical, silenceThreshold)
+
+	first := func(threshold float64) int {
+		for i, l := range levels {
+			if l > threshold {
+				return i
+			}
+		}
+		return n
+	}
+	last := func(threshold float64) int {
+		for i := n - 1; i >= 0; i-- {
+			if levels[i] > threshold {
+				return i
+			}
+		}
+		return -1
+	}
+
+	seconds := func(frame int) float64 {
+		return math.Min(float64(frame)*cueFrame, p.Duration())
+	}
+	cues = Cues{
+		AudioStart: seconds(first(silenceThreshold)),
+		IntroEnd:   seconds(first(quiet)),
+		OutroStart: seconds(last(quiet) + 1),
+		AudioEnd:   seconds(last(silenceThreshold) + 1),
+	}
+	if cues.IntroEnd-cues.AudioStart < minQuietPart {
+		cues.IntroEnd = cues.AudioStart
+	}
+	if cues.AudioEnd-cues.OutroStart < minQuietPart {
+		cues.OutroStart = cues.AudioEnd
+	}
+	return cues, true
+}
@@ -0,0 +1,371 @@
+package subsonic
+
+import (
+	"encoding/base64"
+	"errors"
+	"mime"
+	"musicstore/metadata"
+	"musicstore/model"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/cdfmlr/crud/service"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// this file implements the browsing and the searching of the library.
+//
+// IDs: songs are the IDs of the tracks, artists are "ar-{name}" and
+// albums "al-{artist}\x1f{album}", base64url-encoded, as musicstore has
+// no artist or album entities. The cover art of a song (or an album) is
+// the ID of the track (with the cover).
+
+const (
+	unknownArtist = "[Unknown Artist]"
+	unknownAlbum  = "[Unknown Album]"
+	// ignoredArticles when indexing the artists.
+	ignoredArticles = "The An A"
+)
+
+func artistID(artist string) string {
+	return "ar-" + base64.RawURLEncoding.EncodeToString([]byte(artist))
+}
+
+func albumID(artist, album string) string {
+	return "al-" + base64.RawURLEncoding.EncodeToString([]byte(artist+"\x1f"+album))
+}
+
+// parseArtistID returns the artist name of the ID.
+func parseArtistID(id string) (string, bool) {
+	enc, ok := strings.CutPrefix(id, "ar-")
+	if !ok {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(enc)
+	return string(name), err == nil
+}
+
+// parseAlbumID returns the artist and the album name of the ID.
+func parseAlbumID(id string) (artist, album string, ok bool) {
+	enc, ok := strings.CutPrefix(id, "al-")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", "", false
+	}
+	artist, album, ok = strings.Cut(string(decoded), "\x1f")
+	return artist, album, ok
+}
+
+func orUnknown(name, unknown string) string {
+	if name == "" {
+		return unknown
+	}
+	return name
+}
+
+func coverArtID(trackID uint) string {
+	if trackID == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(trackID), 10)
+}
+
+func toArtist(a metadata.ArtistStats) artistID3 {
+	return artistID3{ID: artistID(a.Artist), Name: orUnknown(a.Artist, unknownArtist), AlbumCount: a.Albums}
+}
+
+func toAlbum(a metadata.AlbumStats) albumID3 {
+	return albumID3{
+		ID:        albumID(a.Artist, a.Album),
+		Name:      orUnknown(a.Album, unknownAlbum),
+		Artist:    orUnknown(a.Artist, unknownArtist),
+		ArtistID:  artistID(a.Artist),
+		CoverArt:  coverArtID(a.CoverTrackID),
+		SongCount: a.Tracks,
+		Duration:  int(a.Duration),
+		Genre:     a.Genre,
+	}
+}
+
+// toAlbumDir: the album as a directory, for getAlbumList.
+func toAlbumDir(a metadata.AlbumStats) child {
+	return child{
+		ID:       albumID(a.Artist, a.Album),
+		Parent:   artistID(a.Artist),
+		IsDir:    true,
+		Title:    orUnknown(a.Album, unknownAlbum),
+		Album:    orUnknown(a.Album, unknownAlbum),
+		Artist:   orUnknown(a.Artist, unknownArtist),
+		Genre:    a.Genre,
+		CoverArt: coverArtID(a.CoverTrackID),
+	}
+}
+
+func toSong(t *model.Track) child {
+	suffix := strings.TrimPrefix(path.Ext(t.AudioFileURL), ".")
+	if i := strings.IndexAny(suffix, "?#"); i >= 0 {
+		suffix = suffix[:i]
+	}
+	song := child{
+		ID:          strconv.FormatUint(uint64(t.ID), 10),
+		Parent:      albumID(t.Artist, t.Album),
+		Title:       t.Name,
+		Album:       orUnknown(t.Album, unknownAlbum),
+		Artist:      orUnknown(t.Artist, unknownArtist),
+		Genre:       t.Genre,
+		Size:        t.FileSize,
+		ContentType: mime.TypeByExtension("." + suffix),
+		Suffix:      suffix,
+		Duration:    int(t.Cues.AudioEnd),
+		BPM:         int(t.BPM + 0.5),
+		AlbumID:     albumID(t.Artist, t.Album),
+		ArtistID:    artistID(t.Artist),
+		Type:        "music",
+		MediaType:   "song",
+	}
+	if t.CoverImageURL != "" {
+		song.CoverArt = song.ID
+	}
+	return song
+}
+
+func toSongs(tracks []*model.Track) []child {
+	songs := make([]child, 0, len(tracks))
+	for _, t := range tracks {
+		songs = append(songs, toSong(t))
+	}
+	return songs
+}
+
+// indexName of the artist: the upper first letter, ignoring the
+// articles, "#" for the others.
+func indexName(artist string) string {
+	for _, article := range strings.Fields(ignoredArticles) {
+		if rest, ok := strings.CutPrefix(artist, article+" "); ok {
+			artist = rest
+			break
+		}
+	}
+	for _, r := range artist {
+		if unicode.IsLetter(r) {
+			return string(unicode.ToUpper(r))
+		}
+		break
+	}
+	return "#"
+}
+
+// getArtists: all the artists, indexed by the first letter.
+func getArtists(c *gin.Context) (*response, error) {
+	artists, err := metadata.ListArtists(c)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &artistsID3{IgnoredArticles: ignoredArticles, Index: []indexID3{}}
+	indexes := map[string]int{} // name -> position in result.Index
+	for _, a := range artists {
+		name := indexName(a.Artist)
+		i, ok := indexes[name]
+		if !ok {
+			i = len(result.Index)
+			indexes[name] = i
+			result.Index = append(result.Index, indexID3{Name: name})
+		}
+		result.Index[i].Artist = append(result.Index[i].Artist, toArtist(a))
+	}
+	return &response{Artists: result}, nil
+}
+
+// getArtist: the artist (id), with the albums.
+func getArtist(c *gin.Context) (*response, error) {
+	id := param(c, "id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	name, ok := parseArtistID(id)
+	if !ok {
+		return nil, notFound("artist")
+	}
+
+	albums, err := metadata.ListAlbums(c, metadata.AlbumsByName, service.Where("artist = ?", name))
+	if err != nil {
+		return nil, err
+	}
+	if len(albums) == 0 {
+		return nil, notFound("artist")
+	}
+
+	artist := &artistID3{ID: id, Name: orUnknown(name, unknownArtist), AlbumCount: int64(len(albums))}
+	for _, a := range albums {
+		artist.Album = append(artist.Album, toAlbum(a))
+	}
+	return &response{Artist: artist}, nil
+}
+
+// getAlbum: the album (id), with the songs.
+func getAlbum(c *gin.Context) (*response, error) {
+	id := param(c, "id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	artist, album, ok := parseAlbumID(id)
+	if !ok {
+		return nil, notFound("album")
+	}
+
+	where := service.Where("artist = ? AND album = ?", artist, album)
+	albums, err := metadata.ListAlbums(c, metadata.AlbumsByName, where)
+	if err != nil {
+		return nil, err
+	}
+	if len(albums) == 0 {
+		return nil, notFound("album")
+	}
+	tracks, err := metadata.GetTracks(c, where, service.OrderBy("id", false))
+	if err != nil {
+		return nil, err
+	}
+
+	result := toAlbum(albums[0])
+	result.Song = toSongs(tracks)
+	return &response{Album: &result}, nil
+}
+
+// getSong: the song (id).
+func getSong(c *gin.Context) (*response, error) {
+	track, err := trackParam(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	song := toSong(track)
+	return &response{Song: &song}, nil
+}
+
+// trackParam gets the track by the ID in the param.
+func trackParam(c *gin.Context, name string) (*model.Track, error) {
+	v := param(c, name)
+	if v == "" {
+		return nil, missingParameter(name)
+	}
+	id, err := strconv.ParseUint(v, 10, 0)
+	if err != nil {
+		return nil, notFound("song")
+	}
+	track, err := metadata.GetTrack(c, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, notFound("song")
+	}
+	return track, err
+}
+
+// listAlbums by the type, size and offset of getAlbumList(2).
+// Play counts, ratings, stars and years are not tracked: frequent,
+// recent and highest are the newest, starred and byYear are empty.
+func listAlbums(c *gin.Context) ([]metadata.AlbumStats, error) {
+	typ := param(c, "type")
+	if typ == "" {
+		return nil, missingParameter("type")
+	}
+	size := intParam(c, "size", 10)
+	if size < 1 || size > 500 {
+		size = 500
+	}
+	options := []service.QueryOption{service.WithPage(size, intParam(c, "offset", 0))}
+
+	var order string
+	switch typ {
+	case "random":
+		order = metadata.AlbumsRandom
+	case "newest", "frequent", "recent", "highest":
+		order = metadata.AlbumsNewest
+	case "alphabeticalByName":
+		order = metadata.AlbumsByName
+	case "alphabeticalByArtist":
+		order = metadata.AlbumsByArtist
+	case "byGenre":
+		genre := param(c, "genre")
+		if genre == "" {
+			return nil, missingParameter("genre")
+		}
+		order = metadata.AlbumsByName
+		options = append(options, service.Where("genre LIKE ?", "%"+genre+"%"))
+	case "starred", "byYear":
+		return nil, nil
+	default:
+		return nil, &apiError{errGeneric, "unknown type: " + typ}
+	}
+	return metadata.ListAlbums(c, order, options...)
+}
+
+// getAlbumList: the albums as directories.
+func getAlbumList(c *gin.Context) (*response, error) {
+	albums, err := listAlbums(c)
+	if err != nil {
+		return nil, err
+	}
+	result := &albumList{Album: []child{}}
+	for _, a := range albums {
+		result.Album = append(result.Album, toAlbumDir(a))
+	}
+	return &response{AlbumList: result}, nil
+}
+
+// getAlbumList2: the albums by the tags.
+func getAlbumList2(c *gin.Context) (*response, error) {
+	albums, err := listAlbums(c)
+	if err != nil {
+		return nil, err
+	}
+	result := &albumList2{Album: []albumID3{}}
+	for _, a := range albums {
+		result.Album = append(result.Album, toAlbum(a))
+	}
+	return &response{AlbumList2: result}, nil
+}
+
+// search3: the artists, albums and songs matching the query, by their
+// names. An empty query ("" or "") matches all, e.g. for clients syncing
+// the whole library.
+func search3(c *gin.Context) (*response, error) {
+	query := strings.Trim(param(c, "query"), `"`)
+	like := "%" + query + "%"
+
+	page := func(name string) service.QueryOption {
+		return service.WithPage(intParam(c, name+"Count", 20), intParam(c, name+"Offset", 0))
+	}
+	result := &searchResult3{Artist: []artistID3{}, Album: []albumID3{}, Song: []child{}}
+
+	artists, err := metadata.ListArtists(c, service.Where("artist LIKE ?", like), page("artist"))
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range artists {
+		result.Artist = append(result.Artist, toArtist(a))
+	}
+
+	albums, err := metadata.ListAlbums(c, metadata.AlbumsByName,
+		service.Where("album LIKE ?", like), page("album"))
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range albums {
+		result.Album = append(result.Album, toAlbum(a))
+	}
+
+	tracks, err := metadata.GetTracks(c,
+		service.Where("(name LIKE ? OR artist LIKE ? OR album LIKE ?)", like, like, like),
+		service.OrderBy("id", false), page("song"))
+	if err != nil {
+		return nil, err
+	}
+	result.Song = toSongs(tracks)
+
+	return &response{SearchResult3: result}, nil
+}
@@ -0,0 +1,65 @@
+package subsonic
+
+import (
+	"musicstore/audiofilestore"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the streaming of the audio files and the cover
+// art. The files in the stores are served directly, others (e.g. covers
+// by external URLs) are redirected to.
+
+// stream (and download): the audio file of the song (id), as it is:
+// maxBitRate and format are ignored.
+func stream(c *gin.Context) (*response, error) {
+	track, err := trackParam(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	if track.AudioFileURL == "" {
+		return nil, notFound("audio file")
+	}
+	serveFile(c, track.AudioFileURL)
+	return nil, nil
+}
+
+// getCoverArt: the cover image of the track (id, see coverArtID), in
+// the original size.
+func getCoverArt(c *gin.Context) (*response, error) {
+	track, err := trackParam(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	if track.CoverImageURL == "" {
+		return nil, notFound("cover art")
+	}
+	serveFile(c, track.CoverImageURL)
+	return nil, nil
+}
+
+// serveFile serves the file of the URL from the store, or redirects to
+// the URL if it's not in any store.
+func serveFile(c *gin.Context, fileUrl string) {
+	path, ok := audiofilestore.LocalPath(fileUrl)
+	if !ok {
+		c.Redirect(http.StatusFound, fileUrl)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fail(c, notFound("file"))
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		fail(c, notFound("file"))
+		return
+	}
+	// ranges, conditions and HEAD are handled by it
+	http.ServeContent(c.Writer, c.Request, st.Name(), st.ModTime(), f)
+}
@@ -0,0 +1,243 @@
+// Package subsonic implements the core of the Subsonic REST API (and the
+// OpenSubsonic extensions of its responses), mapped onto the tracks, so
+// that Subsonic clients (e.g. DSub, Symfonium, play:Sub) can use a
+// musicstore directly. See https://opensubsonic.netlify.app/docs/api-reference/
+//
+// Artists and albums are the Artist and Album tags of the tracks. The
+// audio files are streamed as they are: no transcoding.
+//
+// Clients log in as the users of musicstore (see auth.UseUsers) with
+// their Token as the password: in plain text (p=, or p=enc:{hex}), by
+// the token and the salt (t=md5(password+salt), s=salt), or as the
+// OpenSubsonic apiKey.
+package subsonic
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"musicstore/auth"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cdfmlr/crud/log"
+	"github.com/gin-gonic/gin"
+)
+
+var logger = log.ZoneLogger("musicstore/subsonic")
+
+const (
+	// apiVersion of Subsonic implemented.
+	apiVersion = "1.16.1"
+	xmlns      = "http://subsonic.org/restapi"
+)
+
+// Error codes of the Subsonic API.
+const (
+	errGeneric          = 0
+	errMissingParameter = 10
+	errWrongCredentials = 40
+	errNotAuthorized    = 50
+	errNotFound         = 70
+)
+
+// RegisterRoutes registers the Subsonic API: GET (or POST) /rest/{method}
+// (with or without .view), e.g. /rest/ping.view.
+func RegisterRoutes(r gin.IRouter) {
+	r.GET("/rest/:method", serve)
+	r.POST("/rest/:method", serve)
+}
+
+// handler of a method of the API. It returns the response to fill the
+// envelope of, or an *apiError. Handlers writing the body by themselves
+// (e.g. stream) return nil, nil.
+type handler func(c *gin.Context) (*response, error)
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"ping":                      ping,
+		"getLicense":                getLicense,
+		"getOpenSubsonicExtensions": getOpenSubsonicExtensions,
+		"getMusicFolders":           getMusicFolders,
+		"getArtists":                getArtists,
+		"getArtist":                 getArtist,
+		"getAlbum":                  getAlbum,
+		"getSong":                   getSong,
+		"getAlbumList":              getAlbumList,
+		"getAlbumList2":             getAlbumList2,
+		"search3":                   search3,
+		"stream":                    stream,
+		"download":                  stream,
+		"getCoverArt":               getCoverArt,
+	}
+}
+
+// serve handles: GET /rest/:method
+//
+// The errors are responded in the Subsonic format, with 200 OK.
+func serve(c *gin.Context) {
+	method := strings.TrimSuffix(c.Param("method"), ".view")
+	h, ok := handlers[method]
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if method != "getOpenSubsonicExtensions" { // public, as OpenSubsonic requires
+		if err := authenticate(c); err != nil {
+			fail(c, err)
+			return
+		}
+	}
+
+	resp, err := h(c)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	if resp != nil {
+		respond(c, resp)
+	}
+}
+
+// param of the request: in the query, or the form body.
+func param(c *gin.Context, name string) string {
+	if v, ok := c.GetQuery(name); ok {
+		return v
+	}
+	return c.PostForm(name)
+}
+
+// intParam of the request, def if missing or bad.
+func intParam(c *gin.Context, name string, def int) int {
+	v, err := strconv.Atoi(param(c, name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// authenticate the request by the Subsonic credentials (see the package
+// doc), as a listener.
+func authenticate(c *gin.Context) error {
+	if apiKey := param(c, "apiKey"); apiKey != "" {
+		return authError(auth.Authenticate(c, "", func(token string) bool {
+			return subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) == 1
+		}, auth.RoleListener))
+	}
+
+	user := param(c, "u")
+	if user == "" {
+		return &apiError{errMissingParameter, "required parameter is missing: u"}
+	}
+
+	var check func(token string) bool
+	if t, s := param(c, "t"), param(c, "s"); t != "" && s != "" {
+		check = func(token string) bool {
+			sum := md5.Sum([]byte(token + s))
+			return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(t))) == 1
+		}
+	} else {
+		password := param(c, "p")
+		if enc, ok := strings.CutPrefix(password, "enc:"); ok {
+			decoded, err := hex.DecodeString(enc)
+			if err != nil {
+				return &apiError{errWrongCredentials, "wrong username or password"}
+			}
+			password = string(decoded)
+		}
+		check = func(token string) bool {
+			return password != "" && subtle.ConstantTimeCompare([]byte(token), []byte(password)) == 1
+		}
+	}
+	return authError(auth.Authenticate(c, user, check, auth.RoleListener))
+}
+
+// authError converts the error of auth.Authenticate.
+func authError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, auth.ErrUnauthorized):
+		return &apiError{errWrongCredentials, "wrong username or password"}
+	default:
+		return &apiError{errNotAuthorized, err.Error()}
+	}
+}
+
+// apiError is an error in the Subsonic format.
+type apiError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func notFound(what string) error {
+	return &apiError{errNotFound, what + " not found"}
+}
+
+func missingParameter(name string) error {
+	return &apiError{errMissingParameter, "required parameter is missing: " + name}
+}
+
+// fail responds the error.
+func fail(c *gin.Context, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		logger.WithContext(c).WithError(err).Warn("serve: failed")
+		e = &apiError{errGeneric, err.Error()}
+	}
+	respond(c, &response{Status: "failed", Error: e})
+}
+
+// respond the response in the format (f=xml by default, json).
+func respond(c *gin.Context, resp *response) {
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+	resp.Xmlns = xmlns
+	resp.Version = apiVersion
+	resp.Type = "musicstore"
+	resp.ServerVersion = apiVersion
+	resp.OpenSubsonic = true
+
+	switch param(c, "f") {
+	case "json", "jsonp":
+		c.JSON(http.StatusOK, gin.H{"subsonic-response": resp})
+	default:
+		c.Header("Content-Type", "text/xml; charset=utf-8")
+		c.Status(http.StatusOK)
+		c.Writer.WriteString(xml.Header)
+		if err := xml.NewEncoder(c.Writer).Encode(resp); err != nil {
+			logger.WithContext(c).WithError(err).Error("respond: Encode failed")
+		}
+	}
+}
+
+func ping(c *gin.Context) (*response, error) {
+	return &response{}, nil
+}
+
+func getLicense(c *gin.Context) (*response, error) {
+	return &response{License: &license{Valid: true}}, nil
+}
+
+// getOpenSubsonicExtensions: the parameters can be POSTed in the form body.
+func getOpenSubsonicExtensions(c *gin.Context) (*response, error) {
+	return &response{OpenSubsonicExtensions: []extension{{Name: "formPost", Versions: []int{1}}}}, nil
+}
+
+// getMusicFolders: the whole library (of the user) is one folder.
+func getMusicFolders(c *gin.Context) (*response, error) {
+	return &response{MusicFolders: &musicFolders{
+		MusicFolder: []musicFolder{{ID: 1, Name: "musicstore"}},
+	}}, nil
+}
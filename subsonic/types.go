@@ -0,0 +1,114 @@
+package subsonic
+
+import "encoding/xml"
+
+// this file defines the responses of the Subsonic API. Fields are the
+// attributes in XML, and the same keys in JSON.
+
+// response is the envelope of the responses: subsonic-response.
+type response struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error                  *apiError      `xml:"error,omitempty" json:"error,omitempty"`
+	License                *license       `xml:"license,omitempty" json:"license,omitempty"`
+	OpenSubsonicExtensions []extension    `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+	MusicFolders           *musicFolders  `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Artists                *artistsID3    `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist                 *artistID3     `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album                  *albumID3      `xml:"album,omitempty" json:"album,omitempty"`
+	Song                   *child         `xml:"song,omitempty" json:"song,omitempty"`
+	AlbumList              *albumList     `xml:"albumList,omitempty" json:"albumList,omitempty"`
+	AlbumList2             *albumList2    `xml:"albumList2,omitempty" json:"albumList2,omitempty"`
+	SearchResult3          *searchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type license struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+// extension of OpenSubsonic supported.
+type extension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+type musicFolders struct {
+	MusicFolder []musicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type musicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type artistsID3 struct {
+	IgnoredArticles string     `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []indexID3 `xml:"index" json:"index"`
+}
+
+type indexID3 struct {
+	Name   string      `xml:"name,attr" json:"name"`
+	Artist []artistID3 `xml:"artist" json:"artist"`
+}
+
+// artistID3: with the albums for getArtist.
+type artistID3 struct {
+	ID         string     `xml:"id,attr" json:"id"`
+	Name       string     `xml:"name,attr" json:"name"`
+	AlbumCount int64      `xml:"albumCount,attr" json:"albumCount"`
+	Album      []albumID3 `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+// albumID3: with the songs for getAlbum.
+type albumID3 struct {
+	ID        string  `xml:"id,attr" json:"id"`
+	Name      string  `xml:"name,attr" json:"name"`
+	Artist    string  `xml:"artist,attr" json:"artist"`
+	ArtistID  string  `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string  `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int64   `xml:"songCount,attr" json:"songCount"`
+	Duration  int     `xml:"duration,attr" json:"duration"`
+	Genre     string  `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Song      []child `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+// child is a song, or an album as a directory (IsDir) in getAlbumList.
+type child struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration    int    `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	BPM         int    `xml:"bpm,attr,omitempty" json:"bpm,omitempty"`
+	AlbumID     string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID    string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type        string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	MediaType   string `xml:"mediaType,attr,omitempty" json:"mediaType,omitempty"`
+}
+
+type albumList struct {
+	Album []child `xml:"album" json:"album"`
+}
+
+type albumList2 struct {
+	Album []albumID3 `xml:"album" json:"album"`
+}
+
+type searchResult3 struct {
+	Artist []artistID3 `xml:"artist" json:"artist"`
+	Album  []albumID3  `xml:"album" json:"album"`
+	Song   []child     `xml:"song" json:"song"`
+}
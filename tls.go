@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// this file implements serving HTTPS natively: by the certificate files,
+// or by the certificates obtained from an ACME CA (Let's Encrypt) for the
+// hosts, so that a small deployment needs no reverse proxy for HTTPS.
+
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || len(c.ACME.Hosts) > 0
+}
+
+// check that the config is complete and not ambiguous.
+func (c *TLSConfig) check() error {
+	files := c.CertFile != "" || c.KeyFile != ""
+	if files && (c.CertFile == "" || c.KeyFile == "") {
+		return errors.New("TLS: both CertFile and KeyFile are required")
+	}
+	if files && len(c.ACME.Hosts) > 0 {
+		return errors.New("TLS: CertFile/KeyFile and ACME can not be used together")
+	}
+	return nil
+}
+
+// serveTLS configures srv with the TLS config, and serves it on l.
+// For ACME, the challenge server is started as well.
+func serveTLS(srv *http.Server, l net.Listener, cfg TLSConfig) error {
+	if len(cfg.ACME.Hosts) == 0 {
+		return srv.ServeTLS(l, cfg.CertFile, cfg.KeyFile)
+	}
+
+	cacheDir := cfg.ACME.CacheDir
+	if cacheDir == "" {
+		cacheDir = "acme-cache"
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACME.Hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      cfg.ACME.Email,
+	}
+	if cfg.ACME.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.ACME.DirectoryURL}
+	}
+
+	httpAddr := cfg.ACME.HTTPAddr
+	if httpAddr == "" {
+		httpAddr = ":80"
+	}
+	if httpAddr != "-" {
+		go func() {
+			logger.Infof("ACME http-01 challenge server started at %s", httpAddr)
+			if err := http.ListenAndServe(httpAddr, m.HTTPHandler(nil)); err != nil {
+				logger.WithError(err).Error("ACME challenge server failed")
+			}
+		}()
+	}
+
+	srv.TLSConfig = m.TLSConfig()
+	srv.TLSConfig.MinVersion = tls.VersionTLS12
+	return srv.ServeTLS(l, "", "")
+}
+
+// defaultBaseUrls sets the empty BaseUrls of the stores to the URL of
+// the server: https with TLS, on the first ACME host if any.
+// There is no URL of a unix socket: BaseUrls are required then.
+func (c *MusicstoreConfig) defaultBaseUrls() {
+	if _, ok := unixSocketPath(c.HttpListenAddr); ok {
+		return
+	}
+	scheme := "http"
+	if c.TLS.enabled() {
+		scheme = "https"
+	}
+
+	host := c.HttpListenAddr
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if h == "" || h == "0.0.0.0" || h == "::" {
+			h = "localhost"
+		}
+		if len(c.TLS.ACME.Hosts) > 0 {
+			h = c.TLS.ACME.Hosts[0]
+		}
+		host = net.JoinHostPort(h, port)
+		if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+			host = h
+			if strings.Contains(h, ":") { // IPv6
+				host = "[" + h + "]"
+			}
+		}
+	}
+
+	for i := range c.AudioFileStores {
+		if c.AudioFileStores[i].BaseUrl == "" {
+			c.AudioFileStores[i].BaseUrl = scheme + "://" + host
+		}
+	}
+}
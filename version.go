@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// this file implements the version and build info: GET /version.
+//
+// Set them at build time, e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// Without them, the commit and the time are read from the VCS info
+// embedded by go build, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+// BuildInfo of the running musicstore.
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildTime string
+	GoVersion string
+	Modified  bool // built from a dirty tree (VCS info only)
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// Features enabled in the config.
+type Features struct {
+	Stores        []string // names
+	Emomusic      bool     // any store analyzes the new tracks
+	Genre         bool     // the genre classifier is configured
+	AccessControl bool     // Auth.Users are configured
+	Pprof         bool
+}
+
+func enabledFeatures(cfg *MusicstoreConfig) Features {
+	features := Features{
+		Genre:         cfg.Genre.Server != "",
+		AccessControl: len(cfg.Auth.Users) > 0,
+		Pprof:         cfg.Debug.Pprof,
+	}
+	for _, store := range cfg.AudioFileStores {
+		features.Stores = append(features.Stores, store.Name)
+		features.Emomusic = features.Emomusic || store.EnableEmomusic
+	}
+	return features
+}
+
+// registerVersionRoutes registers GET /version.
+func registerVersionRoutes(r gin.IRouter, cfg *MusicstoreConfig) {
+	r.GET("/version", getVersion(buildInfo(), enabledFeatures(cfg)))
+}
+
+// getVersion handles: GET /version
+//
+// Response:
+//
+//   - 200: OK: {Version: "v1.2.0", Commit: "6fc75a1...", BuildTime: "...", GoVersion: "go1.20",
+//     Modified: false, Features: {Stores: ["main"], Emomusic: true, ...}}
+func getVersion(info BuildInfo, features Features) gin.HandlerFunc {
+	resp := struct {
+		BuildInfo
+		Features Features
+	}{info, features}
+
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, resp)
+	}
+}
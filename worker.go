@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"musicstore/analysis"
+	"musicstore/murecom"
+	"musicstore/nats"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// this file implements `musicstore worker`: a remote analysis worker,
+// running the jobs dispatched by the server (NATS.Jobs) over NATS, to
+// scale the analysis out. It needs no database: the Emomusic, Genre and
+// Analyzers of the config are used, and the audio is read from the local
+// file if it exists (e.g. shared storage), from the URL otherwise.
+
+// runWorker: musicstore worker -config config.yaml
+func runWorker(args []string) error {
+	set := newFlagSet("worker", "runs the analysis jobs dispatched by the server over NATS\n(see NATS.Jobs in the config), until SIGINT or SIGTERM.")
+	configFile := set.String("config", "config.yaml", "config file path, with the NATS, Emomusic and Analyzers of the server")
+	workers := set.Int("workers", 0, "concurrent jobs (default: Emomusic.Workers)")
+	set.Parse(args)
+
+	cfg := loadConfig(*configFile)
+	if cfg.NATS.URL == "" {
+		return errors.New("NATS.URL is required")
+	}
+	if *workers == 0 {
+		*workers = cfg.Emomusic.Workers
+	}
+
+	if err := useLogLevels(cfg.Log.Level, cfg.Log.Zones); err != nil {
+		return fmt.Errorf("useLogLevels failed: %w", err)
+	}
+	if err := startEmomusicClient(cfg.Emomusic); err != nil {
+		return fmt.Errorf("startEmomusicClient failed: %w", err)
+	}
+	if err := startGenreClassifier(cfg.Genre); err != nil {
+		return fmt.Errorf("startGenreClassifier failed: %w", err)
+	}
+	if err := registerAnalyzers(cfg.Analyzers); err != nil {
+		return fmt.Errorf("registerAnalyzers failed: %w", err)
+	}
+	murecom.UseMoodPresets(cfg.Murecom.Moods)
+	useJobTimeout(cfg.Emomusic.JobTimeout)
+
+	conn, err := nats.Dial(cfg.NATS.URL, "musicstore-worker")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sub, err := analysis.ServeRemote(conn, cfg.NATS.subject("jobs.analysis"), *workers)
+	if err != nil {
+		return fmt.Errorf("ServeRemote failed: %w", err)
+	}
+	logger.WithField("workers", *workers).Info("worker started.")
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	signal.Stop(quit)
+	logger.Info("worker stopping ...")
+
+	// no more jobs; the running ones are finished and replied
+	sub.Unsubscribe()
+
+	timeout := cfg.Shutdown.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return analysis.Shutdown(ctx)
+}